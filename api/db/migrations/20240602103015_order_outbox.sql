@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS order_outbox (
+    id SERIAL NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES "order"(id) ON DELETE CASCADE,
+    type VARCHAR(50) NOT NULL,
+    payload JSON,
+    status VARCHAR(30) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error VARCHAR,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    processed_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS order_outbox_status_idx ON order_outbox (status);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE order_outbox;
+-- +goose StatementEnd
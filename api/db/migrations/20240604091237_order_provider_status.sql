@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "order" ADD COLUMN IF NOT EXISTS provider_status VARCHAR(100);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "order" DROP COLUMN IF EXISTS provider_status;
+-- +goose StatementEnd
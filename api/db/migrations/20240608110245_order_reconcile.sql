@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "order" ADD COLUMN IF NOT EXISTS reconciled_at TIMESTAMP WITH TIME ZONE;
+CREATE INDEX IF NOT EXISTS order_pending_created_at_idx ON "order" (created_at) WHERE status = 'pending';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS order_pending_created_at_idx;
+ALTER TABLE "order" DROP COLUMN IF EXISTS reconciled_at;
+-- +goose StatementEnd
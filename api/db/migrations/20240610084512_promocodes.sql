@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS promocode (
+    id SERIAL NOT NULL PRIMARY KEY,
+    project_id INTEGER NOT NULL REFERENCES project(id) ON DELETE CASCADE,
+    offer_id INTEGER REFERENCES offer(id) ON DELETE CASCADE,
+    code VARCHAR(100) NOT NULL,
+    discount_type VARCHAR(20) NOT NULL CHECK (discount_type IN ('percent', 'fixed')),
+    discount_value INTEGER NOT NULL CHECK (discount_value > 0),
+    max_uses INTEGER,
+    max_uses_per_user INTEGER,
+    starts_at TIMESTAMP WITH TIME ZONE,
+    ends_at TIMESTAMP WITH TIME ZONE,
+    is_active BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (discount_type != 'percent' OR discount_value < 100)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS promocode_project_code_idx ON promocode (project_id, lower(code));
+
+ALTER TABLE "order" ADD COLUMN IF NOT EXISTS promocode_id INTEGER REFERENCES promocode(id) ON DELETE SET NULL;
+ALTER TABLE "order" ADD COLUMN IF NOT EXISTS discount INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS order_promocode_id_idx ON "order" (promocode_id) WHERE promocode_id IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS order_promocode_id_idx;
+ALTER TABLE "order" DROP COLUMN IF EXISTS discount;
+ALTER TABLE "order" DROP COLUMN IF EXISTS promocode_id;
+DROP TABLE IF EXISTS promocode;
+-- +goose StatementEnd
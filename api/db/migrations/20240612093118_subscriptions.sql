@@ -0,0 +1,52 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE offer ADD COLUMN IF NOT EXISTS subscription_period VARCHAR(20) CHECK (subscription_period IN ('month', 'year'));
+
+CREATE TABLE IF NOT EXISTS subscription (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    offer_id INTEGER REFERENCES offer(id) ON DELETE SET NULL,
+    project_id INTEGER REFERENCES project(id) ON DELETE CASCADE,
+    integration_id INTEGER REFERENCES pay_integration(id) ON DELETE SET NULL,
+    status VARCHAR(30) NOT NULL DEFAULT 'pending',
+    period VARCHAR(20) NOT NULL CHECK (period IN ('month', 'year')),
+    price INTEGER NOT NULL,
+    rebill_id VARCHAR(150),
+    current_period_end TIMESTAMP WITH TIME ZONE,
+    next_charge_at TIMESTAMP WITH TIME ZONE,
+    failed_attempts INTEGER NOT NULL DEFAULT 0,
+    canceled_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS subscription_next_charge_at_idx ON subscription (next_charge_at) WHERE status IN ('active', 'past_due');
+
+ALTER TABLE "order" ADD COLUMN IF NOT EXISTS subscription_id INTEGER REFERENCES subscription(id) ON DELETE SET NULL;
+
+CREATE OR REPLACE VIEW _userproducts AS (
+    SELECT
+        ug.user_id, p.id, p.name, p.slug, p.description, p.settings,
+        p.parent_id, p.cover, p.layout, p.show_lessons_without_access, p.project_id, p.position
+    FROM product_group AS pg
+    JOIN user_group AS ug ON ug.group_id = pg.group_id AND ug.left_at IS NULL
+        AND (ug.remove_at IS NULL OR ug.remove_at > now())
+    JOIN product AS p ON p.id = pg.product_id AND p.is_published IS TRUE
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE VIEW _userproducts AS (
+    SELECT
+        ug.user_id, p.id, p.name, p.slug, p.description, p.settings,
+        p.parent_id, p.cover, p.layout, p.show_lessons_without_access, p.project_id, p.position
+    FROM product_group AS pg
+    JOIN user_group AS ug ON ug.group_id = pg.group_id AND ug.left_at IS NULL
+    JOIN product AS p ON p.id = pg.product_id AND p.is_published IS TRUE
+);
+
+ALTER TABLE "order" DROP COLUMN IF EXISTS subscription_id;
+DROP TABLE IF EXISTS subscription;
+ALTER TABLE offer DROP COLUMN IF EXISTS subscription_period;
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "order" ADD COLUMN IF NOT EXISTS gift_recipient_id INTEGER REFERENCES "user"(id) ON DELETE SET NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "order" DROP COLUMN IF EXISTS gift_recipient_id;
+-- +goose StatementEnd
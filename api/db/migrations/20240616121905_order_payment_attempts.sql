@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "order" ADD COLUMN IF NOT EXISTS payment_attempt INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS order_user_id_idx ON "order" (user_id, id DESC);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS order_user_id_idx;
+ALTER TABLE "order" DROP COLUMN IF EXISTS payment_attempt;
+-- +goose StatementEnd
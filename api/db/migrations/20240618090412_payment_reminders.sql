@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE offer ADD COLUMN IF NOT EXISTS payment_reminder_delay INTERVAL;
+
+ALTER TABLE "order" ADD COLUMN IF NOT EXISTS reminders_sent INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE "order" ADD COLUMN IF NOT EXISTS reminded_at TIMESTAMP WITH TIME ZONE;
+CREATE INDEX IF NOT EXISTS order_unpaid_created_at_idx ON "order" (created_at) WHERE status IN ('pending', 'rejected');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS order_unpaid_created_at_idx;
+ALTER TABLE "order" DROP COLUMN IF EXISTS reminded_at;
+ALTER TABLE "order" DROP COLUMN IF EXISTS reminders_sent;
+ALTER TABLE offer DROP COLUMN IF EXISTS payment_reminder_delay;
+-- +goose StatementEnd
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE offer ADD COLUMN IF NOT EXISTS max_sales INTEGER CHECK (max_sales > 0);
+ALTER TABLE offer ADD COLUMN IF NOT EXISTS sales_start_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE offer ADD COLUMN IF NOT EXISTS sales_end_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE IF NOT EXISTS offer_price_tier (
+    id SERIAL NOT NULL PRIMARY KEY,
+    offer_id INTEGER NOT NULL REFERENCES offer(id) ON DELETE CASCADE,
+    price INTEGER NOT NULL CHECK (price >= 0),
+    ends_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (offer_id, ends_at)
+);
+
+CREATE INDEX IF NOT EXISTS order_offer_id_status_idx ON "order" (offer_id, status);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS order_offer_id_status_idx;
+DROP TABLE IF EXISTS offer_price_tier;
+ALTER TABLE offer DROP COLUMN IF EXISTS sales_end_at;
+ALTER TABLE offer DROP COLUMN IF EXISTS sales_start_at;
+ALTER TABLE offer DROP COLUMN IF EXISTS max_sales;
+-- +goose StatementEnd
@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS offer_bump (
+    id SERIAL NOT NULL PRIMARY KEY,
+    offer_id INTEGER NOT NULL REFERENCES offer(id) ON DELETE CASCADE,
+    bump_offer_id INTEGER NOT NULL REFERENCES offer(id) ON DELETE CASCADE,
+    -- price — цена дополнения при покупке вместе с оффером, null — обычная цена дополнения
+    price INTEGER CHECK (price >= 0),
+    position INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (offer_id, bump_offer_id),
+    CHECK (offer_id != bump_offer_id)
+);
+
+CREATE TABLE IF NOT EXISTS order_item (
+    id SERIAL NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES "order"(id) ON DELETE CASCADE,
+    offer_id INTEGER REFERENCES offer(id) ON DELETE SET NULL,
+    name VARCHAR(250) NOT NULL,
+    price INTEGER NOT NULL,
+    discount INTEGER NOT NULL DEFAULT 0,
+    is_bump BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS order_item_order_id_idx ON order_item (order_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS order_item;
+DROP TABLE IF EXISTS offer_bump;
+-- +goose StatementEnd
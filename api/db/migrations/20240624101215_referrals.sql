@@ -0,0 +1,49 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS referral_code VARCHAR(20) UNIQUE;
+-- referral_commission — процент от цены оффера, который получает пригласивший. null — оффер без комиссии
+ALTER TABLE offer ADD COLUMN IF NOT EXISTS referral_commission INTEGER CHECK (referral_commission BETWEEN 0 AND 100);
+ALTER TABLE "order" ADD COLUMN IF NOT EXISTS referrer_id INTEGER REFERENCES "user"(id) ON DELETE SET NULL;
+
+CREATE TABLE IF NOT EXISTS referral_click (
+    id SERIAL NOT NULL PRIMARY KEY,
+    referrer_id INTEGER NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    offer_id INTEGER REFERENCES offer(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS referral_click_referrer_id_idx ON referral_click (referrer_id);
+
+CREATE TABLE IF NOT EXISTS referral_payout (
+    id SERIAL NOT NULL PRIMARY KEY,
+    referrer_id INTEGER NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    project_id INTEGER NOT NULL REFERENCES project(id) ON DELETE CASCADE,
+    amount INTEGER NOT NULL,
+    created_by INTEGER REFERENCES "user"(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS referral_commission (
+    id SERIAL NOT NULL PRIMARY KEY,
+    referrer_id INTEGER NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    order_id INTEGER NOT NULL UNIQUE REFERENCES "order"(id) ON DELETE CASCADE,
+    project_id INTEGER NOT NULL REFERENCES project(id) ON DELETE CASCADE,
+    amount INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'accrued' CHECK (status IN ('accrued', 'canceled', 'paid')),
+    payout_id INTEGER REFERENCES referral_payout(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS referral_commission_referrer_id_idx ON referral_commission (referrer_id, project_id, status);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS referral_commission;
+DROP TABLE IF EXISTS referral_payout;
+DROP TABLE IF EXISTS referral_click;
+ALTER TABLE "order" DROP COLUMN IF EXISTS referrer_id;
+ALTER TABLE offer DROP COLUMN IF EXISTS referral_commission;
+ALTER TABLE "user" DROP COLUMN IF EXISTS referral_code;
+-- +goose StatementEnd
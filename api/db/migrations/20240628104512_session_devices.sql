@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE user_session ADD COLUMN IF NOT EXISTS user_agent VARCHAR(512);
+ALTER TABLE user_session ADD COLUMN IF NOT EXISTS ip VARCHAR(45);
+
+-- max_user_sessions — сколько устройств ученика может быть в системе одновременно.
+-- NULL — без ограничений. Если ученик есть в нескольких проектах, действует меньший лимит
+ALTER TABLE project ADD COLUMN IF NOT EXISTS max_user_sessions INTEGER CHECK (max_user_sessions > 0);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE project DROP COLUMN IF EXISTS max_user_sessions;
+ALTER TABLE user_session DROP COLUMN IF EXISTS ip;
+ALTER TABLE user_session DROP COLUMN IF EXISTS user_agent;
+-- +goose StatementEnd
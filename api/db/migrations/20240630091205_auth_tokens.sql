@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+-- auth_token — одноразовые токены из писем: ссылка для входа и т.п. Хранится только хеш,
+-- purpose не дает использовать токен для чужой цели
+CREATE TABLE IF NOT EXISTS auth_token (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+    purpose VARCHAR(30) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS auth_token_user_purpose_idx ON auth_token (user_id, purpose, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS auth_token;
+-- +goose StatementEnd
@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- email_verified_at — когда пользователь подтвердил, что почта его. У старых аккаунтов пусто, пока не подтвердят
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP WITH TIME ZONE;
+
+-- email — адрес, для которого выдан токен: новый адрес при смене email или текущий при подтверждении
+ALTER TABLE auth_token ADD COLUMN IF NOT EXISTS email VARCHAR(80);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE auth_token DROP COLUMN IF EXISTS email;
+ALTER TABLE "user" DROP COLUMN IF EXISTS email_verified_at;
+-- +goose StatementEnd
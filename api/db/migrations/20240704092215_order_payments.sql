@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- order_payment — все платежи заказа. При повторной оплате старая ссылка остается рабочей,
+-- поэтому вебхуки по ней тоже принимаются
+CREATE TABLE IF NOT EXISTS order_payment (
+    id SERIAL NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES "order"(id) ON DELETE CASCADE,
+    payment_id VARCHAR(150) NOT NULL,
+    payment_url TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (order_id, payment_id)
+);
+
+INSERT INTO order_payment (order_id, payment_id, created_at)
+SELECT id, payment_id, created_at FROM "order" WHERE payment_id IS NOT NULL AND payment_id != ''
+ON CONFLICT DO NOTHING;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS order_payment;
+-- +goose StatementEnd
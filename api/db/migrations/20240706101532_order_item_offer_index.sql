@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- места оффера считаются и по позициям-дополнениям других заказов
+CREATE INDEX IF NOT EXISTS order_item_offer_id_idx ON order_item (offer_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS order_item_offer_id_idx;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- refunding_amount — возврат, который уже отправлен в платежную систему, но еще не записан.
+-- Пока он не 0, другой возврат по заказу не начнется
+ALTER TABLE "order" ADD COLUMN IF NOT EXISTS refunding_amount INTEGER NOT NULL DEFAULT 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE "order" DROP COLUMN IF EXISTS refunding_amount;
+-- +goose StatementEnd
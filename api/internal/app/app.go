@@ -10,7 +10,14 @@ import (
 
 func New(db *sqlx.DB, redis *redis.Client, config *config.Config) *fiber.App {
 
-	app := fiber.New()
+	// В ProxyHeader может прийти список адресов или что угодно от клиента,
+	// поэтому берется только корректный IP, а при заданном списке прокси — только от них
+	app := fiber.New(fiber.Config{
+		ProxyHeader:             config.ProxyHeader,
+		EnableIPValidation:      true,
+		EnableTrustedProxyCheck: len(config.TrustedProxies) > 0,
+		TrustedProxies:          config.TrustedProxies,
+	})
 
 	hero.NewHeroApp(db, redis, config, app)
 
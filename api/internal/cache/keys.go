@@ -3,3 +3,7 @@ package cache
 func GetOfferForRegistrationKey(offerSlug string) string {
 	return "offer-" + offerSlug
 }
+
+func GetRevokedSessionKey(sessionId string) string {
+	return "revoked-session-" + sessionId
+}
@@ -12,11 +12,23 @@ var ErrUserNotFound = errors.New("Пользователь не найден")
 // auth
 var ErrWrongCredentials = errors.New("Неверный пароль или логин")
 var ErrEmptyEmail = errors.New("Email не может быть пустым")
+var ErrInvalidEmail = errors.New("Некорректный email")
+var ErrEmailTaken = errors.New("Этот email уже занят другим аккаунтом")
+var ErrEmailNotChanged = errors.New("Это и так твой email")
+var ErrEmailAlreadyVerified = errors.New("Email уже подтвержден")
+var ErrInvalidEmailConfirmLink = errors.New("Ссылка для подтверждения email недействительна")
+var ErrEmailConfirmLinkExpired = errors.New("Время действия ссылки для подтверждения email вышло")
 var ErrEmptyPassword = errors.New("Пароль не может быть пустым")
 var ErrInvalidToken = errors.New("Неверный токен")
 var ErrTokenExpired = errors.New("Сессия истекла")
 var ErrMagicLinkExpired = errors.New("Время действия ссылки вышло")
 var ErrInvalidMagicLink = errors.New("Некорректная ссылка")
+var ErrInvalidRefreshToken = errors.New("Сессия закончилась, войдите заново")
+var ErrRefreshTokenReused = errors.New("Токен обновления уже использован, сессия закрыта")
+var ErrSessionNotFound = errors.New("Такая сессия не найдена")
+var ErrTooManyAuthTokens = errors.New("Слишком много запросов, попробуйте позже")
+var ErrInvalidPasswordResetLink = errors.New("Ссылка для смены пароля недействительна")
+var ErrPasswordResetLinkExpired = errors.New("Время действия ссылки для смены пароля вышло")
 
 // projects
 var ErrProjectAlreadyExists = errors.New("Такой проект уже существует")
@@ -48,12 +60,60 @@ var ErrQuizNotFound = errors.New("Квиз не найден")
 
 // offers
 var ErrOfferNotFound = errors.New("Такой оффер не найден")
+var ErrInvalidDonateAmount = errors.New("Сумма пожертвования меньше минимальной или больше максимальной")
+var ErrOfferSalesClosed = errors.New("Продажи этого предложения сейчас закрыты")
+var ErrOfferSoldOut = errors.New("Места закончились")
+
+// order bumps
+var ErrBumpNotFound = errors.New("Такое дополнение к предложению не найдено")
+var ErrBumpsNotAllowed = errors.New("К этому предложению нельзя добавить дополнения")
+var ErrDuplicateBump = errors.New("Дополнение добавлено к заказу несколько раз")
+var ErrBumpIsOffer = errors.New("Предложение нельзя добавить дополнением к самому себе")
+
+// gifts
+var ErrGiftNotAllowed = errors.New("Это предложение нельзя купить в подарок")
+var ErrEmptyGiftRecipient = errors.New("Укажите email получателя подарка")
+var ErrGiftToYourself = errors.New("Нельзя подарить предложение самому себе")
+
+// promocodes
+var ErrPromocodeNotFound = errors.New("Такой промокод не найден")
+var ErrPromocodeNotApplicable = errors.New("Промокод нельзя применить к этому предложению")
+var ErrPromocodeInactive = errors.New("Промокод сейчас не действует")
+var ErrPromocodeLimitReached = errors.New("Промокод больше нельзя использовать")
+
+// referrals
+var ErrReferrerNotFound = errors.New("Такой реферальный код не найден")
+var ErrReferralCodeTaken = errors.New("Такой реферальный код уже занят")
+var ErrReferralPayoutDenied = errors.New("Нет доступа к выплатам этого проекта")
+var ErrNothingToPayout = errors.New("У партнера нет начислений для выплаты")
 
 // payments
 var ErrPaymentSystemNotFound = errors.New("Такой платежный метод не найден")
+var ErrInvalidReceiptSettings = errors.New("Некорректные настройки чеков у платежного метода")
 
 // orders
 var ErrOrderNotFound = errors.New("Такой заказ не найден")
+var ErrIllegalOrderTransition = errors.New("Заказ не может перейти в такой статус")
+var ErrOrderAccessDenied = errors.New("Нет доступа к этому заказу")
+var ErrOrderNotPayable = errors.New("Этот заказ уже нельзя оплатить")
+
+// subscriptions
+var ErrSubscriptionNotFound = errors.New("Такая подписка не найдена")
+var ErrSubscriptionNotSupported = errors.New("Этот способ оплаты не поддерживает подписки")
+var ErrSubscriptionNotCancelable = errors.New("Подписка уже отменена или закончилась")
+
+// refunds
+var ErrRefundNotSupported = errors.New("Платежная система этого заказа не поддерживает возвраты")
+var ErrOrderNotRefundable = errors.New("Этот заказ нельзя вернуть")
+var ErrInvalidRefundAmount = errors.New("Сумма возврата больше оплаченной суммы")
+var ErrRefundFailed = errors.New("Платежная система не смогла вернуть деньги")
+var ErrRefundInProgress = errors.New("По этому заказу уже идет возврат")
+
+// webhooks
+var ErrInvalidWebhookSignature = errors.New("Неверная подпись уведомления")
+var ErrInvalidWebhookBody = errors.New("Некорректное уведомление")
+var ErrUnknownPaymentStatus = errors.New("Неизвестный статус платежа")
+var ErrWebhookEventIgnored = errors.New("Уведомление не касается оплаты заказа")
 
 // cache
 var ErrCacheItemNotFound = errors.New("Такое ключ не найден в кэше")
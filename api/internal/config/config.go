@@ -11,12 +11,13 @@ import (
 )
 
 type Config struct {
-	BaseURL             string
+	// BaseURL — адрес API снаружи, на нем открывается тестовая страница оплаты
+	BaseURL             string `env:"BASE_URL"`
 	ServerAddress       string
 	DatabaseDSN         string `env:"DATABASE_DSN"`
 	JwtTokenExp         time.Duration
-	MagicLinkExp        time.Duration
-	JwtTokenSecretKey   string `env:"JWT_TOKEN_SECRET_KEY"`
+	MagicLinkExp        time.Duration `env:"MAGIC_LINK_EXP"`
+	JwtTokenSecretKey   string        `env:"JWT_TOKEN_SECRET_KEY"`
 	JwtSigningMethod    jwt.SigningMethod
 	HeroAppBaseURL      string `env:"HERO_APP_BASE_URL"`
 	AwsSecretAccessKey  string `env:"AWS_SECRET_ACCESS_KEY"`
@@ -36,6 +37,37 @@ type Config struct {
 	ProdamusTestLogin   string `env:"PRODAMUS_TEST_LOGIN"`
 	RedisHost           string `env:"REDIS_HOST"`
 	RedisPort           string `env:"REDIS_PORT"`
+	// OrderReconcileAfter — через сколько неоплаченный заказ сверяется с платежной системой
+	OrderReconcileAfter time.Duration
+	// OrderExpireAfter — через сколько неоплаченный заказ истекает
+	OrderExpireAfter time.Duration
+	// SubscriptionGracePeriod — сколько доступ сохраняется после неудачного продления подписки
+	SubscriptionGracePeriod time.Duration
+	// SubscriptionRetryInterval — через сколько повторяется неудачное списание
+	SubscriptionRetryInterval time.Duration
+	// PaymentReminderMaxCount — сколько раз напомнить об оплате заказа. Задержку задает оффер
+	PaymentReminderMaxCount int
+	// RefreshTokenExp — сколько живет сессия без обновления токена. JwtTokenExp — время жизни токена доступа
+	RefreshTokenExp time.Duration
+	// ProxyHeader — заголовок, в котором прокси передает IP клиента, например X-Forwarded-For.
+	// Пустой — берется IP соединения
+	ProxyHeader string `env:"PROXY_HEADER"`
+	// MagicLinkMaxPerHour — сколько ссылок для входа можно запросить на один email за час
+	MagicLinkMaxPerHour int `env:"MAGIC_LINK_MAX_PER_HOUR"`
+	// PasswordResetExp — сколько действует ссылка для смены пароля
+	PasswordResetExp time.Duration `env:"PASSWORD_RESET_EXP"`
+	// PasswordResetMaxPerHour — сколько писем для смены пароля можно запросить на один email за час
+	PasswordResetMaxPerHour int `env:"PASSWORD_RESET_MAX_PER_HOUR"`
+	// EmailConfirmExp — сколько действует ссылка для подтверждения или смены email
+	EmailConfirmExp time.Duration `env:"EMAIL_CONFIRM_EXP"`
+	// EmailConfirmMaxPerHour — сколько писем для подтверждения или смены email можно запросить за час
+	EmailConfirmMaxPerHour int `env:"EMAIL_CONFIRM_MAX_PER_HOUR"`
+	// PaymentLinkExp — сколько живет ссылка на оплату у платежной системы. Пока она жива, напоминание шлет ее же
+	PaymentLinkExp time.Duration `env:"PAYMENT_LINK_EXP"`
+	// TrustedProxies — адреса прокси, которым можно верить в ProxyHeader. Пустой — заголовок берется от любого адреса
+	TrustedProxies []string `env:"TRUSTED_PROXIES" envSeparator:","`
+	// GiftPasswordLinkExp — сколько действует ссылка, по которой новый получатель подарка задает пароль
+	GiftPasswordLinkExp time.Duration `env:"GIFT_PASSWORD_LINK_EXP"`
 }
 
 var config *Config
@@ -56,8 +88,21 @@ func (c *Config) parseEnv() {
 	var flagEnv = flag.String("e", "", "Environment")
 
 	c.JwtSigningMethod = jwt.SigningMethodHS256
-	c.JwtTokenExp = time.Hour * 720
-	c.MagicLinkExp = time.Minute * 1
+	c.JwtTokenExp = time.Minute * 15
+	c.RefreshTokenExp = time.Hour * 720
+	c.MagicLinkExp = time.Minute * 15
+	c.MagicLinkMaxPerHour = 5
+	c.PasswordResetExp = time.Hour * 1
+	c.PasswordResetMaxPerHour = 3
+	c.EmailConfirmExp = time.Hour * 24
+	c.EmailConfirmMaxPerHour = 3
+	c.OrderReconcileAfter = time.Minute * 15
+	c.OrderExpireAfter = time.Hour * 48
+	c.SubscriptionGracePeriod = time.Hour * 72
+	c.SubscriptionRetryInterval = time.Hour * 24
+	c.PaymentReminderMaxCount = 2
+	c.PaymentLinkExp = time.Hour * 24
+	c.GiftPasswordLinkExp = time.Hour * 24 * 7
 	c.ServerAddress = *flagServerAddress
 	c.Env = "dev"
 	c.S3Endpoint = "https://s3.storage.selcloud.ru"
@@ -78,6 +123,10 @@ func (c *Config) parseEnv() {
 	if *flagEnv != "" {
 		c.Env = *flagEnv
 	}
+
+	if c.BaseURL == "" {
+		c.BaseURL = "http://" + c.ServerAddress
+	}
 }
 
 func New(pathToEnv string) *Config {
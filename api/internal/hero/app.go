@@ -1,8 +1,10 @@
 package hero
 
 import (
+	"context"
 	"createtodayapi/internal/cache"
 	"createtodayapi/internal/config"
+	"createtodayapi/internal/payments"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jmoiron/sqlx"
@@ -22,17 +24,30 @@ func NewHeroApp(db *sqlx.DB, redis *redis.Client, config *config.Config, app *fi
 
 	controller := NewController(service)
 
+	StartJobs(context.Background(), service)
+
 	hero := app.Group("/hero")
 
 	hero.Post("/auth/login", controller.Login)
 	hero.Post("/auth/login/get-magic-link", controller.GetMagicLink)
 	hero.Post("/auth/login/validate-magic-link", controller.ValidateMagicLink)
 	hero.Post("/auth/signup", controller.Signup)
+	hero.Post("/auth/refresh", controller.RefreshToken)
+	hero.Post("/auth/logout", AuthMiddleware(service), controller.Logout)
+	hero.Post("/auth/logout/all", AuthMiddleware(service), controller.LogoutEverywhere)
+	hero.Post("/auth/password/forgot", controller.ForgotPassword)
+	hero.Post("/auth/password/reset", controller.ResetPassword)
+	hero.Post("/auth/email/confirm", controller.ConfirmEmail)
+	hero.Post("/auth/email/change/confirm", controller.ConfirmEmailChange)
 
 	hero.Get("/profile", AuthMiddleware(service), controller.GetProfile)
 	hero.Post("/profile", AuthMiddleware(service), controller.UpdateProfile)
 	hero.Post("/profile/avatar", AuthMiddleware(service), controller.ChangeAvatar)
 	hero.Post("/profile/password", AuthMiddleware(service), controller.UpdatePassword)
+	hero.Get("/profile/sessions", AuthMiddleware(service), controller.GetSessions)
+	hero.Delete("/profile/sessions/:id", AuthMiddleware(service), controller.RevokeSession)
+	hero.Post("/profile/email", AuthMiddleware(service), controller.ChangeEmail)
+	hero.Post("/profile/email/verify", AuthMiddleware(service), controller.ResendEmailVerification)
 
 	hero.Get("/courses", AuthMiddleware(service), controller.GetUserAccessibleProducts)
 	hero.Get("/courses/:slug/lessons", AuthMiddleware(service), controller.GetUserAccessibleProduct)
@@ -47,9 +62,29 @@ func NewHeroApp(db *sqlx.DB, redis *redis.Client, config *config.Config, app *fi
 
 	hero.Get("/offers/:slug", controller.GetOffer)
 	hero.Post("/offers/:slug", controller.ProcessOffer)
+	hero.Post("/offers/:slug/promocode", controller.ValidatePromocode)
+
+	hero.Post("/webhooks/:provider", controller.Webhook)
+
+	// тестовая платежная система: оплата без настоящих ключей, только для разработки и e2e-тестов
+	if config.Env != "prod" {
+		payments.RegisterFake(config.BaseURL + "/hero/fake-checkout")
+
+		hero.Get("/fake-checkout/:id", controller.FakeCheckout)
+		hero.Post("/fake-checkout/:id", controller.CompleteFakeCheckout)
+	}
+
+	hero.Get("/orders", AuthMiddleware(service), controller.GetOrders)
+	hero.Get("/orders/:id", AuthMiddleware(service), controller.GetOrder)
+	hero.Post("/orders/:id/pay", AuthMiddleware(service), controller.RetryOrderPayment)
+	hero.Post("/orders/:id/refund", AuthMiddleware(service), controller.RefundOrder)
+
+	hero.Get("/subscriptions", AuthMiddleware(service), controller.GetSubscriptions)
+	hero.Post("/subscriptions/:id/cancel", AuthMiddleware(service), controller.CancelSubscription)
 
-	hero.Post("/webhooks/tinkoff", controller.TinkoffWebhook)
-	hero.Post("/webhooks/prodamus", controller.ProdamusWebhook)
+	hero.Get("/referrals", AuthMiddleware(service), controller.GetReferralStats)
+	hero.Get("/projects/:id/referrals", AuthMiddleware(service), controller.GetProjectReferrers)
+	hero.Post("/projects/:id/referrals/payouts", AuthMiddleware(service), controller.CreateReferralPayout)
 
 	hero.Get("/quizzes/:slug/solved/:id/comments", AuthMiddleware(service), controller.GetQuizComments)
 	hero.Post("/quizzes/:slug/solved/:id/comments", AuthMiddleware(service), controller.CreateQuizComment)
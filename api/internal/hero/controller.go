@@ -4,13 +4,17 @@ import (
 	"context"
 	"createtodayapi/internal/common"
 	"createtodayapi/internal/logger"
+	"createtodayapi/internal/payments"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -22,6 +26,13 @@ type IController interface {
 	Signup(ctx *fiber.Ctx) error
 	GetMagicLink(ctx *fiber.Ctx) error
 	ValidateMagicLink(ctx *fiber.Ctx) error
+	RefreshToken(ctx *fiber.Ctx) error
+	Logout(ctx *fiber.Ctx) error
+	LogoutEverywhere(ctx *fiber.Ctx) error
+	ForgotPassword(ctx *fiber.Ctx) error
+	ResetPassword(ctx *fiber.Ctx) error
+	ConfirmEmail(ctx *fiber.Ctx) error
+	ConfirmEmailChange(ctx *fiber.Ctx) error
 
 	// Products
 	GetUserAccessibleProducts(ctx *fiber.Ctx) error
@@ -32,6 +43,10 @@ type IController interface {
 	// Profile
 	GetProfile(ctx *fiber.Ctx) error
 	UpdatePassword(ctx *fiber.Ctx) error
+	GetSessions(ctx *fiber.Ctx) error
+	RevokeSession(ctx *fiber.Ctx) error
+	ResendEmailVerification(ctx *fiber.Ctx) error
+	ChangeEmail(ctx *fiber.Ctx) error
 
 	// Quizzes
 	SolveQuiz(ctx *fiber.Ctx) error
@@ -39,11 +54,34 @@ type IController interface {
 
 	// Offers
 	GetOffer(ctx *fiber.Ctx) error
+	ValidatePromocode(ctx *fiber.Ctx) error
 
 	// Webhooks
-	TinkoffWebhook(ctx *fiber.Ctx) error
+	Webhook(ctx *fiber.Ctx) error
+	RefundOrder(ctx *fiber.Ctx) error
+
+	// Orders
+	GetOrders(ctx *fiber.Ctx) error
+	GetOrder(ctx *fiber.Ctx) error
+	RetryOrderPayment(ctx *fiber.Ctx) error
+
+	// Subscriptions
+	GetSubscriptions(ctx *fiber.Ctx) error
+	CancelSubscription(ctx *fiber.Ctx) error
+
+	// Fake checkout
+	FakeCheckout(ctx *fiber.Ctx) error
+	CompleteFakeCheckout(ctx *fiber.Ctx) error
+
+	// Referrals
+	GetReferralStats(ctx *fiber.Ctx) error
+	GetProjectReferrers(ctx *fiber.Ctx) error
+	CreateReferralPayout(ctx *fiber.Ctx) error
 }
 
+// maxSessionUserAgentLength — длина колонки user_session.user_agent
+const maxSessionUserAgentLength = 512
+
 type Controller struct {
 	service IService
 }
@@ -65,7 +103,7 @@ func (c *Controller) Login(ctx *fiber.Ctx) error {
 		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
 	}
 
-	result, err := c.service.Login(context.Background(), &body)
+	result, err := c.service.Login(context.Background(), &body, sessionClient(ctx))
 
 	if errors.Is(err, common.ErrWrongCredentials) {
 		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
@@ -76,11 +114,7 @@ func (c *Controller) Login(ctx *fiber.Ctx) error {
 		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
 	}
 
-	tokenCookie := new(fiber.Cookie)
-	tokenCookie.Name = "token"
-	tokenCookie.Value = result.Token
-
-	ctx.Cookie(tokenCookie)
+	setSessionCookies(ctx, result.Token, result.RefreshToken)
 
 	return common.DoApiResponse(ctx, http.StatusOK, result, nil)
 }
@@ -99,18 +133,14 @@ func (c *Controller) Signup(ctx *fiber.Ctx) error {
 		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
 	}
 
-	result, err := c.service.Signup(context.Background(), &body)
+	result, err := c.service.Signup(context.Background(), &body, sessionClient(ctx))
 	if err != nil {
 		logger.Log.Error(err.Error(), "error", err)
 		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
 	}
 
-	if result.Token != nil {
-		tokenCookie := new(fiber.Cookie)
-		tokenCookie.Name = "token"
-		tokenCookie.Value = *result.Token
-
-		ctx.Cookie(tokenCookie)
+	if result.Token != nil && result.RefreshToken != nil {
+		setSessionCookies(ctx, *result.Token, *result.RefreshToken)
 	}
 
 	return common.DoApiResponse(ctx, http.StatusOK, result, nil)
@@ -131,6 +161,10 @@ func (c *Controller) GetMagicLink(ctx *fiber.Ctx) error {
 
 	err = c.service.GetMagicLink(context.Background(), body.Email)
 
+	if errors.Is(err, common.ErrTooManyAuthTokens) {
+		return common.DoApiResponse(ctx, http.StatusTooManyRequests, nil, err)
+	}
+
 	if err != nil {
 		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
 	}
@@ -157,7 +191,7 @@ func (c *Controller) ValidateMagicLink(ctx *fiber.Ctx) error {
 		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
 	}
 
-	result, err := c.service.ValidateMagicLink(context.Background(), body.Token)
+	result, err := c.service.ValidateMagicLink(context.Background(), body.Token, sessionClient(ctx))
 
 	if err != nil {
 		logger.Log.Error(err.Error())
@@ -167,13 +201,361 @@ func (c *Controller) ValidateMagicLink(ctx *fiber.Ctx) error {
 		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
 	}
 
+	setSessionCookies(ctx, result.Token, result.RefreshToken)
+
+	return common.DoApiResponse(ctx, http.StatusOK, result, nil)
+}
+
+// RefreshToken меняет refresh-токен на новую пару токенов. Токен берется из тела запроса,
+// а если его там нет — из cookie
+func (c *Controller) RefreshToken(ctx *fiber.Ctx) error {
+	var body RefreshTokenBody
+
+	if len(ctx.Body()) > 0 {
+		err := json.Unmarshal(ctx.Body(), &body)
+		if err != nil {
+			return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+		}
+	}
+
+	if body.RefreshToken == "" {
+		body.RefreshToken = ctx.Cookies("refresh_token")
+	}
+
+	err := body.Validate()
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusUnauthorized, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "refresh-token")
+
+	result, err := c.service.RefreshSession(rCtx, body.RefreshToken, sessionClient(ctx))
+
+	if errors.Is(err, common.ErrInvalidRefreshToken) || errors.Is(err, common.ErrRefreshTokenReused) {
+		clearSessionCookies(ctx)
+		return common.DoApiResponse(ctx, http.StatusUnauthorized, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	setSessionCookies(ctx, result.Token, result.RefreshToken)
+
+	return common.DoApiResponse(ctx, http.StatusOK, result, nil)
+}
+
+func (c *Controller) Logout(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "logout")
+
+	err := c.service.Logout(rCtx, user)
+
+	if errors.Is(err, common.ErrSessionNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	clearSessionCookies(ctx)
+
+	return common.DoApiResponse(ctx, http.StatusOK, nil, nil)
+}
+
+func (c *Controller) LogoutEverywhere(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "logout-everywhere")
+
+	err := c.service.LogoutEverywhere(rCtx, user.ID)
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	clearSessionCookies(ctx)
+
+	return common.DoApiResponse(ctx, http.StatusOK, nil, nil)
+}
+
+func (c *Controller) ForgotPassword(ctx *fiber.Ctx) error {
+	var body ForgotPasswordBody
+
+	err := json.Unmarshal(ctx.Body(), &body)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	err = body.Validate()
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "forgot-password")
+
+	err = c.service.ForgotPassword(rCtx, body.Email)
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, "Если такой аккаунт есть, мы отправили на почту ссылку для смены пароля", nil)
+}
+
+func (c *Controller) ResetPassword(ctx *fiber.Ctx) error {
+	var body ResetPasswordBody
+
+	err := json.Unmarshal(ctx.Body(), &body)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	err = body.Validate()
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "reset-password")
+
+	err = c.service.ResetPassword(rCtx, body.Token, body.Password)
+
+	if errors.Is(err, common.ErrInvalidPasswordResetLink) || errors.Is(err, common.ErrPasswordResetLinkExpired) {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	clearSessionCookies(ctx)
+
+	return common.DoApiResponse(ctx, http.StatusOK, "Новый пароль успешно сохранен", nil)
+}
+
+func (c *Controller) ConfirmEmail(ctx *fiber.Ctx) error {
+	var body ConfirmEmailBody
+
+	err := json.Unmarshal(ctx.Body(), &body)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	err = body.Validate()
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "confirm-email")
+
+	err = c.service.ConfirmEmail(rCtx, body.Token)
+
+	if errors.Is(err, common.ErrInvalidEmailConfirmLink) || errors.Is(err, common.ErrEmailConfirmLinkExpired) {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, "Email подтвержден", nil)
+}
+
+func (c *Controller) ConfirmEmailChange(ctx *fiber.Ctx) error {
+	var body ConfirmEmailBody
+
+	err := json.Unmarshal(ctx.Body(), &body)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	err = body.Validate()
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "confirm-email-change")
+
+	err = c.service.ConfirmEmailChange(rCtx, body.Token)
+
+	if errors.Is(err, common.ErrInvalidEmailConfirmLink) || errors.Is(err, common.ErrEmailConfirmLinkExpired) {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	if errors.Is(err, common.ErrEmailTaken) {
+		return common.DoApiResponse(ctx, http.StatusConflict, nil, err)
+	}
+
+	if errors.Is(err, common.ErrUserNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, "Email изменен", nil)
+}
+
+func (c *Controller) ResendEmailVerification(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "resend-email-verification")
+
+	err := c.service.ResendEmailVerification(rCtx, user.ID)
+
+	if errors.Is(err, common.ErrEmailAlreadyVerified) {
+		return common.DoApiResponse(ctx, http.StatusConflict, nil, err)
+	}
+
+	if errors.Is(err, common.ErrTooManyAuthTokens) {
+		return common.DoApiResponse(ctx, http.StatusTooManyRequests, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, "Письмо для подтверждения email отправлено на вашу почту", nil)
+}
+
+func (c *Controller) ChangeEmail(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+	var body ChangeEmailBody
+
+	err := json.Unmarshal(ctx.Body(), &body)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	err = body.Validate()
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "change-email")
+
+	err = c.service.RequestEmailChange(rCtx, user.ID, body.Email)
+
+	if errors.Is(err, common.ErrEmailNotChanged) {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	if errors.Is(err, common.ErrEmailTaken) {
+		return common.DoApiResponse(ctx, http.StatusConflict, nil, err)
+	}
+
+	if errors.Is(err, common.ErrTooManyAuthTokens) {
+		return common.DoApiResponse(ctx, http.StatusTooManyRequests, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, "Ссылка для подтверждения отправлена на новый email", nil)
+}
+
+func (c *Controller) GetSessions(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "get-sessions")
+
+	sessions, err := c.service.GetUserSessions(rCtx, user)
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, sessions, nil)
+}
+
+func (c *Controller) RevokeSession(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+	sessionId := ctx.Params("id")
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "revoke-session")
+
+	err := c.service.RevokeSession(rCtx, user.ID, sessionId)
+
+	if errors.Is(err, common.ErrSessionNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	if sessionId == user.SessionID {
+		clearSessionCookies(ctx)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, nil, nil)
+}
+
+// sessionClient — устройство из запроса для списка сессий
+func sessionClient(ctx *fiber.Ctx) SessionClient {
+	userAgent := []rune(ctx.Get(fiber.HeaderUserAgent))
+	if len(userAgent) > maxSessionUserAgentLength {
+		userAgent = userAgent[:maxSessionUserAgentLength]
+	}
+
+	// колонка ip вмещает только адрес. Если прокси передал что-то другое, сессия сохраняется без него
+	ip := ctx.IP()
+	if net.ParseIP(ip) == nil {
+		ip = ""
+	}
+
+	return SessionClient{
+		UserAgent: string(userAgent),
+		IP:        ip,
+	}
+}
+
+// setSessionCookies кладет токены в cookie. Refresh-токен недоступен из js и уходит только на /hero/auth
+func setSessionCookies(ctx *fiber.Ctx, token string, refreshToken string) {
 	tokenCookie := new(fiber.Cookie)
 	tokenCookie.Name = "token"
-	tokenCookie.Value = result.Token
+	tokenCookie.Value = token
 
 	ctx.Cookie(tokenCookie)
 
-	return common.DoApiResponse(ctx, http.StatusOK, result, nil)
+	refreshCookie := new(fiber.Cookie)
+	refreshCookie.Name = "refresh_token"
+	refreshCookie.Value = refreshToken
+	refreshCookie.Path = "/hero/auth"
+	refreshCookie.HTTPOnly = true
+
+	ctx.Cookie(refreshCookie)
+}
+
+func clearSessionCookies(ctx *fiber.Ctx) {
+	ctx.Cookie(&fiber.Cookie{Name: "token", Expires: time.Unix(0, 0)})
+	ctx.Cookie(&fiber.Cookie{Name: "refresh_token", Path: "/hero/auth", Expires: time.Unix(0, 0), HTTPOnly: true})
 }
 
 func (c *Controller) GetProfile(ctx *fiber.Ctx) error {
@@ -516,6 +898,14 @@ func (c *Controller) GetOffer(ctx *fiber.Ctx) error {
 		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
 	}
 
+	// переход по реферальной ссылке считается для партнера, но на ответ не влияет
+	if ref := ctx.Query("ref"); ref != "" {
+		err = c.service.TrackReferralClick(context.Background(), offerSlug, ref)
+		if err != nil {
+			logger.Log.Info("could not track referral click", "offer_slug", offerSlug, "ref", ref, "err", err.Error())
+		}
+	}
+
 	return common.DoApiResponse(ctx, http.StatusOK, offer, nil)
 }
 
@@ -535,6 +925,36 @@ func (c *Controller) ProcessOffer(ctx *fiber.Ctx) error {
 	rCtx = context.WithValue(rCtx, "request-key", "process-offer")
 
 	result, err := c.service.ProcessOffer(rCtx, body)
+
+	if errors.Is(err, common.ErrPromocodeNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if errors.Is(err, common.ErrInvalidDonateAmount) || errors.Is(err, common.ErrSubscriptionNotSupported) {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	if errors.Is(err, common.ErrBumpNotFound) || errors.Is(err, common.ErrBumpsNotAllowed) ||
+		errors.Is(err, common.ErrDuplicateBump) || errors.Is(err, common.ErrBumpIsOffer) {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	if errors.Is(err, common.ErrOfferSoldOut) || errors.Is(err, common.ErrOfferSalesClosed) {
+		return common.DoApiResponse(ctx, http.StatusConflict, nil, err)
+	}
+
+	if errors.Is(err, common.ErrGiftNotAllowed) || errors.Is(err, common.ErrEmptyGiftRecipient) || errors.Is(err, common.ErrGiftToYourself) {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	if errors.Is(err, common.ErrPromocodeNotApplicable) || errors.Is(err, common.ErrPromocodeInactive) {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	if errors.Is(err, common.ErrPromocodeLimitReached) {
+		return common.DoApiResponse(ctx, http.StatusConflict, nil, err)
+	}
+
 	if err != nil {
 		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
 	}
@@ -542,18 +962,84 @@ func (c *Controller) ProcessOffer(ctx *fiber.Ctx) error {
 	return common.DoApiResponse(ctx, http.StatusOK, result, nil)
 }
 
-func (c *Controller) TinkoffWebhook(ctx *fiber.Ctx) error {
-	var body TinkoffWebhookBody
+func (c *Controller) ValidatePromocode(ctx *fiber.Ctx) error {
+	var body ValidatePromocodeBody
 
 	err := json.Unmarshal(ctx.Body(), &body)
 	if err != nil {
-		logger.Log.Error(err.Error())
 		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
 	}
 
-	rCtx := context.Background()
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "validate-promocode")
+
+	result, err := c.service.ValidatePromocode(rCtx, ValidatePromocodeDTO{
+		Slug: ctx.Params("slug"),
+		Code: body.Code,
+	})
+
+	if errors.Is(err, common.ErrOfferNotFound) || errors.Is(err, common.ErrPromocodeNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if errors.Is(err, common.ErrPromocodeNotApplicable) || errors.Is(err, common.ErrPromocodeInactive) {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	if errors.Is(err, common.ErrPromocodeLimitReached) {
+		return common.DoApiResponse(ctx, http.StatusConflict, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, result, nil)
+}
+
+func (c *Controller) Webhook(ctx *fiber.Ctx) error {
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "webhook")
+
+	provider := ctx.Params("provider")
+
+	err := c.service.ProcessWebhook(rCtx, provider, c.getWebhookRequest(ctx))
+
+	// некоторые платежные системы ждут ответ в своем формате
+	if responder, ok := payments.NewPaymentSystem(provider).(payments.WebhookResponder); ok {
+		status, body := responder.WebhookResponse(err)
+		return ctx.Status(status).JSON(body)
+	}
+
+	if errors.Is(err, common.ErrPaymentSystemNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if errors.Is(err, common.ErrInvalidWebhookBody) {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	if errors.Is(err, common.ErrInvalidWebhookSignature) {
+		return common.DoApiResponse(ctx, http.StatusForbidden, nil, err)
+	}
+
+	if errors.Is(err, common.ErrOrderNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	// устаревший статус (например, отказ после оплаты) не применяется. Платежной системе отвечаем успехом,
+	// иначе она будет присылать его снова. Переход уже записан в лог сервисом
+	if errors.Is(err, common.ErrIllegalOrderTransition) {
+		logger.Info(rCtx, "webhook status ignored", "provider", provider, "err", err.Error())
+		return common.DoApiResponse(ctx, http.StatusOK, nil, nil)
+	}
+
+	if errors.Is(err, common.ErrUnknownPaymentStatus) {
+		return common.DoApiResponse(ctx, http.StatusUnprocessableEntity, nil, common.ErrUnknownPaymentStatus)
+	}
 
-	err = c.service.ProcessTinkoffWebhook(rCtx, body)
 	if err != nil {
 		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
 	}
@@ -561,23 +1047,79 @@ func (c *Controller) TinkoffWebhook(ctx *fiber.Ctx) error {
 	return common.DoApiResponse(ctx, http.StatusOK, nil, nil)
 }
 
-func (c *Controller) ProdamusWebhook(ctx *fiber.Ctx) error {
-	var body ProdamusWebhookBody
-
-	rCtx := context.Background()
+func (c *Controller) RefundOrder(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
 
-	err := json.Unmarshal(ctx.Body(), &body)
+	orderId, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
 	if err != nil {
-		logger.Error(rCtx, "could not process body for prodamus webhook", "err", err.Error())
 		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
 	}
 
-	err = c.service.ProcessProdamusWebhook(rCtx, body)
+	var body RefundOrderBody
+	if len(ctx.Body()) > 0 {
+		err = json.Unmarshal(ctx.Body(), &body)
+		if err != nil {
+			return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+		}
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "refund-order")
+
+	result, err := c.service.RefundOrder(rCtx, user.ID, RefundOrderDTO{
+		OrderID:      orderId,
+		Amount:       body.Amount,
+		RevokeAccess: body.RevokeAccess,
+	})
+
+	if errors.Is(err, common.ErrOrderNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if errors.Is(err, common.ErrOrderAccessDenied) {
+		return common.DoApiResponse(ctx, http.StatusForbidden, nil, err)
+	}
+
+	if errors.Is(err, common.ErrInvalidRefundAmount) || errors.Is(err, common.ErrRefundNotSupported) {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	if errors.Is(err, common.ErrOrderNotRefundable) || errors.Is(err, common.ErrRefundInProgress) {
+		return common.DoApiResponse(ctx, http.StatusConflict, nil, err)
+	}
+
+	if errors.Is(err, common.ErrRefundFailed) {
+		return common.DoApiResponse(ctx, http.StatusBadGateway, nil, err)
+	}
+
 	if err != nil {
 		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
 	}
 
-	return common.DoApiResponse(ctx, http.StatusOK, nil, nil)
+	return common.DoApiResponse(ctx, http.StatusOK, result, nil)
+}
+
+// getWebhookRequest отдает тело, заголовки и параметры уведомления без изменений — по ним проверяется подпись
+func (c *Controller) getWebhookRequest(ctx *fiber.Ctx) payments.WebhookRequest {
+	headers := make(http.Header)
+	ctx.Request().Header.VisitAll(func(key, value []byte) {
+		headers.Add(string(key), string(value))
+	})
+
+	query := make(url.Values)
+	ctx.Request().URI().QueryArgs().VisitAll(func(key, value []byte) {
+		query.Add(string(key), string(value))
+	})
+
+	body := make([]byte, len(ctx.Body()))
+	copy(body, ctx.Body())
+
+	return payments.WebhookRequest{
+		Body:    body,
+		Headers: headers,
+		Query:   query,
+	}
 }
 
 func (c *Controller) GetQuizComments(ctx *fiber.Ctx) error {
@@ -667,3 +1209,204 @@ func NewController(service IService) *Controller {
 		service: service,
 	}
 }
+
+func (c *Controller) GetOrders(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "get-orders")
+
+	orders, err := c.service.GetOrders(rCtx, user.ID)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, orders, nil)
+}
+
+func (c *Controller) GetOrder(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+
+	orderId, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "get-order")
+
+	order, err := c.service.GetOrder(rCtx, user.ID, orderId)
+
+	if errors.Is(err, common.ErrOrderNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, order, nil)
+}
+
+func (c *Controller) RetryOrderPayment(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+
+	orderId, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "retry-order-payment")
+
+	result, err := c.service.RetryOrderPayment(rCtx, user.ID, orderId)
+
+	if errors.Is(err, common.ErrOrderNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if errors.Is(err, common.ErrOrderNotPayable) || errors.Is(err, common.ErrOfferSoldOut) || errors.Is(err, common.ErrOfferSalesClosed) ||
+		errors.Is(err, common.ErrPromocodeLimitReached) {
+		return common.DoApiResponse(ctx, http.StatusConflict, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, result, nil)
+}
+
+func (c *Controller) GetSubscriptions(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "get-subscriptions")
+
+	subscriptions, err := c.service.GetSubscriptions(rCtx, user.ID)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, subscriptions, nil)
+}
+
+func (c *Controller) CancelSubscription(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+
+	subscriptionId, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "cancel-subscription")
+
+	err = c.service.CancelSubscription(rCtx, user.ID, subscriptionId)
+
+	if errors.Is(err, common.ErrSubscriptionNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if errors.Is(err, common.ErrSubscriptionNotCancelable) {
+		return common.DoApiResponse(ctx, http.StatusConflict, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, nil, nil)
+}
+
+func (c *Controller) GetReferralStats(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "get-referral-stats")
+
+	stats, err := c.service.GetReferralStats(rCtx, user.ID)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, stats, nil)
+}
+
+func (c *Controller) GetProjectReferrers(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+
+	projectId, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "get-project-referrers")
+
+	referrers, err := c.service.GetProjectReferrers(rCtx, user.ID, projectId)
+
+	if errors.Is(err, common.ErrProjectNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if errors.Is(err, common.ErrReferralPayoutDenied) {
+		return common.DoApiResponse(ctx, http.StatusForbidden, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, referrers, nil)
+}
+
+func (c *Controller) CreateReferralPayout(ctx *fiber.Ctx) error {
+	user := ctx.Locals("user").(*User)
+
+	projectId, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	var body ReferralPayoutBody
+	err = json.Unmarshal(ctx.Body(), &body)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "create-referral-payout")
+
+	payout, err := c.service.CreateReferralPayout(rCtx, ReferralPayoutDTO{
+		ProjectID:    projectId,
+		OwnerID:      int64(user.ID),
+		ReferralCode: body.ReferralCode,
+	})
+
+	if errors.Is(err, common.ErrProjectNotFound) || errors.Is(err, common.ErrReferrerNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if errors.Is(err, common.ErrReferralPayoutDenied) {
+		return common.DoApiResponse(ctx, http.StatusForbidden, nil, err)
+	}
+
+	if errors.Is(err, common.ErrNothingToPayout) {
+		return common.DoApiResponse(ctx, http.StatusConflict, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
+	}
+
+	return common.DoApiResponse(ctx, http.StatusOK, payout, nil)
+}
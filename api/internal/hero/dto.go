@@ -2,6 +2,9 @@ package hero
 
 import (
 	"createtodayapi/internal/common"
+	"net/mail"
+	"strings"
+	"time"
 )
 
 type LoginBody struct {
@@ -47,6 +50,21 @@ func (b *ValidateMagicLinkBody) Validate() error {
 
 type LoginResult struct {
 	Token string `json:"token"`
+	// RefreshToken — одноразовый токен для /auth/refresh, каждый раз выдается новый
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type RefreshTokenBody struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (b *RefreshTokenBody) Validate() error {
+	if b.RefreshToken == "" {
+		return common.ErrInvalidRefreshToken
+	}
+
+	return nil
 }
 
 type SignupBody struct {
@@ -67,6 +85,7 @@ func (b *SignupBody) Validate() error {
 type SignUpResult struct {
 	AlreadyExists bool    `json:"alreadyExists"`
 	Token         *string `json:"token"`
+	RefreshToken  *string `json:"refresh_token,omitempty"`
 	Message       string  `json:"message,omitempty"`
 }
 
@@ -95,6 +114,69 @@ func (b *UpdatePasswordBody) Validate() error {
 	return nil
 }
 
+type ChangeEmailBody struct {
+	Email string `json:"email"`
+}
+
+func (b *ChangeEmailBody) Validate() error {
+	b.Email = strings.TrimSpace(b.Email)
+
+	if b.Email == "" {
+		return common.ErrEmptyEmail
+	}
+
+	address, err := mail.ParseAddress(b.Email)
+	if err != nil || address.Address != b.Email {
+		return common.ErrInvalidEmail
+	}
+
+	return nil
+}
+
+type ConfirmEmailBody struct {
+	Token string `json:"token"`
+}
+
+func (b *ConfirmEmailBody) Validate() error {
+	if b.Token == "" {
+		return common.ErrInvalidEmailConfirmLink
+	}
+
+	return nil
+}
+
+type ForgotPasswordBody struct {
+	Email string `json:"email"`
+}
+
+func (b *ForgotPasswordBody) Validate() error {
+	if b.Email == "" {
+		return common.ErrEmptyEmail
+	}
+	return nil
+}
+
+type ResetPasswordBody struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (b *ResetPasswordBody) Validate() error {
+	if b.Token == "" {
+		return common.ErrInvalidPasswordResetLink
+	}
+
+	if b.Password == "" {
+		return common.ErrNewPasswordIsEmpty
+	}
+
+	if len(b.Password) < 8 {
+		return common.ErrNewPasswordIsShort
+	}
+
+	return nil
+}
+
 type SolveQuizBody struct {
 	Answer string `json:"answer"`
 	Type   string `json:"type"`
@@ -173,14 +255,33 @@ type ProcessOfferDTO struct {
 	Instagram         string `json:"instagram" db:"instagram"`
 	Comment           string `json:"comment"`
 	SelectedPayMethod int64  `json:"selected_pay_method" db:"selected_pay_method"`
+	Promocode         string `json:"promocode"`
+	// DonateAmount — сумма в рублях, которую покупатель выбрал сам, если оффер — пожертвование
+	DonateAmount uint64 `json:"donate_amount"`
+	// IsGift — покупатель оплачивает оффер для другого человека из GiftRecipient
+	IsGift        bool           `json:"is_gift"`
+	GiftRecipient *GiftRecipient `json:"gift_recipient"`
+	// Bumps — слаги дополнений, которые покупатель добавил к заказу
+	Bumps []string `json:"bumps"`
+	// Ref — реферальный код партнера, который привел покупателя
+	Ref string `json:"ref"`
+}
+
+type GiftRecipient struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
 }
 
 type ProcessOfferResult struct {
-	Message     string `json:"message"`
-	RedirectURL string `json:"redirect_url"`
+	Message       string                 `json:"message"`
+	RedirectURL   string                 `json:"redirect_url"`
+	PaymentWidget map[string]interface{} `json:"payment_widget,omitempty"`
 }
 
 type CreatePaymentDTO struct {
+	// OrderID и Attempt — если заказ уже есть и его оплачивают заново, новый заказ не создается
+	OrderID          int64
+	Attempt          int
 	PayMethod        *PayIntegration
 	UserID           int64
 	Email            string
@@ -188,6 +289,38 @@ type CreatePaymentDTO struct {
 	OrderDescription string
 	OfferID          int64
 	Price            uint64
+	ReturnURL        string
+	Promocode        *AppliedPromocode
+	SubscriptionID   *int64
+	// Subscription — подписка, которую оформляет этот заказ. Создается вместе с заказом
+	Subscription *NewSubscription
+	Gift         *Gift
+	// Items — позиции нового заказа, Price — их сумма
+	Items      []NewOrderItem
+	ReferrerID *int64
+}
+
+// Gift — получатель подарка. Аккаунт ему создается только после оплаты заказа
+type Gift struct {
+	GiftedTo GiftedTo
+}
+
+type ValidatePromocodeBody struct {
+	Code string `json:"code"`
+}
+
+type ValidatePromocodeDTO struct {
+	Slug string
+	Code string
+}
+
+// AppliedPromocode — промокод, примененный к цене оффера. Цены в рублях
+type AppliedPromocode struct {
+	PromocodeID int64  `json:"-"`
+	Code        string `json:"code"`
+	Price       uint64 `json:"price"`
+	Discount    uint64 `json:"discount"`
+	FinalPrice  uint64 `json:"final_price"`
 }
 
 type UpdateUserInfoDTO struct {
@@ -197,28 +330,51 @@ type UpdateUserInfoDTO struct {
 	Instagram string `json:"instagram" db:"instagram"`
 }
 
-type TinkoffWebhookBody struct {
-	TerminalKey string `json:"TerminalKey"`
-	Amount      uint64 `json:"Amount"`
-	OrderId     string `json:"OrderId"`
-	Success     bool   `json:"Success"`
-	Status      string `json:"Status"`
-	PaymentId   int64  `json:"PaymentId"`
-	ErrorCode   string `json:"ErrorCode"`
-	Message     string `json:"Message"`
-	Details     string `json:"Details"`
-	RebillId    int64  `json:"RebillId"`
-	CardId      int    `json:"CardId"`
-	Pan         string `json:"Pan"`
-	ExpDate     string `json:"ExpDate"`
-	Token       string `json:"Token"`
+type ChangeOrderStatusDTO struct {
+	OrderID int64
+	Status  string
+	// ProviderStatus — статус платежной системы как есть, по нему разбираемся с непонятными заказами.
+	// Пустой — статус платежной системы не меняется
+	ProviderStatus string
+	Error          OrderError
+	CardInfo       OrderCardInfo
+	// RefundedAmount — сколько всего вернули по уведомлению о возврате, в рублях. 0 — сумма неизвестна
+	RefundedAmount uint64
+	// PaymentID — прошлый платеж заказа, который становится текущим, если статус поменялся. Пустой — платеж тот же
+	PaymentID string
+	// GiftRecipientPassword — хеш случайного пароля, если получателя оплаченного подарка нужно зарегистрировать.
+	// Сам пароль никуда не сохраняется: получатель задаст свой по ссылке из письма
+	GiftRecipientPassword string
+	// Письма и другие действия, которые нужно выполнить, если статус поменялся
+	Outbox []NewOrderOutboxMessage
+	// GroupIDs — группы всех позиций заказа, в которые нужно записать ученика после оплаты
+	GroupIDs []int64
+}
+
+type ChangeOrderStatusResult struct {
+	PreviousStatus string
+	Changed        bool
 }
 
-type ProdamusWebhookBody struct {
-	OrderId                  string `json:"order_id"`
-	OrderNum                 string `json:"order_num"`
-	PaymentStatus            string `json:"payment_status"`
-	PaymentStatusDescription string `json:"payment_status_description"`
+type OrderCompletedEmailPayload struct {
+	Email   string `json:"email"`
+	Ordered string `json:"ordered"`
+	Amount  uint64 `json:"amount"`
+}
+
+type EnrollmentEmailPayload struct {
+	Email   string `json:"email"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// GiftEmailPayload — письмо получателю подарка. Получатель и то, новый ли он, берутся из заказа при отправке:
+// аккаунт создается в той же транзакции, что и письмо
+type GiftEmailPayload struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	FromName  string `json:"from_name"`
+	Ordered   string `json:"ordered"`
 }
 
 type UpdateQuizComment struct {
@@ -226,3 +382,43 @@ type UpdateQuizComment struct {
 	CommentID int64  `db:"comment_id" json:"comment_id"`
 	Text      string `json:"text"`
 }
+
+type RefundOrderBody struct {
+	// Amount — сколько рублей вернуть. Если не указано — возвращается весь остаток
+	Amount       uint64 `json:"amount"`
+	RevokeAccess bool   `json:"revoke_access"`
+}
+
+type RefundOrderDTO struct {
+	OrderID      int64
+	Amount       uint64
+	RevokeAccess bool
+	// GroupIDs — группы позиций заказа, из которых ученика убирают при RevokeAccess
+	GroupIDs []int64
+	// RefundedBefore — сколько было возвращено, когда возврат зарезервировали
+	RefundedBefore uint64
+}
+
+// RefundReservation — зарезервированный возврат: его сумма и сколько было возвращено до него
+type RefundReservation struct {
+	Amount         uint64
+	RefundedBefore uint64
+}
+
+type RefundOrderResult struct {
+	OrderID        int64  `json:"order_id"`
+	Status         string `json:"status"`
+	RefundedAmount uint64 `json:"refunded_amount"`
+	RefundID       string `json:"refund_id"`
+}
+
+type ReferralPayoutBody struct {
+	ReferralCode string `json:"referral_code"`
+}
+
+// ReferralPayoutDTO — владелец проекта OwnerID отмечает, что выплатил партнеру всю начисленную комиссию
+type ReferralPayoutDTO struct {
+	ProjectID    int64
+	OwnerID      int64
+	ReferralCode string
+}
@@ -1,9 +1,11 @@
 package hero
 
 import (
+	"createtodayapi/internal/payments"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -30,6 +32,8 @@ type Profile struct {
 	Telegram  *string `json:"telegram" db:"telegram"`
 	Instagram *string `json:"instagram" db:"instagram"`
 	About     *string `json:"about" db:"about"`
+	// EmailVerified — пользователь подтвердил email по ссылке из письма
+	EmailVerified bool `json:"email_verified" db:"email_verified"`
 }
 
 type User struct {
@@ -43,6 +47,8 @@ type User struct {
 	Telegram  string `json:"telegram" db:"telegram"`
 	Instagram string `json:"instagram" db:"instagram"`
 	LastSeen  string `json:"last_seen" db:"last_seen"`
+	// SessionID — сессия, в которой пришел запрос. Заполняется из токена доступа
+	SessionID string `json:"-" db:"-"`
 }
 
 type ProductCard struct {
@@ -329,8 +335,21 @@ type OfferForRegistration struct {
 	CanUsePromocode bool             `db:"can_use_promocode" json:"can_use_promocode"`
 	IsDonate        bool             `db:"is_donate" json:"is_donate"`
 	MinDonatePrice  int              `db:"min_donate_price" json:"min_donate_price"`
-	PayMethods      json.RawMessage  `db:"pay_methods" json:"pay_methods"`
-	CanProcess      bool             `db:"can_process" json:"can_process"`
+	Type            string           `db:"type" json:"type"`
+	// SubscriptionPeriod — month или year, если оффер — подписка
+	SubscriptionPeriod *string         `db:"subscription_period" json:"subscription_period"`
+	PayMethods         json.RawMessage `db:"pay_methods" json:"pay_methods"`
+	CanProcess         bool            `db:"can_process" json:"can_process"`
+	// BasePrice — цена без ранней скидки. Price — цена сейчас, она действует до PriceEndsAt
+	BasePrice    uint64     `db:"base_price" json:"base_price"`
+	PriceEndsAt  *time.Time `db:"price_ends_at" json:"price_ends_at"`
+	SalesStartAt *time.Time `db:"sales_start_at" json:"sales_start_at"`
+	SalesEndAt   *time.Time `db:"sales_end_at" json:"sales_end_at"`
+	// RemainingSeats — сколько мест осталось, nil — без ограничения
+	RemainingSeats *int `db:"remaining_seats" json:"remaining_seats"`
+	SalesOpen      bool `db:"-" json:"sales_open"`
+	// Bumps — дополнения, которые можно добавить к заказу этого оффера
+	Bumps json.RawMessage `db:"bumps" json:"bumps"`
 }
 
 type OfferForProcessing struct {
@@ -355,25 +374,57 @@ type OfferForProcessing struct {
 	MinDonatePrice         int              `db:"min_donate_price"`
 	SendToSalebot          bool             `db:"send_to_salebot"`
 	SalebotCallbackText    *string          `db:"salebot_callback_text"`
+	Type                   string           `db:"type"`
+	SubscriptionPeriod     *string          `db:"subscription_period"`
 	PayMethod              *PayIntegration  `db:"pay_method"`
+	SalesStartAt           *time.Time       `db:"sales_start_at"`
+	SalesEndAt             *time.Time       `db:"sales_end_at"`
+	RemainingSeats         *int             `db:"remaining_seats"`
+}
+
+// offerSalesOpen — идут ли продажи оффера в момент now и остались ли места
+func offerSalesOpen(now time.Time, startAt *time.Time, endAt *time.Time, remainingSeats *int) bool {
+	if startAt != nil && now.Before(*startAt) {
+		return false
+	}
+
+	if endAt != nil && !now.Before(*endAt) {
+		return false
+	}
+
+	return remainingSeats == nil || *remainingSeats > 0
 }
 
-type ReceiptSettings struct {
-	Taxation string `json:"taxation"`
+// OfferDonateSettings — настройки пожертвования в settings оффера.
+// Предлагаемые суммы donate_tiers только показываются на странице оффера, покупатель может указать любую
+type OfferDonateSettings struct {
+	// MaxDonatePrice — максимальная сумма в рублях, 0 — без ограничения
+	MaxDonatePrice uint64   `json:"max_donate_price"`
+	DonateTiers    []uint64 `json:"donate_tiers"`
 }
 
 type PayIntegration struct {
-	ID              int64            `json:"id" db:"id"`
-	Name            string           `json:"name" db:"name"`
-	Type            string           `json:"type" db:"type"`
-	Login           string           `json:"login" db:"login"`
-	Password        string           `json:"password" db:"password"`
-	IsActive        bool             `json:"is_active" db:"is_active"`
-	SendReceipt     bool             `json:"send_receipt" db:"send_receipt"`
-	ReceiptSettings *ReceiptSettings `json:"receipt_settings" db:"receipt_settings"`
-	ProjectID       int64            `json:"project_id" db:"project_id"`
-	CreatedAt       time.Time        `json:"created_at" db:"created_at"`
-	UpdatedAt       time.Time        `json:"updated_at" db:"updated_at"`
+	ID              int64                     `json:"id" db:"id"`
+	Name            string                    `json:"name" db:"name"`
+	Type            string                    `json:"type" db:"type"`
+	Login           string                    `json:"login" db:"login"`
+	Password        string                    `json:"password" db:"password"`
+	IsActive        bool                      `json:"is_active" db:"is_active"`
+	SendReceipt     bool                      `json:"send_receipt" db:"send_receipt"`
+	ReceiptSettings *payments.ReceiptSettings `json:"receipt_settings" db:"receipt_settings"`
+	ProjectID       int64                     `json:"project_id" db:"project_id"`
+	CreatedAt       time.Time                 `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time                 `json:"updated_at" db:"updated_at"`
+}
+
+// ValidateReceipt проверяет настройки чеков, если интеграция их отправляет.
+// С неверными настройками касса пробьет неправильный чек, поэтому платеж лучше не создавать
+func (p *PayIntegration) ValidateReceipt() error {
+	if !p.SendReceipt {
+		return nil
+	}
+
+	return p.ReceiptSettings.Validate()
 }
 
 type PayMethod struct {
@@ -404,20 +455,189 @@ type Order struct {
 }
 
 type OrderForProcessing struct {
-	ID        int64  `db:"id"`
-	Price     uint64 `db:"price"`
-	OfferID   int64  `db:"offer_id"`
-	OfferSlug string `db:"offer_slug"`
-	Status    string `db:"status"`
-	UserID    int64  `db:"user_id"`
-	UserEmail string `db:"user_email"`
-	PaymentID string `db:"payment_id"`
+	ID            int64  `db:"id"`
+	Price         uint64 `db:"price"`
+	OfferID       int64  `db:"offer_id"`
+	OfferSlug     string `db:"offer_slug"`
+	Status        string `db:"status"`
+	UserID        int64  `db:"user_id"`
+	UserEmail     string `db:"user_email"`
+	PaymentID     string `db:"payment_id"`
+	IntegrationID int64  `db:"integration_id"`
+	// RefundedAmount — сколько рублей уже вернули покупателю
+	RefundedAmount uint64    `db:"refunded_amount"`
+	OfferName      string    `db:"offer_name"`
+	ProjectOwnerID *int64    `db:"project_owner_id"`
+	CreatedAt      time.Time `db:"created_at"`
+	SubscriptionID *int64    `db:"subscription_id"`
+	IsGift         bool      `db:"is_gift"`
+	GiftedTo       *GiftedTo `db:"gifted_to"`
+	// GiftRecipientID — кто получает доступ, если заказ — подарок
+	GiftRecipientID    *int64  `db:"gift_recipient_id"`
+	GiftRecipientEmail *string `db:"gift_recipient_email"`
+}
+
+// OrderPayment — один из платежей заказа. У каждой повторной оплаты свой платеж и своя ссылка
+type OrderPayment struct {
+	PaymentID  string    `db:"payment_id"`
+	PaymentURL *string   `db:"payment_url"`
+	CreatedAt  time.Time `db:"created_at"`
 }
 
 type NewOrder struct {
 	IntegrationID int64 `db:"integration_id"`
 	OfferID       int64 `db:"offer_id"`
 	UserID        int64 `db:"user_id"`
+	// Price — цена заказа в рублях с учетом скидки
+	Price          uint64    `db:"price"`
+	PromocodeID    *int64    `db:"promocode_id"`
+	Discount       uint64    `db:"discount"`
+	SubscriptionID *int64    `db:"subscription_id"`
+	IsGift         bool      `db:"is_gift"`
+	GiftedTo       *GiftedTo `db:"gifted_to"`
+	// Renewal — заказ продления подписки, он не занимает новое место в оффере
+	Renewal bool `db:"-"`
+	// Subscription — новая подписка, ее первый платеж — этот заказ. Создается вместе с заказом
+	Subscription *NewSubscription `db:"-"`
+	// Description — что купили, если пусто — название оффера
+	Description string `db:"description"`
+	// Items — позиции заказа: сам оффер и дополнения. Price заказа — их сумма
+	Items []NewOrderItem `db:"-"`
+	// ReferrerID — партнер, по чьему коду пришел покупатель
+	ReferrerID *int64 `db:"referrer_id"`
+}
+
+type NewOrderItem struct {
+	OfferID int64  `db:"offer_id"`
+	Name    string `db:"name"`
+	// Price — цена позиции в рублях с учетом скидки
+	Price    uint64 `db:"price"`
+	Discount uint64 `db:"discount"`
+	IsBump   bool   `db:"is_bump"`
+}
+
+// OrderItem — позиция оплаченного заказа. OfferID пустой, если оффер уже удалили
+type OrderItem struct {
+	ID        int64   `db:"id"`
+	OfferID   *int64  `db:"offer_id"`
+	OfferSlug *string `db:"offer_slug"`
+	Name      string  `db:"name"`
+	Price     uint64  `db:"price"`
+	Discount  uint64  `db:"discount"`
+	IsBump    bool    `db:"is_bump"`
+}
+
+// OfferBump — дополнение к офферу (order bump): другой оффер, который можно добавить к заказу.
+// Price — цена дополнения вместе с оффером
+type OfferBump struct {
+	OfferID int64  `db:"offer_id"`
+	Slug    string `db:"slug"`
+	Name    string `db:"name"`
+	Price   uint64 `db:"price"`
+}
+
+// GiftedTo — кому и от кого подарок. Хранится в gifted_to заказа.
+// NewUser — получателя зарегистрировали при оплате, и в письме нужна ссылка, чтобы задать пароль
+type GiftedTo struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	FromName  string `json:"from_name"`
+	NewUser   bool   `json:"new_user"`
+}
+
+func (g *GiftedTo) Scan(v interface{}) error {
+	switch vv := v.(type) {
+	case []byte:
+		return json.Unmarshal(vv, g)
+	case string:
+		return json.Unmarshal([]byte(vv), g)
+	default:
+		return fmt.Errorf("unsupported type: %T", v)
+	}
+}
+
+const (
+	OfferTypeOneTime      = "one_time"
+	OfferTypeSubscription = "subscription"
+)
+
+// Статусы подписки. past_due — очередное списание не прошло, но льготный период еще идет
+const (
+	SubscriptionStatusPending  = "pending"
+	SubscriptionStatusActive   = "active"
+	SubscriptionStatusPastDue  = "past_due"
+	SubscriptionStatusCanceled = "canceled"
+	SubscriptionStatusExpired  = "expired"
+)
+
+type Subscription struct {
+	ID               int64      `json:"id" db:"id"`
+	OfferID          *int64     `json:"offer_id" db:"offer_id"`
+	OfferName        *string    `json:"offer_name" db:"offer_name"`
+	Status           string     `json:"status" db:"status"`
+	Period           string     `json:"period" db:"period"`
+	Price            uint64     `json:"price" db:"price"`
+	CurrentPeriodEnd *time.Time `json:"current_period_end" db:"current_period_end"`
+	NextChargeAt     *time.Time `json:"next_charge_at" db:"next_charge_at"`
+	CanceledAt       *time.Time `json:"canceled_at" db:"canceled_at"`
+	CreatedAt        time.Time  `json:"created_at" db:"created_at"`
+}
+
+// NewSubscription — подписка создается вместе с первым заказом и ждет его оплаты
+type NewSubscription struct {
+	UserID        int64  `db:"user_id"`
+	OfferID       int64  `db:"offer_id"`
+	ProjectID     int64  `db:"project_id"`
+	IntegrationID int64  `db:"integration_id"`
+	Period        string `db:"period"`
+	Price         uint64 `db:"price"`
+}
+
+// SubscriptionForRenewal — подписка, по которой пора списать очередной платеж
+type SubscriptionForRenewal struct {
+	ID               int64     `db:"id"`
+	UserID           int64     `db:"user_id"`
+	UserEmail        string    `db:"user_email"`
+	OfferID          int64     `db:"offer_id"`
+	OfferName        string    `db:"offer_name"`
+	IntegrationID    int64     `db:"integration_id"`
+	Price            uint64    `db:"price"`
+	RebillID         *string   `db:"rebill_id"`
+	CurrentPeriodEnd time.Time `db:"current_period_end"`
+	FailedAttempts   int       `db:"failed_attempts"`
+}
+
+const (
+	PromocodeDiscountPercent = "percent"
+	PromocodeDiscountFixed   = "fixed"
+)
+
+// Promocode — скидка на офферы проекта. Без OfferID промокод действует на все офферы проекта
+type Promocode struct {
+	ID             int64      `db:"id"`
+	ProjectID      int64      `db:"project_id"`
+	OfferID        *int64     `db:"offer_id"`
+	Code           string     `db:"code"`
+	DiscountType   string     `db:"discount_type"`
+	DiscountValue  uint64     `db:"discount_value"`
+	MaxUses        *int64     `db:"max_uses"`
+	MaxUsesPerUser *int64     `db:"max_uses_per_user"`
+	StartsAt       *time.Time `db:"starts_at"`
+	EndsAt         *time.Time `db:"ends_at"`
+	IsActive       bool       `db:"is_active"`
+	// Uses и UserUses — сколько заказов с промокодом всего и у пользователя.
+	// Отмененные и истекшие заказы не считаются
+	Uses     int64 `db:"uses"`
+	UserUses int64 `db:"user_uses"`
+}
+
+// Discount считает скидку в рублях для цены price. Процент округляется вниз
+func (p *Promocode) Discount(price uint64) uint64 {
+	if p.DiscountType == PromocodeDiscountPercent {
+		return price * p.DiscountValue / 100
+	}
+
+	return p.DiscountValue
 }
 
 type OrderError struct {
@@ -431,6 +651,66 @@ type OrderCardInfo struct {
 	Pan            string `json:"pan"`
 }
 
+func (c *OrderCardInfo) Scan(v interface{}) error {
+	switch vv := v.(type) {
+	case []byte:
+		return json.Unmarshal(vv, c)
+	case string:
+		return json.Unmarshal([]byte(vv), c)
+	default:
+		return fmt.Errorf("unsupported type: %T", v)
+	}
+}
+
+// Masked — данные карты, которые можно показать ученику: только последние 4 цифры номера
+func (c *OrderCardInfo) Masked() *OrderCardInfo {
+	if c == nil {
+		return nil
+	}
+
+	pan := c.Pan
+	if len(pan) > 4 {
+		pan = strings.Repeat("*", len(pan)-4) + pan[len(pan)-4:]
+	}
+
+	return &OrderCardInfo{
+		ExpirationDate: c.ExpirationDate,
+		Pan:            pan,
+	}
+}
+
+// UserOrder — заказ в истории покупок ученика
+type UserOrder struct {
+	ID        int64          `json:"id" db:"id"`
+	OfferID   *int64         `json:"offer_id" db:"offer_id"`
+	OfferName string         `json:"offer_name" db:"offer_name"`
+	Amount    uint64         `json:"amount" db:"price"`
+	Discount  uint64         `json:"discount" db:"discount"`
+	Currency  string         `json:"currency" db:"currency"`
+	Status    string         `json:"status" db:"status"`
+	CardInfo  *OrderCardInfo `json:"card_info" db:"card_info"`
+	IsGift    bool           `json:"is_gift" db:"is_gift"`
+	// Items — позиции заказа: оффер и дополнения к нему
+	Items json.RawMessage `json:"items" db:"items"`
+	// CanRetry — заказ можно оплатить заново по новой ссылке
+	CanRetry  bool      `json:"can_retry" db:"-"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+type OrderOutboxMessage struct {
+	ID       int64           `db:"id"`
+	OrderID  int64           `db:"order_id"`
+	Type     string          `db:"type"`
+	Payload  json.RawMessage `db:"payload"`
+	Attempts int             `db:"attempts"`
+}
+
+type NewOrderOutboxMessage struct {
+	Type    string
+	Payload json.RawMessage
+}
+
 type QuizComment struct {
 	ID              int64             `db:"id" json:"id"`
 	AuthorID        int64             `db:"-" json:"-"`
@@ -468,3 +748,112 @@ type NewQuizComment struct {
 	UUID         string `db:"uuid" json:"uuid"`
 	Text         string `db:"text" json:"text"`
 }
+
+const (
+	ReferralCommissionAccrued  = "accrued"
+	ReferralCommissionCanceled = "canceled"
+	ReferralCommissionPaid     = "paid"
+)
+
+// ReferralStats — статистика партнера: переходы по его коду, продажи и комиссия в рублях.
+// Balance — начисленная, но еще не выплаченная комиссия
+type ReferralStats struct {
+	Code     string                 `json:"code"`
+	Clicks   int                    `json:"clicks"`
+	Sales    int                    `json:"sales"`
+	Earned   uint64                 `json:"earned"`
+	PaidOut  uint64                 `json:"paid_out"`
+	Balance  uint64                 `json:"balance"`
+	Projects []ReferralProjectStats `json:"projects"`
+}
+
+// ReferralProjectStats — статистика партнера в одном проекте. Выплаты делает владелец проекта
+type ReferralProjectStats struct {
+	ProjectID   int64  `json:"project_id" db:"project_id"`
+	ProjectName string `json:"project_name" db:"project_name"`
+	Clicks      int    `json:"clicks" db:"clicks"`
+	Sales       int    `json:"sales" db:"sales"`
+	Earned      uint64 `json:"earned" db:"earned"`
+	PaidOut     uint64 `json:"paid_out" db:"paid_out"`
+	Balance     uint64 `json:"balance" db:"balance"`
+}
+
+// ProjectReferrer — партнер проекта для владельца: сколько он продал и сколько ему нужно выплатить
+type ProjectReferrer struct {
+	ReferrerID int64  `json:"referrer_id" db:"referrer_id"`
+	Email      string `json:"email" db:"email"`
+	Code       string `json:"code" db:"code"`
+	Sales      int    `json:"sales" db:"sales"`
+	Earned     uint64 `json:"earned" db:"earned"`
+	PaidOut    uint64 `json:"paid_out" db:"paid_out"`
+	Balance    uint64 `json:"balance" db:"balance"`
+}
+
+type ReferralPayout struct {
+	ID         int64     `json:"id" db:"id"`
+	ReferrerID int64     `json:"referrer_id" db:"referrer_id"`
+	ProjectID  int64     `json:"project_id" db:"project_id"`
+	Amount     uint64    `json:"amount" db:"amount"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// FakeCheckout — заказ на тестовой странице оплаты
+type FakeCheckout struct {
+	OrderID     int64
+	Description string
+	Amount      uint64
+	Status      string
+	ReturnURL   string
+}
+
+// NewSession — вход пользователя. Refresh-токен хранится только в виде хеша
+type NewSession struct {
+	SessionClient
+	ID               string    `db:"id"`
+	UserID           int       `db:"user_id"`
+	RefreshTokenHash string    `db:"refresh_token_hash"`
+	ExpiresAt        time.Time `db:"expires_at"`
+}
+
+// Назначения одноразовых токенов из писем
+const (
+	AuthTokenPurposeMagicLink     = "magic_link"
+	AuthTokenPurposePasswordReset = "password_reset"
+	AuthTokenPurposeEmailVerify   = "email_verify"
+	AuthTokenPurposeEmailChange   = "email_change"
+)
+
+// NewAuthToken — одноразовый токен из письма. Сам токен уходит в письмо, в базе только хеш
+type NewAuthToken struct {
+	UserID  int    `db:"user_id"`
+	Purpose string `db:"purpose"`
+	// Email — адрес, для которого выдан токен. Нужен только подтверждению и смене email
+	Email     string    `db:"email"`
+	TokenHash string    `db:"token_hash"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// AuthToken — использованный токен из письма
+type AuthToken struct {
+	UserID    int       `db:"user_id"`
+	Email     *string   `db:"email"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// SessionClient — устройство, с которого вошли или обновили токен
+type SessionClient struct {
+	UserAgent string `db:"user_agent"`
+	IP        string `db:"ip"`
+}
+
+// UserSession — активная сессия в списке устройств профиля
+type UserSession struct {
+	ID         string    `json:"id" db:"id"`
+	UserAgent  *string   `json:"user_agent" db:"user_agent"`
+	IP         *string   `json:"ip" db:"ip"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at" db:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at" db:"expires_at"`
+	// Current — сессия, из которой пришел запрос
+	Current bool `json:"current" db:"-"`
+}
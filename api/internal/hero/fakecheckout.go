@@ -0,0 +1,130 @@
+package hero
+
+import (
+	"bytes"
+	"context"
+	"createtodayapi/internal/common"
+	"createtodayapi/internal/payments"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Тестовая страница оплаты для платежной системы fake. Открывается по ссылке из заказа,
+// а кнопки отправляют уведомление с выбранным статусом. Маршруты есть только вне prod
+var fakeCheckoutPage = template.Must(template.New("fake-checkout").Parse(`<!DOCTYPE html>
+<html lang="ru">
+<head>
+	<meta charset="utf-8">
+	<title>Тестовая оплата заказа №{{.OrderID}}</title>
+</head>
+<body>
+	<h1>Тестовая оплата</h1>
+	<p>Заказ №{{.OrderID}}: {{.Description}}</p>
+	<p>Сумма: {{.Amount}} ₽</p>
+	<p>Статус: {{.Status}}</p>
+	{{if .CanPay}}
+	<form method="post">
+		<button name="status" value="{{.Approved}}">Оплатить</button>
+		<button name="status" value="{{.Declined}}">Отклонить</button>
+		<button name="status" value="{{.Expired}}">Истек срок</button>
+	</form>
+	{{end}}
+	<p><a href="{{.ReturnURL}}">Вернуться в магазин</a></p>
+</body>
+</html>`))
+
+type fakeCheckoutPageData struct {
+	FakeCheckout
+	CanPay   bool
+	Approved string
+	Declined string
+	Expired  string
+}
+
+func (c *Controller) FakeCheckout(ctx *fiber.Ctx) error {
+	orderId, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "fake-checkout")
+
+	checkout, err := c.service.GetFakeCheckout(rCtx, orderId)
+
+	if errors.Is(err, common.ErrOrderNotFound) || errors.Is(err, common.ErrPaymentSystemNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, err)
+	}
+
+	var page bytes.Buffer
+
+	err = fakeCheckoutPage.Execute(&page, fakeCheckoutPageData{
+		FakeCheckout: *checkout,
+		CanPay:       checkout.Status == payments.StatusPending || checkout.Status == payments.StatusRejected,
+		Approved:     payments.FakeStatusApproved,
+		Declined:     payments.FakeStatusDeclined,
+		Expired:      payments.FakeStatusExpired,
+	})
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	ctx.Type("html", "utf-8")
+	return ctx.Send(page.Bytes())
+}
+
+// CompleteFakeCheckout принимает форму тестовой страницы или json с полем status
+// и возвращает на страницу заказа, где уже виден новый статус
+func (c *Controller) CompleteFakeCheckout(ctx *fiber.Ctx) error {
+	orderId, err := strconv.ParseInt(ctx.Params("id"), 10, 64)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	var body struct {
+		Status string `json:"status" form:"status"`
+	}
+
+	err = ctx.BodyParser(&body)
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, err)
+	}
+
+	requestId, _ := uuid.NewRandom()
+	rCtx := context.WithValue(context.Background(), "request-id", requestId)
+	rCtx = context.WithValue(rCtx, "request-key", "complete-fake-checkout")
+
+	err = c.service.CompleteFakeCheckout(rCtx, orderId, body.Status)
+
+	if errors.Is(err, common.ErrOrderNotFound) || errors.Is(err, common.ErrPaymentSystemNotFound) {
+		return common.DoApiResponse(ctx, http.StatusNotFound, nil, err)
+	}
+
+	if errors.Is(err, common.ErrUnknownPaymentStatus) {
+		return common.DoApiResponse(ctx, http.StatusBadRequest, nil, common.ErrUnknownPaymentStatus)
+	}
+
+	if errors.Is(err, common.ErrIllegalOrderTransition) {
+		return common.DoApiResponse(ctx, http.StatusConflict, nil, err)
+	}
+
+	if err != nil {
+		return common.DoApiResponse(ctx, http.StatusInternalServerError, nil, common.ErrInternalError)
+	}
+
+	if ctx.Is("json") {
+		return common.DoApiResponse(ctx, http.StatusOK, nil, nil)
+	}
+
+	return ctx.Redirect(ctx.OriginalURL(), http.StatusSeeOther)
+}
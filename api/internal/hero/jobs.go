@@ -0,0 +1,33 @@
+package hero
+
+import (
+	"context"
+	"createtodayapi/internal/logger"
+	"time"
+)
+
+// StartJobs запускает фоновые задачи, которые работают вместе с api
+func StartJobs(ctx context.Context, service *Service) {
+	go runJob(ctx, "order-outbox", time.Minute, service.ProcessOrderOutbox)
+	go runJob(ctx, "order-reconcile", 5*time.Minute, service.ReconcilePendingOrders)
+	go runJob(ctx, "subscription-renewal", 10*time.Minute, service.ChargeSubscriptions)
+	go runJob(ctx, "payment-reminders", 10*time.Minute, service.SendPaymentReminders)
+}
+
+func runJob(ctx context.Context, name string, interval time.Duration, job func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			jobCtx := context.WithValue(ctx, "request-key", name)
+			err := job(jobCtx)
+			if err != nil {
+				logger.Error(jobCtx, "job failed", "job", name, "err", err.Error())
+			}
+		}
+	}
+}
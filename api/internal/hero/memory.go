@@ -38,6 +38,150 @@ var magicLinkLetter = Email{
 	},
 }
 
+var passwordResetLetter = Email{
+	Subject:  "Смена пароля в CreateToday",
+	Template: "default",
+	From: EmailSender{
+		Email: "hello@createtoday.ru",
+		Name:  "CreateToday",
+	},
+	Body: `
+		<p>
+			Мы получили запрос на смену пароля от твоего личного кабинета на {{ .Context.Domain }}.
+			Чтобы задать новый пароль — нажми на кнопку ниже.
+		</p>
+		<a href='{{ .Context.ResetLink }}' target='_blank' rel='noreferrer noopener' class='btn'>
+			Сменить пароль
+		</a>
+		<p>Или используй ссылку:</p>
+		<p>
+			<a target='_blank' rel='noreferrer noopener' href='{{ .Context.ResetLink }}'>
+				{{ .Context.ResetLink }}
+			</a>
+		</p>
+		<p style='color: #475569;'>
+			Ссылка работает один раз. Если пароль менять не нужно — просто проигнорируй это письмо.
+		</p>
+	`,
+	IsActive: true,
+	Type:     "password_reset",
+	Context: map[string]interface{}{
+		"Domain": "hero.createtoday.ru",
+	},
+}
+
+var passwordChangedLetter = Email{
+	Subject:  "Пароль от CreateToday изменен",
+	Template: "default",
+	From: EmailSender{
+		Email: "hello@createtoday.ru",
+		Name:  "CreateToday",
+	},
+	Body: `
+		<p>
+			Пароль от твоего личного кабинета на {{ .Context.Domain }} только что изменен.
+			Мы вышли из аккаунта на всех устройствах — войди заново с новым паролем.
+		</p>
+		<p style='color: #475569;'>
+			Если это был не ты — сразу напиши нам: {{ .Context.RespondTo }}.
+		</p>
+	`,
+	IsActive: true,
+	Type:     "password_changed",
+	Context: map[string]interface{}{
+		"Domain":    "hero.createtoday.ru",
+		"RespondTo": "hello@createtoday.ru",
+	},
+}
+
+var emailVerifyLetter = Email{
+	Subject:  "Подтверди email в CreateToday",
+	Template: "default",
+	From: EmailSender{
+		Email: "hello@createtoday.ru",
+		Name:  "CreateToday",
+	},
+	Body: `
+		<p>
+			Чтобы подтвердить, что это твоя почта для личного кабинета на {{ .Context.Domain }}, нажми на кнопку ниже.
+		</p>
+		<a href='{{ .Context.ConfirmLink }}' target='_blank' rel='noreferrer noopener' class='btn'>
+			Подтвердить email
+		</a>
+		<p>Или используй ссылку:</p>
+		<p>
+			<a target='_blank' rel='noreferrer noopener' href='{{ .Context.ConfirmLink }}'>
+				{{ .Context.ConfirmLink }}
+			</a>
+		</p>
+		<p style='color: #475569;'>
+			Если ты не регистрировался — просто проигнорируй это письмо.
+		</p>
+	`,
+	IsActive: true,
+	Type:     "email_verify",
+	Context: map[string]interface{}{
+		"Domain": "hero.createtoday.ru",
+	},
+}
+
+var emailChangeLetter = Email{
+	Subject:  "Смена email в CreateToday",
+	Template: "default",
+	From: EmailSender{
+		Email: "hello@createtoday.ru",
+		Name:  "CreateToday",
+	},
+	Body: `
+		<p>
+			Этот адрес указали как новый email личного кабинета на {{ .Context.Domain }}.
+			Чтобы подтвердить смену — нажми на кнопку ниже.
+		</p>
+		<a href='{{ .Context.ConfirmLink }}' target='_blank' rel='noreferrer noopener' class='btn'>
+			Подтвердить новый email
+		</a>
+		<p>Или используй ссылку:</p>
+		<p>
+			<a target='_blank' rel='noreferrer noopener' href='{{ .Context.ConfirmLink }}'>
+				{{ .Context.ConfirmLink }}
+			</a>
+		</p>
+		<p style='color: #475569;'>
+			Если это не ты — просто проигнорируй это письмо, email останется прежним.
+		</p>
+	`,
+	IsActive: true,
+	Type:     "email_change",
+	Context: map[string]interface{}{
+		"Domain": "hero.createtoday.ru",
+	},
+}
+
+var emailChangeNoticeLetter = Email{
+	Subject:  "Запрос на смену email в CreateToday",
+	Template: "default",
+	From: EmailSender{
+		Email: "hello@createtoday.ru",
+		Name:  "CreateToday",
+	},
+	Body: `
+		<p>
+			Для твоего личного кабинета на {{ .Context.Domain }} запросили смену email на
+			<span style='color: #0284c7;'>{{ .Context.NewEmail }}</span>.
+			Email поменяется, только когда смену подтвердят по ссылке из письма на новый адрес.
+		</p>
+		<p style='color: #475569;'>
+			Если это был не ты — смени пароль и напиши нам: {{ .Context.RespondTo }}.
+		</p>
+	`,
+	IsActive: true,
+	Type:     "email_change_notice",
+	Context: map[string]interface{}{
+		"Domain":    "hero.createtoday.ru",
+		"RespondTo": "hello@createtoday.ru",
+	},
+}
+
 var welcomeLetter = Email{
 	Subject:  "Добро пожаловать в CreateToday",
 	Template: "default",
@@ -109,6 +253,38 @@ var orderCreated = Email{
 	`,
 }
 
+var paymentReminder = Email{
+	Subject:  "Заказ ждет оплаты",
+	Template: "default",
+	From: EmailSender{
+		Email: "hello@createtoday.ru",
+		Name:  "CreateToday",
+	},
+	IsActive: true,
+	Type:     "payment-reminder",
+	Context: map[string]interface{}{
+		"Domain":    "hero.createtoday.ru",
+		"RespondTo": "hello@createtoday.ru",
+	},
+	Body: `
+		<h3>Заказ ждет оплаты ⏳</h3>
+
+		<p>Привет! Твой заказ на <strong>{{ .Context.Ordered }}</strong> на сумму <strong>{{ .Context.Amount }}₽</strong> еще не оплачен.</p>
+
+		<p>Если что-то пошло не так с оплатой — вот новая ссылка:</p>
+
+		<a class='btn' target='_blank' rel='noreferrer noopener' href='{{ .Context.PaymentURL }}'>
+			Перейти к оплате
+		</a>
+
+		<p>
+			Если появятся вопросы, вот наша почта: {{ .Context.RespondTo }}.
+		</p>
+
+		<p>Успехов, <br />команда create.today</p>
+	`,
+}
+
 var orderCompleted = Email{
 	Subject:  "Заказ оплачен! 🥳",
 	Template: "default",
@@ -139,6 +315,46 @@ var orderCompleted = Email{
 	`,
 }
 
+var giftLetter = Email{
+	Subject:  "Тебе подарок! 🎁",
+	Template: "default",
+	From: EmailSender{
+		Email: "hello@createtoday.ru",
+		Name:  "CreateToday",
+	},
+	IsActive: true,
+	Type:     "gift",
+	Context: map[string]interface{}{
+		"Domain":    "hero.createtoday.ru",
+		"RespondTo": "hello@createtoday.ru",
+	},
+	Body: `
+		<h3>Тебе подарок! 🎁</h3>
+		<p>
+			Привет{{ if .Context.FirstName }}, {{ .Context.FirstName }}{{ end }}!
+			{{ if .Context.FromName }}{{ .Context.FromName }} дарит{{ else }}Тебе подарили{{ end }}
+			<strong>{{ .Context.Ordered }}</strong>. Доступ уже открыт в личном кабинете на {{ .Context.Domain }}.
+		</p>
+		{{ if .Context.SetPasswordURL }}
+		<p>
+			Для тебя создали личный кабинет, логин — <span style='color: #0284c7;'>{{ .Context.Email }}</span>.
+			Чтобы войти, задай пароль по кнопке ниже. Ссылка работает один раз.
+		</p>
+		<a href='{{ .Context.SetPasswordURL }}' target='_blank' rel='noreferrer noopener' class='btn'>
+			Задать пароль
+		</a>
+		{{ else }}
+		<a href='{{ .Context.LoginFullURL }}' target='_blank' rel='noreferrer noopener' class='btn'>
+			Войти в личный кабинет
+		</a>
+		{{ end }}
+		<p>
+			Если появятся вопросы, вот наша почта: {{ .Context.RespondTo }}.
+		</p>
+		<p>Успехов, <br />команда create.today</p>
+	`,
+}
+
 var general = Email{
 	Subject:  "",
 	Template: "default",
@@ -167,6 +383,6 @@ func (r *MemoryRepo) FindByType(ctx context.Context, emailType string) (*Email,
 }
 
 func NewMemoryRepo() *MemoryRepo {
-	emails = append(emails, magicLinkLetter, welcomeLetter, orderCreated, general, orderCompleted)
+	emails = append(emails, magicLinkLetter, welcomeLetter, orderCreated, general, orderCompleted, giftLetter, paymentReminder, passwordResetLetter, passwordChangedLetter, emailVerifyLetter, emailChangeLetter, emailChangeNoticeLetter)
 	return &MemoryRepo{}
 }
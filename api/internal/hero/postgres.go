@@ -4,9 +4,12 @@ import (
 	"context"
 	"createtodayapi/internal/common"
 	"createtodayapi/internal/logger"
+	"createtodayapi/internal/payments"
 	"database/sql"
 	"errors"
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -33,6 +36,18 @@ const PayIntegrationsTable = "public.pay_integration"
 const OrdersTable = "public.order"
 const OffersGroupsTable = "public.offer_group"
 const QuizCommentsTable = "public.quiz_comment"
+const OrderOutboxTable = "public.order_outbox"
+const PromocodesTable = "public.promocode"
+const SubscriptionsTable = "public.subscription"
+const OfferPriceTiersTable = "public.offer_price_tier"
+const OfferBumpsTable = "public.offer_bump"
+const OrderItemsTable = "public.order_item"
+const OrderPaymentsTable = "public.order_payment"
+const ReferralClicksTable = "public.referral_click"
+const ReferralCommissionsTable = "public.referral_commission"
+const ReferralPayoutsTable = "public.referral_payout"
+const UserSessionsTable = "public.user_session"
+const AuthTokensTable = "public.auth_token"
 
 type PostgresRepo struct {
 	db *sqlx.DB
@@ -66,7 +81,8 @@ func (r *PostgresRepo) FindUserById(ctx context.Context, id int) (*User, error)
 
 func (r *PostgresRepo) GetProfileByUserId(ctx context.Context, userId int) (*Profile, error) {
 	q := fmt.Sprintf(`
-		select email, first_name, last_name, phone, avatar, telegram, instagram, about 
+		select email, first_name, last_name, phone, avatar, telegram, instagram, about,
+			email_verified_at is not null as email_verified
 		from %s where id = $1`,
 		UsersTable,
 	)
@@ -121,10 +137,68 @@ func (r *PostgresRepo) UpdatePassword(ctx context.Context, userId int, password
 	return nil
 }
 
+// VerifyUserEmail отмечает email подтвержденным. Если адрес пользователя с тех пор сменился —
+// ErrInvalidEmailConfirmLink: подтверждать уже нечего
+func (r *PostgresRepo) VerifyUserEmail(ctx context.Context, userId int, email string) error {
+	q := fmt.Sprintf(`
+		update %s set email_verified_at = coalesce(email_verified_at, now())
+		where id = $1 and email = $2
+	`, UsersTable)
+
+	result, err := r.db.ExecContext(ctx, q, userId, email)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.VerifyUserEmail")
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return common.ErrInvalidEmailConfirmLink
+	}
+
+	return nil
+}
+
+// ChangeUserEmail меняет email на уже подтвержденный новый. Если адрес за это время занял
+// другой аккаунт, возвращает ErrEmailTaken
+func (r *PostgresRepo) ChangeUserEmail(ctx context.Context, userId int, email string) error {
+	q := fmt.Sprintf(`
+		update %s set email = $2, email_verified_at = now(), updated_at = now()
+		where id = $1
+	`, UsersTable)
+
+	result, err := r.db.ExecContext(ctx, q, userId, email)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return common.ErrEmailTaken
+		}
+
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.ChangeUserEmail")
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return common.ErrUserNotFound
+	}
+
+	return nil
+}
+
 func (r *PostgresRepo) CreateUser(ctx context.Context, user User) (int64, error) {
 	q := fmt.Sprintf(`
 		insert into %s (email, password, first_name)
-		values (:email, :password, :first_name);
+		values (:email, :password, :first_name)
+		returning id
 	`, UsersTable)
 
 	query, args, err := r.db.BindNamed(q, user)
@@ -595,12 +669,84 @@ func (r *PostgresRepo) DeleteSolvedQuiz(ctx context.Context, solvedQuizId int64,
 	return nil
 }
 
+// offerPriceQuery — цена оффера сейчас: ближайшая незакончившаяся ступень ранней цены или обычная цена
+func offerPriceQuery() string {
+	return fmt.Sprintf(`coalesce((
+		select t.price from %s as t
+		where t.offer_id = o.id and t.ends_at > now()
+		order by t.ends_at
+		limit 1
+	), o.price)`, OfferPriceTiersTable)
+}
+
+// offerPriceEndsAtQuery — до какого момента действует текущая цена, null — обычная цена без срока
+func offerPriceEndsAtQuery() string {
+	return fmt.Sprintf(`(
+		select min(t.ends_at) from %s as t
+		where t.offer_id = o.id and t.ends_at > now()
+	)`, OfferPriceTiersTable)
+}
+
+// offerSoldQuery — сколько мест оффера занято: оплаченные заказы и заказы, которые ждут оплаты не дольше offerSeatHoldTime.
+// updated_at неоплаченного заказа меняется только при выдаче новой ссылки на оплату.
+// Оффер, купленный дополнением к другому заказу, тоже занимает место.
+// Все заказы одной подписки занимают одно место.
+// Заказы оффера и дополнения считаются отдельными запросами, чтобы каждый шел по своему индексу
+func offerSoldQuery() string {
+	seat := "case when ord.subscription_id is null then ord.id else -ord.subscription_id end"
+	occupied := fmt.Sprintf(
+		"(ord.status in ('%s', '%s') or (ord.status = '%s' and ord.updated_at > now() - interval '%d seconds'))",
+		payments.StatusSucceeded, payments.StatusPartiallyRefunded, payments.StatusPending, int(offerSeatHoldTime.Seconds()))
+
+	return fmt.Sprintf(`(
+		select count(distinct sold.seat) from (
+			select %s as seat
+			from %s as ord
+			where ord.offer_id = o.id and %s
+			union all
+			select %s as seat
+			from %s as si
+			join %s as ord on ord.id = si.order_id
+			where si.offer_id = o.id and si.is_bump and %s
+		) as sold
+	)`, seat, OrdersTable, occupied, seat, OrderItemsTable, OrdersTable, occupied)
+}
+
+// offerBumpsQuery — дополнения оффера с id offerIdExpr, которые сейчас продаются.
+// Подписку нельзя добавить к заказу, она продлевается отдельно
+func offerBumpsQuery(offerIdExpr string) string {
+	return fmt.Sprintf(`
+		select o.id as offer_id, o.slug, o.name, o.description, coalesce(b.price, %s) as price, b.position
+		from %s as b
+		join %s as o on o.id = b.bump_offer_id
+		where b.offer_id = %s and o.is_free = false and o.is_donate = false and o.type != '%s'
+		  and (o.sales_start_at is null or o.sales_start_at <= now())
+		  and (o.sales_end_at is null or o.sales_end_at > now())
+		  and (o.max_sales is null or o.max_sales > %s)
+	`, offerPriceQuery(), OfferBumpsTable, OffersTable, offerIdExpr, OfferTypeSubscription, offerSoldQuery())
+}
+
 func (r *PostgresRepo) GetOfferForRegistration(ctx context.Context, slug string) (*OfferForRegistration, error) {
 	q := fmt.Sprintf(`
-		select o.name, o.slug, o.price, o.is_free, o.description, o.ask_for_phone, o.ask_for_comment, o.currency, o.settings, 
+		select o.name, o.slug, %s as price, o.price as base_price, %s as price_ends_at, o.is_free, o.description, o.ask_for_phone, o.ask_for_comment, o.currency, o.settings, 
 		       o.oferta_url, o.agreement_url, o.privacy_url, o.can_use_promocode, 
-		       o.ask_for_telegram, o.ask_for_instagram, o.is_donate, o.min_donate_price, o_pm.pay_methods, json_array_length(o_pm.pay_methods) > 0 as can_process
+		       o.ask_for_telegram, o.ask_for_instagram, o.is_donate, o.min_donate_price, o.type, o.subscription_period,
+		       o_pm.pay_methods, json_array_length(o_pm.pay_methods) > 0 as can_process,
+		       o.sales_start_at, o.sales_end_at, greatest(o.max_sales - %s, 0) as remaining_seats,
+		       coalesce(o_b.bumps, '[]'::json) as bumps
 		from %s as o
+		left join lateral (
+			select
+				json_agg(
+					json_build_object(
+						'slug', b.slug,
+						'name', b.name,
+						'description', b.description,
+						'price', b.price
+					) order by b.position, b.offer_id
+				) as bumps
+			from (%s) as b
+		) as o_b on true
 		left join lateral (
 			select 
 				json_agg(
@@ -615,7 +761,8 @@ func (r *PostgresRepo) GetOfferForRegistration(ctx context.Context, slug string)
 			and pm.is_active = true
 		) as o_pm on true
 		where o.slug = $1; 
-	`, OffersTable, PayIntegrationsTable)
+	`, offerPriceQuery(), offerPriceEndsAtQuery(), offerSoldQuery(), OffersTable,
+		offerBumpsQuery(fmt.Sprintf("(select id from %s where slug = $1)", OffersTable)), PayIntegrationsTable)
 
 	var offer OfferForRegistration
 
@@ -634,15 +781,17 @@ func (r *PostgresRepo) GetOfferForRegistration(ctx context.Context, slug string)
 
 func (r *PostgresRepo) GetOfferForProcessing(ctx context.Context, slug string) (*OfferForProcessing, error) {
 	q := fmt.Sprintf(`
-		select o.id, o.name, o.slug, o.price, o.is_free, o.currency, o.settings, 
+		select o.id, o.name, o.slug, %s as price, o.is_free, o.currency, o.settings, 
 		       o.can_use_promocode, o.is_donate, o.min_donate_price,
 		       o.success_message, o.redirect_url, o.registration_email_theme,
 		       o.send_order_created, o.send_order_completed, o.send_registration_email, o.registration_email,
-		       o.project_id, o.send_welcome_email, o.send_to_salebot, o.salebot_callback_text
+		       o.project_id, o.send_welcome_email, o.send_to_salebot, o.salebot_callback_text,
+		       o.type, o.subscription_period,
+		       o.sales_start_at, o.sales_end_at, greatest(o.max_sales - %s, 0) as remaining_seats
 		from %s as o
 		where o.slug = $1
 		group by o.id; 
-	`, OffersTable)
+	`, offerPriceQuery(), offerSoldQuery(), OffersTable)
 
 	var offer OfferForProcessing
 
@@ -660,6 +809,25 @@ func (r *PostgresRepo) GetOfferForProcessing(ctx context.Context, slug string) (
 	return &offer, nil
 }
 
+// GetOfferBumps — дополнения, которые сейчас можно добавить к заказу оффера
+func (r *PostgresRepo) GetOfferBumps(ctx context.Context, offerId int64) ([]OfferBump, error) {
+	q := fmt.Sprintf(`
+		select b.offer_id, b.slug, b.name, b.price
+		from (%s) as b
+		order by b.position, b.offer_id
+	`, offerBumpsQuery("$1"))
+
+	bumps := make([]OfferBump, 0)
+
+	err := r.db.SelectContext(ctx, &bumps, q, offerId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.GetOfferBumps")
+		return make([]OfferBump, 0), err
+	}
+
+	return bumps, nil
+}
+
 func (r *PostgresRepo) GetPayMethods(ctx context.Context, projectId int64) ([]PayMethod, error) {
 	q := fmt.Sprintf(`
 		select name, type FROM %s
@@ -696,39 +864,327 @@ func (r *PostgresRepo) GetPayMethod(ctx context.Context, payMethodId int64, proj
 	return &payMethod, err
 }
 
+func (r *PostgresRepo) GetPayIntegrationById(ctx context.Context, integrationId int64) (*PayIntegration, error) {
+	q := fmt.Sprintf(`
+		select id, name, type, login, password, send_receipt, receipt_settings, project_id
+		from %s
+		where id = $1;
+	`, PayIntegrationsTable)
+
+	var payIntegration PayIntegration
+
+	err := r.db.GetContext(ctx, &payIntegration, q, integrationId)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, common.ErrPaymentSystemNotFound
+	}
+
+	if err != nil {
+		logger.Error(ctx, "could not get pay integration by id", "err", err.Error(), "where", "hero.postgres.GetPayIntegrationById")
+		return nil, err
+	}
+
+	return &payIntegration, nil
+}
+
+// CreateOrder создает заказ по цене из order.
+// Заказ с промокодом создается под блокировкой промокода, чтобы параллельные заказы не превысили лимиты
 func (r *PostgresRepo) CreateOrder(ctx context.Context, order NewOrder) (int64, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "CreateOrder.BeginTx")
+		return 0, err
+	}
+
+	if order.PromocodeID != nil {
+		err = r.checkPromocodeLimits(ctx, tx, *order.PromocodeID, order.UserID)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if !order.Renewal {
+		// дополнения занимают места в своих офферах так же, как основной оффер
+		offerIds := []int64{order.OfferID}
+		for _, item := range order.Items {
+			if item.IsBump {
+				offerIds = append(offerIds, item.OfferID)
+			}
+		}
+
+		err = r.checkOfferSalesLimits(ctx, tx, offerIds)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	// подписка создается в той же транзакции, что и ее первый заказ, чтобы не осталось подписки без заказа
+	if order.Subscription != nil {
+		subscriptionId, err := r.createSubscription(ctx, tx, *order.Subscription)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+
+		order.SubscriptionID = &subscriptionId
+	}
+
 	q := fmt.Sprintf(`
-		insert into %s (integration_id, offer_id, user_id, description, project_id, price, currency)
-		select :integration_id, :offer_id, :user_id, name, project_id, price, currency
+		insert into %s (integration_id, offer_id, user_id, description, project_id, price, currency, promocode_id, discount, subscription_id,
+		                is_gift, gifted_to, referrer_id)
+		select :integration_id, :offer_id, :user_id, coalesce(nullif(:description, ''), name), project_id, :price, currency, :promocode_id, :discount, :subscription_id,
+		       :is_gift, :gifted_to, :referrer_id
 		from %s where id = :offer_id
 		returning id;
 	`, OrdersTable, OffersTable)
 
-	query, args, err := r.db.BindNamed(q, order)
+	query, args, err := tx.BindNamed(q, order)
 
 	if err != nil {
+		_ = tx.Rollback()
 		logger.Log.Error(err.Error(), "where", "CreateOrder.bindNamed()")
 		return 0, err
 	}
 
 	var orderId int64
 
-	err = r.db.GetContext(ctx, &orderId, query, args...)
+	err = tx.GetContext(ctx, &orderId, query, args...)
 	if err != nil {
+		_ = tx.Rollback()
 		logger.Log.Error(err.Error(), "where", "CreateOrder.GetContext()")
 		return 0, err
 	}
 
+	for _, item := range order.Items {
+		q2 := fmt.Sprintf(`
+			insert into %s (order_id, offer_id, name, price, discount, is_bump)
+			values ($1, $2, $3, $4, $5, $6)
+		`, OrderItemsTable)
+
+		_, err = tx.ExecContext(ctx, q2, orderId, item.OfferID, item.Name, item.Price, item.Discount, item.IsBump)
+		if err != nil {
+			_ = tx.Rollback()
+			logger.Error(ctx, err.Error(), "where", "CreateOrder.q2", "order_id", orderId)
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "CreateOrder.Commit")
+		return 0, err
+	}
+
 	return orderId, nil
 }
 
-func (r *PostgresRepo) UpdateOrderPaymentId(ctx context.Context, orderId int64, paymentId string) error {
-	q := fmt.Sprintf(`update %s set payment_id = $2 where id = $1`, OrdersTable)
+// checkOfferSalesLimits блокирует офферы до конца транзакции и проверяет, что продажи открыты и места остались.
+// Офферы блокируются одним запросом по возрастанию id: иначе два заказа с офферами-дополнениями друг друга
+// заблокировали бы их в разном порядке и попали в deadlock. Один оффер в заказе занимает одно место
+func (r *PostgresRepo) checkOfferSalesLimits(ctx context.Context, tx *sqlx.Tx, offerIds []int64) error {
+	offerIds = slices.Clone(offerIds)
+	slices.Sort(offerIds)
+	offerIds = slices.Compact(offerIds)
+
+	q1 := fmt.Sprintf(`
+		select o.id, o.max_sales is not null as limited,
+		       (o.sales_start_at is null or o.sales_start_at <= now())
+		       and (o.sales_end_at is null or o.sales_end_at > now()) as open
+		from %s as o
+		where o.id = any($1)
+		order by o.id
+		for update`, OffersTable)
+
+	var offers []struct {
+		ID      int64 `db:"id"`
+		Limited bool  `db:"limited"`
+		Open    bool  `db:"open"`
+	}
+
+	err := tx.SelectContext(ctx, &offers, q1, pq.Array(offerIds))
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "checkOfferSalesLimits.q1")
+		return err
+	}
+
+	if len(offers) != len(offerIds) {
+		return common.ErrOfferNotFound
+	}
+
+	for _, offer := range offers {
+		if !offer.Open {
+			return common.ErrOfferSalesClosed
+		}
+	}
+
+	q2 := fmt.Sprintf(`select o.max_sales - %s from %s as o where o.id = $1`, offerSoldQuery(), OffersTable)
+
+	for _, offer := range offers {
+		if !offer.Limited {
+			continue
+		}
+
+		var remaining int
+
+		err = tx.GetContext(ctx, &remaining, q2, offer.ID)
+		if err != nil {
+			logger.Error(ctx, err.Error(), "where", "checkOfferSalesLimits.q2")
+			return err
+		}
+
+		if remaining <= 0 {
+			return common.ErrOfferSoldOut
+		}
+	}
+
+	return nil
+}
+
+// checkPromocodeLimits блокирует промокод до конца транзакции и проверяет лимиты использований.
+// Использования считаются уже после блокировки, чтобы увидеть заказы параллельных транзакций
+func (r *PostgresRepo) checkPromocodeLimits(ctx context.Context, tx *sqlx.Tx, promocodeId int64, userId int64) error {
+	q1 := fmt.Sprintf(`select max_uses, max_uses_per_user from %s where id = $1 for update`, PromocodesTable)
+
+	var limits struct {
+		MaxUses        *int64 `db:"max_uses"`
+		MaxUsesPerUser *int64 `db:"max_uses_per_user"`
+	}
+
+	err := tx.GetContext(ctx, &limits, q1, promocodeId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return common.ErrPromocodeNotFound
+		}
+		logger.Error(ctx, err.Error(), "where", "checkPromocodeLimits.q1")
+		return err
+	}
+
+	// промокод занимают оплаченные заказы и ожидающие оплаты, пока не истекли. Отклоненный заказ его освобождает
+	q2 := fmt.Sprintf(`
+		select count(*) as uses, count(*) filter (where user_id = $2) as user_uses
+		from %s
+		where promocode_id = $1 and status in ($3, $4, $5, $6)
+	`, OrdersTable)
+
+	var uses struct {
+		Uses     int64 `db:"uses"`
+		UserUses int64 `db:"user_uses"`
+	}
+
+	err = tx.GetContext(ctx, &uses, q2, promocodeId, userId,
+		payments.StatusPending, payments.StatusSucceeded, payments.StatusPartiallyRefunded, payments.StatusRefunded)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "checkPromocodeLimits.q2")
+		return err
+	}
+
+	if limits.MaxUses != nil && uses.Uses >= *limits.MaxUses {
+		return common.ErrPromocodeLimitReached
+	}
+
+	if limits.MaxUsesPerUser != nil && uses.UserUses >= *limits.MaxUsesPerUser {
+		return common.ErrPromocodeLimitReached
+	}
+
+	return nil
+}
+
+// FindPromocode ищет промокод проекта без учета регистра.
+// Использования пользователя считаются для userId, 0 — если пользователь неизвестен
+func (r *PostgresRepo) FindPromocode(ctx context.Context, projectId int64, code string, userId int64) (*Promocode, error) {
+	q := fmt.Sprintf(`
+		select p.id, p.project_id, p.offer_id, p.code, p.discount_type, p.discount_value,
+		       p.max_uses, p.max_uses_per_user, p.starts_at, p.ends_at, p.is_active,
+		       count(ord.id) as uses, count(ord.id) filter (where ord.user_id = $3) as user_uses
+		from %s as p
+		left join %s as ord on ord.promocode_id = p.id and ord.status in ($4, $5, $6, $7)
+		where p.project_id = $1 and lower(p.code) = lower($2)
+		group by p.id`,
+		PromocodesTable, OrdersTable)
+
+	var promocode Promocode
+
+	err := r.db.GetContext(ctx, &promocode, q, projectId, code, userId,
+		payments.StatusPending, payments.StatusSucceeded, payments.StatusPartiallyRefunded, payments.StatusRefunded)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, common.ErrPromocodeNotFound
+		}
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.FindPromocode")
+		return nil, err
+	}
+
+	return &promocode, nil
+}
+
+// UpdateOrderPaymentId — делает платеж текущим для заказа и сохраняет его в истории платежей заказа
+func (r *PostgresRepo) UpdateOrderPaymentId(ctx context.Context, orderId int64, paymentId string, paymentUrl string) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "UpdateOrderPaymentId.BeginTxx")
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	q1 := fmt.Sprintf(`update %s set payment_id = $2 where id = $1`, OrdersTable)
+	_, err = tx.ExecContext(ctx, q1, orderId, paymentId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "UpdateOrderPaymentId.q1")
+		return err
+	}
+
+	q2 := fmt.Sprintf(`
+		insert into %s (order_id, payment_id, payment_url) values ($1, $2, nullif($3, ''))
+		on conflict (order_id, payment_id) do nothing`, OrderPaymentsTable)
+	_, err = tx.ExecContext(ctx, q2, orderId, paymentId, paymentUrl)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "UpdateOrderPaymentId.q2")
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// IsOrderPayment — был ли платеж создан для заказа. Нужен для вебхуков по старым ссылкам на оплату
+func (r *PostgresRepo) IsOrderPayment(ctx context.Context, orderId int64, paymentId string) (bool, error) {
+	var exists bool
+	q := fmt.Sprintf(`select exists(select 1 from %s where order_id = $1 and payment_id = $2)`, OrderPaymentsTable)
 
-	_, err := r.db.ExecContext(ctx, q, orderId, paymentId)
+	err := r.db.GetContext(ctx, &exists, q, orderId, paymentId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.IsOrderPayment", "order_id", orderId)
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// FindOrderPayment — платеж заказа из истории. nil, если такого платежа у заказа не было
+func (r *PostgresRepo) FindOrderPayment(ctx context.Context, orderId int64, paymentId string) (*OrderPayment, error) {
+	var payment OrderPayment
+	q := fmt.Sprintf(`select payment_id, payment_url, created_at from %s where order_id = $1 and payment_id = $2`, OrderPaymentsTable)
+
+	err := r.db.GetContext(ctx, &payment, q, orderId, paymentId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.FindOrderPayment", "order_id", orderId)
+		return nil, err
+	}
+
+	return &payment, nil
+}
+
+func (r *PostgresRepo) UpdateOrderProviderStatus(ctx context.Context, orderId int64, providerStatus string) error {
+	q := fmt.Sprintf(`update %s set provider_status = $2 where id = $1`, OrdersTable)
+
+	_, err := r.db.ExecContext(ctx, q, orderId, providerStatus)
 
 	if err != nil {
-		logger.Log.Error(err.Error(), "where", "UpdateOrderPaymentId.Exec()")
+		logger.Error(ctx, err.Error(), "where", "UpdateOrderProviderStatus.Exec()", "order_id", orderId)
 		return err
 	}
 
@@ -778,7 +1234,8 @@ func (r *PostgresRepo) UpdateUserInfo(ctx context.Context, dto UpdateUserInfoDTO
 func (r *PostgresRepo) GetOfferGroups(ctx context.Context, offerId int64) ([]int64, error) {
 	var groups []int64
 
-	q := fmt.Sprintf(`select array_agg(group_id) as groups from %s where offer_id = $1 group by offer_id`, OffersGroupsTable)
+	// у оффера может не быть групп, например у дополнения с одними материалами в письме
+	q := fmt.Sprintf(`select coalesce(array_agg(group_id), '{}') as groups from %s where offer_id = $1`, OffersGroupsTable)
 
 	err := r.db.GetContext(ctx, pq.Array(&groups), q, offerId)
 
@@ -802,7 +1259,7 @@ func (r *PostgresRepo) AddUserToGroups(ctx context.Context, userId int64, groupI
 			insert into %s
 			(user_id, group_id, status)
 			values ($1, $2, 'active')
-			on conflict (user_id, group_id, status) do nothing;
+			on conflict (user_id, group_id, status) do update set left_at = null, remove_at = null;
 		`, UserGroupsTable)
 
 		_, err = tx.ExecContext(ctx, q, userId, groupId)
@@ -820,12 +1277,17 @@ func (r *PostgresRepo) FindOrderById(ctx context.Context, orderId int64) (*Order
 	var order OrderForProcessing
 	q := fmt.Sprintf(`
 		select ord.id, ord.offer_id, ord.status, ord.payment_id, ord.price, 
-		       off.slug as offer_slug, ord.user_id, u.email as user_email
+		       off.slug as offer_slug, ord.user_id, u.email as user_email, ord.integration_id,
+		       ord.refunded_amount, coalesce(nullif(ord.description, ''), off.name) as offer_name, p.owner_id as project_owner_id, ord.created_at,
+		       ord.subscription_id, coalesce(ord.is_gift, false) as is_gift, ord.gifted_to,
+		       ord.gift_recipient_id, gr.email as gift_recipient_email
 		from %s as ord
 		join %s as off on off.id = ord.offer_id
 		join %s as u on u.id = ord.user_id
+		left join %s as gr on gr.id = ord.gift_recipient_id
+		left join %s as p on p.id = ord.project_id
 		where ord.id = $1`,
-		OrdersTable, OffersTable, UsersTable)
+		OrdersTable, OffersTable, UsersTable, UsersTable, ProjectsTable)
 	err := r.db.GetContext(ctx, &order, q, orderId)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -837,19 +1299,1580 @@ func (r *PostgresRepo) FindOrderById(ctx context.Context, orderId int64) (*Order
 	return &order, nil
 }
 
-func (r *PostgresRepo) UpdateOrderStatus(ctx context.Context, orderId int64, status string, orderError OrderError, cardInfo OrderCardInfo) error {
+// GetOrderItems — позиции заказа. У заказов без дополнений и продлений подписки позиций нет
+func (r *PostgresRepo) GetOrderItems(ctx context.Context, orderId int64) ([]OrderItem, error) {
 	q := fmt.Sprintf(`
-		update %s 
-		set status = $2, error = $3, card_info = $4  
-		where id = $1`, OrdersTable)
-	_, err := r.db.ExecContext(ctx, q, orderId, status, orderError, cardInfo)
+		select oi.id, oi.offer_id, off.slug as offer_slug, oi.name, oi.price, oi.discount, oi.is_bump
+		from %s as oi
+		left join %s as off on off.id = oi.offer_id
+		where oi.order_id = $1
+		order by oi.id
+	`, OrderItemsTable, OffersTable)
+
+	items := make([]OrderItem, 0)
 
+	err := r.db.SelectContext(ctx, &items, q, orderId)
 	if err != nil {
-		logger.Error(ctx, fmt.Sprintf("could not update order status for order id %d", orderId), "err", err.Error())
-		return err
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.GetOrderItems", "order_id", orderId)
+		return make([]OrderItem, 0), err
 	}
 
-	return nil
+	return items, nil
+}
+
+// GetUserOrders — заказы, которые оплачивал пользователь, новые первыми
+func (r *PostgresRepo) GetUserOrders(ctx context.Context, userId int64) ([]UserOrder, error) {
+	q := fmt.Sprintf(`
+		select ord.id, ord.offer_id, coalesce(off.name, ord.description, '') as offer_name,
+		       ord.price, ord.discount, ord.currency, ord.status, ord.card_info,
+		       coalesce(ord.is_gift, false) as is_gift, ord.created_at, ord.updated_at,
+		       coalesce(ord_i.items, '[]'::json) as items
+		from %s as ord
+		left join %s as off on off.id = ord.offer_id
+		left join lateral (
+			select json_agg(
+				json_build_object(
+					'offer_id', oi.offer_id,
+					'name', oi.name,
+					'price', oi.price,
+					'discount', oi.discount,
+					'is_bump', oi.is_bump
+				) order by oi.id
+			) as items
+			from %s as oi
+			where oi.order_id = ord.id
+		) as ord_i on true
+		where ord.user_id = $1
+		order by ord.id desc
+	`, OrdersTable, OffersTable, OrderItemsTable)
+
+	orders := make([]UserOrder, 0)
+
+	err := r.db.SelectContext(ctx, &orders, q, userId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.GetUserOrders")
+		return make([]UserOrder, 0), err
+	}
+
+	return orders, nil
+}
+
+func (r *PostgresRepo) GetUserOrder(ctx context.Context, userId int64, orderId int64) (*UserOrder, error) {
+	q := fmt.Sprintf(`
+		select ord.id, ord.offer_id, coalesce(off.name, ord.description, '') as offer_name,
+		       ord.price, ord.discount, ord.currency, ord.status, ord.card_info,
+		       coalesce(ord.is_gift, false) as is_gift, ord.created_at, ord.updated_at,
+		       coalesce(ord_i.items, '[]'::json) as items
+		from %s as ord
+		left join %s as off on off.id = ord.offer_id
+		left join lateral (
+			select json_agg(
+				json_build_object(
+					'offer_id', oi.offer_id,
+					'name', oi.name,
+					'price', oi.price,
+					'discount', oi.discount,
+					'is_bump', oi.is_bump
+				) order by oi.id
+			) as items
+			from %s as oi
+			where oi.order_id = ord.id
+		) as ord_i on true
+		where ord.id = $1 and ord.user_id = $2
+	`, OrdersTable, OffersTable, OrderItemsTable)
+
+	var order UserOrder
+
+	err := r.db.GetContext(ctx, &order, q, orderId, userId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, common.ErrOrderNotFound
+		}
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.GetUserOrder")
+		return nil, err
+	}
+
+	return &order, nil
+}
+
+// RestartOrderPayment готовит заказ к оплате по новой ссылке: возвращает его в ожидание оплаты
+// и увеличивает номер попытки, чтобы платежная система не вернула прошлый платеж
+func (r *PostgresRepo) RestartOrderPayment(ctx context.Context, orderId int64) (int, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "RestartOrderPayment.BeginTx")
+		return 0, err
+	}
+
+	q1 := fmt.Sprintf(`
+		select status, offer_id, user_id, subscription_id, promocode_id,
+		       status = '%s' and updated_at > now() - interval '%d seconds' as holds_seat
+		from %s where id = $1 for update`,
+		payments.StatusPending, int(offerSeatHoldTime.Seconds()), OrdersTable)
+
+	var order struct {
+		Status         string `db:"status"`
+		OfferID        int64  `db:"offer_id"`
+		UserID         int64  `db:"user_id"`
+		SubscriptionID *int64 `db:"subscription_id"`
+		PromocodeID    *int64 `db:"promocode_id"`
+		HoldsSeat      bool   `db:"holds_seat"`
+	}
+
+	err = tx.GetContext(ctx, &order, q1, orderId)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, common.ErrOrderNotFound
+		}
+		logger.Error(ctx, err.Error(), "where", "RestartOrderPayment.q1")
+		return 0, err
+	}
+
+	if order.Status != payments.StatusPending && !payments.CanTransition(order.Status, payments.StatusPending) {
+		_ = tx.Rollback()
+		return 0, common.ErrOrderNotPayable
+	}
+
+	// отклоненный или долго не оплаченный заказ освободил места — свое и своих дополнений, их нужно занять снова.
+	// Место подписки считается по всем ее заказам
+	if !order.HoldsSeat && order.SubscriptionID == nil {
+		q3 := fmt.Sprintf(`select offer_id from %s where order_id = $1 and is_bump and offer_id is not null`, OrderItemsTable)
+
+		bumpOfferIds := make([]int64, 0)
+		err = tx.SelectContext(ctx, &bumpOfferIds, q3, orderId)
+		if err != nil {
+			_ = tx.Rollback()
+			logger.Error(ctx, err.Error(), "where", "RestartOrderPayment.q3", "order_id", orderId)
+			return 0, err
+		}
+
+		err = r.checkOfferSalesLimits(ctx, tx, append(bumpOfferIds, order.OfferID))
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	// и промокод: отклоненный заказ его не занимал
+	if order.Status != payments.StatusPending && order.PromocodeID != nil {
+		err = r.checkPromocodeLimits(ctx, tx, *order.PromocodeID, order.UserID)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	q2 := fmt.Sprintf(`
+		update %s
+		set status = '%s', error = null, payment_attempt = payment_attempt + 1, updated_at = now()
+		where id = $1
+		returning payment_attempt`, OrdersTable, payments.StatusPending)
+
+	var attempt int
+
+	err = tx.GetContext(ctx, &attempt, q2, orderId)
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Error(ctx, err.Error(), "where", "RestartOrderPayment.q2", "order_id", orderId)
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "RestartOrderPayment.Commit")
+		return 0, err
+	}
+
+	return attempt, nil
+}
+
+// TakeOrdersForReminder отдает неоплаченные заказы, о которых пора напомнить: у оффера задана задержка,
+// и она прошла с создания заказа или с прошлого напоминания. Напоминание сразу засчитывается.
+// Заказы пропускаются, если пользователь уже купил этот оффер другим заказом
+func (r *PostgresRepo) TakeOrdersForReminder(ctx context.Context, maxReminders int, limit int) ([]int64, error) {
+	q := fmt.Sprintf(`
+		update %s
+		set reminders_sent = reminders_sent + 1, reminded_at = now()
+		where id in (
+			select ord.id from %s as ord
+			join %s as off on off.id = ord.offer_id
+			left join %s as s on s.id = ord.subscription_id
+			where ord.status in ('%s', '%s')
+			and off.payment_reminder_delay is not null
+			and coalesce(ord.reminded_at, ord.created_at) < now() - off.payment_reminder_delay
+			and ord.reminders_sent < $1
+			and (s.id is null or s.status = '%s')
+			and not exists (
+				select 1 from %s as paid
+				where paid.user_id = ord.user_id and paid.offer_id = ord.offer_id
+				and paid.status in ('%s', '%s', '%s')
+			)
+			order by ord.id
+			limit $2
+			for update of ord skip locked
+		)
+		returning id
+	`, OrdersTable, OrdersTable, OffersTable, SubscriptionsTable,
+		payments.StatusPending, payments.StatusRejected, SubscriptionStatusPending,
+		OrdersTable, payments.StatusSucceeded, payments.StatusPartiallyRefunded, payments.StatusRefunded)
+
+	orderIds := make([]int64, 0)
+
+	err := r.db.SelectContext(ctx, &orderIds, q, maxReminders, limit)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.TakeOrdersForReminder")
+		return make([]int64, 0), err
+	}
+
+	return orderIds, nil
+}
+
+// TakePendingOrdersForReconcile отдает заказы в ожидании оплаты, созданные раньше before.
+// Заказ помечается сверенным, и следующий раз его возьмут, когда и отметка станет раньше before
+func (r *PostgresRepo) TakePendingOrdersForReconcile(ctx context.Context, before time.Time, limit int) ([]int64, error) {
+	q := fmt.Sprintf(`
+		update %s
+		set reconciled_at = now()
+		where id in (
+			select id from %s
+			where status = 'pending'
+			and created_at < $1
+			and (reconciled_at is null or reconciled_at < $1)
+			order by reconciled_at nulls first, id
+			limit $2
+			for update skip locked
+		)
+		returning id
+	`, OrdersTable, OrdersTable)
+
+	orderIds := make([]int64, 0)
+
+	err := r.db.SelectContext(ctx, &orderIds, q, before, limit)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.TakePendingOrdersForReconcile")
+		return make([]int64, 0), err
+	}
+
+	return orderIds, nil
+}
+
+// ChangeOrderStatus переводит заказ в новый статус в одной транзакции:
+// строка заказа блокируется, переход проверяется, при оплате пользователь получает доступ,
+// а письма складываются в outbox. Повторный статус ничего не меняет
+func (r *PostgresRepo) ChangeOrderStatus(ctx context.Context, dto ChangeOrderStatusDTO) (*ChangeOrderStatusResult, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "ChangeOrderStatus.BeginTx")
+		return nil, err
+	}
+
+	q1 := fmt.Sprintf(`select status, refunded_amount from %s where id = $1 for update`, OrdersTable)
+
+	var order struct {
+		Status         string `db:"status"`
+		RefundedAmount uint64 `db:"refunded_amount"`
+	}
+
+	var result ChangeOrderStatusResult
+
+	err = tx.GetContext(ctx, &order, q1, dto.OrderID)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, common.ErrOrderNotFound
+		}
+		logger.Error(ctx, err.Error(), "where", "ChangeOrderStatus.q1")
+		return nil, err
+	}
+
+	result.PreviousStatus = order.Status
+
+	// статус заказа тот же, но платежная система могла сообщить его другим своим статусом,
+	// а о следующем частичном возврате она сообщает тем же статусом с большей суммой
+	if result.PreviousStatus == dto.Status {
+		refundGrew := dto.Status == payments.StatusPartiallyRefunded && dto.RefundedAmount > order.RefundedAmount
+
+		if dto.ProviderStatus == "" && !refundGrew {
+			_ = tx.Rollback()
+			return &result, nil
+		}
+
+		q7 := fmt.Sprintf(`
+			update %s
+			set provider_status = coalesce(nullif($2, ''), provider_status),
+			    refunded_amount = least(price, greatest(refunded_amount, $3))
+			where id = $1`, OrdersTable)
+
+		_, err = tx.ExecContext(ctx, q7, dto.OrderID, dto.ProviderStatus, dto.RefundedAmount, dto.PaymentID)
+		if err != nil {
+			logger.Error(ctx, err.Error(), "where", "ChangeOrderStatus.q7", "order_id", dto.OrderID)
+			_ = tx.Rollback()
+			return nil, err
+		}
+
+		if refundGrew {
+			err = r.adjustReferralCommission(ctx, tx, dto.OrderID)
+			if err != nil {
+				_ = tx.Rollback()
+				return nil, err
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error(ctx, err.Error(), "where", "ChangeOrderStatus.Commit")
+			return nil, err
+		}
+
+		return &result, nil
+	}
+
+	if !payments.CanTransition(result.PreviousStatus, dto.Status) {
+		_ = tx.Rollback()
+		return &result, common.ErrIllegalOrderTransition
+	}
+
+	q2 := fmt.Sprintf(`
+		update %s 
+		set status = $2, error = $3, card_info = $4, updated_at = now(),
+		    provider_status = coalesce(nullif($5, ''), provider_status),
+		    payment_id = coalesce(nullif($7, ''), payment_id),
+		    refunded_amount = case
+		        when $2 = '%s' then price
+		        when $2 = '%s' then least(price, greatest(refunded_amount, $6))
+		        else refunded_amount
+		    end
+		where id = $1`, OrdersTable, payments.StatusRefunded, payments.StatusPartiallyRefunded)
+
+	_, err = tx.ExecContext(ctx, q2, dto.OrderID, dto.Status, dto.Error, dto.CardInfo, dto.ProviderStatus, dto.RefundedAmount)
+	if err != nil {
+		logger.Error(ctx, fmt.Sprintf("could not update order status for order id %d", dto.OrderID), "err", err.Error())
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if dto.Status == payments.StatusSucceeded {
+		err = r.createGiftRecipient(ctx, tx, dto.OrderID, dto.GiftRecipientPassword)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+
+		// подарок получает не покупатель, а получатель подарка
+		q3 := fmt.Sprintf(`
+			insert into %s (user_id, group_id, status)
+			select coalesce(ord.gift_recipient_id, ord.user_id), g.group_id, 'active'
+			from %s as ord, unnest($2::int[]) as g(group_id)
+			where ord.id = $1
+			on conflict (user_id, group_id, status) do update set left_at = null, remove_at = null;
+		`, UserGroupsTable, OrdersTable)
+
+		_, err = tx.ExecContext(ctx, q3, dto.OrderID, pq.Array(dto.GroupIDs))
+		if err != nil {
+			logger.Error(ctx, err.Error(), "where", "ChangeOrderStatus.q3", "order_id", dto.OrderID)
+			_ = tx.Rollback()
+			return nil, err
+		}
+
+		// Оплата заказа подписки продлевает ее на период. Повторное уведомление сюда не доходит,
+		// поэтому подписка не продлится дважды
+		q5 := fmt.Sprintf(`
+			update %s as s
+			set status = '%s',
+			    current_period_end = coalesce(s.current_period_end, now()) + ('1 ' || s.period)::interval,
+			    next_charge_at = coalesce(s.current_period_end, now()) + ('1 ' || s.period)::interval,
+			    failed_attempts = 0, updated_at = now()
+			from %s as ord
+			where ord.id = $1 and s.id = ord.subscription_id and s.canceled_at is null
+		`, SubscriptionsTable, SubscriptionStatusActive, OrdersTable)
+
+		_, err = tx.ExecContext(ctx, q5, dto.OrderID)
+		if err != nil {
+			logger.Error(ctx, err.Error(), "where", "ChangeOrderStatus.q5", "order_id", dto.OrderID)
+			_ = tx.Rollback()
+			return nil, err
+		}
+
+		// комиссия партнера считается по каждой позиции заказа с процентом ее оффера.
+		// У заказа без позиций, например продления подписки, партнера нет
+		q6 := fmt.Sprintf(`
+			insert into %s (referrer_id, order_id, project_id, amount)
+			select ord.referrer_id, ord.id, ord.project_id, sum(oi.price * off.referral_commission / 100)
+			from %s as ord
+			join %s as oi on oi.order_id = ord.id
+			join %s as off on off.id = oi.offer_id
+			where ord.id = $1 and ord.referrer_id is not null and off.referral_commission > 0
+			group by ord.referrer_id, ord.id, ord.project_id
+			on conflict (order_id) do nothing
+		`, ReferralCommissionsTable, OrdersTable, OrderItemsTable, OffersTable)
+
+		_, err = tx.ExecContext(ctx, q6, dto.OrderID)
+		if err != nil {
+			logger.Error(ctx, err.Error(), "where", "ChangeOrderStatus.q6", "order_id", dto.OrderID)
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	// возврат мог пройти мимо RefundOrder, например из личного кабинета платежной системы
+	if dto.Status == payments.StatusRefunded || dto.Status == payments.StatusPartiallyRefunded {
+		err = r.adjustReferralCommission(ctx, tx, dto.OrderID)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	for _, message := range dto.Outbox {
+		q4 := fmt.Sprintf(`insert into %s (order_id, type, payload) values ($1, $2, $3)`, OrderOutboxTable)
+
+		_, err = tx.ExecContext(ctx, q4, dto.OrderID, message.Type, []byte(message.Payload))
+		if err != nil {
+			logger.Error(ctx, err.Error(), "where", "ChangeOrderStatus.q4", "order_id", dto.OrderID)
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "ChangeOrderStatus.Commit")
+		return nil, err
+	}
+
+	result.Changed = true
+
+	return &result, nil
+}
+
+// ReserveRefund блокирует заказ и откладывает сумму возврата до ответа платежной системы,
+// чтобы два одновременных возврата не вернули деньги дважды. Amount 0 — весь остаток.
+// Пока резерв не записан через RefundOrder или не снят через CancelRefund, новый возврат — ErrRefundInProgress
+func (r *PostgresRepo) ReserveRefund(ctx context.Context, orderId int64, amount uint64) (*RefundReservation, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "ReserveRefund.BeginTx")
+		return nil, err
+	}
+
+	q1 := fmt.Sprintf(`select status, price, refunded_amount, refunding_amount from %s where id = $1 for update`, OrdersTable)
+
+	var order struct {
+		Status          string `db:"status"`
+		Price           uint64 `db:"price"`
+		RefundedAmount  uint64 `db:"refunded_amount"`
+		RefundingAmount uint64 `db:"refunding_amount"`
+	}
+
+	err = tx.GetContext(ctx, &order, q1, orderId)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, common.ErrOrderNotFound
+		}
+		logger.Error(ctx, err.Error(), "where", "ReserveRefund.q1")
+		return nil, err
+	}
+
+	if order.Status != payments.StatusSucceeded && order.Status != payments.StatusPartiallyRefunded {
+		_ = tx.Rollback()
+		return nil, common.ErrOrderNotRefundable
+	}
+
+	if order.RefundingAmount > 0 {
+		_ = tx.Rollback()
+		return nil, common.ErrRefundInProgress
+	}
+
+	reservation := RefundReservation{
+		Amount:         amount,
+		RefundedBefore: order.RefundedAmount,
+	}
+
+	if reservation.Amount == 0 {
+		reservation.Amount = order.Price - order.RefundedAmount
+	}
+
+	if reservation.Amount == 0 || order.RefundedAmount+reservation.Amount > order.Price {
+		_ = tx.Rollback()
+		return nil, common.ErrInvalidRefundAmount
+	}
+
+	q2 := fmt.Sprintf(`update %s set refunding_amount = $2, updated_at = now() where id = $1`, OrdersTable)
+
+	_, err = tx.ExecContext(ctx, q2, orderId, reservation.Amount)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "ReserveRefund.q2", "order_id", orderId)
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "ReserveRefund.Commit", "order_id", orderId)
+		return nil, err
+	}
+
+	return &reservation, nil
+}
+
+// CancelRefund снимает резерв возврата, который платежная система не провела
+func (r *PostgresRepo) CancelRefund(ctx context.Context, orderId int64) error {
+	q := fmt.Sprintf(`update %s set refunding_amount = 0, updated_at = now() where id = $1`, OrdersTable)
+
+	_, err := r.db.ExecContext(ctx, q, orderId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "CancelRefund", "order_id", orderId)
+		return err
+	}
+
+	return nil
+}
+
+// createGiftRecipient находит или регистрирует получателя оплаченного подарка и записывает его в заказ.
+// До оплаты аккаунт не создается, чтобы неоплаченный заказ не заводил аккаунты на чужие email
+func (r *PostgresRepo) createGiftRecipient(ctx context.Context, tx *sqlx.Tx, orderId int64, passwordHash string) error {
+	q1 := fmt.Sprintf(`
+		select gifted_to->>'email' as email, coalesce(gifted_to->>'first_name', '') as first_name
+		from %s
+		where id = $1 and is_gift and gift_recipient_id is null and gifted_to is not null
+	`, OrdersTable)
+
+	var recipient User
+
+	err := tx.GetContext(ctx, &recipient, q1, orderId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "createGiftRecipient.q1", "order_id", orderId)
+		return err
+	}
+
+	q2 := fmt.Sprintf(`
+		insert into %s (email, password, first_name) values ($1, $2, $3)
+		on conflict (email) do nothing
+		returning id
+	`, UsersTable)
+
+	newUser := true
+	var recipientId int64
+
+	err = tx.GetContext(ctx, &recipientId, q2, recipient.Email, passwordHash, recipient.FirstName)
+	if errors.Is(err, sql.ErrNoRows) {
+		newUser = false
+
+		q3 := fmt.Sprintf(`select id from %s where email = $1`, UsersTable)
+		err = tx.GetContext(ctx, &recipientId, q3, recipient.Email)
+	}
+
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "createGiftRecipient.q2", "order_id", orderId)
+		return err
+	}
+
+	q4 := fmt.Sprintf(`
+		update %s
+		set gift_recipient_id = $2, gifted_to = (gifted_to::jsonb || jsonb_build_object('new_user', $3::boolean))::json
+		where id = $1
+	`, OrdersTable)
+
+	_, err = tx.ExecContext(ctx, q4, orderId, recipientId, newUser)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "createGiftRecipient.q4", "order_id", orderId)
+		return err
+	}
+
+	return nil
+}
+
+// RefundOrder записывает зарезервированный возврат, который уже прошел в платежной системе:
+// меняет возвращенную сумму и статус, снимает резерв и, если нужно, забирает доступ к группам оффера
+func (r *PostgresRepo) RefundOrder(ctx context.Context, dto RefundOrderDTO) (*RefundOrderResult, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "RefundOrder.BeginTx")
+		return nil, err
+	}
+
+	q1 := fmt.Sprintf(`select status, price, refunded_amount from %s where id = $1 for update`, OrdersTable)
+
+	var order struct {
+		Status         string `db:"status"`
+		Price          uint64 `db:"price"`
+		RefundedAmount uint64 `db:"refunded_amount"`
+	}
+
+	err = tx.GetContext(ctx, &order, q1, dto.OrderID)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, common.ErrOrderNotFound
+		}
+		logger.Error(ctx, err.Error(), "where", "RefundOrder.q1")
+		return nil, err
+	}
+
+	// уведомление о полном возврате могло прийти раньше ответа платежной системы и уже записать возврат.
+	// Тогда остается только забрать доступ, если нужно
+	if order.Status == payments.StatusRefunded {
+		result := RefundOrderResult{
+			OrderID:        dto.OrderID,
+			Status:         payments.StatusRefunded,
+			RefundedAmount: order.RefundedAmount,
+		}
+
+		return r.finishRefund(ctx, tx, dto, result)
+	}
+
+	if dto.Amount == 0 || dto.RefundedBefore+dto.Amount > order.Price {
+		_ = tx.Rollback()
+		return nil, common.ErrInvalidRefundAmount
+	}
+
+	// уведомление о частичном возврате тоже могло прийти раньше и записать эту же сумму — второй раз она не прибавляется
+	result := RefundOrderResult{
+		OrderID:        dto.OrderID,
+		Status:         payments.StatusPartiallyRefunded,
+		RefundedAmount: max(order.RefundedAmount, dto.RefundedBefore+dto.Amount),
+	}
+
+	if result.RefundedAmount == order.Price {
+		result.Status = payments.StatusRefunded
+	}
+
+	if result.Status != order.Status && !payments.CanTransition(order.Status, result.Status) {
+		_ = tx.Rollback()
+		return nil, common.ErrOrderNotRefundable
+	}
+
+	q2 := fmt.Sprintf(`
+		update %s
+		set status = $2, refunded_amount = $3, updated_at = now()
+		where id = $1`, OrdersTable)
+
+	_, err = tx.ExecContext(ctx, q2, dto.OrderID, result.Status, result.RefundedAmount)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "RefundOrder.q2", "order_id", dto.OrderID)
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	err = r.adjustReferralCommission(ctx, tx, dto.OrderID)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	return r.finishRefund(ctx, tx, dto, result)
+}
+
+// adjustReferralCommission пересчитывает невыплаченную комиссию партнера после возврата:
+// за полностью возвращенный заказ она отменяется, за частично — уменьшается пропорционально возврату
+func (r *PostgresRepo) adjustReferralCommission(ctx context.Context, tx *sqlx.Tx, orderId int64) error {
+	q := fmt.Sprintf(`
+		update %s as rc
+		set status = case when ord.refunded_amount >= ord.price then '%s' else rc.status end,
+		    amount = case when ord.refunded_amount >= ord.price then rc.amount else (
+		        select coalesce(sum(oi.price * off.referral_commission / 100), 0)
+		        from %s as oi
+		        join %s as off on off.id = oi.offer_id
+		        where oi.order_id = ord.id and off.referral_commission > 0
+		    ) * (ord.price - ord.refunded_amount) / ord.price end,
+		    updated_at = now()
+		from %s as ord
+		where ord.id = $1 and rc.order_id = ord.id and rc.status = '%s' and ord.price > 0
+	`, ReferralCommissionsTable, ReferralCommissionCanceled, OrderItemsTable, OffersTable, OrdersTable, ReferralCommissionAccrued)
+
+	_, err := tx.ExecContext(ctx, q, orderId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "adjustReferralCommission", "order_id", orderId)
+		return err
+	}
+
+	return nil
+}
+
+// finishRefund снимает резерв возврата, забирает доступ к группам заказа, если нужно, и завершает транзакцию возврата
+func (r *PostgresRepo) finishRefund(ctx context.Context, tx *sqlx.Tx, dto RefundOrderDTO, result RefundOrderResult) (*RefundOrderResult, error) {
+	q4 := fmt.Sprintf(`update %s set refunding_amount = 0 where id = $1`, OrdersTable)
+
+	_, err := tx.ExecContext(ctx, q4, dto.OrderID)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "RefundOrder.q4", "order_id", dto.OrderID)
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if dto.RevokeAccess {
+		q3 := fmt.Sprintf(`
+			update %s as ug
+			set left_at = now()
+			from %s as ord
+			where ord.id = $1 and ug.user_id = coalesce(ord.gift_recipient_id, ord.user_id)
+			  and ug.group_id = any($2::int[]) and ug.left_at is null
+		`, UserGroupsTable, OrdersTable)
+
+		_, err = tx.ExecContext(ctx, q3, dto.OrderID, pq.Array(dto.GroupIDs))
+		if err != nil {
+			logger.Error(ctx, err.Error(), "where", "RefundOrder.q3", "order_id", dto.OrderID)
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "RefundOrder.Commit", "order_id", dto.OrderID)
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// CreateSession сохраняет новую сессию. Если у пользователя стало больше сессий, чем позволяет
+// лимит его проектов, самые давно использованные отзываются — их id возвращаются
+func (r *PostgresRepo) CreateSession(ctx context.Context, session NewSession) ([]string, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "CreateSession.BeginTx")
+		return nil, err
+	}
+
+	// одновременные входы одного пользователя проходят по очереди, иначе оба могут не заметить лимит
+	q1 := fmt.Sprintf(`select id from %s where id = $1 for update`, UsersTable)
+
+	var userId int
+	err = tx.GetContext(ctx, &userId, q1, session.UserID)
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Error(ctx, err.Error(), "where", "CreateSession.q1")
+		return nil, err
+	}
+
+	q2 := fmt.Sprintf(`
+		insert into %s (id, user_id, refresh_token_hash, expires_at, user_agent, ip)
+		values (:id, :user_id, :refresh_token_hash, :expires_at, nullif(:user_agent, ''), nullif(:ip, ''))
+	`, UserSessionsTable)
+
+	_, err = tx.NamedExecContext(ctx, q2, session)
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Error(ctx, err.Error(), "where", "CreateSession.q2")
+		return nil, err
+	}
+
+	q3 := fmt.Sprintf(`
+		with session_limit as (
+			select min(p.max_user_sessions) as max_sessions
+			from %s ug
+			join %s g on g.id = ug.group_id
+			join %s p on p.id = g.project_id
+			where ug.user_id = $1 and ug.status = 'active'
+		)
+		update %s set revoked_at = now()
+		where id in (
+			select us.id
+			from %s us, session_limit sl
+			where us.user_id = $1 and us.revoked_at is null and us.expires_at > now()
+				and sl.max_sessions is not null
+			order by us.last_used_at desc, us.created_at desc
+			offset (select max_sessions from session_limit)
+		)
+		returning id
+	`, UserGroupsTable, GroupsTable, ProjectsTable, UserSessionsTable, UserSessionsTable)
+
+	revokedIds := make([]string, 0)
+
+	err = tx.SelectContext(ctx, &revokedIds, q3, session.UserID)
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Error(ctx, err.Error(), "where", "CreateSession.q3")
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "CreateSession.Commit")
+		return nil, err
+	}
+
+	return revokedIds, nil
+}
+
+// RotateSession меняет refresh-токен сессии на новый и возвращает пользователя сессии.
+// Если пришел не последний выданный токен, значит его украли или использовали повторно —
+// сессия отзывается целиком, и новые токены по ней больше не выдаются
+func (r *PostgresRepo) RotateSession(ctx context.Context, sessionId string, refreshTokenHash string, newRefreshTokenHash string, expiresAt time.Time, client SessionClient) (int, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "RotateSession.BeginTx")
+		return 0, err
+	}
+
+	q1 := fmt.Sprintf(`
+		select user_id, refresh_token_hash, revoked_at is null and expires_at > now() as active
+		from %s
+		where id = $1
+		for update
+	`, UserSessionsTable)
+
+	var session struct {
+		UserID           int    `db:"user_id"`
+		RefreshTokenHash string `db:"refresh_token_hash"`
+		Active           bool   `db:"active"`
+	}
+
+	err = tx.GetContext(ctx, &session, q1, sessionId)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, common.ErrInvalidRefreshToken
+		}
+		logger.Error(ctx, err.Error(), "where", "RotateSession.q1")
+		return 0, err
+	}
+
+	if !session.Active {
+		_ = tx.Rollback()
+		return session.UserID, common.ErrInvalidRefreshToken
+	}
+
+	if session.RefreshTokenHash != refreshTokenHash {
+		q2 := fmt.Sprintf(`update %s set revoked_at = now() where id = $1`, UserSessionsTable)
+
+		_, err = tx.ExecContext(ctx, q2, sessionId)
+		if err != nil {
+			_ = tx.Rollback()
+			logger.Error(ctx, err.Error(), "where", "RotateSession.q2")
+			return 0, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			logger.Error(ctx, err.Error(), "where", "RotateSession.Commit")
+			return 0, err
+		}
+
+		return session.UserID, common.ErrRefreshTokenReused
+	}
+
+	q3 := fmt.Sprintf(`
+		update %s
+		set refresh_token_hash = $2, expires_at = $3, last_used_at = now(),
+			user_agent = coalesce(nullif($4, ''), user_agent), ip = coalesce(nullif($5, ''), ip)
+		where id = $1
+	`, UserSessionsTable)
+
+	_, err = tx.ExecContext(ctx, q3, sessionId, newRefreshTokenHash, expiresAt, client.UserAgent, client.IP)
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Error(ctx, err.Error(), "where", "RotateSession.q3")
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "RotateSession.Commit")
+		return 0, err
+	}
+
+	return session.UserID, nil
+}
+
+// GetUserSessions — активные сессии пользователя, последние использованные первыми
+func (r *PostgresRepo) GetUserSessions(ctx context.Context, userId int) ([]UserSession, error) {
+	q := fmt.Sprintf(`
+		select id, user_agent, ip, created_at, last_used_at, expires_at
+		from %s
+		where user_id = $1 and revoked_at is null and expires_at > now()
+		order by last_used_at desc
+	`, UserSessionsTable)
+
+	sessions := make([]UserSession, 0)
+
+	err := r.db.SelectContext(ctx, &sessions, q, userId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.GetUserSessions")
+		return make([]UserSession, 0), err
+	}
+
+	return sessions, nil
+}
+
+func (r *PostgresRepo) RevokeSession(ctx context.Context, userId int, sessionId string) error {
+	q := fmt.Sprintf(`
+		update %s set revoked_at = now()
+		where id = $1 and user_id = $2 and revoked_at is null
+	`, UserSessionsTable)
+
+	result, err := r.db.ExecContext(ctx, q, sessionId, userId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.RevokeSession")
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return common.ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// RevokeUserSessions отзывает все активные сессии пользователя и возвращает их id
+func (r *PostgresRepo) RevokeUserSessions(ctx context.Context, userId int) ([]string, error) {
+	q := fmt.Sprintf(`
+		update %s set revoked_at = now()
+		where user_id = $1 and revoked_at is null
+		returning id
+	`, UserSessionsTable)
+
+	sessionIds := make([]string, 0)
+
+	err := r.db.SelectContext(ctx, &sessionIds, q, userId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.RevokeUserSessions")
+		return make([]string, 0), err
+	}
+
+	return sessionIds, nil
+}
+
+// IsSessionRevoked — отозвана ли сессия. Неизвестная сессия считается отозванной
+func (r *PostgresRepo) IsSessionRevoked(ctx context.Context, sessionId string) (bool, error) {
+	q := fmt.Sprintf(`select revoked_at is not null from %s where id = $1`, UserSessionsTable)
+
+	var revoked bool
+
+	err := r.db.GetContext(ctx, &revoked, q, sessionId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	}
+
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.IsSessionRevoked")
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+// CreateAuthToken сохраняет токен из письма. Если за последний час пользователю уже выдано
+// maxPerHour токенов с тем же назначением, возвращает ErrTooManyAuthTokens
+func (r *PostgresRepo) CreateAuthToken(ctx context.Context, token NewAuthToken, maxPerHour int) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "CreateAuthToken.BeginTx")
+		return err
+	}
+
+	// запросы одного пользователя проходят по очереди, иначе одновременные не заметят лимит
+	q1 := fmt.Sprintf(`select id from %s where id = $1 for update`, UsersTable)
+
+	var userId int
+	err = tx.GetContext(ctx, &userId, q1, token.UserID)
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Error(ctx, err.Error(), "where", "CreateAuthToken.q1")
+		return err
+	}
+
+	q2 := fmt.Sprintf(`
+		select count(*) from %s
+		where user_id = $1 and purpose = $2 and created_at > now() - interval '1 hour'
+	`, AuthTokensTable)
+
+	var issued int
+	err = tx.GetContext(ctx, &issued, q2, token.UserID, token.Purpose)
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Error(ctx, err.Error(), "where", "CreateAuthToken.q2")
+		return err
+	}
+
+	if issued >= maxPerHour {
+		_ = tx.Rollback()
+		return common.ErrTooManyAuthTokens
+	}
+
+	q3 := fmt.Sprintf(`
+		insert into %s (user_id, purpose, email, token_hash, expires_at)
+		values (:user_id, :purpose, nullif(:email, ''), :token_hash, :expires_at)
+	`, AuthTokensTable)
+
+	_, err = tx.NamedExecContext(ctx, q3, token)
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Error(ctx, err.Error(), "where", "CreateAuthToken.q3")
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "CreateAuthToken.Commit")
+		return err
+	}
+
+	return nil
+}
+
+// ConsumeAuthToken отмечает токен использованным. Второй раз тот же токен уже не найдется — вернется nil.
+// Срок проверяет вызывающий, чтобы отличить истекшую ссылку от неверной
+func (r *PostgresRepo) ConsumeAuthToken(ctx context.Context, purpose string, tokenHash string) (*AuthToken, error) {
+	q := fmt.Sprintf(`
+		update %s set used_at = now()
+		where token_hash = $1 and purpose = $2 and used_at is null
+		returning user_id, email, expires_at
+	`, AuthTokensTable)
+
+	var token AuthToken
+
+	err := r.db.GetContext(ctx, &token, q, tokenHash, purpose)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.ConsumeAuthToken")
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// UseUserAuthTokens отмечает использованными все еще действующие токены пользователя с такими назначениями
+func (r *PostgresRepo) UseUserAuthTokens(ctx context.Context, userId int, purposes []string) error {
+	q := fmt.Sprintf(`
+		update %s set used_at = now()
+		where user_id = $1 and purpose = any($2) and used_at is null
+	`, AuthTokensTable)
+
+	_, err := r.db.ExecContext(ctx, q, userId, pq.Array(purposes))
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.UseUserAuthTokens", "user_id", userId)
+		return err
+	}
+
+	return nil
+}
+
+func (r *PostgresRepo) createSubscription(ctx context.Context, tx *sqlx.Tx, subscription NewSubscription) (int64, error) {
+	q := fmt.Sprintf(`
+		insert into %s (user_id, offer_id, project_id, integration_id, period, price)
+		values (:user_id, :offer_id, :project_id, :integration_id, :period, :price)
+		returning id
+	`, SubscriptionsTable)
+
+	query, args, err := tx.BindNamed(q, subscription)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.createSubscription.BindNamed")
+		return 0, err
+	}
+
+	var subscriptionId int64
+
+	err = tx.GetContext(ctx, &subscriptionId, query, args...)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.createSubscription")
+		return 0, err
+	}
+
+	return subscriptionId, nil
+}
+
+func (r *PostgresRepo) UpdateSubscriptionRebillId(ctx context.Context, subscriptionId int64, rebillId string) error {
+	q := fmt.Sprintf(`update %s set rebill_id = $2, updated_at = now() where id = $1`, SubscriptionsTable)
+
+	_, err := r.db.ExecContext(ctx, q, subscriptionId, rebillId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.UpdateSubscriptionRebillId")
+		return err
+	}
+
+	return nil
+}
+
+func (r *PostgresRepo) GetUserSubscriptions(ctx context.Context, userId int64) ([]Subscription, error) {
+	q := fmt.Sprintf(`
+		select s.id, s.offer_id, off.name as offer_name, s.status, s.period, s.price,
+		       s.current_period_end, s.next_charge_at, s.canceled_at, s.created_at
+		from %s as s
+		left join %s as off on off.id = s.offer_id
+		where s.user_id = $1 and s.status != '%s'
+		order by s.id desc
+	`, SubscriptionsTable, OffersTable, SubscriptionStatusPending)
+
+	subscriptions := make([]Subscription, 0)
+
+	err := r.db.SelectContext(ctx, &subscriptions, q, userId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.GetUserSubscriptions")
+		return make([]Subscription, 0), err
+	}
+
+	return subscriptions, nil
+}
+
+// TakeSubscriptionsForRenewal забирает подписки, которым пора списать очередной платеж.
+// Следующая попытка сразу переносится на retryAt: если списание не пройдет, подписку возьмут снова тогда.
+// Подписки с недавним неоплаченным заказом пропускаются, чтобы не списать деньги дважды
+func (r *PostgresRepo) TakeSubscriptionsForRenewal(ctx context.Context, retryAt time.Time, limit int) ([]SubscriptionForRenewal, error) {
+	q := fmt.Sprintf(`
+		with taken as (
+			update %s
+			set next_charge_at = $1, updated_at = now()
+			where id in (
+				select s.id from %s as s
+				where s.status in ('%s', '%s')
+				and s.next_charge_at <= now()
+				and s.canceled_at is null
+				and not exists (
+					select 1 from %s as ord
+					where ord.subscription_id = s.id and ord.status = '%s' and ord.created_at > now() - interval '1 day'
+				)
+				order by s.next_charge_at
+				limit $2
+				for update skip locked
+			)
+			returning id, user_id, offer_id, integration_id, price, rebill_id, current_period_end, failed_attempts
+		)
+		select t.id, t.user_id, u.email as user_email, t.offer_id, off.name as offer_name, t.integration_id,
+		       t.price, t.rebill_id, t.current_period_end, t.failed_attempts
+		from taken as t
+		join %s as u on u.id = t.user_id
+		join %s as off on off.id = t.offer_id
+	`, SubscriptionsTable, SubscriptionsTable, SubscriptionStatusActive, SubscriptionStatusPastDue,
+		OrdersTable, payments.StatusPending, UsersTable, OffersTable)
+
+	subscriptions := make([]SubscriptionForRenewal, 0)
+
+	err := r.db.SelectContext(ctx, &subscriptions, q, retryAt, limit)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.TakeSubscriptionsForRenewal")
+		return make([]SubscriptionForRenewal, 0), err
+	}
+
+	return subscriptions, nil
+}
+
+// FailSubscriptionRenewal отмечает неудачное списание: подписка ждет оплаты,
+// а доступ к группам оффера будет закрыт в removeAt, если подписку так и не оплатят
+func (r *PostgresRepo) FailSubscriptionRenewal(ctx context.Context, subscriptionId int64, removeAt time.Time) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "FailSubscriptionRenewal.BeginTx")
+		return err
+	}
+
+	q1 := fmt.Sprintf(`
+		update %s
+		set status = '%s', failed_attempts = failed_attempts + 1, updated_at = now()
+		where id = $1`, SubscriptionsTable, SubscriptionStatusPastDue)
+
+	_, err = tx.ExecContext(ctx, q1, subscriptionId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "FailSubscriptionRenewal.q1", "subscription_id", subscriptionId)
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = r.setSubscriptionRemoveAt(ctx, tx, subscriptionId, removeAt)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ExpireSubscription закрывает подписку после льготного периода. Выход из групп назначается
+// здесь же: если последнее списание отклонили уведомлением или задача не работала, его еще нет
+func (r *PostgresRepo) ExpireSubscription(ctx context.Context, subscriptionId int64) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "ExpireSubscription.BeginTx")
+		return err
+	}
+
+	q1 := fmt.Sprintf(`
+		update %s
+		set status = '%s', next_charge_at = null, updated_at = now()
+		where id = $1`, SubscriptionsTable, SubscriptionStatusExpired)
+
+	_, err = tx.ExecContext(ctx, q1, subscriptionId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "ExpireSubscription.q1", "subscription_id", subscriptionId)
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = r.setSubscriptionRemoveAt(ctx, tx, subscriptionId, time.Now())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CancelSubscription отменяет подписку пользователя. Следующих списаний не будет,
+// а доступ к группам оффера останется до конца оплаченного периода
+func (r *PostgresRepo) CancelSubscription(ctx context.Context, userId int64, subscriptionId int64) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "CancelSubscription.BeginTx")
+		return err
+	}
+
+	q1 := fmt.Sprintf(`select status, current_period_end from %s where id = $1 and user_id = $2 for update`, SubscriptionsTable)
+
+	var subscription struct {
+		Status           string     `db:"status"`
+		CurrentPeriodEnd *time.Time `db:"current_period_end"`
+	}
+
+	err = tx.GetContext(ctx, &subscription, q1, subscriptionId, userId)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return common.ErrSubscriptionNotFound
+		}
+		logger.Error(ctx, err.Error(), "where", "CancelSubscription.q1")
+		return err
+	}
+
+	if subscription.Status == SubscriptionStatusCanceled || subscription.Status == SubscriptionStatusExpired {
+		_ = tx.Rollback()
+		return common.ErrSubscriptionNotCancelable
+	}
+
+	q2 := fmt.Sprintf(`
+		update %s
+		set status = '%s', canceled_at = now(), next_charge_at = null, updated_at = now()
+		where id = $1`, SubscriptionsTable, SubscriptionStatusCanceled)
+
+	_, err = tx.ExecContext(ctx, q2, subscriptionId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "CancelSubscription.q2", "subscription_id", subscriptionId)
+		_ = tx.Rollback()
+		return err
+	}
+
+	removeAt := time.Now()
+	if subscription.CurrentPeriodEnd != nil {
+		removeAt = *subscription.CurrentPeriodEnd
+	}
+
+	err = r.setSubscriptionRemoveAt(ctx, tx, subscriptionId, removeAt)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setSubscriptionRemoveAt назначает, когда пользователь подписки выйдет из групп ее оффера.
+// Уже назначенный более ранний выход не переносится
+func (r *PostgresRepo) setSubscriptionRemoveAt(ctx context.Context, tx *sqlx.Tx, subscriptionId int64, removeAt time.Time) error {
+	q := fmt.Sprintf(`
+		update %s as ug
+		set remove_at = $2
+		from %s as s
+		join %s as og on og.offer_id = s.offer_id
+		where s.id = $1 and ug.user_id = s.user_id and ug.group_id = og.group_id
+		and ug.left_at is null and (ug.remove_at is null or ug.remove_at > $2)
+	`, UserGroupsTable, SubscriptionsTable, OffersGroupsTable)
+
+	_, err := tx.ExecContext(ctx, q, subscriptionId, removeAt)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "setSubscriptionRemoveAt", "subscription_id", subscriptionId)
+		return err
+	}
+
+	return nil
+}
+
+// TakeOrderOutboxMessages забирает сообщения в обработку.
+// Сообщения, зависшие в обработке, забираются повторно
+func (r *PostgresRepo) TakeOrderOutboxMessages(ctx context.Context, limit int) ([]OrderOutboxMessage, error) {
+	q := fmt.Sprintf(`
+		update %s
+		set status = 'processing', attempts = attempts + 1, updated_at = now()
+		where id in (
+			select id from %s
+			where status = 'pending'
+			or (status = 'processing' and updated_at < now() - interval '10 minutes')
+			order by id
+			limit $1
+			for update skip locked
+		)
+		returning id, order_id, type, payload, attempts
+	`, OrderOutboxTable, OrderOutboxTable)
+
+	messages := make([]OrderOutboxMessage, 0)
+
+	err := r.db.SelectContext(ctx, &messages, q, limit)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.TakeOrderOutboxMessages")
+		return make([]OrderOutboxMessage, 0), err
+	}
+
+	return messages, nil
+}
+
+func (r *PostgresRepo) CompleteOrderOutboxMessage(ctx context.Context, messageId int64) error {
+	q := fmt.Sprintf(`
+		update %s
+		set status = 'done', last_error = null, processed_at = now(), updated_at = now()
+		where id = $1
+	`, OrderOutboxTable)
+
+	_, err := r.db.ExecContext(ctx, q, messageId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.CompleteOrderOutboxMessage")
+		return err
+	}
+
+	return nil
+}
+
+func (r *PostgresRepo) FailOrderOutboxMessage(ctx context.Context, messageId int64, errMessage string, retry bool) error {
+	status := "failed"
+	if retry {
+		status = "pending"
+	}
+
+	q := fmt.Sprintf(`
+		update %s
+		set status = $2, last_error = $3, updated_at = now()
+		where id = $1
+	`, OrderOutboxTable)
+
+	_, err := r.db.ExecContext(ctx, q, messageId, status, errMessage)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.FailOrderOutboxMessage")
+		return err
+	}
+
+	return nil
+}
+
+// SetReferralCode сохраняет реферальный код пользователя, если его еще нет, и возвращает действующий код
+func (r *PostgresRepo) SetReferralCode(ctx context.Context, userId int64, code string) (string, error) {
+	q := fmt.Sprintf(`
+		update %s set referral_code = coalesce(referral_code, $2)
+		where id = $1
+		returning referral_code
+	`, UsersTable)
+
+	var referralCode string
+
+	err := r.db.GetContext(ctx, &referralCode, q, userId, code)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return "", common.ErrReferralCodeTaken
+		}
+
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", common.ErrUserNotFound
+		}
+
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.SetReferralCode")
+		return "", err
+	}
+
+	return referralCode, nil
+}
+
+func (r *PostgresRepo) FindUserByReferralCode(ctx context.Context, code string) (int64, error) {
+	q := fmt.Sprintf(`select id from %s where referral_code = $1`, UsersTable)
+
+	var userId int64
+
+	err := r.db.GetContext(ctx, &userId, q, code)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, common.ErrReferrerNotFound
+		}
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.FindUserByReferralCode")
+		return 0, err
+	}
+
+	return userId, nil
+}
+
+func (r *PostgresRepo) CreateReferralClick(ctx context.Context, referrerId int64, offerSlug string) error {
+	q := fmt.Sprintf(`
+		insert into %s (referrer_id, offer_id)
+		select $1, id from %s where slug = $2
+	`, ReferralClicksTable, OffersTable)
+
+	_, err := r.db.ExecContext(ctx, q, referrerId, offerSlug)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.CreateReferralClick")
+		return err
+	}
+
+	return nil
+}
+
+// GetReferralStats — переходы, продажи и комиссия партнера по проектам, где у него что-то есть
+func (r *PostgresRepo) GetReferralStats(ctx context.Context, referrerId int64) ([]ReferralProjectStats, error) {
+	q := fmt.Sprintf(`
+		select p.id as project_id, p.name as project_name,
+		       coalesce(cl.clicks, 0) as clicks, coalesce(c.sales, 0) as sales,
+		       coalesce(c.earned, 0) as earned, coalesce(c.paid_out, 0) as paid_out, coalesce(c.balance, 0) as balance
+		from %s as p
+		left join (
+			select off.project_id, count(*) as clicks
+			from %s as rc
+			join %s as off on off.id = rc.offer_id
+			where rc.referrer_id = $1
+			group by off.project_id
+		) as cl on cl.project_id = p.id
+		left join (
+			select project_id,
+			       count(*) filter (where status != '%s') as sales,
+			       sum(amount) filter (where status != '%s') as earned,
+			       sum(amount) filter (where status = '%s') as paid_out,
+			       sum(amount) filter (where status = '%s') as balance
+			from %s
+			where referrer_id = $1
+			group by project_id
+		) as c on c.project_id = p.id
+		where cl.project_id is not null or c.project_id is not null
+		order by p.id
+	`, ProjectsTable, ReferralClicksTable, OffersTable,
+		ReferralCommissionCanceled, ReferralCommissionCanceled, ReferralCommissionPaid, ReferralCommissionAccrued,
+		ReferralCommissionsTable)
+
+	stats := make([]ReferralProjectStats, 0)
+
+	err := r.db.SelectContext(ctx, &stats, q, referrerId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.GetReferralStats")
+		return make([]ReferralProjectStats, 0), err
+	}
+
+	return stats, nil
+}
+
+// GetProjectReferrers — партнеры с комиссией в проекте, сначала те, кому больше всего нужно выплатить
+func (r *PostgresRepo) GetProjectReferrers(ctx context.Context, projectId int64) ([]ProjectReferrer, error) {
+	q := fmt.Sprintf(`
+		select c.referrer_id, u.email, coalesce(u.referral_code, '') as code,
+		       count(*) filter (where c.status != '%s') as sales,
+		       coalesce(sum(c.amount) filter (where c.status != '%s'), 0) as earned,
+		       coalesce(sum(c.amount) filter (where c.status = '%s'), 0) as paid_out,
+		       coalesce(sum(c.amount) filter (where c.status = '%s'), 0) as balance
+		from %s as c
+		join %s as u on u.id = c.referrer_id
+		where c.project_id = $1
+		group by c.referrer_id, u.email, u.referral_code
+		order by balance desc, c.referrer_id
+	`, ReferralCommissionCanceled, ReferralCommissionCanceled, ReferralCommissionPaid, ReferralCommissionAccrued,
+		ReferralCommissionsTable, UsersTable)
+
+	referrers := make([]ProjectReferrer, 0)
+
+	err := r.db.SelectContext(ctx, &referrers, q, projectId)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.GetProjectReferrers")
+		return make([]ProjectReferrer, 0), err
+	}
+
+	return referrers, nil
+}
+
+func (r *PostgresRepo) GetProjectOwnerID(ctx context.Context, projectId int64) (*int64, error) {
+	q := fmt.Sprintf(`select owner_id from %s where id = $1`, ProjectsTable)
+
+	var ownerId *int64
+
+	err := r.db.GetContext(ctx, &ownerId, q, projectId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, common.ErrProjectNotFound
+		}
+		logger.Error(ctx, err.Error(), "where", "hero.postgres.GetProjectOwnerID")
+		return nil, err
+	}
+
+	return ownerId, nil
+}
+
+// CreateReferralPayout записывает выплату партнеру всей начисленной комиссии в проекте.
+// Начисления блокируются, поэтому параллельная выплата не заберет их второй раз
+func (r *PostgresRepo) CreateReferralPayout(ctx context.Context, projectId int64, referrerId int64, createdBy int64) (*ReferralPayout, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "CreateReferralPayout.BeginTx")
+		return nil, err
+	}
+
+	q1 := fmt.Sprintf(`
+		select id from %s
+		where referrer_id = $1 and project_id = $2 and status = '%s'
+		for update
+	`, ReferralCommissionsTable, ReferralCommissionAccrued)
+
+	var commissionIds []int64
+
+	err = tx.SelectContext(ctx, &commissionIds, q1, referrerId, projectId)
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Error(ctx, err.Error(), "where", "CreateReferralPayout.q1")
+		return nil, err
+	}
+
+	if len(commissionIds) == 0 {
+		_ = tx.Rollback()
+		return nil, common.ErrNothingToPayout
+	}
+
+	q2 := fmt.Sprintf(`
+		insert into %s (referrer_id, project_id, amount, created_by)
+		select $1, $2, sum(amount), $3 from %s where id = any($4::int[])
+		returning id, referrer_id, project_id, amount, created_at
+	`, ReferralPayoutsTable, ReferralCommissionsTable)
+
+	var payout ReferralPayout
+
+	err = tx.GetContext(ctx, &payout, q2, referrerId, projectId, createdBy, pq.Array(commissionIds))
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Error(ctx, err.Error(), "where", "CreateReferralPayout.q2")
+		return nil, err
+	}
+
+	q3 := fmt.Sprintf(`
+		update %s set status = '%s', payout_id = $2, updated_at = now()
+		where id = any($1::int[])
+	`, ReferralCommissionsTable, ReferralCommissionPaid)
+
+	_, err = tx.ExecContext(ctx, q3, pq.Array(commissionIds), payout.ID)
+	if err != nil {
+		_ = tx.Rollback()
+		logger.Error(ctx, err.Error(), "where", "CreateReferralPayout.q3")
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "CreateReferralPayout.Commit")
+		return nil, err
+	}
+
+	return &payout, nil
 }
 
 func (r *PostgresRepo) GetQuizComments(ctx context.Context, solvedQuizId int64) ([]QuizComment, error) {
@@ -9,13 +9,18 @@ import (
 	"createtodayapi/internal/logger"
 	"createtodayapi/internal/payments"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image/jpeg"
 	"math/big"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/disintegration/imaging"
@@ -26,11 +31,16 @@ import (
 
 // TODO: refactor to small interfaces
 type IService interface {
-	Signup(ctx context.Context, body *SignupBody) (*SignUpResult, error)
-	Login(ctx context.Context, body *LoginBody) (*LoginResult, error)
+	Signup(ctx context.Context, body *SignupBody, client SessionClient) (*SignUpResult, error)
+	Login(ctx context.Context, body *LoginBody, client SessionClient) (*LoginResult, error)
 	GetMagicLink(ctx context.Context, to string) error
-	ValidateMagicLink(ctx context.Context, token string) (*LoginResult, error)
+	ValidateMagicLink(ctx context.Context, token string, client SessionClient) (*LoginResult, error)
 	ValidateJWTToken(ctx context.Context, token string) (*User, error)
+	RefreshSession(ctx context.Context, refreshToken string, client SessionClient) (*LoginResult, error)
+	Logout(ctx context.Context, user *User) error
+	LogoutEverywhere(ctx context.Context, userId int) error
+	GetUserSessions(ctx context.Context, user *User) ([]UserSession, error)
+	RevokeSession(ctx context.Context, userId int, sessionId string) error
 
 	GetProfile(ctx context.Context, userId int) (*Profile, error)
 	UpdateProfile(ctx context.Context, userId int, profile UpdateProfileBody) error
@@ -43,6 +53,12 @@ type IService interface {
 
 	ChangeAvatar(ctx context.Context, userId int, avatarPath string, avatarFileName string) error
 	ChangePassword(ctx context.Context, userId int, password string) error
+	ForgotPassword(ctx context.Context, email string) error
+	ResendEmailVerification(ctx context.Context, userId int) error
+	ConfirmEmail(ctx context.Context, token string) error
+	RequestEmailChange(ctx context.Context, userId int, email string) error
+	ConfirmEmailChange(ctx context.Context, token string) error
+	ResetPassword(ctx context.Context, token string, password string) error
 
 	GetSolvedQuizzesForQuiz(ctx context.Context, lessonSlug string, skip int, limit int) ([]QuizSolvedInfo, error)
 	GetSolvedQuizzesForProduct(ctx context.Context, productSlug string, userId int, skip int, limit int) ([]QuizSolvedInfo, error)
@@ -54,9 +70,24 @@ type IService interface {
 	GetOfferForRegistration(ctx context.Context, offerSlug string) (*OfferForRegistration, error)
 	GetOfferForProcessing(ctx context.Context, offerSlug string) (*OfferForProcessing, error)
 	ProcessOffer(ctx context.Context, dto ProcessOfferDTO) (*ProcessOfferResult, error)
+	ValidatePromocode(ctx context.Context, dto ValidatePromocodeDTO) (*AppliedPromocode, error)
 
-	ProcessTinkoffWebhook(ctx context.Context, payload TinkoffWebhookBody) error
-	ProcessProdamusWebhook(ctx context.Context, payload ProdamusWebhookBody) error
+	ProcessWebhook(ctx context.Context, provider string, req payments.WebhookRequest) error
+	RefundOrder(ctx context.Context, userId int, dto RefundOrderDTO) (*RefundOrderResult, error)
+	GetOrders(ctx context.Context, userId int) ([]UserOrder, error)
+	GetOrder(ctx context.Context, userId int, orderId int64) (*UserOrder, error)
+	RetryOrderPayment(ctx context.Context, userId int, orderId int64) (*ProcessOfferResult, error)
+
+	GetSubscriptions(ctx context.Context, userId int) ([]Subscription, error)
+	CancelSubscription(ctx context.Context, userId int, subscriptionId int64) error
+
+	GetFakeCheckout(ctx context.Context, orderId int64) (*FakeCheckout, error)
+	CompleteFakeCheckout(ctx context.Context, orderId int64, status string) error
+
+	TrackReferralClick(ctx context.Context, offerSlug string, code string) error
+	GetReferralStats(ctx context.Context, userId int) (*ReferralStats, error)
+	GetProjectReferrers(ctx context.Context, userId int, projectId int64) ([]ProjectReferrer, error)
+	CreateReferralPayout(ctx context.Context, dto ReferralPayoutDTO) (*ReferralPayout, error)
 
 	GetQuizComments(ctx context.Context, solvedQuizId int64) ([]QuizComment, error)
 	CreateQuizComment(ctx context.Context, dto NewQuizComment) (*QuizComment, error)
@@ -67,6 +98,8 @@ type IService interface {
 type Claims struct {
 	jwt.RegisteredClaims
 	UserID int `json:"user_id"`
+	// SessionID — сессия, для которой выдан токен доступа. У ссылки для входа ее нет
+	SessionID string `json:"sid,omitempty"`
 }
 
 const (
@@ -74,6 +107,29 @@ const (
 	RelatedMediaTypeSolvedQuiz = "solved_quiz"
 )
 
+const (
+	OrderOutboxOrderCompletedEmail = "order_completed_email"
+	OrderOutboxEnrollmentEmail     = "enrollment_email"
+	OrderOutboxGiftEmail           = "gift_email"
+
+	orderOutboxBatchSize   = 50
+	orderOutboxMaxAttempts = 5
+
+	orderReconcileBatchSize = 50
+
+	paymentReminderBatchSize = 50
+
+	subscriptionRenewalBatchSize = 50
+
+	// offerSeatHoldTime — сколько неоплаченный заказ держит место в оффере с момента выдачи ссылки на оплату.
+	// Потом место снова продается, а повторная оплата заказа занимает его заново, если оно осталось
+	offerSeatHoldTime = 30 * time.Minute
+
+	// activeSessionCacheTime — сколько кэш помнит, что сессия не отозвана. Если отзыв не попал в кэш,
+	// токены сессии перестанут приниматься не позже чем через это время
+	activeSessionCacheTime = time.Minute
+)
+
 type Service struct {
 	repo   Storage
 	config *config.Config
@@ -163,7 +219,9 @@ func (s *Service) GetOfferForRegistration(ctx context.Context, offerSlug string)
 
 	err := s.cache.Get(ctx, offerCacheKey, offer)
 
+	// продажи открываются и закрываются по времени, поэтому считаются уже после кэша
 	if err == nil {
+		offer.SalesOpen = offerSalesOpen(time.Now(), offer.SalesStartAt, offer.SalesEndAt, offer.RemainingSeats)
 		return offer, nil
 	}
 
@@ -187,6 +245,8 @@ func (s *Service) GetOfferForRegistration(ctx context.Context, offerSlug string)
 		logger.Error(ctx, "could not set offer in cache", "err", err.Error(), "offerSlug", offerSlug)
 	}
 
+	offer.SalesOpen = offerSalesOpen(time.Now(), offer.SalesStartAt, offer.SalesEndAt, offer.RemainingSeats)
+
 	return offer, nil
 }
 
@@ -213,6 +273,11 @@ func (s *Service) ProcessOffer(ctx context.Context, dto ProcessOfferDTO) (*Proce
 
 	logger.Info(ctx, "got offer", "offer_id", offer.ID)
 
+	err = checkOfferSales(offer)
+	if err != nil {
+		return nil, err
+	}
+
 	payMethod, err := s.repo.GetPayMethod(ctx, dto.SelectedPayMethod, offer.ProjectID)
 	if err != nil {
 		logger.Error(ctx, err.Error())
@@ -223,6 +288,18 @@ func (s *Service) ProcessOffer(ctx context.Context, dto ProcessOfferDTO) (*Proce
 
 	offer.PayMethod = payMethod
 
+	if dto.IsGift {
+		err = s.validateGift(offer, dto)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bumps, err := s.getOrderBumps(ctx, offer, dto.Bumps)
+	if err != nil {
+		return nil, err
+	}
+
 	// Шаг 2. Зарегистрировать пользователя
 	userId, _, err := s.createUser(ctx, CreateUserDTO{
 		FirstName: dto.FirstName,
@@ -240,6 +317,8 @@ func (s *Service) ProcessOffer(ctx context.Context, dto ProcessOfferDTO) (*Proce
 
 	result := ProcessOfferResult{}
 
+	referrerId := s.getReferrer(ctx, dto.Ref, userId)
+
 	// Шаг 3. Обновить информацию о пользователе
 	err = s.repo.UpdateUserInfo(ctx, UpdateUserInfoDTO{
 		UserID:    userId,
@@ -269,18 +348,70 @@ func (s *Service) ProcessOffer(ctx context.Context, dto ProcessOfferDTO) (*Proce
 		return &result, nil
 	}
 
-	// Шаг 4. Если оффер платный, создать заказ и вернуть ссылку на оплату
+	// Шаг 4. Если оффер платный, посчитать цену: сумму пожертвования или цену с промокодом
+	price := offer.Price
+
+	if offer.IsDonate {
+		price, err = s.getDonatePrice(ctx, offer, dto.DonateAmount)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Шаг 5. Если оффер — подписка, подготовить ее. Создается она вместе с заказом,
+	// продлевается по полной цене, а промокод действует на первый платеж
+	var subscription *NewSubscription
+	if offer.Type == OfferTypeSubscription {
+		subscription, err = newSubscription(ctx, userId, offer, price)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var promocode *AppliedPromocode
+	if dto.Promocode != "" {
+		promocode, err = s.applyPromocode(ctx, offer, dto.Promocode, userId)
+		if err != nil {
+			return nil, err
+		}
+
+		price = promocode.FinalPrice
+
+		logger.Info(ctx, "applied promocode", "promocode_id", promocode.PromocodeID, "discount", promocode.Discount)
+	}
+
+	// дополнения добавляются к заказу отдельными позициями, промокод на них не действует
+	items := newOrderItems(offer, price, promocode, bumps)
+	price = orderItemsTotal(items)
+
+	// Шаг 6. Если это подарок, запомнить получателя: доступ после оплаты получит он
+	var gift *Gift
+	if dto.IsGift {
+		gift = newGift(dto)
+	}
+
+	// Шаг 7. Создать заказ и вернуть ссылку на оплату
 	payment, err := s.createPayment(ctx, CreatePaymentDTO{
 		PayMethod:        offer.PayMethod,
 		UserID:           dto.UserID,
 		Email:            dto.Email,
 		Phone:            dto.Phone,
-		OrderDescription: offer.Name,
+		OrderDescription: orderDescription(items),
 		OfferID:          offer.ID,
-		Price:            offer.Price,
+		Price:            price,
+		ReturnURL:        s.getPaymentReturnURL(offer),
+		Promocode:        promocode,
+		Subscription:     subscription,
+		Gift:             gift,
+		Items:            items,
+		ReferrerID:       referrerId,
 		// TODO: отправка письма о создании заказа может быть отключена
 	})
 
+	if errors.Is(err, common.ErrPromocodeLimitReached) || errors.Is(err, common.ErrOfferSoldOut) || errors.Is(err, common.ErrOfferSalesClosed) {
+		return nil, err
+	}
+
 	if err != nil {
 		logger.Log.Error(err.Error())
 		return nil, common.ErrInternalError
@@ -289,6 +420,7 @@ func (s *Service) ProcessOffer(ctx context.Context, dto ProcessOfferDTO) (*Proce
 	logger.Log.InfoContext(ctx, "created payment", "payment_id", payment.PaymentID, "order_id", payment.OrderID, "payment_url", payment.PaymentURL)
 
 	result.RedirectURL = payment.PaymentURL
+	result.PaymentWidget = payment.Widget
 
 	return &result, nil
 }
@@ -298,11 +430,42 @@ func (s *Service) createPayment(ctx context.Context, dto CreatePaymentDTO) (*pay
 		return nil, common.ErrInternalError
 	}
 
-	// создать заказ
-	orderId, err := s.createOrder(ctx, dto.UserID, dto.PayMethod.ID, dto.OfferID)
+	err := dto.PayMethod.ValidateReceipt()
 	if err != nil {
-		logger.Log.Error(err.Error())
-		return nil, common.ErrInternalError
+		logger.Error(ctx, "invalid receipt settings", "integration_id", dto.PayMethod.ID, "err", err.Error())
+		return nil, common.ErrInvalidReceiptSettings
+	}
+
+	// создать заказ, если это не повторная оплата
+	orderId := dto.OrderID
+	if orderId == 0 {
+		newOrder := NewOrder{
+			UserID:        dto.UserID,
+			OfferID:       dto.OfferID,
+			IntegrationID: dto.PayMethod.ID,
+			Price:         dto.Price,
+			Description:   dto.OrderDescription,
+			Items:         dto.Items,
+			ReferrerID:    dto.ReferrerID,
+		}
+
+		if dto.Promocode != nil {
+			newOrder.PromocodeID = &dto.Promocode.PromocodeID
+			newOrder.Discount = dto.Promocode.Discount
+		}
+
+		newOrder.SubscriptionID = dto.SubscriptionID
+		newOrder.Subscription = dto.Subscription
+
+		if dto.Gift != nil {
+			newOrder.IsGift = true
+			newOrder.GiftedTo = &dto.Gift.GiftedTo
+		}
+
+		orderId, err = s.createOrder(ctx, newOrder)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// создать ссылку на оплату
@@ -321,6 +484,11 @@ func (s *Service) createPayment(ctx context.Context, dto CreatePaymentDTO) (*pay
 		OrderId:         orderId,
 		SendReceipt:     dto.PayMethod.SendReceipt,
 		ReceiptSettings: dto.PayMethod.ReceiptSettings,
+		ReturnURL:       dto.ReturnURL,
+		// первый платеж подписки привязывает карту для следующих списаний
+		Recurrent:   dto.SubscriptionID != nil || dto.Subscription != nil,
+		CustomerKey: strconv.FormatInt(dto.UserID, 10),
+		Attempt:     dto.Attempt,
 	})
 
 	if err != nil {
@@ -330,316 +498,1908 @@ func (s *Service) createPayment(ctx context.Context, dto CreatePaymentDTO) (*pay
 
 	// Обновить paymentId в созданного заказа
 	// paymentId у платежных систем генерируется со ссылкой для оплаты
-	err = s.repo.UpdateOrderPaymentId(ctx, paymentResult.OrderID, paymentResult.PaymentID)
+	err = s.repo.UpdateOrderPaymentId(ctx, paymentResult.OrderID, paymentResult.PaymentID, paymentResult.PaymentURL)
 	if err != nil {
 		logger.Log.Error(err.Error())
 		return nil, common.ErrInternalError
 	}
 
-	// отправить письмо, что заказ создан
-	err = s.sendOrderCreatedEmail(ctx, dto.Email, dto.OrderDescription, dto.Price, paymentResult.PaymentURL)
-	if err != nil {
-		logger.Log.Error(err.Error())
+	// отправить письмо, что заказ создан. При повторной оплате ссылка нужна только сейчас
+	if dto.Attempt == 0 {
+		err = s.sendOrderCreatedEmail(ctx, dto.Email, dto.OrderDescription, dto.Price, paymentResult.PaymentURL)
+		if err != nil {
+			logger.Log.Error(err.Error())
+		}
 	}
 
 	return paymentResult, nil
 }
 
-func (s *Service) createOrder(ctx context.Context, userId int64, payMethodId int64, offerId int64) (int64, error) {
-	newOrder := NewOrder{
-		UserID:        userId,
-		OfferID:       offerId,
-		IntegrationID: payMethodId,
+// GetOrders — история покупок ученика
+func (s *Service) GetOrders(ctx context.Context, userId int) ([]UserOrder, error) {
+	orders, err := s.repo.GetUserOrders(ctx, int64(userId))
+	if err != nil {
+		return nil, common.ErrInternalError
 	}
 
-	orderId, err := s.repo.CreateOrder(ctx, newOrder)
-	if err != nil {
-		logger.Log.Error(err.Error())
-		return 0, common.ErrInternalError
+	for i := range orders {
+		prepareUserOrder(&orders[i])
 	}
 
-	return orderId, nil
+	return orders, nil
 }
 
-func (s *Service) enrollUser(ctx context.Context, userId int64, userEmail string, offer *OfferForProcessing) error {
-	groups, err := s.repo.GetOfferGroups(ctx, offer.ID)
-	if err != nil {
-		logger.Log.ErrorContext(ctx, err.Error())
-		return common.ErrInternalError
+func (s *Service) GetOrder(ctx context.Context, userId int, orderId int64) (*UserOrder, error) {
+	order, err := s.repo.GetUserOrder(ctx, int64(userId), orderId)
+	if errors.Is(err, common.ErrOrderNotFound) {
+		return nil, err
 	}
 
-	err = s.repo.AddUserToGroups(ctx, userId, groups)
 	if err != nil {
-		logger.Log.ErrorContext(ctx, err.Error())
-		return common.ErrInternalError
+		return nil, common.ErrInternalError
 	}
 
-	if offer.SendRegistrationEmail {
-		err = s.sendEnrollmentEmail(ctx, userEmail, *offer.RegistrationEmailTheme, *offer.RegistrationEmail)
-		if err != nil {
-			logger.Error(ctx, err.Error())
-		}
-	}
+	prepareUserOrder(order)
 
-	return nil
+	return order, nil
 }
 
-func (s *Service) GetProfile(ctx context.Context, userId int) (*Profile, error) {
-	profile, err := s.repo.GetProfileByUserId(ctx, userId)
+// prepareUserOrder скрывает номер карты и отмечает, можно ли оплатить заказ заново
+func prepareUserOrder(order *UserOrder) {
+	order.CardInfo = order.CardInfo.Masked()
+	order.CanRetry = order.Status == payments.StatusPending || order.Status == payments.StatusRejected
+}
+
+// RetryOrderPayment создает новую ссылку на оплату заказа, который еще ждет оплаты или был отклонен.
+// Заказ остается тем же, поэтому цена, промокод и подарок сохраняются
+func (s *Service) RetryOrderPayment(ctx context.Context, userId int, orderId int64) (*ProcessOfferResult, error) {
+	order, err := s.repo.FindOrderById(ctx, orderId)
+	if errors.Is(err, common.ErrOrderNotFound) {
+		return nil, err
+	}
 
 	if err != nil {
-		logger.Log.Error(err.Error(), "error", err)
 		return nil, common.ErrInternalError
 	}
 
-	return profile, nil
+	// чужой заказ не показываем, как будто его нет
+	if order.UserID != int64(userId) {
+		return nil, common.ErrOrderNotFound
+	}
+
+	payment, err := s.restartOrderPayment(ctx, order)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProcessOfferResult{
+		RedirectURL:   payment.PaymentURL,
+		PaymentWidget: payment.Widget,
+	}, nil
 }
 
-func (s *Service) ProcessTinkoffWebhook(ctx context.Context, payload TinkoffWebhookBody) error {
-	// Отформатировать статус
-	status := payments.FormatStatus(payload.Status)
+// restartOrderPayment создает новую ссылку на оплату существующего заказа
+func (s *Service) restartOrderPayment(ctx context.Context, order *OrderForProcessing) (*payments.GetPaymentLinkResult, error) {
+	if order.Status != payments.StatusPending && order.Status != payments.StatusRejected {
+		return nil, common.ErrOrderNotPayable
+	}
 
-	orderId, err := strconv.ParseInt(payload.OrderId, 10, 64)
+	payIntegration, err := s.repo.GetPayIntegrationById(ctx, order.IntegrationID)
 	if err != nil {
-		logger.Error(ctx, fmt.Sprintf("could not parse int64 from orderId %s", payload.OrderId), "err", err.Error())
-		return common.ErrInternalError
+		logger.Error(ctx, "could not get pay integration for order", "order_id", order.ID, "integration_id", order.IntegrationID, "err", err.Error())
+		return nil, common.ErrInternalError
 	}
 
-	// Получить заказ
-	order, err := s.repo.FindOrderById(ctx, orderId)
+	err = s.checkPaymentBeforeRetry(ctx, payIntegration, order)
 	if err != nil {
-		if !errors.Is(err, common.ErrOrderNotFound) {
-			logger.Error(ctx, fmt.Sprintf("could not get order by id %s", payload.OrderId), "err", err.Error())
-			return common.ErrInternalError
-		}
+		return nil, err
 	}
 
-	// Провалидировать данные
-	err = s.validateTinkoffWebhook(ctx, payload, order)
+	offer, err := s.GetOfferForProcessing(ctx, order.OfferSlug)
 	if err != nil {
-		return err
+		logger.Error(ctx, "could not find offer for processing", "order_id", order.ID, "offer_slug", order.OfferSlug, "err", err.Error())
+		return nil, common.ErrInternalError
 	}
 
-	logger.Info(ctx, "got valid order tinkoff webhook", "orderId", orderId, "status", status)
-
-	// Обновить заказ
-	cardInfo := OrderCardInfo{
-		ExpirationDate: payload.ExpDate,
-		Pan:            payload.Pan,
+	attempt, err := s.repo.RestartOrderPayment(ctx, order.ID)
+	if errors.Is(err, common.ErrOrderNotPayable) || errors.Is(err, common.ErrOfferSoldOut) || errors.Is(err, common.ErrOfferSalesClosed) ||
+		errors.Is(err, common.ErrPromocodeLimitReached) {
+		return nil, err
 	}
 
-	orderError := OrderError{
-		Message:    payload.Message,
-		Details:    payload.Details,
-		StatusCode: payload.ErrorCode,
+	if err != nil {
+		return nil, common.ErrInternalError
 	}
 
-	if payload.ErrorCode == "" {
-		orderError.StatusCode = "0"
+	payment, err := s.createPayment(ctx, CreatePaymentDTO{
+		OrderID:          order.ID,
+		Attempt:          attempt,
+		PayMethod:        payIntegration,
+		UserID:           order.UserID,
+		Email:            order.UserEmail,
+		OrderDescription: order.OfferName,
+		OfferID:          order.OfferID,
+		Price:            order.Price,
+		ReturnURL:        s.getPaymentReturnURL(offer),
+		SubscriptionID:   order.SubscriptionID,
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	err = s.repo.UpdateOrderStatus(ctx, order.ID, status, orderError, cardInfo)
+	logger.Info(ctx, "created payment retry", "order_id", order.ID, "attempt", attempt, "payment_id", payment.PaymentID)
+
+	return payment, nil
+}
+
+// SendPaymentReminders напоминает об оплате заказов, которые так и не оплатили,
+// и отправляет в письме новую ссылку на оплату
+func (s *Service) SendPaymentReminders(ctx context.Context) error {
+	orderIds, err := s.repo.TakeOrdersForReminder(ctx, s.config.PaymentReminderMaxCount, paymentReminderBatchSize)
 	if err != nil {
-		return common.ErrInternalError
+		return err
 	}
 
-	if status == payments.StatusSucceeded {
-		err = s.processSucceededOrder(ctx, order)
-		return err
+	for _, orderId := range orderIds {
+		err = s.sendPaymentReminder(ctx, orderId)
+		if err != nil {
+			logger.Error(ctx, "could not send payment reminder", "order_id", orderId, "err", err.Error())
+		}
 	}
 
 	return nil
 }
 
-func (s *Service) ProcessProdamusWebhook(ctx context.Context, payload ProdamusWebhookBody) error {
-	// Отформатировать статус
-	status := payments.FormatStatus(payload.PaymentStatus)
-
-	orderId, err := strconv.ParseInt(payload.OrderNum, 10, 64)
+func (s *Service) sendPaymentReminder(ctx context.Context, orderId int64) error {
+	order, err := s.repo.FindOrderById(ctx, orderId)
 	if err != nil {
-		logger.Error(ctx, fmt.Sprintf("could not parse int64 from orderId %s", payload.OrderId), "err", err.Error())
-		return common.ErrInternalError
+		return err
+	}
+
+	// заказ могли оплатить, пока он ждал напоминания, тогда новая ссылка не создастся
+	paymentURL, err := s.getReminderPaymentURL(ctx, order)
+	if errors.Is(err, common.ErrOrderNotPayable) || errors.Is(err, common.ErrOfferSoldOut) || errors.Is(err, common.ErrOfferSalesClosed) ||
+		errors.Is(err, common.ErrPromocodeLimitReached) {
+		logger.Info(ctx, "order is not payable anymore, skip reminder", "order_id", order.ID, "err", err.Error())
+		return nil
 	}
 
-	// Получить заказ
-	order, err := s.repo.FindOrderById(ctx, orderId)
 	if err != nil {
-		if !errors.Is(err, common.ErrOrderNotFound) {
-			logger.Error(ctx, fmt.Sprintf("could not get order by id %d", orderId), "err", err.Error())
-			return common.ErrInternalError
-		}
+		return err
 	}
 
-	// Провалидировать данные
-	err = s.validateProdamusWebhook(ctx, payload, order)
+	if paymentURL == "" {
+		return fmt.Errorf("payment system returned empty payment url for order %d", order.ID)
+	}
+
+	err = s.sendPaymentReminderEmail(ctx, order.UserEmail, order.OfferName, order.Price, paymentURL)
 	if err != nil {
 		return err
 	}
 
-	logger.Info(ctx, "got valid order prodamus webhook", "orderId", orderId, "status", status)
+	logger.Info(ctx, "sent payment reminder", "order_id", order.ID)
 
-	// Обновить заказ
-	cardInfo := OrderCardInfo{}
+	return nil
+}
 
-	orderError := OrderError{
-		Message:    payload.PaymentStatusDescription,
-		StatusCode: "0",
-	}
+// getReminderPaymentURL — ссылка для напоминания. Пока прошлая ссылка жива, покупатель получает ее же,
+// иначе по ссылке из прошлого письма уже нельзя было бы заплатить. Новая создается, если платеж отклонили или ссылка истекла
+func (s *Service) getReminderPaymentURL(ctx context.Context, order *OrderForProcessing) (string, error) {
+	if order.Status == payments.StatusPending && order.PaymentID != "" {
+		payment, err := s.repo.FindOrderPayment(ctx, order.ID, order.PaymentID)
+		if err != nil {
+			return "", common.ErrInternalError
+		}
 
-	if status != payments.StatusSucceeded {
-		orderError.StatusCode = "1"
+		if payment != nil && payment.PaymentURL != nil && time.Since(payment.CreatedAt) < s.config.PaymentLinkExp {
+			return *payment.PaymentURL, nil
+		}
 	}
 
-	err = s.repo.UpdateOrderStatus(ctx, order.ID, status, orderError, cardInfo)
+	payment, err := s.restartOrderPayment(ctx, order)
 	if err != nil {
-		return common.ErrInternalError
-	}
-
-	if status == payments.StatusSucceeded {
-		err = s.processSucceededOrder(ctx, order)
-		return err
+		return "", err
 	}
 
-	return nil
+	return payment.PaymentURL, nil
 }
 
-func (s *Service) processSucceededOrder(ctx context.Context, order *OrderForProcessing) error {
+// checkPaymentBeforeRetry спрашивает платежную систему о прошлом платеже заказа.
+// Если его уже оплатили, новая ссылка заменила бы payment_id, и уведомление о прошлой оплате не прошло бы проверку
+func (s *Service) checkPaymentBeforeRetry(ctx context.Context, payIntegration *PayIntegration, order *OrderForProcessing) error {
+	paymentSystem := payments.NewPaymentSystem(payIntegration.Type)
+	checker, ok := paymentSystem.(payments.StatusChecker)
+	if !ok || order.PaymentID == "" {
+		return nil
+	}
 
-	// Выдать пользователю оффер
-	offer, err := s.GetOfferForProcessing(ctx, order.OfferSlug)
+	event, err := checker.GetPaymentState(ctx, payments.PaymentStatePayload{
+		Login:     payIntegration.Login,
+		Password:  payIntegration.Password,
+		PaymentID: order.PaymentID,
+		OrderId:   order.ID,
+	})
 	if err != nil {
-		logger.Error(ctx, "could not find offer for processing", "order_id", order.ID, "offer_slug", order.OfferSlug, "err", err.Error())
+		logger.Error(ctx, "could not get payment state", "provider", payIntegration.Type, "order_id", order.ID, "err", err.Error())
 		return common.ErrInternalError
 	}
 
-	err = s.sendOrderCompletedEmail(ctx, order.UserEmail, offer.Name, offer.Price)
-	if err != nil {
-		logger.Error(ctx, "could not send order completed email", "order", order.ID, "err", err.Error())
+	if event.OrderID != order.ID {
+		logger.Error(ctx, "payment state order id not equal with order", "order_id", order.ID, "state_order_id", event.OrderID)
 		return common.ErrInternalError
 	}
 
-	err = s.enrollUser(ctx, order.UserID, order.UserEmail, offer)
+	status, err := paymentSystem.FormatStatus(event.RawStatus)
 	if err != nil {
-		logger.Error(ctx, "could not enroll user", "order", order.ID, "err", err.Error())
+		logger.Error(ctx, err.Error(), "order_id", order.ID)
 		return common.ErrInternalError
 	}
 
+	if status == payments.StatusPending || status == order.Status {
+		return nil
+	}
+
+	err = s.applyPaymentEvent(ctx, paymentSystem, payIntegration.Type, event, order)
+	if err != nil {
+		return err
+	}
+
+	if status != payments.StatusRejected {
+		return common.ErrOrderNotPayable
+	}
+
 	return nil
 }
 
-func (s *Service) validateProdamusWebhook(ctx context.Context, payload ProdamusWebhookBody, order *OrderForProcessing) error {
-	if order.PaymentID != payload.OrderId {
-		logger.Error(ctx, "order payment id not equal with webhook payment id", "order_payment_id", order.PaymentID, "webhook_payment_id", payload.OrderId)
-		return common.ErrInternalError
+// getPaymentReturnURL — после оплаты возвращаем покупателя туда же,
+// куда отправляем после бесплатного оффера, а если такого нет — в личный кабинет
+func (s *Service) getPaymentReturnURL(offer *OfferForProcessing) string {
+	if offer.RedirectURL != nil && *offer.RedirectURL != "" {
+		return *offer.RedirectURL
 	}
 
-	return nil
+	return s.config.HeroAppBaseURL
 }
 
-func (s *Service) validateTinkoffWebhook(ctx context.Context, payload TinkoffWebhookBody, order *OrderForProcessing) error {
-	if order.PaymentID != strconv.Itoa(int(payload.PaymentId)) {
-		logger.Error(ctx, "order payment id not equal with webhook payment id", "order_payment_id", order.PaymentID, "webhook_payment_id", payload.PaymentId)
-		return common.ErrInternalError
+// checkOfferSales — быстрая проверка окна продаж и мест до регистрации пользователя.
+// Окончательно места проверяются при создании заказа
+func checkOfferSales(offer *OfferForProcessing) error {
+	if offerSalesOpen(time.Now(), offer.SalesStartAt, offer.SalesEndAt, offer.RemainingSeats) {
+		return nil
 	}
 
-	if order.Price != payload.Amount {
-		logger.Error(ctx, "order price not equal with webhook amount", "order_price", order.Price, "webhook_amount", payload.Amount, "order_id", order.ID)
-		return common.ErrInternalError
+	if offer.RemainingSeats != nil && *offer.RemainingSeats <= 0 {
+		return common.ErrOfferSoldOut
 	}
 
-	return nil
+	return common.ErrOfferSalesClosed
 }
 
-func (s *Service) UpdateProfile(ctx context.Context, userId int, profile UpdateProfileBody) error {
-	err := s.repo.UpdateProfile(ctx, userId, profile)
+// getOrderBumps находит дополнения, которые покупатель выбрал к офферу.
+// Бесплатный оффер выдается без заказа, а подписка продлевается без дополнений, поэтому к ним ничего не добавить
+func (s *Service) getOrderBumps(ctx context.Context, offer *OfferForProcessing, slugs []string) ([]OfferBump, error) {
+	if len(slugs) == 0 {
+		return nil, nil
+	}
+
+	if offer.IsFree || offer.Type == OfferTypeSubscription {
+		return nil, common.ErrBumpsNotAllowed
+	}
 
+	available, err := s.repo.GetOfferBumps(ctx, offer.ID)
 	if err != nil {
-		logger.Log.Error(err.Error(), "error", err)
-		return common.ErrInternalError
+		logger.Error(ctx, "could not get offer bumps", "offer_id", offer.ID, "err", err.Error())
+		return nil, common.ErrInternalError
 	}
 
-	return nil
+	return selectOfferBumps(offer, available, slugs)
 }
 
-func (s *Service) ChangeAvatar(ctx context.Context, userId int, avatarPathToDir string, avatarFileName string) error {
-	defer func() {
-		err := RemoveLocalFile(avatarPathToDir + "/" + avatarFileName)
-		if err != nil {
-			logger.Log.Error(err.Error(), "error", err)
+// selectOfferBumps оставляет выбранные дополнения в порядке оффера.
+// Каждое дополнение — это место в своем оффере и запись на него, поэтому повтор и сам оффер в дополнениях — ошибка
+func selectOfferBumps(offer *OfferForProcessing, available []OfferBump, slugs []string) ([]OfferBump, error) {
+	selected := make(map[string]bool, len(slugs))
+	for _, slug := range slugs {
+		if slug == offer.Slug {
+			return nil, common.ErrBumpIsOffer
 		}
-	}()
-
-	src, err := imaging.Open(avatarPathToDir + "/" + avatarFileName)
 
-	if err != nil {
-		logger.Log.Error(err.Error(), "error", err)
-		return common.ErrInternalError
+		if selected[slug] {
+			return nil, common.ErrDuplicateBump
+		}
+		selected[slug] = true
 	}
 
-	fileName := fmt.Sprintf("avatar_for_user_%d", userId)
-	newAvatarFileName := MakeFileHashName(fileName, "jpeg")
+	bumps := make([]OfferBump, 0, len(selected))
+	offerIds := map[int64]bool{offer.ID: true}
+	for _, bump := range available {
+		if !selected[bump.Slug] {
+			continue
+		}
 
-	buff := new(bytes.Buffer)
+		if bump.OfferID == offer.ID {
+			return nil, common.ErrBumpIsOffer
+		}
 
-	size := src.Bounds().Size()
+		if offerIds[bump.OfferID] {
+			return nil, common.ErrDuplicateBump
+		}
+		offerIds[bump.OfferID] = true
 
-	if size.X > 300 {
-		src = imaging.Resize(src, 300, 0, imaging.Lanczos)
+		bumps = append(bumps, bump)
+		delete(selected, bump.Slug)
 	}
 
-	err = jpeg.Encode(buff, src, nil)
-	if err != nil {
-		logger.Log.Error(err.Error())
-		return common.ErrInternalError
+	if len(selected) > 0 {
+		return nil, common.ErrBumpNotFound
 	}
 
-	fileUrl, err := UploadFileToS3(s.config.PhotosBucket, newAvatarFileName, bytes.NewReader(buff.Bytes()), s.config)
-	if err != nil {
-		logger.Log.Error(err.Error(), "error", err)
-		return common.ErrInternalError
+	return bumps, nil
+}
+
+// newOrderItems — позиции заказа: оффер по цене с учетом скидки и выбранные дополнения
+func newOrderItems(offer *OfferForProcessing, price uint64, promocode *AppliedPromocode, bumps []OfferBump) []NewOrderItem {
+	item := NewOrderItem{
+		OfferID: offer.ID,
+		Name:    offer.Name,
+		Price:   price,
 	}
 
-	err = s.repo.UpdateAvatar(ctx, userId, fileUrl)
-	if err != nil {
-		logger.Log.Error(err.Error(), "error", err)
-		return common.ErrInternalError
+	if promocode != nil {
+		item.Discount = promocode.Discount
 	}
 
-	return nil
-}
+	items := []NewOrderItem{item}
 
-func (s *Service) ChangePassword(ctx context.Context, userId int, password string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
-	if err != nil {
-		logger.Log.Error(err.Error())
-		return common.ErrInternalError
+	for _, bump := range bumps {
+		items = append(items, NewOrderItem{
+			OfferID: bump.OfferID,
+			Name:    bump.Name,
+			Price:   bump.Price,
+			IsBump:  true,
+		})
 	}
 
-	err = s.repo.UpdatePassword(ctx, userId, string(hashedPassword))
-	if err != nil {
-		logger.Log.Error(err.Error())
-		return common.ErrInternalError
+	return items
+}
+
+func orderItemsTotal(items []NewOrderItem) uint64 {
+	var total uint64
+	for _, item := range items {
+		total += item.Price
 	}
 
-	return nil
+	return total
 }
 
-func (s *Service) GetUserAccessibleProducts(ctx context.Context, userId int) ([]ProductCard, error) {
-	products, err := s.repo.GetUserAccessibleProducts(ctx, userId)
-
-	if err != nil {
-		logger.Log.Error(err.Error(), "error", err)
-		return nil, common.ErrInternalError
+// orderDescription — что купили: название оффера и дополнений через плюс
+func orderDescription(items []NewOrderItem) string {
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		names = append(names, item.Name)
 	}
 
-	return products, nil
+	return strings.Join(names, " + ")
 }
 
-func (s *Service) GetUserAccessibleProduct(ctx context.Context, courseSlug string, userId int) (*ProductInfo, error) {
-	product, err := s.repo.GetUserAccessibleProduct(ctx, courseSlug, userId)
+// validateGift проверяет, что оффер можно подарить. Бесплатный оффер получатель возьмет сам,
+// а подписку пришлось бы продлевать с карты покупателя
+func (s *Service) validateGift(offer *OfferForProcessing, dto ProcessOfferDTO) error {
+	if offer.IsFree || offer.Type == OfferTypeSubscription {
+		return common.ErrGiftNotAllowed
+	}
 
-	if errors.Is(err, common.ErrProductNotFound) {
-		return nil, common.ErrProductNotFound
+	if dto.GiftRecipient == nil || strings.TrimSpace(dto.GiftRecipient.Email) == "" {
+		return common.ErrEmptyGiftRecipient
+	}
+
+	if strings.EqualFold(strings.TrimSpace(dto.GiftRecipient.Email), strings.TrimSpace(dto.Email)) {
+		return common.ErrGiftToYourself
+	}
+
+	return nil
+}
+
+// newGift — получатель подарка из формы заказа. Аккаунт ему создается только после оплаты,
+// а пароль он задает сам по ссылке из письма о подарке
+func newGift(dto ProcessOfferDTO) *Gift {
+	return &Gift{
+		GiftedTo: GiftedTo{
+			Email:     strings.TrimSpace(dto.GiftRecipient.Email),
+			FirstName: dto.GiftRecipient.FirstName,
+			FromName:  dto.FirstName,
+		},
+	}
+}
+
+func (s *Service) createOrder(ctx context.Context, newOrder NewOrder) (int64, error) {
+	orderId, err := s.repo.CreateOrder(ctx, newOrder)
+	if errors.Is(err, common.ErrPromocodeLimitReached) {
+		logger.Info(ctx, "promocode limit reached", "promocode_id", *newOrder.PromocodeID, "user_id", newOrder.UserID)
+		return 0, err
+	}
+
+	if errors.Is(err, common.ErrOfferSoldOut) || errors.Is(err, common.ErrOfferSalesClosed) {
+		logger.Info(ctx, "offer is not on sale", "offer_id", newOrder.OfferID, "user_id", newOrder.UserID, "err", err.Error())
+		return 0, err
+	}
+
+	if err != nil {
+		logger.Log.Error(err.Error())
+		return 0, common.ErrInternalError
+	}
+
+	return orderId, nil
+}
+
+// getDonatePrice проверяет сумму пожертвования: не меньше min_donate_price оффера
+// и не больше max_donate_price из настроек, если он задан
+func (s *Service) getDonatePrice(ctx context.Context, offer *OfferForProcessing, amount uint64) (uint64, error) {
+	var settings OfferDonateSettings
+	if offer.Settings != nil {
+		err := json.Unmarshal(*offer.Settings, &settings)
+		if err != nil {
+			logger.Error(ctx, "could not parse offer donate settings", "offer_id", offer.ID, "err", err.Error())
+			return 0, common.ErrInternalError
+		}
+	}
+
+	minPrice := uint64(1)
+	if offer.MinDonatePrice > 0 {
+		minPrice = uint64(offer.MinDonatePrice)
+	}
+
+	if amount < minPrice || (settings.MaxDonatePrice > 0 && amount > settings.MaxDonatePrice) {
+		logger.Info(ctx, "invalid donate amount", "offer_id", offer.ID, "amount", amount, "min", minPrice, "max", settings.MaxDonatePrice)
+		return 0, common.ErrInvalidDonateAmount
+	}
+
+	return amount, nil
+}
+
+// ValidatePromocode проверяет промокод на странице оффера до оформления заказа.
+// Если покупатель уже указал email, учитываются и его использования промокода
+func (s *Service) ValidatePromocode(ctx context.Context, dto ValidatePromocodeDTO) (*AppliedPromocode, error) {
+	offer, err := s.GetOfferForProcessing(ctx, dto.Slug)
+	if err != nil {
+		return nil, err
+	}
+
+	// проверка открытая, поэтому лимит на пользователя здесь не проверяется: по ответу можно было бы узнать,
+	// какие email покупали оффер. Он проверяется при создании заказа
+	return s.applyPromocode(ctx, offer, dto.Code, 0)
+}
+
+// applyPromocode проверяет, что промокод действует для оффера и пользователя, и считает цену со скидкой.
+// Лимиты здесь проверяются предварительно, окончательно — при создании заказа
+func (s *Service) applyPromocode(ctx context.Context, offer *OfferForProcessing, code string, userId int64) (*AppliedPromocode, error) {
+	// сумму пожертвования покупатель выбирает сам, скидка к ней не нужна
+	if !offer.CanUsePromocode || offer.IsFree || offer.IsDonate {
+		return nil, common.ErrPromocodeNotApplicable
+	}
+
+	promocode, err := s.repo.FindPromocode(ctx, offer.ProjectID, strings.TrimSpace(code), userId)
+	if errors.Is(err, common.ErrPromocodeNotFound) {
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, common.ErrInternalError
+	}
+
+	if promocode.OfferID != nil && *promocode.OfferID != offer.ID {
+		return nil, common.ErrPromocodeNotApplicable
+	}
+
+	now := time.Now()
+	if !promocode.IsActive ||
+		(promocode.StartsAt != nil && now.Before(*promocode.StartsAt)) ||
+		(promocode.EndsAt != nil && now.After(*promocode.EndsAt)) {
+		return nil, common.ErrPromocodeInactive
+	}
+
+	if promocode.MaxUses != nil && promocode.Uses >= *promocode.MaxUses {
+		return nil, common.ErrPromocodeLimitReached
+	}
+
+	if userId != 0 && promocode.MaxUsesPerUser != nil && promocode.UserUses >= *promocode.MaxUsesPerUser {
+		return nil, common.ErrPromocodeLimitReached
+	}
+
+	// Заказ нельзя оплатить на 0 рублей, поэтому скидка должна быть меньше цены
+	discount := promocode.Discount(offer.Price)
+	if discount >= offer.Price {
+		return nil, common.ErrPromocodeNotApplicable
+	}
+
+	return &AppliedPromocode{
+		PromocodeID: promocode.ID,
+		Code:        promocode.Code,
+		Price:       offer.Price,
+		Discount:    discount,
+		FinalPrice:  offer.Price - discount,
+	}, nil
+}
+
+func (s *Service) enrollUser(ctx context.Context, userId int64, userEmail string, offer *OfferForProcessing) error {
+	groups, err := s.repo.GetOfferGroups(ctx, offer.ID)
+	if err != nil {
+		logger.Log.ErrorContext(ctx, err.Error())
+		return common.ErrInternalError
+	}
+
+	err = s.repo.AddUserToGroups(ctx, userId, groups)
+	if err != nil {
+		logger.Log.ErrorContext(ctx, err.Error())
+		return common.ErrInternalError
+	}
+
+	if offer.SendRegistrationEmail && offer.RegistrationEmailTheme != nil && offer.RegistrationEmail != nil {
+		err = s.sendEnrollmentEmail(ctx, userEmail, *offer.RegistrationEmailTheme, *offer.RegistrationEmail)
+		if err != nil {
+			logger.Error(ctx, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) GetProfile(ctx context.Context, userId int) (*Profile, error) {
+	profile, err := s.repo.GetProfileByUserId(ctx, userId)
+
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+		return nil, common.ErrInternalError
+	}
+
+	return profile, nil
+}
+
+func (s *Service) ProcessWebhook(ctx context.Context, provider string, req payments.WebhookRequest) error {
+	paymentSystem := payments.NewPaymentSystem(provider)
+	if paymentSystem == nil {
+		logger.Error(ctx, "got webhook for unknown payment system", "provider", provider)
+		return common.ErrPaymentSystemNotFound
+	}
+
+	// Разобрать уведомление
+	event, err := paymentSystem.ParseWebhook(ctx, req)
+	if errors.Is(err, common.ErrWebhookEventIgnored) {
+		logger.Info(ctx, "skip webhook", "provider", provider, "err", err.Error())
+		return nil
+	}
+
+	if err != nil {
+		logger.Error(ctx, "could not parse webhook", "provider", provider, "err", err.Error())
+		return common.ErrInvalidWebhookBody
+	}
+
+	// Получить заказ
+	order, err := s.repo.FindOrderById(ctx, event.OrderID)
+	if err != nil {
+		if errors.Is(err, common.ErrOrderNotFound) {
+			logger.Error(ctx, "got webhook for unknown order", "provider", provider, "orderId", event.OrderID)
+			return common.ErrOrderNotFound
+		}
+		logger.Error(ctx, fmt.Sprintf("could not get order by id %d", event.OrderID), "err", err.Error())
+		return common.ErrInternalError
+	}
+
+	// Провалидировать данные
+	err = s.validateWebhook(ctx, paymentSystem, provider, req, event, order)
+	if err != nil {
+		return err
+	}
+
+	return s.applyPaymentEvent(ctx, paymentSystem, provider, event, order)
+}
+
+// applyPaymentEvent переводит заказ в статус из уведомления или из ответа платежной системы.
+// Состояние, запрошенное сверкой, проходит те же проверки, что и уведомление
+func (s *Service) applyPaymentEvent(ctx context.Context, paymentSystem payments.PaymentSystem, provider string, event *payments.WebhookEvent, order *OrderForProcessing) error {
+	// Уведомление по одной из прошлых ссылок. Отказ по ней не трогает заказ — его могут оплатить по новой ссылке,
+	// а оплата делает этот платеж текущим, чтобы возврат шел по нему. Текущим он станет
+	// только вместе со сменой статуса, когда сумма и переход уже проверены
+	var previousPaymentID string
+	if event.PaymentID != "" && order.PaymentID != "" && event.PaymentID != order.PaymentID {
+		status, err := paymentSystem.FormatStatus(event.RawStatus)
+		if err != nil || status != payments.StatusSucceeded {
+			logger.Info(ctx, "skip status of previous order payment", "provider", provider, "orderId", order.ID, "paymentId", event.PaymentID, "rawStatus", event.RawStatus)
+			return nil
+		}
+
+		previousPaymentID = event.PaymentID
+	}
+
+	// Первый платеж подписки присылает токен карты, по нему списываются следующие
+	if event.RebillID != "" && order.SubscriptionID != nil {
+		err := s.repo.UpdateSubscriptionRebillId(ctx, *order.SubscriptionID, event.RebillID)
+		if err != nil {
+			return common.ErrInternalError
+		}
+	}
+
+	status, err := paymentSystem.FormatStatus(event.RawStatus)
+	if err != nil {
+		var unknownStatus *payments.UnknownStatusError
+		if errors.As(err, &unknownStatus) {
+			logger.Error(ctx, "got unknown payment status", "provider", provider, "orderId", order.ID, "rawStatus", event.RawStatus)
+
+			// статус заказа не меняется, но непонятный статус платежной системы нужен, чтобы разобраться с заказом
+			err = s.repo.UpdateOrderProviderStatus(ctx, order.ID, event.RawStatus)
+			if err != nil {
+				return common.ErrInternalError
+			}
+
+			return fmt.Errorf("%w: %w", common.ErrUnknownPaymentStatus, unknownStatus)
+		}
+		logger.Error(ctx, "could not format payment status", "provider", provider, "orderId", order.ID, "err", err.Error())
+		return common.ErrInternalError
+	}
+
+	// юкасса не меняет статус платежа после возврата, о возврате говорит только возвращенная сумма
+	if status == payments.StatusSucceeded && event.RefundedAmount > 0 {
+		status = payments.StatusPartiallyRefunded
+		if event.RefundedAmount >= order.Price*100 {
+			status = payments.StatusRefunded
+		}
+	}
+
+	// цена заказа хранится в рублях, платежные системы присылают сумму в копейках.
+	// В уведомлениях о возврате сумма возврата, а не заказа — их не сверяем.
+	// Оплата без суммы не засчитывается: ее нечем сверить с ценой заказа
+	isRefund := status == payments.StatusRefunded || status == payments.StatusPartiallyRefunded
+	if status == payments.StatusSucceeded && event.Amount == 0 {
+		logger.Error(ctx, "webhook has no amount for paid order", "order_id", order.ID, "provider", provider)
+		return common.ErrInternalError
+	}
+
+	if !isRefund && event.Amount != 0 && order.Price*100 != event.Amount {
+		logger.Error(ctx, "order price not equal with webhook amount", "order_price", order.Price, "webhook_amount", event.Amount, "order_id", order.ID)
+		return common.ErrInternalError
+	}
+
+	logger.Info(ctx, "got valid order payment status", "provider", provider, "orderId", order.ID, "status", status, "rawStatus", event.RawStatus)
+
+	// Обновить заказ
+	return s.changeOrderStatus(ctx, order, ChangeOrderStatusDTO{
+		Status:         status,
+		ProviderStatus: event.RawStatus,
+		Error: OrderError{
+			StatusCode: event.Error.StatusCode,
+			Message:    event.Error.Message,
+			Details:    event.Error.Details,
+		},
+		CardInfo: OrderCardInfo{
+			ExpirationDate: event.CardInfo.ExpirationDate,
+			Pan:            event.CardInfo.Pan,
+		},
+		// возвращенная сумма хранится в рублях, как и цена
+		RefundedAmount: event.RefundedAmount / 100,
+		PaymentID:      previousPaymentID,
+	})
+}
+
+// ReconcilePendingOrders сверяет с платежными системами заказы, которые долго ждут оплаты.
+// Если уведомление потерялось, статус берется из платежной системы,
+// а заказы, не оплаченные до крайнего срока, истекают
+func (s *Service) ReconcilePendingOrders(ctx context.Context) error {
+	orderIds, err := s.repo.TakePendingOrdersForReconcile(ctx, time.Now().Add(-s.config.OrderReconcileAfter), orderReconcileBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, orderId := range orderIds {
+		err = s.reconcileOrder(ctx, orderId)
+		if err != nil {
+			logger.Error(ctx, "could not reconcile order", "order_id", orderId, "err", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) reconcileOrder(ctx context.Context, orderId int64) error {
+	order, err := s.repo.FindOrderById(ctx, orderId)
+	if err != nil {
+		return err
+	}
+
+	expired := order.CreatedAt.Before(time.Now().Add(-s.config.OrderExpireAfter))
+
+	payIntegration, err := s.repo.GetPayIntegrationById(ctx, order.IntegrationID)
+	if err != nil {
+		return err
+	}
+
+	paymentSystem := payments.NewPaymentSystem(payIntegration.Type)
+
+	// Без идентификатора платежа оплатить заказ нельзя: ссылку на оплату так и не получили
+	if order.PaymentID == "" {
+		if !expired {
+			return nil
+		}
+
+		logger.Info(ctx, "order payment deadline passed without payment link", "order_id", order.ID, "created_at", order.CreatedAt)
+
+		return s.changeOrderStatus(ctx, order, ChangeOrderStatusDTO{
+			Status: payments.StatusExpired,
+			Error:  OrderError{StatusCode: "0"},
+		})
+	}
+
+	// Истекает только заказ, про который платежная система подтвердила, что он не оплачен.
+	// Если спросить не у кого или ответ непонятен, заказ ждет уведомления — иначе поздняя оплата потеряется
+	checker, ok := paymentSystem.(payments.StatusChecker)
+	if !ok {
+		return nil
+	}
+
+	event, err := checker.GetPaymentState(ctx, payments.PaymentStatePayload{
+		Login:     payIntegration.Login,
+		Password:  payIntegration.Password,
+		PaymentID: order.PaymentID,
+		OrderId:   order.ID,
+	})
+	if err != nil {
+		logger.Error(ctx, "could not get payment state", "provider", payIntegration.Type, "order_id", order.ID, "err", err.Error())
+		return nil
+	}
+
+	if event.OrderID != order.ID {
+		logger.Error(ctx, "payment state order id not equal with order", "order_id", order.ID, "state_order_id", event.OrderID)
+		return common.ErrInternalError
+	}
+
+	status, err := paymentSystem.FormatStatus(event.RawStatus)
+	if err != nil {
+		logger.Error(ctx, "got unknown payment state", "provider", payIntegration.Type, "order_id", order.ID, "rawStatus", event.RawStatus)
+		return nil
+	}
+
+	if status != payments.StatusPending {
+		return s.applyPaymentEvent(ctx, paymentSystem, payIntegration.Type, event, order)
+	}
+
+	logger.Info(ctx, "order still waits for payment", "order_id", order.ID, "rawStatus", event.RawStatus)
+
+	if !expired {
+		return nil
+	}
+
+	logger.Info(ctx, "order payment deadline passed", "order_id", order.ID, "created_at", order.CreatedAt)
+
+	return s.changeOrderStatus(ctx, order, ChangeOrderStatusDTO{
+		Status: payments.StatusExpired,
+		Error:  OrderError{StatusCode: "0"},
+	})
+}
+
+// newSubscription готовит подписку в ожидании первого платежа.
+// Подписку можно оформить, только если платежная система умеет списывать платежи с привязанной карты
+func newSubscription(ctx context.Context, userId int64, offer *OfferForProcessing, price uint64) (*NewSubscription, error) {
+	if offer.SubscriptionPeriod == nil {
+		logger.Error(ctx, "subscription offer has no period", "offer_id", offer.ID)
+		return nil, common.ErrInternalError
+	}
+
+	if _, ok := payments.NewPaymentSystem(offer.PayMethod.Type).(payments.RecurrentCharger); !ok {
+		return nil, common.ErrSubscriptionNotSupported
+	}
+
+	return &NewSubscription{
+		UserID:        userId,
+		OfferID:       offer.ID,
+		ProjectID:     offer.ProjectID,
+		IntegrationID: offer.PayMethod.ID,
+		Period:        *offer.SubscriptionPeriod,
+		Price:         price,
+	}, nil
+}
+
+// ChargeSubscriptions списывает очередные платежи подписок с привязанных карт.
+// Если списание не прошло, доступ сохраняется на льготный период, а списание повторяется;
+// после льготного периода подписка истекает
+func (s *Service) ChargeSubscriptions(ctx context.Context) error {
+	subscriptions, err := s.repo.TakeSubscriptionsForRenewal(ctx, time.Now().Add(s.config.SubscriptionRetryInterval), subscriptionRenewalBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, subscription := range subscriptions {
+		err = s.renewSubscription(ctx, subscription)
+		if err != nil {
+			logger.Error(ctx, "could not renew subscription", "subscription_id", subscription.ID, "err", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) renewSubscription(ctx context.Context, subscription SubscriptionForRenewal) error {
+	graceEnd := subscription.CurrentPeriodEnd.Add(s.config.SubscriptionGracePeriod)
+
+	if time.Now().After(graceEnd) {
+		logger.Info(ctx, "subscription grace period is over", "subscription_id", subscription.ID, "failed_attempts", subscription.FailedAttempts)
+		return s.repo.ExpireSubscription(ctx, subscription.ID)
+	}
+
+	status, err := s.chargeSubscription(ctx, subscription)
+	if err != nil {
+		logger.Error(ctx, "could not charge subscription", "subscription_id", subscription.ID, "err", err.Error())
+	}
+
+	// Оплаченный заказ уже продлил подписку, а платеж в обработке подтвердится уведомлением
+	if err == nil && (status == payments.StatusSucceeded || status == payments.StatusPending) {
+		return nil
+	}
+
+	logger.Info(ctx, "subscription renewal failed", "subscription_id", subscription.ID, "status", status, "access_until", graceEnd)
+
+	return s.repo.FailSubscriptionRenewal(ctx, subscription.ID, graceEnd)
+}
+
+// chargeSubscription создает заказ на очередной период и списывает его с привязанной карты.
+// Результат списания применяется к заказу так же, как уведомление
+func (s *Service) chargeSubscription(ctx context.Context, subscription SubscriptionForRenewal) (string, error) {
+	if subscription.RebillID == nil {
+		return "", fmt.Errorf("subscription %d has no rebill id", subscription.ID)
+	}
+
+	payIntegration, err := s.repo.GetPayIntegrationById(ctx, subscription.IntegrationID)
+	if err != nil {
+		return "", err
+	}
+
+	paymentSystem := payments.NewPaymentSystem(payIntegration.Type)
+	charger, ok := paymentSystem.(payments.RecurrentCharger)
+	if !ok {
+		return "", common.ErrSubscriptionNotSupported
+	}
+
+	err = payIntegration.ValidateReceipt()
+	if err != nil {
+		return "", err
+	}
+
+	orderId, err := s.createOrder(ctx, NewOrder{
+		UserID:         subscription.UserID,
+		OfferID:        subscription.OfferID,
+		IntegrationID:  subscription.IntegrationID,
+		Price:          subscription.Price,
+		SubscriptionID: &subscription.ID,
+		Renewal:        true,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	event, err := charger.Charge(ctx, payments.ChargePayload{
+		Login:           payIntegration.Login,
+		Password:        payIntegration.Password,
+		OrderId:         orderId,
+		Amount:          subscription.Price,
+		RebillID:        *subscription.RebillID,
+		Email:           subscription.UserEmail,
+		Description:     subscription.OfferName,
+		SendReceipt:     payIntegration.SendReceipt,
+		ReceiptSettings: payIntegration.ReceiptSettings,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = s.repo.UpdateOrderPaymentId(ctx, orderId, event.PaymentID, "")
+	if err != nil {
+		return "", err
+	}
+
+	order, err := s.repo.FindOrderById(ctx, orderId)
+	if err != nil {
+		return "", err
+	}
+
+	status, err := paymentSystem.FormatStatus(event.RawStatus)
+	if err != nil {
+		return "", err
+	}
+
+	return status, s.applyPaymentEvent(ctx, paymentSystem, payIntegration.Type, event, order)
+}
+
+func (s *Service) GetSubscriptions(ctx context.Context, userId int) ([]Subscription, error) {
+	subscriptions, err := s.repo.GetUserSubscriptions(ctx, int64(userId))
+	if err != nil {
+		return nil, common.ErrInternalError
+	}
+
+	return subscriptions, nil
+}
+
+// CancelSubscription отменяет продление подписки. Оплаченный период остается доступен
+func (s *Service) CancelSubscription(ctx context.Context, userId int, subscriptionId int64) error {
+	err := s.repo.CancelSubscription(ctx, int64(userId), subscriptionId)
+	if errors.Is(err, common.ErrSubscriptionNotFound) || errors.Is(err, common.ErrSubscriptionNotCancelable) {
+		return err
+	}
+
+	if err != nil {
+		return common.ErrInternalError
+	}
+
+	logger.Info(ctx, "canceled subscription", "subscription_id", subscriptionId, "user_id", userId)
+
+	return nil
+}
+
+// RefundOrder возвращает деньги за заказ полностью или частично.
+// Вернуть может только владелец проекта, в котором оформлен заказ
+func (s *Service) RefundOrder(ctx context.Context, userId int, dto RefundOrderDTO) (*RefundOrderResult, error) {
+	order, err := s.repo.FindOrderById(ctx, dto.OrderID)
+	if err != nil {
+		if errors.Is(err, common.ErrOrderNotFound) {
+			return nil, common.ErrOrderNotFound
+		}
+		logger.Error(ctx, "could not get order for refund", "order_id", dto.OrderID, "err", err.Error())
+		return nil, common.ErrInternalError
+	}
+
+	if order.ProjectOwnerID == nil || *order.ProjectOwnerID != int64(userId) {
+		logger.Error(ctx, "user is not allowed to refund order", "order_id", order.ID, "user_id", userId)
+		return nil, common.ErrOrderAccessDenied
+	}
+
+	if order.Status != payments.StatusSucceeded && order.Status != payments.StatusPartiallyRefunded {
+		return nil, common.ErrOrderNotRefundable
+	}
+
+	// группы собираются до возврата денег, чтобы ошибка здесь не оставила возврат незаписанным
+	if dto.RevokeAccess {
+		items, err := s.getOrderItems(ctx, order)
+		if err != nil {
+			return nil, err
+		}
+
+		dto.GroupIDs, err = s.getOrderGroups(ctx, order, items)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	payIntegration, err := s.repo.GetPayIntegrationById(ctx, order.IntegrationID)
+	if err != nil {
+		logger.Error(ctx, "could not get pay integration for order", "order_id", order.ID, "integration_id", order.IntegrationID, "err", err.Error())
+		return nil, common.ErrInternalError
+	}
+
+	refunder, ok := payments.NewPaymentSystem(payIntegration.Type).(payments.Refunder)
+	if !ok {
+		return nil, common.ErrRefundNotSupported
+	}
+
+	err = payIntegration.ValidateReceipt()
+	if err != nil {
+		logger.Error(ctx, "invalid receipt settings", "integration_id", payIntegration.ID, "err", err.Error())
+		return nil, common.ErrInvalidReceiptSettings
+	}
+
+	// сумма откладывается в заказе до запроса в платежную систему, поэтому одновременный второй возврат не пройдет
+	reservation, err := s.repo.ReserveRefund(ctx, order.ID, dto.Amount)
+	if err != nil {
+		if errors.Is(err, common.ErrOrderNotFound) || errors.Is(err, common.ErrOrderNotRefundable) ||
+			errors.Is(err, common.ErrInvalidRefundAmount) || errors.Is(err, common.ErrRefundInProgress) {
+			return nil, err
+		}
+		return nil, common.ErrInternalError
+	}
+	dto.Amount = reservation.Amount
+	dto.RefundedBefore = reservation.RefundedBefore
+
+	refund, err := refunder.Refund(ctx, payments.RefundPayload{
+		Login:           payIntegration.Login,
+		Password:        payIntegration.Password,
+		PaymentID:       order.PaymentID,
+		OrderId:         order.ID,
+		Amount:          dto.Amount,
+		Email:           order.UserEmail,
+		Description:     order.OfferName,
+		SendReceipt:     payIntegration.SendReceipt,
+		ReceiptSettings: payIntegration.ReceiptSettings,
+		IdempotenceKey:  fmt.Sprintf("refund-%d-%d-%d", order.ID, dto.RefundedBefore, dto.Amount),
+	})
+	if err != nil {
+		logger.Error(ctx, "could not refund order", "order_id", order.ID, "amount", dto.Amount, "err", err.Error())
+
+		err = s.repo.CancelRefund(ctx, order.ID)
+		if err != nil {
+			logger.Error(ctx, "could not cancel refund reservation", "order_id", order.ID, "err", err.Error())
+		}
+
+		return nil, common.ErrRefundFailed
+	}
+
+	result, err := s.repo.RefundOrder(ctx, dto)
+	if err != nil {
+		// деньги уже вернулись, а заказ остался прежним — такое нужно разбирать руками
+		logger.Error(ctx, "refunded order in payment system but could not save refund", "order_id", order.ID, "amount", dto.Amount, "refund_id", refund.RefundID, "err", err.Error())
+		return nil, common.ErrInternalError
+	}
+
+	result.RefundID = refund.RefundID
+
+	logger.Info(ctx, "refunded order", "order_id", order.ID, "amount", dto.Amount, "status", result.Status, "revoke_access", dto.RevokeAccess)
+
+	return result, nil
+}
+
+// changeOrderStatus применяет статус из уведомления к заказу.
+// Платежные системы повторяют уведомления, поэтому повторный статус просто игнорируется,
+// а выдача доступа и письма происходят только при фактической смене статуса.
+// В dto заполняется то, что пришло от платежной системы, группы и письма добавляются здесь
+func (s *Service) changeOrderStatus(ctx context.Context, order *OrderForProcessing, dto ChangeOrderStatusDTO) error {
+	dto.OrderID = order.ID
+	status := dto.Status
+
+	if status == payments.StatusSucceeded {
+		items, err := s.getOrderItems(ctx, order)
+		if err != nil {
+			return err
+		}
+
+		groups, err := s.getOrderGroups(ctx, order, items)
+		if err != nil {
+			return err
+		}
+		dto.GroupIDs = groups
+
+		// получатель подарка регистрируется вместе с оплатой. Пароль случайный и никуда не сохраняется
+		if order.IsGift && order.GiftRecipientID == nil {
+			hashedPassword, _, err := s.createUserPassword(ctx, "")
+			if err != nil {
+				logger.Error(ctx, err.Error(), "where", "changeOrderStatus.createUserPassword", "order_id", order.ID)
+				return common.ErrInternalError
+			}
+			dto.GiftRecipientPassword = hashedPassword
+		}
+
+		outbox, err := s.getSucceededOrderOutbox(ctx, order, items)
+		if err != nil {
+			return err
+		}
+		dto.Outbox = outbox
+	}
+
+	result, err := s.repo.ChangeOrderStatus(ctx, dto)
+	if errors.Is(err, common.ErrIllegalOrderTransition) {
+		logger.Error(ctx, "illegal order status transition", "order_id", order.ID, "from", result.PreviousStatus, "to", status)
+		return err
+	}
+
+	if err != nil {
+		logger.Error(ctx, "could not change order status", "order_id", order.ID, "status", status, "err", err.Error())
+		return common.ErrInternalError
+	}
+
+	if !result.Changed {
+		logger.Info(ctx, "order already has status, skip webhook", "order_id", order.ID, "status", status)
+		return nil
+	}
+
+	logger.Info(ctx, "changed order status", "order_id", order.ID, "from", result.PreviousStatus, "to", status)
+
+	if len(dto.Outbox) > 0 {
+		err = s.ProcessOrderOutbox(ctx)
+		if err != nil {
+			logger.Error(ctx, "could not process order outbox", "order_id", order.ID, "err", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// getOrderItems — позиции заказа. У заказов без позиций, например продлений подписки, позиция одна — сам оффер
+func (s *Service) getOrderItems(ctx context.Context, order *OrderForProcessing) ([]OrderItem, error) {
+	items, err := s.repo.GetOrderItems(ctx, order.ID)
+	if err != nil {
+		logger.Error(ctx, "could not get order items", "order_id", order.ID, "err", err.Error())
+		return nil, common.ErrInternalError
+	}
+
+	if len(items) == 0 {
+		items = append(items, OrderItem{
+			OfferID:   &order.OfferID,
+			OfferSlug: &order.OfferSlug,
+			Name:      order.OfferName,
+			Price:     order.Price,
+		})
+	}
+
+	return items, nil
+}
+
+// getOrderGroups собирает группы всех позиций заказа без повторов
+func (s *Service) getOrderGroups(ctx context.Context, order *OrderForProcessing, items []OrderItem) ([]int64, error) {
+	groups := make([]int64, 0)
+	seen := make(map[int64]bool)
+
+	for _, item := range items {
+		// оффер позиции могли удалить, тогда и выдавать по ней нечего
+		if item.OfferID == nil {
+			continue
+		}
+
+		offerGroups, err := s.repo.GetOfferGroups(ctx, *item.OfferID)
+		if err != nil {
+			logger.Error(ctx, "could not get offer groups", "order_id", order.ID, "offer_id", *item.OfferID, "err", err.Error())
+			return nil, common.ErrInternalError
+		}
+
+		for _, groupId := range offerGroups {
+			if !seen[groupId] {
+				seen[groupId] = true
+				groups = append(groups, groupId)
+			}
+		}
+	}
+
+	return groups, nil
+}
+
+// getSucceededOrderOutbox собирает письма, которые нужно отправить после оплаты заказа
+func (s *Service) getSucceededOrderOutbox(ctx context.Context, order *OrderForProcessing, items []OrderItem) ([]NewOrderOutboxMessage, error) {
+	offer, err := s.GetOfferForProcessing(ctx, order.OfferSlug)
+	if err != nil {
+		logger.Error(ctx, "could not find offer for processing", "order_id", order.ID, "offer_slug", order.OfferSlug, "err", err.Error())
+		return nil, common.ErrInternalError
+	}
+
+	outbox := make([]NewOrderOutboxMessage, 0, len(items)+2)
+
+	// письмо об оплате — чек покупателю, а доступ и письма оффера достаются получателю подарка
+	enrollmentEmailTo := order.UserEmail
+	if order.IsGift && order.GiftedTo != nil {
+		enrollmentEmailTo = order.GiftedTo.Email
+	}
+
+	completedEmail, err := json.Marshal(OrderCompletedEmailPayload{
+		Email:   order.UserEmail,
+		Ordered: order.OfferName,
+		// цена заказа может отличаться от цены оффера, например со скидкой
+		Amount: order.Price,
+	})
+	if err != nil {
+		logger.Error(ctx, "could not marshal order completed email", "order_id", order.ID, "err", err.Error())
+		return nil, common.ErrInternalError
+	}
+
+	outbox = append(outbox, NewOrderOutboxMessage{
+		Type:    OrderOutboxOrderCompletedEmail,
+		Payload: completedEmail,
+	})
+
+	// письма о записи отправляют и основной оффер, и каждое дополнение
+	enrolledOffers := []*OfferForProcessing{offer}
+	for _, item := range items {
+		if !item.IsBump || item.OfferSlug == nil {
+			continue
+		}
+
+		bumpOffer, err := s.GetOfferForProcessing(ctx, *item.OfferSlug)
+		if err != nil {
+			logger.Error(ctx, "could not find bump offer for processing", "order_id", order.ID, "offer_slug", *item.OfferSlug, "err", err.Error())
+			return nil, common.ErrInternalError
+		}
+
+		enrolledOffers = append(enrolledOffers, bumpOffer)
+	}
+
+	for _, enrolledOffer := range enrolledOffers {
+		if !enrolledOffer.SendRegistrationEmail {
+			continue
+		}
+
+		// без темы или текста письмо не отправить, а заказ из-за этого не должен вставать
+		if enrolledOffer.RegistrationEmailTheme == nil || enrolledOffer.RegistrationEmail == nil {
+			logger.Error(ctx, "offer has no registration email, skip it", "order_id", order.ID, "offer_id", enrolledOffer.ID)
+			continue
+		}
+
+		enrollmentEmail, err := json.Marshal(EnrollmentEmailPayload{
+			Email:   enrollmentEmailTo,
+			Subject: *enrolledOffer.RegistrationEmailTheme,
+			Body:    *enrolledOffer.RegistrationEmail,
+		})
+		if err != nil {
+			logger.Error(ctx, "could not marshal enrollment email", "order_id", order.ID, "err", err.Error())
+			return nil, common.ErrInternalError
+		}
+
+		outbox = append(outbox, NewOrderOutboxMessage{
+			Type:    OrderOutboxEnrollmentEmail,
+			Payload: enrollmentEmail,
+		})
+	}
+
+	if order.IsGift && order.GiftedTo != nil {
+		payload, err := json.Marshal(GiftEmailPayload{
+			Email:     order.GiftedTo.Email,
+			FirstName: order.GiftedTo.FirstName,
+			FromName:  order.GiftedTo.FromName,
+			Ordered:   order.OfferName,
+		})
+		if err != nil {
+			logger.Error(ctx, "could not marshal gift email", "order_id", order.ID, "err", err.Error())
+			return nil, common.ErrInternalError
+		}
+
+		outbox = append(outbox, NewOrderOutboxMessage{
+			Type:    OrderOutboxGiftEmail,
+			Payload: payload,
+		})
+	}
+
+	return outbox, nil
+}
+
+// ProcessOrderOutbox отправляет накопившиеся письма по заказам.
+// Неудачные попытки повторяются, пока не закончится лимит
+func (s *Service) ProcessOrderOutbox(ctx context.Context) error {
+	messages, err := s.repo.TakeOrderOutboxMessages(ctx, orderOutboxBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		err = s.processOrderOutboxMessage(ctx, message)
+		if err == nil {
+			err = s.repo.CompleteOrderOutboxMessage(ctx, message.ID)
+			if err != nil {
+				logger.Error(ctx, "could not complete order outbox message", "message_id", message.ID, "err", err.Error())
+			}
+			continue
+		}
+
+		logger.Error(ctx, "could not process order outbox message", "message_id", message.ID, "order_id", message.OrderID, "type", message.Type, "attempts", message.Attempts, "err", err.Error())
+
+		retry := message.Attempts < orderOutboxMaxAttempts
+		err = s.repo.FailOrderOutboxMessage(ctx, message.ID, err.Error(), retry)
+		if err != nil {
+			logger.Error(ctx, "could not fail order outbox message", "message_id", message.ID, "err", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) processOrderOutboxMessage(ctx context.Context, message OrderOutboxMessage) error {
+	switch message.Type {
+	case OrderOutboxOrderCompletedEmail:
+		var payload OrderCompletedEmailPayload
+		err := json.Unmarshal(message.Payload, &payload)
+		if err != nil {
+			return err
+		}
+		return s.sendOrderCompletedEmail(ctx, payload.Email, payload.Ordered, payload.Amount)
+	case OrderOutboxEnrollmentEmail:
+		var payload EnrollmentEmailPayload
+		err := json.Unmarshal(message.Payload, &payload)
+		if err != nil {
+			return err
+		}
+		return s.sendEnrollmentEmail(ctx, payload.Email, payload.Subject, payload.Body)
+	case OrderOutboxGiftEmail:
+		var payload GiftEmailPayload
+		err := json.Unmarshal(message.Payload, &payload)
+		if err != nil {
+			return err
+		}
+		return s.sendGiftEmail(ctx, message.OrderID, payload)
+	}
+
+	return fmt.Errorf("unknown order outbox message type %s", message.Type)
+}
+
+// referralCodeLength — длина реферального кода. Символы без похожих друг на друга 0/O и 1/I
+const referralCodeLength = 8
+const referralCodeChars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// getReferrer находит партнера по коду из заказа. Неизвестный код или собственный код покупателя
+// не мешают покупке — заказ просто остается без партнера
+func (s *Service) getReferrer(ctx context.Context, code string, buyerId int64) *int64 {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return nil
+	}
+
+	referrerId, err := s.repo.FindUserByReferralCode(ctx, code)
+	if err != nil {
+		logger.Info(ctx, "could not find referrer", "code", code, "err", err.Error())
+		return nil
+	}
+
+	if referrerId == buyerId {
+		logger.Info(ctx, "skip self referral", "user_id", buyerId)
+		return nil
+	}
+
+	return &referrerId
+}
+
+// TrackReferralClick записывает переход на оффер по реферальному коду
+func (s *Service) TrackReferralClick(ctx context.Context, offerSlug string, code string) error {
+	referrerId, err := s.repo.FindUserByReferralCode(ctx, strings.ToUpper(strings.TrimSpace(code)))
+	if err != nil {
+		return err
+	}
+
+	err = s.repo.CreateReferralClick(ctx, referrerId, offerSlug)
+	if err != nil {
+		return common.ErrInternalError
+	}
+
+	return nil
+}
+
+// GetReferralStats — реферальный код пользователя и статистика по нему.
+// Код создается при первом запросе статистики
+func (s *Service) GetReferralStats(ctx context.Context, userId int) (*ReferralStats, error) {
+	code, err := s.getReferralCode(ctx, int64(userId))
+	if err != nil {
+		return nil, err
+	}
+
+	projects, err := s.repo.GetReferralStats(ctx, int64(userId))
+	if err != nil {
+		return nil, common.ErrInternalError
+	}
+
+	return sumReferralStats(code, projects), nil
+}
+
+func (s *Service) getReferralCode(ctx context.Context, userId int64) (string, error) {
+	// код может совпасть с чужим, тогда пробуем другой
+	for attempt := 0; attempt < 3; attempt++ {
+		code, err := generateReferralCode()
+		if err != nil {
+			logger.Error(ctx, "could not generate referral code", "err", err.Error())
+			return "", common.ErrInternalError
+		}
+
+		referralCode, err := s.repo.SetReferralCode(ctx, userId, code)
+		if errors.Is(err, common.ErrReferralCodeTaken) {
+			continue
+		}
+
+		if err != nil {
+			return "", common.ErrInternalError
+		}
+
+		return referralCode, nil
+	}
+
+	logger.Error(ctx, "could not find free referral code", "user_id", userId)
+	return "", common.ErrInternalError
+}
+
+func generateReferralCode() (string, error) {
+	charsetLength := big.NewInt(int64(len(referralCodeChars)))
+	code := make([]byte, referralCodeLength)
+
+	for i := range code {
+		num, err := rand.Int(rand.Reader, charsetLength)
+		if err != nil {
+			return "", err
+		}
+		code[i] = referralCodeChars[num.Int64()]
+	}
+
+	return string(code), nil
+}
+
+func sumReferralStats(code string, projects []ReferralProjectStats) *ReferralStats {
+	stats := ReferralStats{
+		Code:     code,
+		Projects: projects,
+	}
+
+	for _, project := range projects {
+		stats.Clicks += project.Clicks
+		stats.Sales += project.Sales
+		stats.Earned += project.Earned
+		stats.PaidOut += project.PaidOut
+		stats.Balance += project.Balance
+	}
+
+	return &stats
+}
+
+// checkProjectOwner — реферальную программу проекта видит и ведет только его владелец
+func (s *Service) checkProjectOwner(ctx context.Context, userId int64, projectId int64) error {
+	ownerId, err := s.repo.GetProjectOwnerID(ctx, projectId)
+	if errors.Is(err, common.ErrProjectNotFound) {
+		return err
+	}
+
+	if err != nil {
+		return common.ErrInternalError
+	}
+
+	if ownerId == nil || *ownerId != userId {
+		logger.Error(ctx, "user is not allowed to manage project referrals", "project_id", projectId, "user_id", userId)
+		return common.ErrReferralPayoutDenied
+	}
+
+	return nil
+}
+
+// GetProjectReferrers — партнеры проекта и начисленная им комиссия
+func (s *Service) GetProjectReferrers(ctx context.Context, userId int, projectId int64) ([]ProjectReferrer, error) {
+	err := s.checkProjectOwner(ctx, int64(userId), projectId)
+	if err != nil {
+		return nil, err
+	}
+
+	referrers, err := s.repo.GetProjectReferrers(ctx, projectId)
+	if err != nil {
+		return nil, common.ErrInternalError
+	}
+
+	return referrers, nil
+}
+
+// CreateReferralPayout отмечает, что владелец проекта выплатил партнеру всю начисленную комиссию.
+// Сами деньги переводятся вне платформы
+func (s *Service) CreateReferralPayout(ctx context.Context, dto ReferralPayoutDTO) (*ReferralPayout, error) {
+	err := s.checkProjectOwner(ctx, dto.OwnerID, dto.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	referrerId, err := s.repo.FindUserByReferralCode(ctx, strings.ToUpper(strings.TrimSpace(dto.ReferralCode)))
+	if errors.Is(err, common.ErrReferrerNotFound) {
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, common.ErrInternalError
+	}
+
+	payout, err := s.repo.CreateReferralPayout(ctx, dto.ProjectID, referrerId, dto.OwnerID)
+	if errors.Is(err, common.ErrNothingToPayout) {
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, common.ErrInternalError
+	}
+
+	logger.Info(ctx, "created referral payout", "payout_id", payout.ID, "project_id", dto.ProjectID, "referrer_id", referrerId, "amount", payout.Amount)
+
+	return payout, nil
+}
+
+// getFakeCheckoutOrder — заказ, который можно оплатить на тестовой странице.
+// В prod тестовой платежной системы нет, а заказы других платежных систем так оплатить нельзя
+func (s *Service) getFakeCheckoutOrder(ctx context.Context, orderId int64) (*OrderForProcessing, *PayIntegration, error) {
+	if s.config.Env == "prod" {
+		return nil, nil, common.ErrPaymentSystemNotFound
+	}
+
+	order, err := s.repo.FindOrderById(ctx, orderId)
+	if errors.Is(err, common.ErrOrderNotFound) {
+		return nil, nil, err
+	}
+
+	if err != nil {
+		return nil, nil, common.ErrInternalError
+	}
+
+	payIntegration, err := s.repo.GetPayIntegrationById(ctx, order.IntegrationID)
+	if err != nil {
+		logger.Error(ctx, "could not get pay integration for order", "order_id", order.ID, "integration_id", order.IntegrationID, "err", err.Error())
+		return nil, nil, common.ErrInternalError
+	}
+
+	if payIntegration.Type != payments.FakeType {
+		return nil, nil, common.ErrPaymentSystemNotFound
+	}
+
+	return order, payIntegration, nil
+}
+
+func (s *Service) GetFakeCheckout(ctx context.Context, orderId int64) (*FakeCheckout, error) {
+	order, _, err := s.getFakeCheckoutOrder(ctx, orderId)
+	if err != nil {
+		return nil, err
+	}
+
+	checkout := FakeCheckout{
+		OrderID:     order.ID,
+		Description: order.OfferName,
+		Amount:      order.Price,
+		Status:      order.Status,
+		ReturnURL:   s.config.HeroAppBaseURL,
+	}
+
+	offer, err := s.GetOfferForProcessing(ctx, order.OfferSlug)
+	if err == nil {
+		checkout.ReturnURL = s.getPaymentReturnURL(offer)
+	}
+
+	return &checkout, nil
+}
+
+// CompleteFakeCheckout завершает платеж на тестовой странице: собирает подписанное уведомление
+// с выбранным статусом и отправляет его в обычную обработку уведомлений
+func (s *Service) CompleteFakeCheckout(ctx context.Context, orderId int64, status string) error {
+	order, payIntegration, err := s.getFakeCheckoutOrder(ctx, orderId)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(payments.NewFakeWebhookBody(order.ID, order.PaymentID, order.Price, status, order.SubscriptionID != nil))
+	if err != nil {
+		return common.ErrInternalError
+	}
+
+	headers := make(http.Header)
+	headers.Set(payments.FakeSignatureHeader, payments.SignFakeWebhook(body, payIntegration.Password))
+
+	logger.Info(ctx, "completing fake checkout", "order_id", order.ID, "status", status)
+
+	return s.ProcessWebhook(ctx, payments.FakeType, payments.WebhookRequest{
+		Body:    body,
+		Headers: headers,
+	})
+}
+
+func (s *Service) validateWebhook(ctx context.Context, paymentSystem payments.PaymentSystem, provider string, req payments.WebhookRequest, event *payments.WebhookEvent, order *OrderForProcessing) error {
+	// Проверить подпись ключами интеграции, через которую создан заказ
+	payIntegration, err := s.repo.GetPayIntegrationById(ctx, order.IntegrationID)
+	if err != nil {
+		logger.Error(ctx, "could not get pay integration for order", "order_id", order.ID, "integration_id", order.IntegrationID, "err", err.Error())
+		return common.ErrInternalError
+	}
+
+	if payIntegration.Type != provider {
+		logger.Error(ctx, "webhook provider not equal with order integration", "order_id", order.ID, "provider", provider, "integration_type", payIntegration.Type)
+		return common.ErrInvalidWebhookSignature
+	}
+
+	err = paymentSystem.VerifyWebhook(ctx, req, payments.Credentials{
+		Login:    payIntegration.Login,
+		Password: payIntegration.Password,
+	})
+	if err != nil {
+		logger.Error(ctx, "got forged webhook", "provider", provider, "order_id", order.ID, "status", event.RawStatus, "err", err.Error())
+		return common.ErrInvalidWebhookSignature
+	}
+
+	// после повторной оплаты у заказа новый платеж, но покупатель может оплатить и по старой ссылке
+	if event.PaymentID != "" && order.PaymentID != event.PaymentID {
+		known, err := s.repo.IsOrderPayment(ctx, order.ID, event.PaymentID)
+		if err != nil {
+			return common.ErrInternalError
+		}
+		if !known {
+			logger.Error(ctx, "order payment id not equal with webhook payment id", "order_payment_id", order.PaymentID, "webhook_payment_id", event.PaymentID)
+			return common.ErrInternalError
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) UpdateProfile(ctx context.Context, userId int, profile UpdateProfileBody) error {
+	err := s.repo.UpdateProfile(ctx, userId, profile)
+
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
+	}
+
+	return nil
+}
+
+func (s *Service) ChangeAvatar(ctx context.Context, userId int, avatarPathToDir string, avatarFileName string) error {
+	defer func() {
+		err := RemoveLocalFile(avatarPathToDir + "/" + avatarFileName)
+		if err != nil {
+			logger.Log.Error(err.Error(), "error", err)
+		}
+	}()
+
+	src, err := imaging.Open(avatarPathToDir + "/" + avatarFileName)
+
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
+	}
+
+	fileName := fmt.Sprintf("avatar_for_user_%d", userId)
+	newAvatarFileName := MakeFileHashName(fileName, "jpeg")
+
+	buff := new(bytes.Buffer)
+
+	size := src.Bounds().Size()
+
+	if size.X > 300 {
+		src = imaging.Resize(src, 300, 0, imaging.Lanczos)
+	}
+
+	err = jpeg.Encode(buff, src, nil)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		return common.ErrInternalError
+	}
+
+	fileUrl, err := UploadFileToS3(s.config.PhotosBucket, newAvatarFileName, bytes.NewReader(buff.Bytes()), s.config)
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
+	}
+
+	err = s.repo.UpdateAvatar(ctx, userId, fileUrl)
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
+	}
+
+	return nil
+}
+
+func (s *Service) ChangePassword(ctx context.Context, userId int, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		logger.Log.Error(err.Error())
+		return common.ErrInternalError
+	}
+
+	err = s.repo.UpdatePassword(ctx, userId, string(hashedPassword))
+	if err != nil {
+		logger.Log.Error(err.Error())
+		return common.ErrInternalError
+	}
+
+	return nil
+}
+
+// ForgotPassword отправляет ссылку для смены пароля. Для неизвестного email ничего не отправляет,
+// но и не сообщает об этом, чтобы по ответу нельзя было проверить, есть ли аккаунт
+func (s *Service) ForgotPassword(ctx context.Context, to string) error {
+	user, err := s.repo.FindUserByEmail(ctx, to)
+	if errors.Is(err, common.ErrUserNotFound) {
+		logger.Info(ctx, "password reset for unknown email")
+		return nil
+	}
+
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
+	}
+
+	// по ответу нельзя понять, есть ли такой аккаунт, поэтому лимит и ошибки отправки только пишутся в лог
+	token, err := s.createAuthToken(ctx, user.ID, AuthTokenPurposePasswordReset, "", s.config.PasswordResetExp, s.config.PasswordResetMaxPerHour)
+	if errors.Is(err, common.ErrTooManyAuthTokens) {
+		logger.Info(ctx, "too many password reset requests", "user_id", user.ID)
+		return nil
+	}
+
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "ForgotPassword.createAuthToken", "user_id", user.ID)
+		return nil
+	}
+
+	err = s.sendPasswordResetEmail(ctx, user.Email, s.config.HeroAppBaseURL+"/password/reset?token="+token)
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "ForgotPassword.sendPasswordResetEmail", "user_id", user.ID)
+	}
+
+	return nil
+}
+
+// ResetPassword задает новый пароль по ссылке из письма, закрывает все сессии
+// и сообщает пользователю, что пароль изменен
+func (s *Service) ResetPassword(ctx context.Context, token string, password string) error {
+	userId, err := s.consumeAuthToken(ctx, AuthTokenPurposePasswordReset, token)
+	if errors.Is(err, common.ErrTokenExpired) {
+		return common.ErrPasswordResetLinkExpired
+	}
+
+	if errors.Is(err, common.ErrInvalidToken) {
+		return common.ErrInvalidPasswordResetLink
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// остальные ссылки для входа и смены пароля из старых писем больше не должны работать
+	err = s.repo.UseUserAuthTokens(ctx, userId, []string{AuthTokenPurposeMagicLink, AuthTokenPurposePasswordReset})
+	if err != nil {
+		return common.ErrInternalError
+	}
+
+	err = s.ChangePassword(ctx, userId, password)
+	if err != nil {
+		return err
+	}
+
+	err = s.LogoutEverywhere(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.repo.FindUserById(ctx, userId)
+	if err != nil || user == nil {
+		logger.Error(ctx, "could not find user to notify about password change", "user_id", userId)
+		return nil
+	}
+
+	// пароль уже изменен, поэтому ошибка письма не должна ломать ответ
+	err = s.sendPasswordChangedEmail(ctx, user.Email)
+	if err != nil {
+		logger.Error(ctx, "could not send password changed email", "user_id", userId)
+	}
+
+	return nil
+}
+
+// ResendEmailVerification повторно отправляет письмо для подтверждения email
+func (s *Service) ResendEmailVerification(ctx context.Context, userId int) error {
+	profile, err := s.repo.GetProfileByUserId(ctx, userId)
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
+	}
+
+	if profile.EmailVerified {
+		return common.ErrEmailAlreadyVerified
+	}
+
+	return s.sendEmailVerification(ctx, userId, profile.Email)
+}
+
+// ConfirmEmail подтверждает email по ссылке из письма
+func (s *Service) ConfirmEmail(ctx context.Context, token string) error {
+	authToken, err := s.consumeEmailToken(ctx, AuthTokenPurposeEmailVerify, token)
+	if err != nil {
+		return emailConfirmError(err)
+	}
+
+	if authToken.Email == nil {
+		return common.ErrInvalidEmailConfirmLink
+	}
+
+	err = s.repo.VerifyUserEmail(ctx, authToken.UserID, *authToken.Email)
+	if errors.Is(err, common.ErrInvalidEmailConfirmLink) {
+		return err
+	}
+
+	if err != nil {
+		return common.ErrInternalError
+	}
+
+	logger.Info(ctx, "email verified", "user_id", authToken.UserID)
+
+	return nil
+}
+
+// RequestEmailChange отправляет ссылку для подтверждения на новый адрес и предупреждает старый.
+// Email меняется только после перехода по ссылке
+func (s *Service) RequestEmailChange(ctx context.Context, userId int, newEmail string) error {
+	user, err := s.repo.FindUserById(ctx, userId)
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
+	}
+
+	if strings.EqualFold(user.Email, newEmail) {
+		return common.ErrEmailNotChanged
+	}
+
+	_, err = s.repo.FindUserByEmail(ctx, newEmail)
+	if err == nil {
+		return common.ErrEmailTaken
+	}
+
+	if !errors.Is(err, common.ErrUserNotFound) {
+		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
+	}
+
+	token, err := s.createAuthToken(ctx, userId, AuthTokenPurposeEmailChange, newEmail, s.config.EmailConfirmExp, s.config.EmailConfirmMaxPerHour)
+	if errors.Is(err, common.ErrTooManyAuthTokens) {
+		return err
+	}
+
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "RequestEmailChange.createAuthToken", "user_id", userId)
+		return common.ErrInternalError
+	}
+
+	err = s.sendEmailChangeEmail(ctx, newEmail, s.config.HeroAppBaseURL+"/email/change?token="+token)
+	if err != nil {
+		return err
+	}
+
+	// письмо на старый адрес — на случай, если смену запросил не владелец
+	err = s.sendEmailChangeNoticeEmail(ctx, user.Email, newEmail)
+	if err != nil {
+		logger.Error(ctx, "could not send email change notice", "user_id", userId)
+	}
+
+	return nil
+}
+
+// ConfirmEmailChange меняет email на новый по ссылке, отправленной на новый адрес
+func (s *Service) ConfirmEmailChange(ctx context.Context, token string) error {
+	authToken, err := s.consumeEmailToken(ctx, AuthTokenPurposeEmailChange, token)
+	if err != nil {
+		return emailConfirmError(err)
+	}
+
+	if authToken.Email == nil {
+		return common.ErrInvalidEmailConfirmLink
+	}
+
+	err = s.repo.ChangeUserEmail(ctx, authToken.UserID, *authToken.Email)
+	if errors.Is(err, common.ErrEmailTaken) || errors.Is(err, common.ErrUserNotFound) {
+		return err
+	}
+
+	if err != nil {
+		return common.ErrInternalError
+	}
+
+	logger.Info(ctx, "email changed", "user_id", authToken.UserID)
+
+	return nil
+}
+
+// sendEmailVerification отправляет ссылку для подтверждения текущего email
+func (s *Service) sendEmailVerification(ctx context.Context, userId int, userEmail string) error {
+	token, err := s.createAuthToken(ctx, userId, AuthTokenPurposeEmailVerify, userEmail, s.config.EmailConfirmExp, s.config.EmailConfirmMaxPerHour)
+	if errors.Is(err, common.ErrTooManyAuthTokens) {
+		return err
+	}
+
+	if err != nil {
+		logger.Error(ctx, err.Error(), "where", "sendEmailVerification.createAuthToken", "user_id", userId)
+		return common.ErrInternalError
+	}
+
+	return s.sendEmailVerifyEmail(ctx, userEmail, s.config.HeroAppBaseURL+"/email/confirm?token="+token)
+}
+
+func emailConfirmError(err error) error {
+	if errors.Is(err, common.ErrTokenExpired) {
+		return common.ErrEmailConfirmLinkExpired
+	}
+
+	if errors.Is(err, common.ErrInvalidToken) {
+		return common.ErrInvalidEmailConfirmLink
+	}
+
+	return err
+}
+
+func (s *Service) GetUserAccessibleProducts(ctx context.Context, userId int) ([]ProductCard, error) {
+	products, err := s.repo.GetUserAccessibleProducts(ctx, userId)
+
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+		return nil, common.ErrInternalError
+	}
+
+	return products, nil
+}
+
+func (s *Service) GetUserAccessibleProduct(ctx context.Context, courseSlug string, userId int) (*ProductInfo, error) {
+	product, err := s.repo.GetUserAccessibleProduct(ctx, courseSlug, userId)
+
+	if errors.Is(err, common.ErrProductNotFound) {
+		return nil, common.ErrProductNotFound
 	}
 
 	if err != nil {
@@ -965,62 +2725,242 @@ func (s *Service) createUserPassword(ctx context.Context, userPassword string) (
 		return "", "", nil
 	}
 
-	return string(hashedPassword), userPassword, nil
-}
-
-func (s *Service) createUser(ctx context.Context, dto CreateUserDTO) (int64, bool, error) {
+	return string(hashedPassword), userPassword, nil
+}
+
+func (s *Service) createUser(ctx context.Context, dto CreateUserDTO) (int64, bool, error) {
+
+	// создать пароль для пользователя
+	hashedPassword, rawPassword, err := s.createUserPassword(ctx, dto.Password)
+
+	if err != nil {
+		logger.Log.Error(err.Error())
+		return 0, false, common.ErrInternalError
+	}
+
+	// создать пользователя в базе
+	user := User{
+		Email:     dto.Email,
+		Password:  hashedPassword,
+		FirstName: dto.FirstName,
+	}
+
+	userId, err := s.repo.CreateUser(ctx, user)
+
+	var alreadyExists bool
+
+	if err != nil {
+		if !errors.Is(err, common.ErrUserAlreadyExists) {
+			logger.Log.Error(err.Error(), "error", err)
+			return userId, alreadyExists, err
+		}
+
+		alreadyExists = true
+	}
+
+	if alreadyExists {
+		return userId, alreadyExists, nil
+	}
+
+	// отправить welcome-письмо
+	err = s.sendWelcomeEmail(ctx, user.Email, rawPassword)
+	if err != nil {
+		logger.Log.Error(err.Error())
+	}
+
+	// попросить подтвердить email. Без этого аккаунтом можно пользоваться, поэтому ошибка только логируется
+	verifyErr := s.sendEmailVerification(ctx, int(userId), user.Email)
+	if verifyErr != nil {
+		logger.Error(ctx, "could not send email verification", "user_id", userId, "err", verifyErr.Error())
+	}
+
+	return userId, alreadyExists, err
+}
+
+func (s *Service) sendOrderCompletedEmail(ctx context.Context, userEmail string, ordered string, amount uint64) error {
+	email, err := s.emails.GetEmailByType(ctx, "order-completed")
+
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+	}
+
+	email.Context["Ordered"] = ordered
+	email.Context["Amount"] = amount
+	email.Context["HeroURL"] = s.config.HeroAppBaseURL + "/login?way=password&email=" + userEmail
+
+	err = s.emails.SendEmail(email, []string{userEmail})
+
+	if err != nil {
+		logger.Log.Error(err.Error())
+		return common.ErrInternalError
+	}
+
+	return nil
+}
+
+// sendGiftEmail отправляет получателю письмо о подарке. Новому пользователю в письме ссылка,
+// по которой он сам задаст пароль. Повторная отправка выдает новую ссылку, но пароль не меняет
+func (s *Service) sendGiftEmail(ctx context.Context, orderId int64, payload GiftEmailPayload) error {
+	order, err := s.repo.FindOrderById(ctx, orderId)
+	if err != nil {
+		logger.Error(ctx, "could not get gift order", "order_id", orderId, "err", err.Error())
+		return common.ErrInternalError
+	}
+
+	if order.GiftRecipientID == nil {
+		logger.Error(ctx, "gift order has no recipient", "order_id", orderId)
+		return common.ErrInternalError
+	}
+
+	email, err := s.emails.GetEmailByType(ctx, "gift")
+
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
+	}
+
+	newUser := order.GiftedTo != nil && order.GiftedTo.NewUser
+	if newUser {
+		token, err := s.createAuthToken(ctx, int(*order.GiftRecipientID), AuthTokenPurposePasswordReset, "", s.config.GiftPasswordLinkExp, s.config.PasswordResetMaxPerHour)
+		if err != nil {
+			logger.Error(ctx, err.Error(), "where", "sendGiftEmail.createAuthToken", "order_id", orderId)
+			return common.ErrInternalError
+		}
+
+		email.Context["SetPasswordURL"] = s.config.HeroAppBaseURL + "/password/reset?token=" + token
+	}
+
+	email.Context["Email"] = payload.Email
+	email.Context["FirstName"] = payload.FirstName
+	email.Context["FromName"] = payload.FromName
+	email.Context["Ordered"] = payload.Ordered
+	email.Context["LoginFullURL"] = s.config.HeroAppBaseURL + "/login?way=password&email=" + payload.Email
+
+	err = s.emails.SendEmail(email, []string{payload.Email})
+
+	if err != nil {
+		logger.Log.Error(err.Error())
+		return common.ErrInternalError
+	}
+
+	logger.Info(ctx, "send gift email", "order_id", orderId, "user_id", *order.GiftRecipientID, "new_user", newUser)
+
+	return nil
+}
+
+func (s *Service) sendWelcomeEmail(ctx context.Context, userEmail string, userPassword string) error {
+	email, err := s.emails.GetEmailByType(ctx, "welcome")
+
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+	}
+
+	email.Context["Email"] = userEmail
+	email.Context["Password"] = userPassword
+	email.Context["LoginURL"] = s.config.HeroAppBaseURL + "/login"
+	email.Context["LoginFullURL"] = s.config.HeroAppBaseURL + "/login?way=password&email=" + userEmail
+	email.Context["MailFrom"] = email.From.Email
+
+	err = s.emails.SendEmail(email, []string{userEmail})
+
+	if err != nil {
+		logger.Log.Error(err.Error())
+		return common.ErrInternalError
+	}
+
+	return nil
+}
+
+func (s *Service) sendOrderCreatedEmail(ctx context.Context, userEmail string, ordered string, amount uint64, paymentUrl string) error {
+	email, err := s.emails.GetEmailByType(ctx, "order-created")
+
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+	}
+
+	email.Context["PaymentURL"] = paymentUrl
+	email.Context["Ordered"] = ordered
+	email.Context["Amount"] = amount
+
+	err = s.emails.SendEmail(email, []string{userEmail})
+
+	if err != nil {
+		logger.Log.Error(err.Error())
+		return common.ErrInternalError
+	}
+
+	return nil
+}
+
+func (s *Service) sendPaymentReminderEmail(ctx context.Context, userEmail string, ordered string, amount uint64, paymentUrl string) error {
+	email, err := s.emails.GetEmailByType(ctx, "payment-reminder")
+
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
+	}
+
+	email.Context["PaymentURL"] = paymentUrl
+	email.Context["Ordered"] = ordered
+	email.Context["Amount"] = amount
+
+	err = s.emails.SendEmail(email, []string{userEmail})
+
+	if err != nil {
+		logger.Log.Error(err.Error())
+		return common.ErrInternalError
+	}
+
+	return nil
+}
+
+func (s *Service) sendPasswordResetEmail(ctx context.Context, userEmail string, resetLink string) error {
+	email, err := s.emails.GetEmailByType(ctx, "password_reset")
+
+	if err != nil {
+		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
+	}
+
+	email.Context["ResetLink"] = resetLink
 
-	// создать пароль для пользователя
-	hashedPassword, rawPassword, err := s.createUserPassword(ctx, dto.Password)
+	err = s.emails.SendEmail(email, []string{userEmail})
 
 	if err != nil {
 		logger.Log.Error(err.Error())
-		return 0, false, common.ErrInternalError
-	}
-
-	// создать пользователя в базе
-	user := User{
-		Email:     dto.Email,
-		Password:  hashedPassword,
-		FirstName: dto.FirstName,
+		return common.ErrInternalError
 	}
 
-	userId, err := s.repo.CreateUser(ctx, user)
+	return nil
+}
 
-	var alreadyExists bool
+func (s *Service) sendPasswordChangedEmail(ctx context.Context, userEmail string) error {
+	email, err := s.emails.GetEmailByType(ctx, "password_changed")
 
 	if err != nil {
-		if !errors.Is(err, common.ErrUserAlreadyExists) {
-			logger.Log.Error(err.Error(), "error", err)
-			return userId, alreadyExists, err
-		}
-
-		alreadyExists = true
+		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
 	}
 
-	if alreadyExists {
-		return userId, alreadyExists, nil
-	}
+	err = s.emails.SendEmail(email, []string{userEmail})
 
-	// отправить welcome-письмо
-	err = s.sendWelcomeEmail(ctx, user.Email, rawPassword)
 	if err != nil {
 		logger.Log.Error(err.Error())
+		return common.ErrInternalError
 	}
 
-	return userId, alreadyExists, err
+	return nil
 }
 
-func (s *Service) sendOrderCompletedEmail(ctx context.Context, userEmail string, ordered string, amount uint64) error {
-	email, err := s.emails.GetEmailByType(ctx, "order-completed")
+func (s *Service) sendEmailVerifyEmail(ctx context.Context, userEmail string, confirmLink string) error {
+	email, err := s.emails.GetEmailByType(ctx, "email_verify")
 
 	if err != nil {
 		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
 	}
 
-	email.Context["Ordered"] = ordered
-	email.Context["Amount"] = amount
-	email.Context["HeroURL"] = s.config.HeroAppBaseURL + "/login?way=password&email=" + userEmail
+	email.Context["ConfirmLink"] = confirmLink
 
 	err = s.emails.SendEmail(email, []string{userEmail})
 
@@ -1032,18 +2972,15 @@ func (s *Service) sendOrderCompletedEmail(ctx context.Context, userEmail string,
 	return nil
 }
 
-func (s *Service) sendWelcomeEmail(ctx context.Context, userEmail string, userPassword string) error {
-	email, err := s.emails.GetEmailByType(ctx, "welcome")
+func (s *Service) sendEmailChangeEmail(ctx context.Context, userEmail string, confirmLink string) error {
+	email, err := s.emails.GetEmailByType(ctx, "email_change")
 
 	if err != nil {
 		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
 	}
 
-	email.Context["Email"] = userEmail
-	email.Context["Password"] = userPassword
-	email.Context["LoginURL"] = s.config.HeroAppBaseURL + "/login"
-	email.Context["LoginFullURL"] = s.config.HeroAppBaseURL + "/login?way=password&email=" + userEmail
-	email.Context["MailFrom"] = email.From.Email
+	email.Context["ConfirmLink"] = confirmLink
 
 	err = s.emails.SendEmail(email, []string{userEmail})
 
@@ -1055,16 +2992,15 @@ func (s *Service) sendWelcomeEmail(ctx context.Context, userEmail string, userPa
 	return nil
 }
 
-func (s *Service) sendOrderCreatedEmail(ctx context.Context, userEmail string, ordered string, amount uint64, paymentUrl string) error {
-	email, err := s.emails.GetEmailByType(ctx, "order-created")
+func (s *Service) sendEmailChangeNoticeEmail(ctx context.Context, userEmail string, newEmail string) error {
+	email, err := s.emails.GetEmailByType(ctx, "email_change_notice")
 
 	if err != nil {
 		logger.Log.Error(err.Error(), "error", err)
+		return common.ErrInternalError
 	}
 
-	email.Context["PaymentURL"] = paymentUrl
-	email.Context["Ordered"] = ordered
-	email.Context["Amount"] = amount
+	email.Context["NewEmail"] = newEmail
 
 	err = s.emails.SendEmail(email, []string{userEmail})
 
@@ -1099,7 +3035,7 @@ func (s *Service) sendEnrollmentEmail(ctx context.Context, userEmail string, ema
 	return nil
 }
 
-func (s *Service) Signup(ctx context.Context, body *SignupBody) (*SignUpResult, error) {
+func (s *Service) Signup(ctx context.Context, body *SignupBody, client SessionClient) (*SignUpResult, error) {
 
 	_, alreadyExists, err := s.createUser(ctx, CreateUserDTO{
 		FirstName: body.FirstName,
@@ -1135,20 +3071,21 @@ func (s *Service) Signup(ctx context.Context, body *SignupBody) (*SignUpResult,
 		return &result, nil
 	}
 
-	token, err := s.createJWTToken(foundUser.ID)
+	session, err := s.createSession(ctx, foundUser.ID, client)
 
 	if err != nil {
 		return &result, common.ErrInternalError
 	}
 
-	result.Token = &token
+	result.Token = &session.Token
+	result.RefreshToken = &session.RefreshToken
 	result.Message = "Привет. С возвращением!"
 
 	return &result, nil
 
 }
 
-func (s *Service) Login(ctx context.Context, body *LoginBody) (*LoginResult, error) {
+func (s *Service) Login(ctx context.Context, body *LoginBody, client SessionClient) (*LoginResult, error) {
 
 	user, err := s.repo.FindUserByEmail(ctx, body.Email)
 
@@ -1164,16 +3101,13 @@ func (s *Service) Login(ctx context.Context, body *LoginBody) (*LoginResult, err
 		return nil, common.ErrWrongCredentials
 	}
 
-	token, err := s.createJWTToken(user.ID)
+	result, err := s.createSession(ctx, user.ID, client)
 
 	if err != nil {
 		return nil, common.ErrInternalError
 	}
-	result := LoginResult{
-		Token: token,
-	}
 
-	return &result, nil
+	return result, nil
 
 }
 
@@ -1187,7 +3121,11 @@ func (s *Service) GetMagicLink(ctx context.Context, to string) error {
 		return common.ErrUserNotFound
 	}
 
-	magicLink, err := s.createMagicLink(user.ID)
+	magicLink, err := s.createMagicLink(ctx, user.ID)
+
+	if errors.Is(err, common.ErrTooManyAuthTokens) {
+		return err
+	}
 
 	if err != nil {
 		logger.Log.Error(err.Error(), "error", err)
@@ -1216,61 +3154,302 @@ func (s *Service) GetMagicLink(ctx context.Context, to string) error {
 	return nil
 }
 
-func (s *Service) ValidateMagicLink(ctx context.Context, token string) (*LoginResult, error) {
-	user, err := s.ValidateJWTToken(ctx, token)
+// ValidateMagicLink входит по ссылке из письма. Ссылка работает один раз
+func (s *Service) ValidateMagicLink(ctx context.Context, token string, client SessionClient) (*LoginResult, error) {
+	userId, err := s.consumeAuthToken(ctx, AuthTokenPurposeMagicLink, token)
+	if errors.Is(err, common.ErrTokenExpired) {
+		return nil, common.ErrMagicLinkExpired
+	}
+
+	if errors.Is(err, common.ErrInvalidToken) {
+		return nil, common.ErrInvalidMagicLink
+	}
+
 	if err != nil {
-		if errors.Is(err, common.ErrTokenExpired) {
-			return nil, common.ErrMagicLinkExpired
-		}
-		if errors.Is(err, common.ErrInvalidToken) {
-			return nil, common.ErrInvalidMagicLink
-		}
 		return nil, err
 	}
 
-	jwtToken, err := s.createJWTToken(user.ID)
+	result, err := s.createSession(ctx, userId, client)
 
 	if err != nil {
 		return nil, common.ErrInternalError
 	}
 
-	result := LoginResult{
-		Token: jwtToken,
+	return result, nil
+
+}
+
+func (s *Service) createMagicLink(ctx context.Context, userId int) (string, error) {
+	token, err := s.createAuthToken(ctx, userId, AuthTokenPurposeMagicLink, "", s.config.MagicLinkExp, s.config.MagicLinkMaxPerHour)
+	if err != nil {
+		return "", err
 	}
 
-	return &result, nil
+	magicLink := s.config.HeroAppBaseURL + "/login/magic-link?token=" + token
 
+	return magicLink, nil
 }
 
-func (s *Service) createMagicLink(userId int) (string, error) {
+// createAuthToken выдает одноразовый токен для письма. Не больше maxPerHour токенов с одним назначением в час.
+// email — адрес, который подтверждает токен, для остальных назначений пустой
+func (s *Service) createAuthToken(ctx context.Context, userId int, purpose string, email string, ttl time.Duration, maxPerHour int) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = s.repo.CreateAuthToken(ctx, NewAuthToken{
+		UserID:    userId,
+		Purpose:   purpose,
+		Email:     email,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(ttl),
+	}, maxPerHour)
+	if err != nil {
+		return "", err
+	}
 
-	claims := Claims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.config.MagicLinkExp)),
-		},
-		UserID: userId,
+	return token, nil
+}
+
+// consumeAuthToken использует токен из письма и возвращает его пользователя.
+// Неизвестный, уже использованный или выданный для другой цели токен — ErrInvalidToken
+func (s *Service) consumeAuthToken(ctx context.Context, purpose string, token string) (int, error) {
+	authToken, err := s.consumeEmailToken(ctx, purpose, token)
+	if err != nil {
+		return 0, err
 	}
 
-	token := jwt.NewWithClaims(s.config.JwtSigningMethod, claims)
+	return authToken.UserID, nil
+}
 
-	tokenString, err := token.SignedString([]byte(s.config.JwtTokenSecretKey))
+// consumeEmailToken — как consumeAuthToken, но отдает и адрес, для которого выдан токен
+func (s *Service) consumeEmailToken(ctx context.Context, purpose string, token string) (*AuthToken, error) {
+	if token == "" {
+		return nil, common.ErrInvalidToken
+	}
+
+	authToken, err := s.repo.ConsumeAuthToken(ctx, purpose, hashToken(token))
+	if err != nil {
+		return nil, common.ErrInternalError
+	}
+
+	if authToken == nil {
+		return nil, common.ErrInvalidToken
+	}
+
+	if authToken.ExpiresAt.Before(time.Now()) {
+		return nil, common.ErrTokenExpired
+	}
+
+	return authToken, nil
+}
+
+// createSession начинает новую сессию: короткий токен доступа и refresh-токен, по которому его можно обновить
+// Если устройств стало больше лимита проекта, самые давно использованные сессии закрываются
+func (s *Service) createSession(ctx context.Context, userId int, client SessionClient) (*LoginResult, error) {
+	sessionId, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, refreshTokenHash, err := generateRefreshToken(sessionId.String())
+	if err != nil {
+		logger.Error(ctx, "could not generate refresh token", "err", err.Error())
+		return nil, err
+	}
+
+	revokedIds, err := s.repo.CreateSession(ctx, NewSession{
+		SessionClient:    client,
+		ID:               sessionId.String(),
+		UserID:           userId,
+		RefreshTokenHash: refreshTokenHash,
+		ExpiresAt:        time.Now().Add(s.config.RefreshTokenExp),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(revokedIds) > 0 {
+		logger.Info(ctx, "session limit reached, old sessions revoked", "user_id", userId, "count", len(revokedIds))
+		s.markSessionsRevoked(ctx, revokedIds)
+	}
+
+	return s.createSessionTokens(userId, sessionId.String(), refreshToken)
+}
+
+func (s *Service) createSessionTokens(userId int, sessionId string, refreshToken string) (*LoginResult, error) {
+	expiresAt := time.Now().Add(s.config.JwtTokenExp)
+
+	token, err := s.createJWTToken(userId, sessionId, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginResult{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt,
+	}, nil
+}
+
+// RefreshSession выдает новую пару токенов и меняет refresh-токен сессии.
+// Повторно использованный или отозванный refresh-токен закрывает всю сессию
+func (s *Service) RefreshSession(ctx context.Context, refreshToken string, client SessionClient) (*LoginResult, error) {
+	sessionId, ok := parseRefreshToken(refreshToken)
+	if !ok {
+		return nil, common.ErrInvalidRefreshToken
+	}
+
+	newRefreshToken, newRefreshTokenHash, err := generateRefreshToken(sessionId)
+	if err != nil {
+		logger.Error(ctx, "could not generate refresh token", "err", err.Error())
+		return nil, common.ErrInternalError
+	}
+
+	userId, err := s.repo.RotateSession(ctx, sessionId, hashToken(refreshToken), newRefreshTokenHash, time.Now().Add(s.config.RefreshTokenExp), client)
+	if errors.Is(err, common.ErrRefreshTokenReused) {
+		logger.Error(ctx, "refresh token reused, session revoked", "session_id", sessionId, "user_id", userId)
+		s.markSessionsRevoked(ctx, []string{sessionId})
+		return nil, common.ErrInvalidRefreshToken
+	}
+
+	if errors.Is(err, common.ErrInvalidRefreshToken) {
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, common.ErrInternalError
+	}
+
+	result, err := s.createSessionTokens(userId, sessionId, newRefreshToken)
+	if err != nil {
+		return nil, common.ErrInternalError
+	}
+
+	return result, nil
+}
+
+// Logout закрывает сессию, в которой пришел запрос
+func (s *Service) Logout(ctx context.Context, user *User) error {
+	return s.RevokeSession(ctx, user.ID, user.SessionID)
+}
+
+// GetUserSessions — устройства, на которых открыт аккаунт. Текущее отмечено
+func (s *Service) GetUserSessions(ctx context.Context, user *User) ([]UserSession, error) {
+	sessions, err := s.repo.GetUserSessions(ctx, user.ID)
+	if err != nil {
+		return nil, common.ErrInternalError
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == user.SessionID
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession закрывает одну сессию пользователя, например на чужом устройстве
+func (s *Service) RevokeSession(ctx context.Context, userId int, sessionId string) error {
+	_, err := uuid.Parse(sessionId)
+	if err != nil {
+		return common.ErrSessionNotFound
+	}
+
+	err = s.repo.RevokeSession(ctx, userId, sessionId)
+	if errors.Is(err, common.ErrSessionNotFound) {
+		return err
+	}
+
+	if err != nil {
+		return common.ErrInternalError
+	}
+
+	s.markSessionsRevoked(ctx, []string{sessionId})
+
+	return nil
+}
+
+// LogoutEverywhere закрывает все сессии пользователя на всех устройствах
+func (s *Service) LogoutEverywhere(ctx context.Context, userId int) error {
+	sessionIds, err := s.repo.RevokeUserSessions(ctx, userId)
+	if err != nil {
+		return common.ErrInternalError
+	}
+
+	s.markSessionsRevoked(ctx, sessionIds)
+
+	logger.Info(ctx, "revoked all user sessions", "user_id", userId, "count", len(sessionIds))
+
+	return nil
+}
+
+// markSessionsRevoked запоминает отозванные сессии в кэше, чтобы сразу перестать принимать их токены доступа.
+// Дольше времени жизни токена доступа помнить не нужно — потом он истечет сам
+func (s *Service) markSessionsRevoked(ctx context.Context, sessionIds []string) {
+	exp := s.config.JwtTokenExp
+
+	for _, sessionId := range sessionIds {
+		err := s.cache.Set(ctx, cache.GetRevokedSessionKey(sessionId), true, &exp)
+		if err != nil {
+			logger.Error(ctx, "could not mark session revoked", "session_id", sessionId, "err", err.Error())
+		}
+	}
+}
 
+// generateRefreshToken — случайный refresh-токен сессии и его хеш для базы.
+// Id сессии в начале токена нужен, чтобы найти сессию без перебора
+func generateRefreshToken(sessionId string) (string, string, error) {
+	secret, err := generateToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	token := sessionId + "." + secret
+
+	return token, hashToken(token), nil
+}
+
+func parseRefreshToken(token string) (string, bool) {
+	sessionId, secret, found := strings.Cut(token, ".")
+	if !found || secret == "" {
+		return "", false
+	}
+
+	_, err := uuid.Parse(sessionId)
+	if err != nil {
+		return "", false
+	}
+
+	return sessionId, true
+}
+
+// generateToken — случайный токен, который можно положить в ссылку
+func generateToken() (string, error) {
+	secret := make([]byte, 32)
+
+	_, err := rand.Read(secret)
 	if err != nil {
 		return "", err
 	}
 
-	magicLink := s.config.HeroAppBaseURL + "/login/magic-link?token=" + tokenString
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
 
-	return magicLink, nil
+// hashToken — хеш токена для базы. Сами токены не хранятся
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
 }
 
-func (s *Service) createJWTToken(userId int) (string, error) {
+func (s *Service) createJWTToken(userId int, sessionId string, expiresAt time.Time) (string, error) {
 
 	claims := Claims{
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.config.JwtTokenExp)),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
 		},
-		UserID: userId,
+		UserID:    userId,
+		SessionID: sessionId,
 	}
 
 	token := jwt.NewWithClaims(s.config.JwtSigningMethod, claims)
@@ -1284,7 +3463,69 @@ func (s *Service) createJWTToken(userId int) (string, error) {
 	return tokenString, nil
 }
 
+// ValidateJWTToken проверяет токен доступа: подпись, срок и то, что его сессию не закрыли
 func (s *Service) ValidateJWTToken(ctx context.Context, token string) (*User, error) {
+	claims, err := s.parseJWTToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = uuid.Parse(claims.SessionID); err != nil {
+		return nil, common.ErrInvalidToken
+	}
+
+	revoked, err := s.isSessionRevoked(ctx, claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if revoked {
+		return nil, common.ErrInvalidToken
+	}
+
+	user, err := s.repo.FindUserById(ctx, claims.UserID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	user.SessionID = claims.SessionID
+
+	return user, nil
+}
+
+// isSessionRevoked проверяет, отозвана ли сессия токена доступа. Кэш только ускоряет проверку:
+// если ответа в нем нет или кэш недоступен, ответ берется из базы. Если не ответила и база, токен не принимается
+func (s *Service) isSessionRevoked(ctx context.Context, sessionId string) (bool, error) {
+	var revoked bool
+	err := s.cache.Get(ctx, cache.GetRevokedSessionKey(sessionId), &revoked)
+	if err == nil {
+		return revoked, nil
+	}
+
+	if !errors.Is(err, common.ErrCacheItemNotFound) {
+		logger.Error(ctx, "could not check revoked session in cache", "session_id", sessionId, "err", err.Error())
+	}
+
+	revoked, err = s.repo.IsSessionRevoked(ctx, sessionId)
+	if err != nil {
+		return false, common.ErrInternalError
+	}
+
+	exp := activeSessionCacheTime
+	if revoked {
+		exp = s.config.JwtTokenExp
+	}
+
+	err = s.cache.Set(ctx, cache.GetRevokedSessionKey(sessionId), revoked, &exp)
+	if err != nil {
+		logger.Error(ctx, "could not cache session state", "session_id", sessionId, "err", err.Error())
+	}
+
+	return revoked, nil
+}
+
+func (s *Service) parseJWTToken(token string) (*Claims, error) {
 	claims := Claims{}
 	data, err := jwt.ParseWithClaims(token, &claims,
 		func(t *jwt.Token) (interface{}, error) {
@@ -1311,13 +3552,7 @@ func (s *Service) ValidateJWTToken(ctx context.Context, token string) (*User, er
 		return nil, common.ErrInvalidToken
 	}
 
-	user, err := s.repo.FindUserById(ctx, claims.UserID)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return user, nil
+	return &claims, nil
 }
 
 func (s *Service) passwordMatches(hash string, password string) bool {
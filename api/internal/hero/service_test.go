@@ -1,12 +1,27 @@
 package hero
 
 import (
+	"context"
 	"createtodayapi/internal/cache"
+	"createtodayapi/internal/common"
 	"createtodayapi/internal/config"
 	"createtodayapi/internal/infra"
 	"createtodayapi/internal/logger"
+	"createtodayapi/internal/payments"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/require"
 )
 
@@ -27,6 +42,67 @@ func NewTestService() *Service {
 	return service
 }
 
+// NewTestDBService — NewTestService для тестов, которым нужна база. Если база из .env недоступна, тест пропускается
+func NewTestDBService(t *testing.T) (*Service, *sqlx.DB) {
+	t.Helper()
+
+	service := NewTestService()
+	if service == nil {
+		t.Skip("postgres is not configured")
+	}
+
+	db := service.repo.(*PostgresRepo).db
+	if err := db.Ping(); err != nil {
+		t.Skipf("postgres is not available: %s", err)
+	}
+
+	return service, db
+}
+
+func createTestUser(t *testing.T, db *sqlx.DB) int64 {
+	t.Helper()
+
+	var userId int64
+	email := fmt.Sprintf("test-%d@createtoday.test", time.Now().UnixNano())
+	err := db.Get(&userId, `insert into "user" (email, password) values ($1, 'password') returning id`, email)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_, _ = db.Exec(`delete from "user" where id = $1`, userId)
+	})
+
+	return userId
+}
+
+func createTestOffer(t *testing.T, db *sqlx.DB, reminderDelay *string) int64 {
+	t.Helper()
+
+	var offerId int64
+	slug := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	err := db.Get(&offerId, `
+		insert into offer (name, slug, price, is_free, payment_reminder_delay)
+		values ('Тестовый оффер', $1, 1000, false, $2::interval) returning id`, slug, reminderDelay)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_, _ = db.Exec(`delete from offer where id = $1`, offerId)
+	})
+
+	return offerId
+}
+
+func createTestOrder(t *testing.T, db *sqlx.DB, userId, offerId int64, status string, createdAt time.Time) int64 {
+	t.Helper()
+
+	var orderId int64
+	err := db.Get(&orderId, `
+		insert into "order" (price, status, offer_id, user_id, created_at)
+		values (1000, $1, $2, $3, $4) returning id`, status, offerId, userId, createdAt)
+	require.NoError(t, err)
+
+	return orderId
+}
+
 func TestGeneratePassword(t *testing.T) {
 	t.Parallel()
 	service := NewTestService()
@@ -37,3 +113,961 @@ func TestGeneratePassword(t *testing.T) {
 		t.Log(password)
 	})
 }
+
+func TestPromocodeDiscount(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		Promocode Promocode
+		Price     uint64
+		Want      uint64
+	}{
+		"percent":             {Promocode: Promocode{DiscountType: PromocodeDiscountPercent, DiscountValue: 10}, Price: 2900, Want: 290},
+		"percent rounds down": {Promocode: Promocode{DiscountType: PromocodeDiscountPercent, DiscountValue: 15}, Price: 999, Want: 149},
+		"fixed":               {Promocode: Promocode{DiscountType: PromocodeDiscountFixed, DiscountValue: 500}, Price: 2900, Want: 500},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.Want, tc.Promocode.Discount(tc.Price))
+		})
+	}
+}
+
+func TestGetDonatePrice(t *testing.T) {
+	t.Parallel()
+	service := &Service{}
+
+	settings := json.RawMessage(`{"max_donate_price":10000,"donate_tiers":[500,1000,3000]}`)
+	offer := &OfferForProcessing{IsDonate: true, MinDonatePrice: 300, Settings: &settings}
+
+	cases := map[string]struct {
+		Amount  uint64
+		WantErr error
+	}{
+		"within limits": {Amount: 1500},
+		"minimum":       {Amount: 300},
+		"maximum":       {Amount: 10000},
+		"too small":     {Amount: 299, WantErr: common.ErrInvalidDonateAmount},
+		"too large":     {Amount: 10001, WantErr: common.ErrInvalidDonateAmount},
+		"empty":         {Amount: 0, WantErr: common.ErrInvalidDonateAmount},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			price, err := service.getDonatePrice(context.Background(), offer, tc.Amount)
+			if tc.WantErr != nil {
+				require.ErrorIs(t, err, tc.WantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.Amount, price)
+		})
+	}
+}
+
+func TestValidateGift(t *testing.T) {
+	t.Parallel()
+	service := &Service{}
+
+	recipient := &GiftRecipient{Email: "friend@example.com", FirstName: "Мария"}
+
+	cases := map[string]struct {
+		Offer   *OfferForProcessing
+		DTO     ProcessOfferDTO
+		WantErr error
+	}{
+		"paid offer": {
+			Offer: &OfferForProcessing{Type: OfferTypeOneTime},
+			DTO:   ProcessOfferDTO{Email: "buyer@example.com", GiftRecipient: recipient},
+		},
+		"free offer": {
+			Offer:   &OfferForProcessing{IsFree: true},
+			DTO:     ProcessOfferDTO{Email: "buyer@example.com", GiftRecipient: recipient},
+			WantErr: common.ErrGiftNotAllowed,
+		},
+		"subscription": {
+			Offer:   &OfferForProcessing{Type: OfferTypeSubscription},
+			DTO:     ProcessOfferDTO{Email: "buyer@example.com", GiftRecipient: recipient},
+			WantErr: common.ErrGiftNotAllowed,
+		},
+		"without recipient": {
+			Offer:   &OfferForProcessing{Type: OfferTypeOneTime},
+			DTO:     ProcessOfferDTO{Email: "buyer@example.com"},
+			WantErr: common.ErrEmptyGiftRecipient,
+		},
+		"to yourself": {
+			Offer:   &OfferForProcessing{Type: OfferTypeOneTime},
+			DTO:     ProcessOfferDTO{Email: "Friend@Example.com", GiftRecipient: recipient},
+			WantErr: common.ErrGiftToYourself,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := service.validateGift(tc.Offer, tc.DTO)
+			if tc.WantErr != nil {
+				require.ErrorIs(t, err, tc.WantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestPrepareUserOrder(t *testing.T) {
+	t.Parallel()
+
+	t.Run("should mask card number", func(t *testing.T) {
+		order := UserOrder{
+			Status:   "succeeded",
+			CardInfo: &OrderCardInfo{Pan: "430000******0777", ExpirationDate: "1122"},
+		}
+
+		prepareUserOrder(&order)
+
+		require.Equal(t, "************0777", order.CardInfo.Pan)
+		require.Equal(t, "1122", order.CardInfo.ExpirationDate)
+		require.False(t, order.CanRetry)
+	})
+
+	t.Run("should allow retry for rejected order without card", func(t *testing.T) {
+		order := UserOrder{Status: "rejected"}
+
+		prepareUserOrder(&order)
+
+		require.Nil(t, order.CardInfo)
+		require.True(t, order.CanRetry)
+	})
+}
+
+func TestCheckOfferSales(t *testing.T) {
+	t.Parallel()
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	noSeats := 0
+	someSeats := 3
+
+	cases := map[string]struct {
+		Offer   OfferForProcessing
+		WantErr error
+	}{
+		"without limits":       {Offer: OfferForProcessing{}},
+		"inside sales window":  {Offer: OfferForProcessing{SalesStartAt: &past, SalesEndAt: &future, RemainingSeats: &someSeats}},
+		"sales not started":    {Offer: OfferForProcessing{SalesStartAt: &future}, WantErr: common.ErrOfferSalesClosed},
+		"sales ended":          {Offer: OfferForProcessing{SalesEndAt: &past}, WantErr: common.ErrOfferSalesClosed},
+		"no seats left":        {Offer: OfferForProcessing{RemainingSeats: &noSeats}, WantErr: common.ErrOfferSoldOut},
+		"closed and no seats":  {Offer: OfferForProcessing{SalesEndAt: &past, RemainingSeats: &noSeats}, WantErr: common.ErrOfferSoldOut},
+		"seats before opening": {Offer: OfferForProcessing{SalesStartAt: &future, RemainingSeats: &someSeats}, WantErr: common.ErrOfferSalesClosed},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := checkOfferSales(&tc.Offer)
+			if tc.WantErr != nil {
+				require.ErrorIs(t, err, tc.WantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestCheckOfferSalesLimits(t *testing.T) {
+	service, db := NewTestDBService(t)
+	ctx := context.Background()
+	repo := service.repo.(*PostgresRepo)
+
+	first := createTestOffer(t, db, nil)
+	second := createTestOffer(t, db, nil)
+
+	check := func(offerIds []int64) error {
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		err = repo.checkOfferSalesLimits(ctx, tx, offerIds)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	t.Run("should not deadlock on offers that are bumps of each other", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 40)
+
+		for _, offerIds := range [][]int64{{first, second}, {second, first}} {
+			wg.Add(1)
+			go func(offerIds []int64) {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					errs <- check(offerIds)
+				}
+			}(offerIds)
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("should check repeated offer once", func(t *testing.T) {
+		require.NoError(t, check([]int64{first, first, second}))
+	})
+
+	t.Run("should not find unknown offer", func(t *testing.T) {
+		require.ErrorIs(t, check([]int64{first, -1}), common.ErrOfferNotFound)
+	})
+}
+
+func TestOrderItemsWithBumps(t *testing.T) {
+	t.Parallel()
+
+	available := []OfferBump{
+		{OfferID: 2, Slug: "workbook", Name: "Рабочая тетрадь", Price: 490},
+		{OfferID: 3, Slug: "bonus-lesson", Name: "Бонусный урок", Price: 990},
+	}
+
+	offer := OfferForProcessing{ID: 1, Slug: "course", Name: "Курс", Price: 2900}
+
+	t.Run("should keep offer order", func(t *testing.T) {
+		bumps, err := selectOfferBumps(&offer, available, []string{"bonus-lesson", "workbook"})
+		require.NoError(t, err)
+		require.Len(t, bumps, 2)
+		require.Equal(t, "workbook", bumps[0].Slug)
+	})
+
+	t.Run("should reject repeated bump", func(t *testing.T) {
+		_, err := selectOfferBumps(&offer, available, []string{"bonus-lesson", "workbook", "bonus-lesson"})
+		require.ErrorIs(t, err, common.ErrDuplicateBump)
+	})
+
+	t.Run("should reject bump with the same offer twice", func(t *testing.T) {
+		twice := append(available, OfferBump{OfferID: 2, Slug: "workbook-copy", Name: "Рабочая тетрадь", Price: 490})
+		_, err := selectOfferBumps(&offer, twice, []string{"workbook", "workbook-copy"})
+		require.ErrorIs(t, err, common.ErrDuplicateBump)
+	})
+
+	t.Run("should reject offer as its own bump", func(t *testing.T) {
+		_, err := selectOfferBumps(&offer, available, []string{"course"})
+		require.ErrorIs(t, err, common.ErrBumpIsOffer)
+	})
+
+	t.Run("should reject unknown bump", func(t *testing.T) {
+		_, err := selectOfferBumps(&offer, available, []string{"workbook", "other"})
+		require.ErrorIs(t, err, common.ErrBumpNotFound)
+	})
+
+	t.Run("should apply promocode to offer only", func(t *testing.T) {
+		promocode := AppliedPromocode{Discount: 290, FinalPrice: 2610}
+
+		items := newOrderItems(&offer, promocode.FinalPrice, &promocode, available)
+
+		require.Len(t, items, 3)
+		require.Equal(t, uint64(290), items[0].Discount)
+		require.False(t, items[0].IsBump)
+		require.True(t, items[1].IsBump)
+		require.Equal(t, uint64(2610+490+990), orderItemsTotal(items))
+		require.Equal(t, "Курс + Рабочая тетрадь + Бонусный урок", orderDescription(items))
+	})
+}
+
+func TestReferralStats(t *testing.T) {
+	t.Parallel()
+
+	t.Run("should generate code without similar chars", func(t *testing.T) {
+		code, err := generateReferralCode()
+		require.NoError(t, err)
+		require.Len(t, code, referralCodeLength)
+		require.NotContains(t, code, "0")
+		require.NotContains(t, code, "O")
+	})
+
+	t.Run("should sum stats of all projects", func(t *testing.T) {
+		stats := sumReferralStats("K7M2QX9P", []ReferralProjectStats{
+			{ProjectID: 1, Clicks: 10, Sales: 2, Earned: 580, PaidOut: 290, Balance: 290},
+			{ProjectID: 2, Clicks: 3, Sales: 1, Earned: 100, Balance: 100},
+		})
+
+		require.Equal(t, "K7M2QX9P", stats.Code)
+		require.Equal(t, 13, stats.Clicks)
+		require.Equal(t, 3, stats.Sales)
+		require.Equal(t, uint64(680), stats.Earned)
+		require.Equal(t, uint64(290), stats.PaidOut)
+		require.Equal(t, uint64(390), stats.Balance)
+	})
+}
+
+func TestRefreshToken(t *testing.T) {
+	t.Parallel()
+
+	sessionId := "0b5f3c2e-8a51-4d43-9a4b-2f6d0c1e7a90"
+
+	t.Run("should start with session id", func(t *testing.T) {
+		token, hash, err := generateRefreshToken(sessionId)
+		require.NoError(t, err)
+		require.Equal(t, hashToken(token), hash)
+		require.Len(t, hash, 64)
+
+		parsed, ok := parseRefreshToken(token)
+		require.True(t, ok)
+		require.Equal(t, sessionId, parsed)
+	})
+
+	t.Run("should differ for the same session", func(t *testing.T) {
+		first, _, err := generateRefreshToken(sessionId)
+		require.NoError(t, err)
+		second, _, err := generateRefreshToken(sessionId)
+		require.NoError(t, err)
+		require.NotEqual(t, first, second)
+	})
+
+	t.Run("should reject malformed token", func(t *testing.T) {
+		for _, token := range []string{"", sessionId, sessionId + ".", "not-a-uuid.secret"} {
+			_, ok := parseRefreshToken(token)
+			require.False(t, ok, token)
+		}
+	})
+}
+
+func TestGenerateToken(t *testing.T) {
+	t.Parallel()
+
+	t.Run("should be url safe and unique", func(t *testing.T) {
+		first, err := generateToken()
+		require.NoError(t, err)
+		second, err := generateToken()
+		require.NoError(t, err)
+
+		require.Len(t, first, 43)
+		require.NotContains(t, first, "+")
+		require.NotContains(t, first, "/")
+		require.NotEqual(t, first, second)
+	})
+
+	t.Run("should store hash instead of token", func(t *testing.T) {
+		token, err := generateToken()
+		require.NoError(t, err)
+
+		require.Equal(t, hashToken(token), hashToken(token))
+		require.NotContains(t, hashToken(token), token)
+	})
+}
+
+func TestAuthTokens(t *testing.T) {
+	service, db := NewTestDBService(t)
+	ctx := context.Background()
+
+	t.Run("should be used only once", func(t *testing.T) {
+		userId := int(createTestUser(t, db))
+
+		token, err := service.createAuthToken(ctx, userId, AuthTokenPurposeMagicLink, "", time.Hour, 5)
+		require.NoError(t, err)
+
+		consumedBy, err := service.consumeAuthToken(ctx, AuthTokenPurposeMagicLink, token)
+		require.NoError(t, err)
+		require.Equal(t, userId, consumedBy)
+
+		_, err = service.consumeAuthToken(ctx, AuthTokenPurposeMagicLink, token)
+		require.ErrorIs(t, err, common.ErrInvalidToken)
+	})
+
+	t.Run("should not be used for another purpose", func(t *testing.T) {
+		userId := int(createTestUser(t, db))
+
+		token, err := service.createAuthToken(ctx, userId, AuthTokenPurposeMagicLink, "", time.Hour, 5)
+		require.NoError(t, err)
+
+		_, err = service.consumeAuthToken(ctx, AuthTokenPurposePasswordReset, token)
+		require.ErrorIs(t, err, common.ErrInvalidToken)
+
+		// неудачная попытка не тратит токен
+		consumedBy, err := service.consumeAuthToken(ctx, AuthTokenPurposeMagicLink, token)
+		require.NoError(t, err)
+		require.Equal(t, userId, consumedBy)
+	})
+
+	t.Run("should keep email of email token", func(t *testing.T) {
+		userId := int(createTestUser(t, db))
+
+		token, err := service.createAuthToken(ctx, userId, AuthTokenPurposeEmailChange, "new@createtoday.test", time.Hour, 5)
+		require.NoError(t, err)
+
+		authToken, err := service.consumeEmailToken(ctx, AuthTokenPurposeEmailChange, token)
+		require.NoError(t, err)
+		require.NotNil(t, authToken.Email)
+		require.Equal(t, "new@createtoday.test", *authToken.Email)
+	})
+
+	t.Run("should reject expired token", func(t *testing.T) {
+		userId := int(createTestUser(t, db))
+
+		token, err := service.createAuthToken(ctx, userId, AuthTokenPurposePasswordReset, "", -time.Minute, 5)
+		require.NoError(t, err)
+
+		_, err = service.consumeAuthToken(ctx, AuthTokenPurposePasswordReset, token)
+		require.ErrorIs(t, err, common.ErrTokenExpired)
+
+		_, err = service.consumeAuthToken(ctx, AuthTokenPurposePasswordReset, token)
+		require.ErrorIs(t, err, common.ErrInvalidToken)
+	})
+
+	t.Run("should limit tokens per hour for each purpose", func(t *testing.T) {
+		userId := int(createTestUser(t, db))
+
+		for i := 0; i < 2; i++ {
+			_, err := service.createAuthToken(ctx, userId, AuthTokenPurposeMagicLink, "", time.Hour, 2)
+			require.NoError(t, err)
+		}
+
+		_, err := service.createAuthToken(ctx, userId, AuthTokenPurposeMagicLink, "", time.Hour, 2)
+		require.ErrorIs(t, err, common.ErrTooManyAuthTokens)
+
+		_, err = service.createAuthToken(ctx, userId, AuthTokenPurposePasswordReset, "", time.Hour, 2)
+		require.NoError(t, err)
+
+		// токены старше часа в лимит не входят
+		_, err = db.Exec(`update auth_token set created_at = now() - interval '2 hours' where user_id = $1`, userId)
+		require.NoError(t, err)
+
+		_, err = service.createAuthToken(ctx, userId, AuthTokenPurposeMagicLink, "", time.Hour, 2)
+		require.NoError(t, err)
+	})
+
+	t.Run("should use all user tokens of given purposes", func(t *testing.T) {
+		userId := int(createTestUser(t, db))
+
+		magicLink, err := service.createAuthToken(ctx, userId, AuthTokenPurposeMagicLink, "", time.Hour, 5)
+		require.NoError(t, err)
+		verify, err := service.createAuthToken(ctx, userId, AuthTokenPurposeEmailVerify, "", time.Hour, 5)
+		require.NoError(t, err)
+
+		err = service.repo.UseUserAuthTokens(ctx, userId, []string{AuthTokenPurposeMagicLink, AuthTokenPurposePasswordReset})
+		require.NoError(t, err)
+
+		_, err = service.consumeAuthToken(ctx, AuthTokenPurposeMagicLink, magicLink)
+		require.ErrorIs(t, err, common.ErrInvalidToken)
+
+		_, err = service.consumeAuthToken(ctx, AuthTokenPurposeEmailVerify, verify)
+		require.NoError(t, err)
+	})
+}
+
+func TestResetPasswordBody(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		Body    ResetPasswordBody
+		WantErr error
+	}{
+		"valid":          {Body: ResetPasswordBody{Token: "token", Password: "12345678"}},
+		"without token":  {Body: ResetPasswordBody{Password: "12345678"}, WantErr: common.ErrInvalidPasswordResetLink},
+		"empty password": {Body: ResetPasswordBody{Token: "token"}, WantErr: common.ErrNewPasswordIsEmpty},
+		"short password": {Body: ResetPasswordBody{Token: "token", Password: "1234567"}, WantErr: common.ErrNewPasswordIsShort},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.Body.Validate()
+			if tc.WantErr != nil {
+				require.ErrorIs(t, err, tc.WantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestChangeEmailBody(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		Email   string
+		WantErr error
+	}{
+		"valid":         {Email: "new@example.com"},
+		"with spaces":   {Email: "  new@example.com "},
+		"empty":         {Email: " ", WantErr: common.ErrEmptyEmail},
+		"without at":    {Email: "new.example.com", WantErr: common.ErrInvalidEmail},
+		"with name":     {Email: "Мария <new@example.com>", WantErr: common.ErrInvalidEmail},
+		"several mails": {Email: "a@example.com, b@example.com", WantErr: common.ErrInvalidEmail},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			body := ChangeEmailBody{Email: tc.Email}
+			err := body.Validate()
+			if tc.WantErr != nil {
+				require.ErrorIs(t, err, tc.WantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "new@example.com", body.Email)
+		})
+	}
+
+	t.Run("should map token errors to confirm link errors", func(t *testing.T) {
+		require.ErrorIs(t, emailConfirmError(common.ErrTokenExpired), common.ErrEmailConfirmLinkExpired)
+		require.ErrorIs(t, emailConfirmError(common.ErrInvalidToken), common.ErrInvalidEmailConfirmLink)
+		require.ErrorIs(t, emailConfirmError(common.ErrInternalError), common.ErrInternalError)
+	})
+}
+
+func TestTakeOrdersForReminder(t *testing.T) {
+	service, db := NewTestDBService(t)
+	ctx := context.Background()
+	repo := service.repo.(*PostgresRepo)
+
+	delay := "1 hour"
+	offerId := createTestOffer(t, db, &delay)
+	offerWithoutReminder := createTestOffer(t, db, nil)
+	userId := createTestUser(t, db)
+	buyerId := createTestUser(t, db)
+
+	longAgo := time.Now().Add(-2 * time.Hour)
+	due := createTestOrder(t, db, userId, offerId, payments.StatusPending, longAgo)
+	rejected := createTestOrder(t, db, userId, offerId, payments.StatusRejected, longAgo)
+	fresh := createTestOrder(t, db, userId, offerId, payments.StatusPending, time.Now())
+	noReminder := createTestOrder(t, db, userId, offerWithoutReminder, payments.StatusPending, longAgo)
+	expired := createTestOrder(t, db, userId, offerId, payments.StatusExpired, longAgo)
+	// покупатель уже оплатил оффер другим заказом
+	paidPending := createTestOrder(t, db, buyerId, offerId, payments.StatusPending, longAgo)
+	createTestOrder(t, db, buyerId, offerId, payments.StatusSucceeded, longAgo)
+
+	takeOwn := func() []int64 {
+		orderIds, err := repo.TakeOrdersForReminder(ctx, 2, 10000)
+		require.NoError(t, err)
+
+		own := make([]int64, 0)
+		for _, id := range orderIds {
+			for _, ownId := range []int64{due, rejected, fresh, noReminder, expired, paidPending} {
+				if id == ownId {
+					own = append(own, id)
+				}
+			}
+		}
+		return own
+	}
+
+	t.Run("should take unpaid orders after offer delay", func(t *testing.T) {
+		require.ElementsMatch(t, []int64{due, rejected}, takeOwn())
+	})
+
+	t.Run("should wait delay after previous reminder", func(t *testing.T) {
+		require.Empty(t, takeOwn())
+	})
+
+	t.Run("should stop after max reminders", func(t *testing.T) {
+		_, err := db.Exec(`update "order" set reminded_at = $2 where id = any($1)`, pq.Array([]int64{due, rejected}), longAgo)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []int64{due, rejected}, takeOwn())
+
+		_, err = db.Exec(`update "order" set reminded_at = $2 where id = any($1)`, pq.Array([]int64{due, rejected}), longAgo)
+		require.NoError(t, err)
+		require.Empty(t, takeOwn())
+
+		var remindersSent int
+		err = db.Get(&remindersSent, `select reminders_sent from "order" where id = $1`, due)
+		require.NoError(t, err)
+		require.Equal(t, 2, remindersSent)
+	})
+}
+
+func TestChangeOrderStatusPaymentId(t *testing.T) {
+	service, db := NewTestDBService(t)
+	ctx := context.Background()
+	repo := service.repo.(*PostgresRepo)
+
+	offerId := createTestOffer(t, db, nil)
+	userId := createTestUser(t, db)
+
+	paymentId := func(orderId int64) string {
+		var id string
+		err := db.Get(&id, `select payment_id from "order" where id = $1`, orderId)
+		require.NoError(t, err)
+		return id
+	}
+
+	createOrderWithPayment := func(status string) int64 {
+		orderId := createTestOrder(t, db, userId, offerId, status, time.Now())
+		_, err := db.Exec(`update "order" set payment_id = 'current' where id = $1`, orderId)
+		require.NoError(t, err)
+		return orderId
+	}
+
+	t.Run("should not switch payment on illegal transition", func(t *testing.T) {
+		orderId := createOrderWithPayment(payments.StatusRefunded)
+
+		_, err := repo.ChangeOrderStatus(ctx, ChangeOrderStatusDTO{
+			OrderID:   orderId,
+			Status:    payments.StatusSucceeded,
+			PaymentID: "previous",
+		})
+		require.ErrorIs(t, err, common.ErrIllegalOrderTransition)
+		require.Equal(t, "current", paymentId(orderId))
+	})
+
+	t.Run("should not switch payment of already paid order", func(t *testing.T) {
+		orderId := createOrderWithPayment(payments.StatusSucceeded)
+
+		_, err := repo.ChangeOrderStatus(ctx, ChangeOrderStatusDTO{
+			OrderID:   orderId,
+			Status:    payments.StatusSucceeded,
+			PaymentID: "previous",
+		})
+		require.NoError(t, err)
+		require.Equal(t, "current", paymentId(orderId))
+	})
+
+	t.Run("should switch payment with status change", func(t *testing.T) {
+		orderId := createOrderWithPayment(payments.StatusPending)
+
+		result, err := repo.ChangeOrderStatus(ctx, ChangeOrderStatusDTO{
+			OrderID:   orderId,
+			Status:    payments.StatusSucceeded,
+			PaymentID: "previous",
+		})
+		require.NoError(t, err)
+		require.True(t, result.Changed)
+		require.Equal(t, "previous", paymentId(orderId))
+	})
+}
+
+func TestCreateGiftRecipientOnSuccess(t *testing.T) {
+	service, db := NewTestDBService(t)
+	ctx := context.Background()
+	repo := service.repo.(*PostgresRepo)
+
+	offerId := createTestOffer(t, db, nil)
+	buyerId := createTestUser(t, db)
+
+	createGiftOrder := func(recipientEmail string) int64 {
+		orderId := createTestOrder(t, db, buyerId, offerId, payments.StatusPending, time.Now())
+		_, err := db.Exec(`
+			update "order" set is_gift = true, gifted_to = json_build_object('email', $2::text, 'first_name', 'Маша', 'from_name', 'Петя')
+			where id = $1`, orderId, recipientEmail)
+		require.NoError(t, err)
+		return orderId
+	}
+
+	giftRecipient := func(orderId int64) (*int64, GiftedTo) {
+		var order struct {
+			GiftRecipientID *int64    `db:"gift_recipient_id"`
+			GiftedTo        *GiftedTo `db:"gifted_to"`
+		}
+		err := db.Get(&order, `select gift_recipient_id, gifted_to from "order" where id = $1`, orderId)
+		require.NoError(t, err)
+		require.NotNil(t, order.GiftedTo)
+		return order.GiftRecipientID, *order.GiftedTo
+	}
+
+	recipientEmail := fmt.Sprintf("gift-%d@createtoday.test", time.Now().UnixNano())
+	t.Cleanup(func() {
+		_, _ = db.Exec(`delete from "user" where email = $1`, recipientEmail)
+	})
+
+	t.Run("should not create recipient before payment", func(t *testing.T) {
+		orderId := createGiftOrder(recipientEmail)
+
+		_, err := repo.ChangeOrderStatus(ctx, ChangeOrderStatusDTO{OrderID: orderId, Status: payments.StatusRejected})
+		require.NoError(t, err)
+
+		recipientId, _ := giftRecipient(orderId)
+		require.Nil(t, recipientId)
+
+		var users int
+		err = db.Get(&users, `select count(*) from "user" where email = $1`, recipientEmail)
+		require.NoError(t, err)
+		require.Zero(t, users)
+	})
+
+	t.Run("should register new recipient on payment", func(t *testing.T) {
+		orderId := createGiftOrder(recipientEmail)
+
+		_, err := repo.ChangeOrderStatus(ctx, ChangeOrderStatusDTO{
+			OrderID:               orderId,
+			Status:                payments.StatusSucceeded,
+			GiftRecipientPassword: "hashed-password",
+		})
+		require.NoError(t, err)
+
+		recipientId, giftedTo := giftRecipient(orderId)
+		require.NotNil(t, recipientId)
+		require.True(t, giftedTo.NewUser)
+		require.Equal(t, "Маша", giftedTo.FirstName)
+	})
+
+	t.Run("should use existing recipient", func(t *testing.T) {
+		orderId := createGiftOrder(recipientEmail)
+
+		_, err := repo.ChangeOrderStatus(ctx, ChangeOrderStatusDTO{
+			OrderID:               orderId,
+			Status:                payments.StatusSucceeded,
+			GiftRecipientPassword: "another-password",
+		})
+		require.NoError(t, err)
+
+		recipientId, giftedTo := giftRecipient(orderId)
+		require.NotNil(t, recipientId)
+		require.False(t, giftedTo.NewUser)
+
+		var password string
+		err = db.Get(&password, `select password from "user" where id = $1`, *recipientId)
+		require.NoError(t, err)
+		require.Equal(t, "hashed-password", password)
+	})
+}
+
+func TestPartialRefundWebhook(t *testing.T) {
+	service, db := NewTestDBService(t)
+	ctx := context.Background()
+	repo := service.repo.(*PostgresRepo)
+
+	offerId := createTestOffer(t, db, nil)
+	userId := createTestUser(t, db)
+	orderId := createTestOrder(t, db, userId, offerId, payments.StatusSucceeded, time.Now())
+
+	refundedAmount := func() uint64 {
+		var amount uint64
+		err := db.Get(&amount, `select refunded_amount from "order" where id = $1`, orderId)
+		require.NoError(t, err)
+		return amount
+	}
+
+	t.Run("should save refunded amount from webhook", func(t *testing.T) {
+		_, err := repo.ChangeOrderStatus(ctx, ChangeOrderStatusDTO{
+			OrderID:        orderId,
+			Status:         payments.StatusPartiallyRefunded,
+			ProviderStatus: "PARTIAL_REFUNDED",
+			RefundedAmount: 300,
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(300), refundedAmount())
+	})
+
+	t.Run("should save next partial refund with same status", func(t *testing.T) {
+		_, err := repo.ChangeOrderStatus(ctx, ChangeOrderStatusDTO{
+			OrderID:        orderId,
+			Status:         payments.StatusPartiallyRefunded,
+			RefundedAmount: 400,
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(400), refundedAmount())
+	})
+
+	t.Run("should not refund more than left after webhook", func(t *testing.T) {
+		_, err := repo.ReserveRefund(ctx, orderId, 1000)
+		require.ErrorIs(t, err, common.ErrInvalidRefundAmount)
+	})
+
+	t.Run("should not start second refund until first is saved", func(t *testing.T) {
+		reservation, err := repo.ReserveRefund(ctx, orderId, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint64(600), reservation.Amount)
+		require.Equal(t, uint64(400), reservation.RefundedBefore)
+
+		_, err = repo.ReserveRefund(ctx, orderId, 100)
+		require.ErrorIs(t, err, common.ErrRefundInProgress)
+
+		err = repo.CancelRefund(ctx, orderId)
+		require.NoError(t, err)
+	})
+
+	t.Run("should refund the rest through api", func(t *testing.T) {
+		reservation, err := repo.ReserveRefund(ctx, orderId, 600)
+		require.NoError(t, err)
+
+		// уведомление о возврате пришло раньше ответа платежной системы
+		_, err = repo.ChangeOrderStatus(ctx, ChangeOrderStatusDTO{
+			OrderID:        orderId,
+			Status:         payments.StatusPartiallyRefunded,
+			RefundedAmount: 1000,
+		})
+		require.NoError(t, err)
+
+		result, err := repo.RefundOrder(ctx, RefundOrderDTO{
+			OrderID:        orderId,
+			Amount:         reservation.Amount,
+			RefundedBefore: reservation.RefundedBefore,
+		})
+		require.NoError(t, err)
+		require.Equal(t, payments.StatusRefunded, result.Status)
+		require.Equal(t, uint64(1000), refundedAmount())
+
+		var refundingAmount uint64
+		err = db.Get(&refundingAmount, `select refunding_amount from "order" where id = $1`, orderId)
+		require.NoError(t, err)
+		require.Zero(t, refundingAmount)
+	})
+}
+
+func TestSessionClient(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		Forwarded string
+		Validate  bool
+		WantIP    string
+	}{
+		"single address":                {Forwarded: "203.0.113.7", WantIP: "203.0.113.7"},
+		"ipv6 address":                  {Forwarded: "2001:db8::1", WantIP: "2001:db8::1"},
+		"list without validation":       {Forwarded: "203.0.113.7, 10.0.0.1", WantIP: ""},
+		"list with validation":          {Forwarded: "203.0.113.7, 10.0.0.1", Validate: true, WantIP: "203.0.113.7"},
+		"spoofed long value":            {Forwarded: strings.Repeat("x", 100), WantIP: ""},
+		"spoofed value uses connection": {Forwarded: "not-an-ip", Validate: true, WantIP: "0.0.0.0"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			app := fiber.New(fiber.Config{ProxyHeader: fiber.HeaderXForwardedFor, EnableIPValidation: tc.Validate})
+
+			var client SessionClient
+			app.Get("/", func(ctx *fiber.Ctx) error {
+				client = sessionClient(ctx)
+				return nil
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(fiber.HeaderXForwardedFor, tc.Forwarded)
+			_, err := app.Test(req)
+			require.NoError(t, err)
+
+			require.Equal(t, tc.WantIP, client.IP)
+		})
+	}
+}
+
+// sessionStorage отвечает только на проверку отзыва сессии
+type sessionStorage struct {
+	Storage
+	revoked bool
+	err     error
+	calls   int
+}
+
+func (s *sessionStorage) IsSessionRevoked(ctx context.Context, sessionId string) (bool, error) {
+	s.calls++
+	return s.revoked, s.err
+}
+
+// brokenCache — недоступный кэш
+type brokenCache struct {
+	cache.Cache
+}
+
+func (c brokenCache) Get(ctx context.Context, key string, dest interface{}) error {
+	return errors.New("cache is down")
+}
+
+func (c brokenCache) Set(ctx context.Context, key string, val interface{}, exp *time.Duration) error {
+	return errors.New("cache is down")
+}
+
+func TestIsSessionRevoked(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	conf := &config.Config{JwtTokenExp: 15 * time.Minute}
+	sessionId := uuid.NewString()
+
+	t.Run("should check database when cache is down", func(t *testing.T) {
+		service := &Service{repo: &sessionStorage{revoked: true}, config: conf, cache: brokenCache{}}
+
+		revoked, err := service.isSessionRevoked(ctx, sessionId)
+		require.NoError(t, err)
+		require.True(t, revoked)
+	})
+
+	t.Run("should reject token when cache and database are down", func(t *testing.T) {
+		service := &Service{repo: &sessionStorage{err: errors.New("database is down")}, config: conf, cache: brokenCache{}}
+
+		_, err := service.isSessionRevoked(ctx, sessionId)
+		require.ErrorIs(t, err, common.ErrInternalError)
+	})
+
+	t.Run("should cache session state from database", func(t *testing.T) {
+		storage := &sessionStorage{}
+		service := &Service{repo: storage, config: conf, cache: cache.NewMemoryCache()}
+
+		for i := 0; i < 2; i++ {
+			revoked, err := service.isSessionRevoked(ctx, sessionId)
+			require.NoError(t, err)
+			require.False(t, revoked)
+		}
+		require.Equal(t, 1, storage.calls)
+	})
+
+	t.Run("should trust revoked mark in cache", func(t *testing.T) {
+		storage := &sessionStorage{}
+		service := &Service{repo: storage, config: conf, cache: cache.NewMemoryCache()}
+		service.markSessionsRevoked(ctx, []string{sessionId})
+
+		revoked, err := service.isSessionRevoked(ctx, sessionId)
+		require.NoError(t, err)
+		require.True(t, revoked)
+		require.Zero(t, storage.calls)
+	})
+}
+
+func TestCreateSession(t *testing.T) {
+	service, db := NewTestDBService(t)
+	ctx := context.Background()
+	repo := service.repo.(*PostgresRepo)
+
+	userId := createTestUser(t, db)
+
+	var projectId int64
+	domain := fmt.Sprintf("test-%d.createtoday.test", time.Now().UnixNano())
+	err := db.Get(&projectId, `insert into project (name, domain, max_user_sessions) values ('Тест', $1, 2) returning id`, domain)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = db.Exec(`delete from project where id = $1`, projectId)
+	})
+
+	var groupId int64
+	err = db.Get(&groupId, `insert into "group" (name, project_id) values ('Тест', $1) returning id`, projectId)
+	require.NoError(t, err)
+	_, err = db.Exec(`insert into user_group (group_id, user_id) values ($1, $2)`, groupId, userId)
+	require.NoError(t, err)
+
+	newSession := func() NewSession {
+		return NewSession{
+			SessionClient:    SessionClient{UserAgent: "test", IP: "203.0.113.7"},
+			ID:               uuid.NewString(),
+			UserID:           int(userId),
+			RefreshTokenHash: hashToken(uuid.NewString()),
+			ExpiresAt:        time.Now().Add(time.Hour),
+		}
+	}
+
+	first := newSession()
+	revoked, err := repo.CreateSession(ctx, first)
+	require.NoError(t, err)
+	require.Empty(t, revoked)
+
+	revoked, err = repo.CreateSession(ctx, newSession())
+	require.NoError(t, err)
+	require.Empty(t, revoked)
+
+	t.Run("should revoke oldest session over project limit", func(t *testing.T) {
+		revoked, err := repo.CreateSession(ctx, newSession())
+		require.NoError(t, err)
+		require.Equal(t, []string{first.ID}, revoked)
+	})
+
+	t.Run("should not limit sessions without active groups", func(t *testing.T) {
+		_, err := db.Exec(`update user_group set status = 'inactive' where user_id = $1`, userId)
+		require.NoError(t, err)
+
+		revoked, err := repo.CreateSession(ctx, newSession())
+		require.NoError(t, err)
+		require.Empty(t, revoked)
+	})
+}
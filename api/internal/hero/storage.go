@@ -2,6 +2,7 @@ package hero
 
 import (
 	"context"
+	"time"
 )
 
 // TODO: refactor to small interfaces
@@ -17,6 +18,8 @@ type Storage interface {
 	UpdateProfile(ctx context.Context, userId int, profile UpdateProfileBody) error
 	UpdateAvatar(ctx context.Context, userId int, avatar string) error
 	UpdatePassword(ctx context.Context, userId int, password string) error
+	VerifyUserEmail(ctx context.Context, userId int, email string) error
+	ChangeUserEmail(ctx context.Context, userId int, email string) error
 
 	// products
 	GetUserAccessibleProducts(ctx context.Context, userId int) ([]ProductCard, error)
@@ -47,16 +50,68 @@ type Storage interface {
 	GetOfferForRegistration(ctx context.Context, slug string) (*OfferForRegistration, error)
 	GetOfferForProcessing(ctx context.Context, slug string) (*OfferForProcessing, error)
 	GetOfferGroups(ctx context.Context, offerId int64) ([]int64, error)
+	GetOfferBumps(ctx context.Context, offerId int64) ([]OfferBump, error)
 
 	// payments
 	GetPayMethods(ctx context.Context, projectId int64) ([]PayMethod, error)
 	GetPayMethod(ctx context.Context, payMethodId int64, projectId int64) (*PayIntegration, error)
+	GetPayIntegrationById(ctx context.Context, integrationId int64) (*PayIntegration, error)
+
+	// promocodes
+	FindPromocode(ctx context.Context, projectId int64, code string, userId int64) (*Promocode, error)
 
 	// orders
 	CreateOrder(ctx context.Context, order NewOrder) (int64, error)
-	UpdateOrderPaymentId(ctx context.Context, orderId int64, paymentId string) error
+	UpdateOrderPaymentId(ctx context.Context, orderId int64, paymentId string, paymentUrl string) error
+	IsOrderPayment(ctx context.Context, orderId int64, paymentId string) (bool, error)
+	FindOrderPayment(ctx context.Context, orderId int64, paymentId string) (*OrderPayment, error)
+	UpdateOrderProviderStatus(ctx context.Context, orderId int64, providerStatus string) error
 	FindOrderById(ctx context.Context, orderId int64) (*OrderForProcessing, error)
-	UpdateOrderStatus(ctx context.Context, orderId int64, status string, orderError OrderError, cardInfo OrderCardInfo) error
+	ChangeOrderStatus(ctx context.Context, dto ChangeOrderStatusDTO) (*ChangeOrderStatusResult, error)
+	ReserveRefund(ctx context.Context, orderId int64, amount uint64) (*RefundReservation, error)
+	CancelRefund(ctx context.Context, orderId int64) error
+	RefundOrder(ctx context.Context, dto RefundOrderDTO) (*RefundOrderResult, error)
+	TakePendingOrdersForReconcile(ctx context.Context, before time.Time, limit int) ([]int64, error)
+	GetUserOrders(ctx context.Context, userId int64) ([]UserOrder, error)
+	GetUserOrder(ctx context.Context, userId int64, orderId int64) (*UserOrder, error)
+	GetOrderItems(ctx context.Context, orderId int64) ([]OrderItem, error)
+	RestartOrderPayment(ctx context.Context, orderId int64) (int, error)
+	TakeOrdersForReminder(ctx context.Context, maxReminders int, limit int) ([]int64, error)
+
+	// referrals
+	SetReferralCode(ctx context.Context, userId int64, code string) (string, error)
+	FindUserByReferralCode(ctx context.Context, code string) (int64, error)
+	CreateReferralClick(ctx context.Context, referrerId int64, offerSlug string) error
+	GetReferralStats(ctx context.Context, referrerId int64) ([]ReferralProjectStats, error)
+	GetProjectReferrers(ctx context.Context, projectId int64) ([]ProjectReferrer, error)
+	GetProjectOwnerID(ctx context.Context, projectId int64) (*int64, error)
+	CreateReferralPayout(ctx context.Context, projectId int64, referrerId int64, createdBy int64) (*ReferralPayout, error)
+
+	// sessions
+	CreateSession(ctx context.Context, session NewSession) ([]string, error)
+	RotateSession(ctx context.Context, sessionId string, refreshTokenHash string, newRefreshTokenHash string, expiresAt time.Time, client SessionClient) (int, error)
+	GetUserSessions(ctx context.Context, userId int) ([]UserSession, error)
+	RevokeSession(ctx context.Context, userId int, sessionId string) error
+	RevokeUserSessions(ctx context.Context, userId int) ([]string, error)
+	IsSessionRevoked(ctx context.Context, sessionId string) (bool, error)
+
+	// auth tokens
+	CreateAuthToken(ctx context.Context, token NewAuthToken, maxPerHour int) error
+	ConsumeAuthToken(ctx context.Context, purpose string, tokenHash string) (*AuthToken, error)
+	UseUserAuthTokens(ctx context.Context, userId int, purposes []string) error
+
+	// subscriptions
+	UpdateSubscriptionRebillId(ctx context.Context, subscriptionId int64, rebillId string) error
+	GetUserSubscriptions(ctx context.Context, userId int64) ([]Subscription, error)
+	TakeSubscriptionsForRenewal(ctx context.Context, retryAt time.Time, limit int) ([]SubscriptionForRenewal, error)
+	FailSubscriptionRenewal(ctx context.Context, subscriptionId int64, removeAt time.Time) error
+	ExpireSubscription(ctx context.Context, subscriptionId int64) error
+	CancelSubscription(ctx context.Context, userId int64, subscriptionId int64) error
+
+	// order outbox
+	TakeOrderOutboxMessages(ctx context.Context, limit int) ([]OrderOutboxMessage, error)
+	CompleteOrderOutboxMessage(ctx context.Context, messageId int64) error
+	FailOrderOutboxMessage(ctx context.Context, messageId int64, errMessage string, retry bool) error
 
 	// enrollments
 	AddUserToGroups(ctx context.Context, userId int64, groupIds []int64) error
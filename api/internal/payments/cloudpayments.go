@@ -0,0 +1,314 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"createtodayapi/internal/common"
+	"createtodayapi/internal/logger"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CloudPaymentsBaseURL = "https://api.cloudpayments.ru"
+)
+
+// Виды уведомлений. Для каждого в личном кабинете CloudPayments указывается свой адрес:
+// /hero/webhooks/cloudpayments?notification=check и т.д.
+const (
+	CloudPaymentsNotificationCheck = "check"
+	CloudPaymentsNotificationPay   = "pay"
+	CloudPaymentsNotificationFail  = "fail"
+)
+
+// Коды ответа на уведомления
+const (
+	cloudPaymentsCodeOK             = 0
+	cloudPaymentsCodeInvalidInvoice = 10
+	cloudPaymentsCodeRejected       = 13
+)
+
+type CloudPaymentsOrderPayload struct {
+	Amount      float64           `json:"Amount"`
+	Currency    string            `json:"Currency"`
+	Description string            `json:"Description"`
+	Email       string            `json:"Email,omitempty"`
+	Phone       string            `json:"Phone,omitempty"`
+	InvoiceId   string            `json:"InvoiceId"`
+	AccountId   string            `json:"AccountId"`
+	SendEmail   bool              `json:"SendEmail"`
+	SuccessUrl  string            `json:"SuccessRedirectUrl,omitempty"`
+	JsonData    map[string]string `json:"JsonData,omitempty"`
+}
+
+type CloudPaymentsOrderResponse struct {
+	Success bool   `json:"Success"`
+	Message string `json:"Message"`
+	Model   struct {
+		Id  string `json:"Id"`
+		Url string `json:"Url"`
+	} `json:"Model"`
+}
+
+type CloudPaymentsWebhookBody struct {
+	TransactionId string
+	Amount        string
+	Currency      string
+	InvoiceId     string
+	AccountId     string
+	Email         string
+	Status        string
+	CardFirstSix  string
+	CardLastFour  string
+	CardExpDate   string
+	Reason        string
+	ReasonCode    string
+}
+
+type CloudPaymentsWebhookResponse struct {
+	Code int `json:"code"`
+}
+
+// cloudPaymentsStatuses — Check и Fail приходят без статуса, поэтому статусом считается вид уведомления.
+// Check приходит до списания: заказ еще ждет оплаты,
+// но уже оплаченный заказ перевести в ожидание нельзя — так повторный платеж будет отклонен
+var cloudPaymentsStatuses = map[string]string{
+	CloudPaymentsNotificationCheck: StatusPending,
+	CloudPaymentsNotificationFail:  StatusRejected,
+	"Authorized":                   StatusPending,
+	"Completed":                    StatusSucceeded,
+}
+
+type CloudPayments struct {
+	baseURL string
+	client  *http.Client
+}
+
+func init() {
+	Register("cloudpayments", func() PaymentSystem {
+		return NewCloudPayments()
+	})
+}
+
+// GetPaymentLink создает заказ в CloudPayments со ссылкой на страницу оплаты,
+// а параметры для виджета отдает, чтобы оплатить можно было прямо на странице оффера.
+// Login интеграции — Public ID сайта, Password — пароль для API
+func (c *CloudPayments) GetPaymentLink(ctx context.Context, payload GetPaymentLinkPayload) (*GetPaymentLinkResult, error) {
+	invoiceId := strconv.FormatInt(payload.OrderId, 10)
+
+	orderPayload := CloudPaymentsOrderPayload{
+		Amount:      float64(payload.Amount),
+		Currency:    "RUB",
+		Description: payload.Description,
+		Email:       payload.Email,
+		Phone:       payload.Phone,
+		InvoiceId:   invoiceId,
+		AccountId:   payload.Email,
+		SuccessUrl:  payload.ReturnURL,
+	}
+
+	jsonBody, err := json.Marshal(orderPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/orders/create", bytes.NewReader(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+
+	req.SetBasicAuth(payload.Login, payload.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		logger.Error(ctx, "error requesting cloudpayments order", "err", err, "order_id", payload.OrderId)
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cloudpayments responded with status %d", resp.StatusCode)
+	}
+
+	var result CloudPaymentsOrderResponse
+
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if !result.Success {
+		return nil, errors.New(result.Message)
+	}
+
+	return &GetPaymentLinkResult{
+		PaymentID:  result.Model.Id,
+		PaymentURL: result.Model.Url,
+		OrderID:    payload.OrderId,
+		Widget: map[string]interface{}{
+			"publicId":    payload.Login,
+			"description": payload.Description,
+			"amount":      payload.Amount,
+			"currency":    "RUB",
+			"invoiceId":   invoiceId,
+			"accountId":   payload.Email,
+			"email":       payload.Email,
+		},
+	}, nil
+}
+
+func (c *CloudPayments) ParseWebhook(ctx context.Context, req WebhookRequest) (*WebhookEvent, error) {
+	body, err := parseCloudPaymentsWebhook(req)
+	if err != nil {
+		return nil, err
+	}
+
+	orderId, err := strconv.ParseInt(body.InvoiceId, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse order id %s: %w", body.InvoiceId, err)
+	}
+
+	amount, err := parseKopecks(body.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	event := WebhookEvent{
+		OrderID: orderId,
+		Amount:  amount,
+		CardInfo: WebhookCardInfo{
+			ExpirationDate: strings.ReplaceAll(body.CardExpDate, "/", ""),
+		},
+		Error: WebhookError{
+			StatusCode: "0",
+		},
+	}
+
+	if body.CardFirstSix != "" {
+		event.CardInfo.Pan = body.CardFirstSix + "******" + body.CardLastFour
+	}
+
+	switch notification := req.Query.Get("notification"); notification {
+	case CloudPaymentsNotificationCheck:
+		event.RawStatus = CloudPaymentsNotificationCheck
+	case CloudPaymentsNotificationPay:
+		// в Pay статус транзакции: Completed, а при двухстадийной оплате — Authorized
+		event.RawStatus = body.Status
+	case CloudPaymentsNotificationFail:
+		event.RawStatus = CloudPaymentsNotificationFail
+		event.Error = WebhookError{
+			StatusCode: body.ReasonCode,
+			Message:    body.Reason,
+		}
+	default:
+		return nil, fmt.Errorf("unknown cloudpayments notification %s", notification)
+	}
+
+	return &event, nil
+}
+
+// VerifyWebhook проверяет заголовок Content-HMAC — base64 от HMAC-SHA256 тела уведомления
+// с паролем для API
+func (c *CloudPayments) VerifyWebhook(ctx context.Context, req WebhookRequest, credentials Credentials) error {
+	sign, err := base64.StdEncoding.DecodeString(req.Headers.Get("Content-HMAC"))
+	if err != nil || len(sign) == 0 {
+		return common.ErrInvalidWebhookSignature
+	}
+
+	h := hmac.New(sha256.New, []byte(credentials.Password))
+	h.Write(req.Body)
+
+	if !hmac.Equal(h.Sum(nil), sign) {
+		return common.ErrInvalidWebhookSignature
+	}
+
+	return nil
+}
+
+func (c *CloudPayments) FormatStatus(status string) (string, error) {
+	return formatStatus("cloudpayments", cloudPaymentsStatuses, status)
+}
+
+// WebhookResponse — CloudPayments ждет в ответ {"code": 0}, иначе отклоняет платеж на Check.
+// На внутренние ошибки отвечаем 500, чтобы уведомление пришло повторно
+func (c *CloudPayments) WebhookResponse(err error) (int, interface{}) {
+	switch {
+	case err == nil:
+		return http.StatusOK, CloudPaymentsWebhookResponse{Code: cloudPaymentsCodeOK}
+	case errors.Is(err, common.ErrOrderNotFound):
+		return http.StatusOK, CloudPaymentsWebhookResponse{Code: cloudPaymentsCodeInvalidInvoice}
+	case errors.Is(err, common.ErrInvalidWebhookSignature),
+		errors.Is(err, common.ErrInvalidWebhookBody),
+		errors.Is(err, common.ErrIllegalOrderTransition):
+		return http.StatusOK, CloudPaymentsWebhookResponse{Code: cloudPaymentsCodeRejected}
+	}
+
+	return http.StatusInternalServerError, CloudPaymentsWebhookResponse{Code: cloudPaymentsCodeRejected}
+}
+
+// parseCloudPaymentsWebhook — CloudPayments присылает уведомления формой, а если так настроено — json
+func parseCloudPaymentsWebhook(req WebhookRequest) (CloudPaymentsWebhookBody, error) {
+	values := url.Values{}
+
+	if strings.Contains(req.Headers.Get("Content-Type"), "application/json") {
+		decoder := json.NewDecoder(bytes.NewReader(req.Body))
+		decoder.UseNumber()
+
+		var raw map[string]interface{}
+		err := decoder.Decode(&raw)
+		if err != nil {
+			return CloudPaymentsWebhookBody{}, err
+		}
+
+		for k, v := range raw {
+			if v != nil {
+				values.Set(k, fmt.Sprint(v))
+			}
+		}
+	} else {
+		var err error
+		values, err = url.ParseQuery(string(req.Body))
+		if err != nil {
+			return CloudPaymentsWebhookBody{}, err
+		}
+	}
+
+	return CloudPaymentsWebhookBody{
+		TransactionId: values.Get("TransactionId"),
+		Amount:        values.Get("Amount"),
+		Currency:      values.Get("Currency"),
+		InvoiceId:     values.Get("InvoiceId"),
+		AccountId:     values.Get("AccountId"),
+		Email:         values.Get("Email"),
+		Status:        values.Get("Status"),
+		CardFirstSix:  values.Get("CardFirstSix"),
+		CardLastFour:  values.Get("CardLastFour"),
+		CardExpDate:   values.Get("CardExpDate"),
+		Reason:        values.Get("Reason"),
+		ReasonCode:    values.Get("ReasonCode"),
+	}, nil
+}
+
+func NewCloudPayments() *CloudPayments {
+	return &CloudPayments{
+		baseURL: CloudPaymentsBaseURL,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
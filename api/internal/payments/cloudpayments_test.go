@@ -0,0 +1,159 @@
+package payments
+
+import (
+	"context"
+	"createtodayapi/internal/common"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCloudPaymentsWebhookRequest(body string, notification string, secret string) WebhookRequest {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(body))
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/x-www-form-urlencoded")
+	headers.Set("Content-HMAC", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+
+	return WebhookRequest{
+		Body:    []byte(body),
+		Headers: headers,
+		Query:   url.Values{"notification": {notification}},
+	}
+}
+
+func TestCloudPaymentsGetPaymentLink(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/orders/create", r.URL.Path)
+
+		login, password, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "pk_test", login)
+		assert.Equal(t, "api_secret", password)
+
+		var got CloudPaymentsOrderPayload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		assert.Equal(t, float64(2900), got.Amount)
+		assert.Equal(t, "1967", got.InvoiceId)
+
+		_, _ = w.Write([]byte(`{"Success":true,"Model":{"Id":"f2K8LV6reGE9WBFn","Url":"https://orders.cloudpayments.ru/d/f2K8LV6reGE9WBFn"}}`))
+	}))
+	defer server.Close()
+
+	cloudPayments := &CloudPayments{baseURL: server.URL, client: server.Client()}
+
+	result, err := cloudPayments.GetPaymentLink(context.Background(), GetPaymentLinkPayload{
+		Login:       "pk_test",
+		Password:    "api_secret",
+		Amount:      2900,
+		Email:       "test@test.com",
+		Description: "Тестовый продукт",
+		OrderId:     1967,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "f2K8LV6reGE9WBFn", result.PaymentID)
+	assert.Equal(t, "https://orders.cloudpayments.ru/d/f2K8LV6reGE9WBFn", result.PaymentURL)
+	assert.Equal(t, "pk_test", result.Widget["publicId"])
+	assert.Equal(t, "1967", result.Widget["invoiceId"])
+}
+
+func TestCloudPaymentsWebhook(t *testing.T) {
+	t.Parallel()
+	secret := "api_secret"
+	cloudPayments := NewCloudPayments()
+
+	form := url.Values{}
+	form.Set("TransactionId", "504")
+	form.Set("Amount", "2900.00")
+	form.Set("Currency", "RUB")
+	form.Set("InvoiceId", "1967")
+	form.Set("Status", "Completed")
+	form.Set("CardFirstSix", "411111")
+	form.Set("CardLastFour", "1111")
+	form.Set("CardExpDate", "10/28")
+	body := form.Encode()
+
+	cases := []struct {
+		Notification string
+		Want         string
+	}{
+		{Notification: CloudPaymentsNotificationCheck, Want: "check"},
+		{Notification: CloudPaymentsNotificationPay, Want: "Completed"},
+		{Notification: CloudPaymentsNotificationFail, Want: "fail"},
+	}
+
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("should parse %s notification", tc.Notification), func(t *testing.T) {
+			event, err := cloudPayments.ParseWebhook(context.Background(), newCloudPaymentsWebhookRequest(body, tc.Notification, secret))
+			require.NoError(t, err)
+			assert.Equal(t, int64(1967), event.OrderID)
+			assert.Equal(t, uint64(290000), event.Amount)
+			assert.Equal(t, tc.Want, event.RawStatus)
+		})
+	}
+
+	t.Run("should fill card info", func(t *testing.T) {
+		event, err := cloudPayments.ParseWebhook(context.Background(), newCloudPaymentsWebhookRequest(body, CloudPaymentsNotificationPay, secret))
+		require.NoError(t, err)
+		assert.Equal(t, "411111******1111", event.CardInfo.Pan)
+		assert.Equal(t, "1028", event.CardInfo.ExpirationDate)
+	})
+
+	t.Run("should not parse unknown notification", func(t *testing.T) {
+		_, err := cloudPayments.ParseWebhook(context.Background(), newCloudPaymentsWebhookRequest(body, "refund", secret))
+		assert.Error(t, err)
+	})
+
+	t.Run("should accept correctly signed webhook", func(t *testing.T) {
+		err := cloudPayments.VerifyWebhook(context.Background(), newCloudPaymentsWebhookRequest(body, CloudPaymentsNotificationPay, secret), Credentials{Password: secret})
+		assert.NoError(t, err)
+	})
+
+	t.Run("should reject webhook signed with another secret", func(t *testing.T) {
+		err := cloudPayments.VerifyWebhook(context.Background(), newCloudPaymentsWebhookRequest(body, CloudPaymentsNotificationPay, "another"), Credentials{Password: secret})
+		assert.ErrorIs(t, err, common.ErrInvalidWebhookSignature)
+	})
+
+	t.Run("should reject webhook without sign", func(t *testing.T) {
+		req := newCloudPaymentsWebhookRequest(body, CloudPaymentsNotificationPay, secret)
+		req.Headers.Del("Content-HMAC")
+		err := cloudPayments.VerifyWebhook(context.Background(), req, Credentials{Password: secret})
+		assert.ErrorIs(t, err, common.ErrInvalidWebhookSignature)
+	})
+}
+
+func TestCloudPaymentsWebhookResponse(t *testing.T) {
+	t.Parallel()
+	cloudPayments := NewCloudPayments()
+
+	cases := map[string]struct {
+		Err        error
+		WantStatus int
+		WantCode   int
+	}{
+		"processed":     {Err: nil, WantStatus: http.StatusOK, WantCode: 0},
+		"unknown order": {Err: common.ErrOrderNotFound, WantStatus: http.StatusOK, WantCode: 10},
+		"already paid":  {Err: common.ErrIllegalOrderTransition, WantStatus: http.StatusOK, WantCode: 13},
+		"internal":      {Err: common.ErrInternalError, WantStatus: http.StatusInternalServerError, WantCode: 13},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			status, body := cloudPayments.WebhookResponse(tc.Err)
+			assert.Equal(t, tc.WantStatus, status)
+			assert.Equal(t, CloudPaymentsWebhookResponse{Code: tc.WantCode}, body)
+		})
+	}
+}
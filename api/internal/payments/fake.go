@@ -0,0 +1,182 @@
+package payments
+
+import (
+	"context"
+	"createtodayapi/internal/common"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// FakeType — тестовая платежная система для локальной разработки и e2e-тестов.
+// Она не ходит в сеть: ссылка ведет на страницу оплаты самого API, а уведомление
+// собирает эта страница. В prod не регистрируется
+const FakeType = "fake"
+
+// FakeSignatureHeader — заголовок с подписью уведомления: HMAC-SHA256 тела на пароле интеграции
+const FakeSignatureHeader = "X-Fake-Signature"
+
+// Статусы, которые можно выбрать на тестовой странице оплаты
+const (
+	FakeStatusApproved = "approved"
+	FakeStatusDeclined = "declined"
+	FakeStatusExpired  = "expired"
+)
+
+// Тестовая карта, которой «оплачиваются» заказы
+const (
+	fakeCardPan            = "430000******0777"
+	fakeCardExpirationDate = "1230"
+)
+
+type FakeWebhookBody struct {
+	OrderId   int64  `json:"order_id"`
+	PaymentId string `json:"payment_id"`
+	// Amount — сумма в копейках, как у настоящих платежных систем
+	Amount       uint64 `json:"amount"`
+	Status       string `json:"status"`
+	RebillId     string `json:"rebill_id,omitempty"`
+	CardPan      string `json:"card_pan,omitempty"`
+	CardExpDate  string `json:"card_exp_date,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+var fakeStatuses = map[string]string{
+	FakeStatusApproved: StatusSucceeded,
+	FakeStatusDeclined: StatusRejected,
+	FakeStatusExpired:  StatusExpired,
+}
+
+type Fake struct {
+	// checkoutURL — адрес тестовой страницы оплаты, к нему добавляется номер заказа
+	checkoutURL string
+}
+
+// RegisterFake включает тестовую платежную систему. Вызывается только вне prod
+func RegisterFake(checkoutURL string) {
+	Register(FakeType, func() PaymentSystem {
+		return NewFake(checkoutURL)
+	})
+}
+
+// GetPaymentLink ничего не создает во внешней системе: номер платежа собирается из заказа и попытки,
+// чтобы повторная оплата получала новый платеж
+func (f *Fake) GetPaymentLink(ctx context.Context, payload GetPaymentLinkPayload) (*GetPaymentLinkResult, error) {
+	return &GetPaymentLinkResult{
+		PaymentID:  fmt.Sprintf("fake-%d-%d", payload.OrderId, payload.Attempt),
+		PaymentURL: fmt.Sprintf("%s/%d", strings.TrimRight(f.checkoutURL, "/"), payload.OrderId),
+		OrderID:    payload.OrderId,
+	}, nil
+}
+
+func (f *Fake) ParseWebhook(ctx context.Context, req WebhookRequest) (*WebhookEvent, error) {
+	var body FakeWebhookBody
+
+	err := json.Unmarshal(req.Body, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body.OrderId == 0 {
+		return nil, fmt.Errorf("fake webhook without order id")
+	}
+
+	return &WebhookEvent{
+		OrderID:   body.OrderId,
+		PaymentID: body.PaymentId,
+		Amount:    body.Amount,
+		RawStatus: body.Status,
+		CardInfo: WebhookCardInfo{
+			Pan:            body.CardPan,
+			ExpirationDate: body.CardExpDate,
+		},
+		Error: WebhookError{
+			StatusCode: body.ErrorCode,
+			Message:    body.ErrorMessage,
+		},
+		RebillID: body.RebillId,
+	}, nil
+}
+
+func (f *Fake) VerifyWebhook(ctx context.Context, req WebhookRequest, credentials Credentials) error {
+	signature := req.Headers.Get(FakeSignatureHeader)
+	if signature == "" {
+		return common.ErrInvalidWebhookSignature
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(SignFakeWebhook(req.Body, credentials.Password))) {
+		return common.ErrInvalidWebhookSignature
+	}
+
+	return nil
+}
+
+func (f *Fake) FormatStatus(status string) (string, error) {
+	return formatStatus(FakeType, fakeStatuses, status)
+}
+
+// Refund всегда проходит: возвращать нечего, а заказ проходит обычный путь возврата
+func (f *Fake) Refund(ctx context.Context, payload RefundPayload) (*RefundResult, error) {
+	return &RefundResult{
+		RefundID: fmt.Sprintf("fake-refund-%d-%d", payload.OrderId, payload.Amount),
+	}, nil
+}
+
+// Charge сразу списывает продление подписки с тестовой карты
+func (f *Fake) Charge(ctx context.Context, payload ChargePayload) (*WebhookEvent, error) {
+	return &WebhookEvent{
+		OrderID:   payload.OrderId,
+		PaymentID: fmt.Sprintf("fake-%d-charge", payload.OrderId),
+		Amount:    payload.Amount * 100,
+		RawStatus: FakeStatusApproved,
+		CardInfo: WebhookCardInfo{
+			Pan:            fakeCardPan,
+			ExpirationDate: fakeCardExpirationDate,
+		},
+		RebillID: payload.RebillID,
+	}, nil
+}
+
+// NewFakeWebhookBody — уведомление, которое отправляет тестовая страница оплаты.
+// Amount — цена заказа в рублях, recurrent — заказ подписки, для него возвращается токен карты
+func NewFakeWebhookBody(orderId int64, paymentId string, amount uint64, status string, recurrent bool) FakeWebhookBody {
+	body := FakeWebhookBody{
+		OrderId:   orderId,
+		PaymentId: paymentId,
+		Amount:    amount * 100,
+		Status:    status,
+	}
+
+	switch status {
+	case FakeStatusApproved:
+		body.CardPan = fakeCardPan
+		body.CardExpDate = fakeCardExpirationDate
+		if recurrent {
+			body.RebillId = fmt.Sprintf("fake-rebill-%d", orderId)
+		}
+	case FakeStatusDeclined:
+		body.CardPan = fakeCardPan
+		body.CardExpDate = fakeCardExpirationDate
+		body.ErrorCode = "51"
+		body.ErrorMessage = "Недостаточно средств на тестовой карте"
+	}
+
+	return body
+}
+
+func SignFakeWebhook(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func NewFake(checkoutURL string) *Fake {
+	return &Fake{
+		checkoutURL: checkoutURL,
+	}
+}
@@ -0,0 +1,87 @@
+package payments
+
+import (
+	"context"
+	"createtodayapi/internal/common"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newFakeWebhookRequest(t *testing.T, body FakeWebhookBody, secret string) WebhookRequest {
+	raw, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	headers := make(http.Header)
+	headers.Set(FakeSignatureHeader, SignFakeWebhook(raw, secret))
+
+	return WebhookRequest{
+		Body:    raw,
+		Headers: headers,
+	}
+}
+
+func TestFakeGetPaymentLink(t *testing.T) {
+	t.Parallel()
+
+	fake := NewFake("http://localhost:8080/hero/fake-checkout/")
+
+	result, err := fake.GetPaymentLink(context.Background(), GetPaymentLinkPayload{OrderId: 42, Amount: 2900, Attempt: 1})
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:8080/hero/fake-checkout/42", result.PaymentURL)
+	require.Equal(t, "fake-42-1", result.PaymentID)
+	require.Equal(t, int64(42), result.OrderID)
+}
+
+func TestFakeWebhook(t *testing.T) {
+	t.Parallel()
+
+	fake := NewFake("http://localhost:8080/hero/fake-checkout")
+	credentials := Credentials{Login: "fake", Password: "secret"}
+
+	t.Run("should parse approved payment of subscription", func(t *testing.T) {
+		req := newFakeWebhookRequest(t, NewFakeWebhookBody(42, "fake-42-0", 2900, FakeStatusApproved, true), credentials.Password)
+
+		require.NoError(t, fake.VerifyWebhook(context.Background(), req, credentials))
+
+		event, err := fake.ParseWebhook(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, int64(42), event.OrderID)
+		require.Equal(t, "fake-42-0", event.PaymentID)
+		require.Equal(t, uint64(290000), event.Amount)
+		require.Equal(t, "fake-rebill-42", event.RebillID)
+
+		status, err := fake.FormatStatus(event.RawStatus)
+		require.NoError(t, err)
+		require.Equal(t, StatusSucceeded, status)
+	})
+
+	t.Run("should return error for declined payment", func(t *testing.T) {
+		req := newFakeWebhookRequest(t, NewFakeWebhookBody(42, "fake-42-0", 2900, FakeStatusDeclined, false), credentials.Password)
+
+		event, err := fake.ParseWebhook(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, "51", event.Error.StatusCode)
+		require.Empty(t, event.RebillID)
+
+		status, err := fake.FormatStatus(event.RawStatus)
+		require.NoError(t, err)
+		require.Equal(t, StatusRejected, status)
+	})
+
+	t.Run("should reject webhook signed with another password", func(t *testing.T) {
+		req := newFakeWebhookRequest(t, NewFakeWebhookBody(42, "fake-42-0", 2900, FakeStatusApproved, false), "other")
+
+		err := fake.VerifyWebhook(context.Background(), req, credentials)
+		require.ErrorIs(t, err, common.ErrInvalidWebhookSignature)
+	})
+
+	t.Run("should not know other statuses", func(t *testing.T) {
+		_, err := fake.FormatStatus("refunded")
+
+		var unknownStatus *UnknownStatusError
+		require.ErrorAs(t, err, &unknownStatus)
+	})
+}
@@ -2,29 +2,177 @@ package payments
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type GetPaymentLinkPayload struct {
-	Login           string      `json:"login"`
-	Password        string      `json:"password"`
-	Amount          uint64      `json:"amount"`
-	Email           string      `json:"email"`
-	Phone           string      `json:"phone"`
-	Description     string      `json:"description"`
-	OrderId         int64       `json:"order_id"`
-	SendReceipt     bool        `json:"send_receipt"`
-	ReceiptSettings interface{} `json:"receipt_settings"`
+	Login           string           `json:"login"`
+	Password        string           `json:"password"`
+	Amount          uint64           `json:"amount"`
+	Email           string           `json:"email"`
+	Phone           string           `json:"phone"`
+	Description     string           `json:"description"`
+	OrderId         int64            `json:"order_id"`
+	SendReceipt     bool             `json:"send_receipt"`
+	ReceiptSettings *ReceiptSettings `json:"receipt_settings"`
+	// ReturnURL — куда вернуть покупателя после оплаты
+	ReturnURL string `json:"return_url"`
+	// Recurrent — первый платеж подписки: карта привязывается к покупателю CustomerKey
+	Recurrent   bool   `json:"recurrent"`
+	CustomerKey string `json:"customer_key"`
+	// Attempt — номер повторной оплаты заказа по новой ссылке, у первой оплаты 0
+	Attempt int `json:"attempt"`
 }
 
 type GetPaymentLinkResult struct {
 	PaymentURL string `json:"payment_url"`
 	PaymentID  string `json:"payment_id"`
 	OrderID    int64  `json:"order_id"`
+	// Widget — параметры для виджета оплаты на странице оффера, если платежная система его поддерживает
+	Widget map[string]interface{} `json:"widget,omitempty"`
+}
+
+// WebhookRequest — уведомление от платежной системы в том виде, в котором оно пришло.
+// Подписи считаются по сырому телу и заголовкам, поэтому разбираем его уже здесь
+type WebhookRequest struct {
+	Body    []byte
+	Headers http.Header
+	Query   url.Values
+}
+
+// Credentials — ключи интеграции, через которую создан заказ
+type Credentials struct {
+	Login    string
+	Password string
+}
+
+type WebhookCardInfo struct {
+	Pan            string
+	ExpirationDate string
+}
+
+type WebhookError struct {
+	StatusCode string
+	Message    string
+	Details    string
+}
+
+// WebhookEvent — уведомление платежной системы, приведенное к единому виду
+type WebhookEvent struct {
+	OrderID int64
+	// PaymentID — идентификатор платежа в платежной системе.
+	// Если платежная система его не присылает — остается пустым и не проверяется
+	PaymentID string
+	// Amount — сумма платежа в копейках. 0 — если платежная система ее не присылает
+	Amount uint64
+	// RawStatus — статус как его прислала платежная система.
+	// К нашему статусу его приводит FormatStatus уже после проверки подписи
+	RawStatus string
+	CardInfo  WebhookCardInfo
+	Error     WebhookError
+	// RebillID — токен привязанной карты для следующих платежей подписки
+	RebillID string
+	// RefundedAmount — сколько всего вернули покупателю, в копейках. 0 — если платежная система его не присылает
+	RefundedAmount uint64
 }
 
 type PaymentSystem interface {
 	GetPaymentLink(ctx context.Context, payload GetPaymentLinkPayload) (*GetPaymentLinkResult, error)
+	// ParseWebhook достает из уведомления заказ и статус платежа.
+	// Подпись здесь не проверяется: ключи для нее есть только у интеграции заказа
+	ParseWebhook(ctx context.Context, req WebhookRequest) (*WebhookEvent, error)
+	// VerifyWebhook проверяет, что уведомление пришло от платежной системы
+	VerifyWebhook(ctx context.Context, req WebhookRequest, credentials Credentials) error
+	// FormatStatus приводит статус платежной системы к нашему.
+	// Статус, которого нет в таблице платежной системы, возвращается как *UnknownStatusError
+	FormatStatus(status string) (string, error)
+}
+
+type RefundPayload struct {
+	Login     string
+	Password  string
+	PaymentID string
+	OrderId   int64
+	// Amount — сумма возврата в рублях, как price у заказа
+	Amount          uint64
+	Email           string
+	Description     string
+	SendReceipt     bool
+	ReceiptSettings *ReceiptSettings
+	// IdempotenceKey — повтор возврата с тем же ключом не вернет деньги второй раз
+	IdempotenceKey string
+}
+
+type RefundResult struct {
+	RefundID string
+}
+
+// Refunder — для платежных систем, через которые можно вернуть деньги за заказ полностью или частично
+type Refunder interface {
+	Refund(ctx context.Context, payload RefundPayload) (*RefundResult, error)
+}
+
+type PaymentStatePayload struct {
+	Login     string
+	Password  string
+	PaymentID string
+	OrderId   int64
+}
+
+// StatusChecker — для платежных систем, у которых можно запросить статус платежа.
+// Нужен, когда уведомление потерялось и заказ завис в ожидании оплаты.
+// Состояние возвращается в том же виде, что и уведомление
+type StatusChecker interface {
+	GetPaymentState(ctx context.Context, payload PaymentStatePayload) (*WebhookEvent, error)
+}
+
+type ChargePayload struct {
+	Login    string
+	Password string
+	OrderId  int64
+	// Amount — сумма в рублях, как price у заказа
+	Amount          uint64
+	RebillID        string
+	Email           string
+	Description     string
+	SendReceipt     bool
+	ReceiptSettings *ReceiptSettings
+}
+
+// RecurrentCharger — для платежных систем с рекуррентными платежами.
+// Первый платеж подписки привязывает карту, а следующие списываются без покупателя по RebillID.
+// Результат списания возвращается в том же виде, что и уведомление
+type RecurrentCharger interface {
+	Charge(ctx context.Context, payload ChargePayload) (*WebhookEvent, error)
+}
+
+// WebhookResponder — для платежных систем, которые ждут ответ на уведомление в своем формате.
+// Получает результат обработки уведомления и возвращает http-статус и тело ответа
+type WebhookResponder interface {
+	WebhookResponse(err error) (int, interface{})
+}
+
+type PaymentSystemFactory func() PaymentSystem
+
+var registry = struct {
+	sync.RWMutex
+	factories map[string]PaymentSystemFactory
+}{
+	factories: make(map[string]PaymentSystemFactory),
+}
+
+// Register добавляет платежную систему. Тип совпадает с pay_integration.type
+// и с последней частью адреса для уведомлений /hero/webhooks/:provider
+func Register(paymentSystemType string, factory PaymentSystemFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.factories[paymentSystemType] = factory
 }
 
 const StatusSucceeded = "succeeded"
@@ -32,37 +180,84 @@ const StatusCanceled = "canceled"
 const StatusRejected = "rejected"
 const StatusPending = "pending"
 const StatusExpired = "expired"
+const StatusRefunded = "refunded"
+const StatusPartiallyRefunded = "partially_refunded"
 
-var statuses map[string]string = map[string]string{
-	StatusSucceeded: "CONFIRMED,Completed,succeeded,success",
-	StatusCanceled:  "canceled,order_canceled",
-	StatusRejected:  "REJECTED,Declined,order_denied",
-	StatusExpired:   "DEADLINE_EXPIRED",
+// transitions — куда заказ может перейти из каждого статуса.
+// Отклоненный заказ можно оплатить повторно, оплаченный — вернуть частями или полностью.
+// Истекший заказ еще может оплатиться, если покупатель заплатил по старой ссылке после срока,
+// остальные конечные статусы не меняются
+var transitions = map[string][]string{
+	StatusPending:           {StatusSucceeded, StatusCanceled, StatusRejected, StatusExpired},
+	StatusRejected:          {StatusPending, StatusSucceeded, StatusCanceled, StatusExpired},
+	StatusExpired:           {StatusSucceeded},
+	StatusSucceeded:         {StatusRefunded, StatusPartiallyRefunded},
+	StatusPartiallyRefunded: {StatusRefunded},
+}
+
+// UnknownStatusError — платежная система прислала статус, которого нет в ее таблице статусов
+type UnknownStatusError struct {
+	PaymentSystem string
+	Status        string
+}
+
+func (e *UnknownStatusError) Error() string {
+	return fmt.Sprintf("unknown %s payment status %q", e.PaymentSystem, e.Status)
 }
 
 func NewPaymentSystem(paymentSystemType string) PaymentSystem {
-	switch paymentSystemType {
-	case "tinkoff":
-		return NewTinkoff()
-	case "prodamus":
-		return NewProdamus()
+	registry.RLock()
+	factory, ok := registry.factories[paymentSystemType]
+	registry.RUnlock()
+
+	if !ok {
+		return nil
 	}
-	return nil
-}
 
-func FormatStatus(status string) string {
-	// У всех платежных систем свои статусы
-	// Здесь приводим их в одну единую систему
+	return factory()
+}
 
-	if status == "" {
-		return StatusPending
+// formatStatus ищет статус в таблице платежной системы.
+// У всех платежных систем свои статусы, таблица приводит их в одну единую систему
+func formatStatus(paymentSystem string, statuses map[string]string, status string) (string, error) {
+	formatted, ok := statuses[status]
+	if !ok {
+		return "", &UnknownStatusError{
+			PaymentSystem: paymentSystem,
+			Status:        status,
+		}
 	}
 
-	for needStatus, possibleStatus := range statuses {
-		if strings.Contains(strings.ToLower(possibleStatus), strings.ToLower(status)) {
-			return needStatus
+	return formatted, nil
+}
+
+// CanTransition проверяет, можно ли перевести заказ из статуса from в статус to
+func CanTransition(from string, to string) bool {
+	for _, status := range transitions[from] {
+		if status == to {
+			return true
 		}
 	}
 
-	return StatusPending
+	return false
+}
+
+// parseKopecks переводит сумму вида "2900.00" в копейки без потери точности
+func parseKopecks(amount string) (uint64, error) {
+	rubles, kopecks, _ := strings.Cut(strings.TrimSpace(amount), ".")
+
+	if len(kopecks) > 2 {
+		return 0, fmt.Errorf("invalid amount %s", amount)
+	}
+
+	for len(kopecks) < 2 {
+		kopecks += "0"
+	}
+
+	value, err := strconv.ParseUint(rubles+kopecks, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %s: %w", amount, err)
+	}
+
+	return value, nil
 }
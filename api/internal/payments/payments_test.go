@@ -3,100 +3,131 @@ package payments
 import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testing"
 )
 
 func TestFormatStatus(t *testing.T) {
 	t.Parallel()
 	cases := []struct {
-		Status string
-		Want   string
+		PaymentSystem string
+		Status        string
+		Want          string
 	}{
-		{
-			Status: "CONFIRMED",
-			Want:   StatusSucceeded,
-		},
-		{
-			Status: "confirmed",
-			Want:   StatusSucceeded,
-		},
-		{
-			Status: "conFirmed",
-			Want:   StatusSucceeded,
-		},
-		{
-			Status: "Completed",
-			Want:   StatusSucceeded,
-		},
-		{
-			Status: "completed",
-			Want:   StatusSucceeded,
-		},
-		{
-			Status: "succeeded",
-			Want:   StatusSucceeded,
-		},
-		{
-			Status: "success",
-			Want:   StatusSucceeded,
-		},
-		{
-			Status: "canceled",
-			Want:   StatusCanceled,
-		},
-		{
-			Status: "Canceled",
-			Want:   StatusCanceled,
-		},
-		{
-			Status: "order_canceled",
-			Want:   StatusCanceled,
-		},
-		{
-			Status: "order_denied",
-			Want:   StatusRejected,
-		},
-		{
-			Status: "Declined",
-			Want:   StatusRejected,
-		},
-		{
-			Status: "eclined",
-			Want:   StatusRejected,
-		},
-		{
-			Status: "REJECTED",
-			Want:   StatusRejected,
-		},
-		{
-			Status: "rejected",
-			Want:   StatusRejected,
-		},
-		{
-			Status: "DEADLINE_EXPIRED",
-			Want:   StatusExpired,
-		},
-		{
-			Status: "",
-			Want:   StatusPending,
-		},
-		{
-			Status: ".",
-			Want:   StatusPending,
-		},
-		{
-			Status: "sdfsdfsf",
-			Want:   StatusPending,
-		},
+		{PaymentSystem: "tinkoff", Status: "NEW", Want: StatusPending},
+		{PaymentSystem: "tinkoff", Status: "AUTHORIZED", Want: StatusPending},
+		{PaymentSystem: "tinkoff", Status: "CONFIRMED", Want: StatusSucceeded},
+		{PaymentSystem: "tinkoff", Status: "CANCELED", Want: StatusCanceled},
+		{PaymentSystem: "tinkoff", Status: "REVERSED", Want: StatusCanceled},
+		{PaymentSystem: "tinkoff", Status: "REJECTED", Want: StatusRejected},
+		{PaymentSystem: "tinkoff", Status: "AUTH_FAIL", Want: StatusRejected},
+		{PaymentSystem: "tinkoff", Status: "DEADLINE_EXPIRED", Want: StatusExpired},
+		{PaymentSystem: "tinkoff", Status: "REFUNDED", Want: StatusRefunded},
+		{PaymentSystem: "tinkoff", Status: "PARTIAL_REFUNDED", Want: StatusPartiallyRefunded},
+		{PaymentSystem: "tinkoff", Status: "PARTIAL_REVERSED", Want: StatusPartiallyRefunded},
+		{PaymentSystem: "prodamus", Status: "success", Want: StatusSucceeded},
+		{PaymentSystem: "prodamus", Status: "order_canceled", Want: StatusCanceled},
+		{PaymentSystem: "prodamus", Status: "order_denied", Want: StatusRejected},
+		{PaymentSystem: "yookassa", Status: "pending", Want: StatusPending},
+		{PaymentSystem: "yookassa", Status: "waiting_for_capture", Want: StatusPending},
+		{PaymentSystem: "yookassa", Status: "succeeded", Want: StatusSucceeded},
+		{PaymentSystem: "yookassa", Status: "canceled", Want: StatusCanceled},
+		{PaymentSystem: "cloudpayments", Status: "check", Want: StatusPending},
+		{PaymentSystem: "cloudpayments", Status: "Authorized", Want: StatusPending},
+		{PaymentSystem: "cloudpayments", Status: "Completed", Want: StatusSucceeded},
+		{PaymentSystem: "cloudpayments", Status: "fail", Want: StatusRejected},
 	}
 
 	for _, testCase := range cases {
-		name := fmt.Sprintf(`Status %s should be %s`, testCase.Status, testCase.Want)
+		name := fmt.Sprintf(`%s status %s should be %s`, testCase.PaymentSystem, testCase.Status, testCase.Want)
 		t.Run(name, func(t *testing.T) {
-			gotStatus := FormatStatus(testCase.Status)
+			gotStatus, err := NewPaymentSystem(testCase.PaymentSystem).FormatStatus(testCase.Status)
+			require.NoError(t, err)
 			assert.Equal(t, testCase.Want, gotStatus)
-			t.Log(testCase.Status, gotStatus)
 		})
 	}
+}
+
+func TestFormatUnknownStatus(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		PaymentSystem string
+		Status        string
+	}{
+		// раньше такие статусы находились подстрокой или молча становились pending
+		{PaymentSystem: "tinkoff", Status: ""},
+		{PaymentSystem: "tinkoff", Status: "confirmed"},
+		{PaymentSystem: "tinkoff", Status: "FIRMED"},
+		{PaymentSystem: "prodamus", Status: "succes"},
+		{PaymentSystem: "prodamus", Status: "success "},
+		{PaymentSystem: "prodamus", Status: "canceled"},
+		{PaymentSystem: "yookassa", Status: "Succeeded"},
+		{PaymentSystem: "yookassa", Status: "eclined"},
+		{PaymentSystem: "cloudpayments", Status: "Declined"},
+		{PaymentSystem: "cloudpayments", Status: "."},
+	}
+
+	for _, testCase := range cases {
+		name := fmt.Sprintf(`%s status %q should be unknown`, testCase.PaymentSystem, testCase.Status)
+		t.Run(name, func(t *testing.T) {
+			_, err := NewPaymentSystem(testCase.PaymentSystem).FormatStatus(testCase.Status)
+
+			var unknownStatus *UnknownStatusError
+			require.ErrorAs(t, err, &unknownStatus)
+			assert.Equal(t, testCase.PaymentSystem, unknownStatus.PaymentSystem)
+			assert.Equal(t, testCase.Status, unknownStatus.Status)
+		})
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		From string
+		To   string
+		Want bool
+	}{
+		{From: StatusPending, To: StatusSucceeded, Want: true},
+		{From: StatusPending, To: StatusCanceled, Want: true},
+		{From: StatusPending, To: StatusRejected, Want: true},
+		{From: StatusPending, To: StatusExpired, Want: true},
+		{From: StatusPending, To: StatusRefunded, Want: false},
+		{From: StatusRejected, To: StatusSucceeded, Want: true},
+		{From: StatusRejected, To: StatusPending, Want: true},
+		{From: StatusSucceeded, To: StatusRefunded, Want: true},
+		{From: StatusSucceeded, To: StatusPending, Want: false},
+		{From: StatusSucceeded, To: StatusRejected, Want: false},
+		{From: StatusSucceeded, To: StatusSucceeded, Want: false},
+		{From: StatusCanceled, To: StatusSucceeded, Want: false},
+		{From: StatusExpired, To: StatusSucceeded, Want: true},
+		{From: StatusExpired, To: StatusPending, Want: false},
+		{From: StatusRefunded, To: StatusSucceeded, Want: false},
+		{From: StatusSucceeded, To: StatusPartiallyRefunded, Want: true},
+		{From: StatusPartiallyRefunded, To: StatusRefunded, Want: true},
+		{From: StatusPartiallyRefunded, To: StatusSucceeded, Want: false},
+		{From: StatusPending, To: StatusPartiallyRefunded, Want: false},
+		{From: StatusRefunded, To: StatusPartiallyRefunded, Want: false},
+	}
+
+	for _, testCase := range cases {
+		name := fmt.Sprintf(`Transition from %s to %s should be %v`, testCase.From, testCase.To, testCase.Want)
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, testCase.Want, CanTransition(testCase.From, testCase.To))
+		})
+	}
+}
+
+func TestNewPaymentSystem(t *testing.T) {
+	t.Parallel()
+
+	t.Run("should return registered payment systems", func(t *testing.T) {
+		assert.IsType(t, &Tinkoff{}, NewPaymentSystem("tinkoff"))
+		assert.IsType(t, &Prodamus{}, NewPaymentSystem("prodamus"))
+		assert.IsType(t, &YooKassa{}, NewPaymentSystem("yookassa"))
+		assert.IsType(t, &CloudPayments{}, NewPaymentSystem("cloudpayments"))
+	})
 
+	t.Run("should return nil for unknown payment system", func(t *testing.T) {
+		assert.Nil(t, NewPaymentSystem("unknown"))
+	})
 }
@@ -1,13 +1,21 @@
 package payments
 
 import (
+	"bytes"
 	"context"
+	"createtodayapi/internal/common"
 	"createtodayapi/internal/logger"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
 )
@@ -18,20 +26,89 @@ type ProdamusInitPayload struct {
 	Description string `json:"description"`
 	Email       string `json:"email"`
 	Phone       string `json:"phone"`
+	// Receipt — настройки чека, если интеграция отправляет чеки
+	Receipt *ReceiptSettings `json:"receipt"`
+}
+
+type ProdamusWebhookBody struct {
+	OrderId                  string `json:"order_id"`
+	OrderNum                 string `json:"order_num"`
+	PaymentStatus            string `json:"payment_status"`
+	PaymentStatusDescription string `json:"payment_status_description"`
+	// Sum — оплаченная сумма в рублях, например "2900.00"
+	Sum string `json:"sum"`
+}
+
+// prodamusTaxTypes — ставки НДС в products[][tax][tax_type]
+var prodamusTaxTypes = map[string]int{
+	"none":   0,
+	"vat20":  1,
+	"vat10":  2,
+	"vat120": 3,
+	"vat110": 4,
+	"vat0":   5,
+}
+
+// prodamusPaymentMethods — способ расчета кодом из 54-ФЗ (тег 1214)
+var prodamusPaymentMethods = map[string]int{
+	"full_prepayment": 1,
+	"prepayment":      2,
+	"advance":         3,
+	"full_payment":    4,
+	"partial_payment": 5,
+	"credit":          6,
+	"credit_payment":  7,
+}
+
+// prodamusPaymentObjects — предмет расчета кодом из 54-ФЗ (тег 1212)
+var prodamusPaymentObjects = map[string]int{
+	"commodity":             1,
+	"excise":                2,
+	"job":                   3,
+	"service":               4,
+	"gambling_bet":          5,
+	"gambling_prize":        6,
+	"lottery":               7,
+	"lottery_prize":         8,
+	"intellectual_activity": 9,
+	"payment":               10,
+	"agent_commission":      11,
+	"composite":             12,
+	"another":               13,
+}
+
+// prodamusStatuses — значения payment_status в уведомлениях продамуса
+var prodamusStatuses = map[string]string{
+	"success":        StatusSucceeded,
+	"order_canceled": StatusCanceled,
+	"order_denied":   StatusRejected,
 }
 
 type Prodamus struct{}
 
+func init() {
+	Register("prodamus", func() PaymentSystem {
+		return NewProdamus()
+	})
+}
+
 func (t *Prodamus) GetPaymentLink(ctx context.Context, payload GetPaymentLinkPayload) (*GetPaymentLinkResult, error) {
 	var result GetPaymentLinkResult
 
-	params := t.generateQueryParams(ProdamusInitPayload{
+	initPayload := ProdamusInitPayload{
 		Amount:      payload.Amount,
 		OrderId:     payload.OrderId,
 		Email:       payload.Email,
 		Phone:       payload.Phone,
 		Description: payload.Description,
-	})
+	}
+
+	if payload.SendReceipt {
+		settings := payload.ReceiptSettings.withDefaults()
+		initPayload.Receipt = &settings
+	}
+
+	params := t.generateQueryParams(initPayload)
 
 	base, err := url.Parse(fmt.Sprintf("https://%s.payform.ru", payload.Login))
 	if err != nil {
@@ -86,11 +163,286 @@ func (t *Prodamus) generateQueryParams(data ProdamusInitPayload) string {
 	q.Add("products[0][name]", data.Description)
 	q.Add("products[0][price]", strconv.FormatUint(data.Amount, 10))
 	q.Add("products[0][quantity]", "1")
+
+	// систему налогообложения и агента продамус берет из настроек кассы в своем кабинете
+	if data.Receipt != nil {
+		settings := data.Receipt.withDefaults()
+		q.Add("products[0][tax][tax_type]", strconv.Itoa(prodamusTaxTypes[settings.Vat]))
+		q.Add("products[0][paymentMethod]", strconv.Itoa(prodamusPaymentMethods[settings.PaymentMode]))
+		q.Add("products[0][paymentObject]", strconv.Itoa(prodamusPaymentObjects[settings.PaymentSubject]))
+	}
 	q.Add("callbackType", "json")
 
 	return q.Encode()
 }
 
+func (t *Prodamus) ParseWebhook(ctx context.Context, req WebhookRequest) (*WebhookEvent, error) {
+	data, err := ParseProdamusWebhook(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body := newProdamusWebhookBody(data)
+
+	// order_num — это наш заказ, order_id — заказ в продамусе
+	orderId, err := strconv.ParseInt(body.OrderNum, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse order id %s: %w", body.OrderNum, err)
+	}
+
+	// без суммы нельзя сверить оплату с ценой заказа
+	if body.Sum == "" {
+		return nil, fmt.Errorf("prodamus webhook for order %s has no sum", body.OrderNum)
+	}
+
+	amount, err := parseKopecks(body.Sum)
+	if err != nil {
+		return nil, err
+	}
+
+	event := WebhookEvent{
+		OrderID:   orderId,
+		PaymentID: body.OrderId,
+		Amount:    amount,
+		RawStatus: body.PaymentStatus,
+		Error: WebhookError{
+			Message:    body.PaymentStatusDescription,
+			StatusCode: "0",
+		},
+	}
+
+	if status, _ := t.FormatStatus(body.PaymentStatus); status != StatusSucceeded {
+		event.Error.StatusCode = "1"
+	}
+
+	return &event, nil
+}
+
+func (t *Prodamus) VerifyWebhook(ctx context.Context, req WebhookRequest, credentials Credentials) error {
+	return VerifyProdamusWebhook(req, credentials.Password)
+}
+
+func (t *Prodamus) FormatStatus(status string) (string, error) {
+	return formatStatus("prodamus", prodamusStatuses, status)
+}
+
 func NewProdamus() *Prodamus {
 	return &Prodamus{}
 }
+
+// ParseProdamusWebhook разбирает уведомление Продамуса в дерево значений.
+// Продамус присылает либо json, либо форму с вложенными полями вида products[0][name]
+func ParseProdamusWebhook(req WebhookRequest) (map[string]interface{}, error) {
+	if strings.Contains(req.Headers.Get("Content-Type"), "application/json") {
+		decoder := json.NewDecoder(bytes.NewReader(req.Body))
+		decoder.UseNumber()
+
+		var data map[string]interface{}
+		err := decoder.Decode(&data)
+		if err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	}
+
+	values, err := url.ParseQuery(string(req.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]interface{})
+
+	for key, vals := range values {
+		if len(vals) == 0 {
+			continue
+		}
+		setProdamusFormValue(data, parseProdamusFormKey(key), vals[len(vals)-1])
+	}
+
+	return data, nil
+}
+
+// parseProdamusFormKey превращает products[0][name] в [products 0 name]
+func parseProdamusFormKey(key string) []string {
+	open := strings.Index(key, "[")
+	if open <= 0 || !strings.HasSuffix(key, "]") {
+		return []string{key}
+	}
+
+	path := []string{key[:open]}
+	rest := strings.TrimSuffix(key[open+1:], "]")
+
+	return append(path, strings.Split(rest, "][")...)
+}
+
+func setProdamusFormValue(data map[string]interface{}, path []string, value string) {
+	current := data
+
+	for i, part := range path {
+		if i == len(path)-1 {
+			current[part] = value
+			return
+		}
+
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			current[part] = next
+		}
+
+		current = next
+	}
+}
+
+func newProdamusWebhookBody(data map[string]interface{}) ProdamusWebhookBody {
+	get := func(key string) string {
+		value, ok := data[key]
+		if !ok || value == nil {
+			return ""
+		}
+		return fmt.Sprint(value)
+	}
+
+	return ProdamusWebhookBody{
+		OrderId:                  get("order_id"),
+		OrderNum:                 get("order_num"),
+		PaymentStatus:            get("payment_status"),
+		PaymentStatusDescription: get("payment_status_description"),
+		Sum:                      get("sum"),
+	}
+}
+
+// VerifyProdamusWebhook проверяет заголовок Sign — HMAC-SHA256 от уведомления,
+// подписанного секретным ключом магазина
+func VerifyProdamusWebhook(req WebhookRequest, secret string) error {
+	sign := req.Headers.Get("Sign")
+	if sign == "" {
+		return common.ErrInvalidWebhookSignature
+	}
+
+	data, err := ParseProdamusWebhook(req)
+	if err != nil {
+		return err
+	}
+
+	expected := generateProdamusSign(data, secret)
+
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(sign))) {
+		return common.ErrInvalidWebhookSignature
+	}
+
+	return nil
+}
+
+func generateProdamusSign(data map[string]interface{}, secret string) string {
+	// Продамус подписывает данные так же, как их кодирует php:
+	// все значения приводятся к строкам, ключи сортируются на каждом уровне,
+	// а массивы с ключами 0..n-1 кодируются как json-списки
+	var buf bytes.Buffer
+	writeProdamusJSON(&buf, data)
+
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(buf.Bytes())
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeProdamusJSON(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		writeProdamusObject(buf, v)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeProdamusJSON(buf, item)
+		}
+		buf.WriteByte(']')
+	default:
+		writeProdamusString(buf, prodamusStringValue(v))
+	}
+}
+
+func writeProdamusObject(buf *bytes.Buffer, data map[string]interface{}) {
+	keys := make([]string, 0, len(data))
+	numericKeys := true
+
+	for k := range data {
+		keys = append(keys, k)
+		if _, err := strconv.Atoi(k); err != nil {
+			numericKeys = false
+		}
+	}
+
+	if numericKeys {
+		sort.Slice(keys, func(i, j int) bool {
+			a, _ := strconv.Atoi(keys[i])
+			b, _ := strconv.Atoi(keys[j])
+			return a < b
+		})
+	} else {
+		sort.Strings(keys)
+	}
+
+	isList := numericKeys
+	for i, k := range keys {
+		if k != strconv.Itoa(i) {
+			isList = false
+			break
+		}
+	}
+
+	if isList {
+		buf.WriteByte('[')
+	} else {
+		buf.WriteByte('{')
+	}
+
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if !isList {
+			writeProdamusString(buf, k)
+			buf.WriteByte(':')
+		}
+		writeProdamusJSON(buf, data[k])
+	}
+
+	if isList {
+		buf.WriteByte(']')
+	} else {
+		buf.WriteByte('}')
+	}
+}
+
+func prodamusStringValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "1"
+		}
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeProdamusString(buf *bytes.Buffer, value string) {
+	// php оставляет юникод и html-символы как есть, но экранирует слэш
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(value)
+
+	buf.WriteString(strings.ReplaceAll(strings.TrimSuffix(encoded.String(), "\n"), "/", `\/`))
+}
@@ -1,11 +1,18 @@
 package payments
 
 import (
+	"bytes"
 	"context"
+	"createtodayapi/internal/common"
 	"createtodayapi/internal/config"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -63,6 +70,19 @@ func TestProdamusGenerateQueryParams(t *testing.T) {
 	require.True(t, ok)
 	assert.Equal(t, "json", callbackType[0])
 
+	_, ok = vals["products[0][tax][tax_type]"]
+	assert.False(t, ok)
+
+	t.Run("should add receipt fields to product", func(t *testing.T) {
+		payload.Receipt = &ReceiptSettings{Vat: "vat20", PaymentSubject: "service", PaymentMode: "full_prepayment"}
+
+		vals, err := url.ParseQuery(prodamus.generateQueryParams(payload))
+		require.NoError(t, err)
+
+		assert.Equal(t, "1", vals.Get("products[0][tax][tax_type]"))
+		assert.Equal(t, "1", vals.Get("products[0][paymentMethod]"))
+		assert.Equal(t, "4", vals.Get("products[0][paymentObject]"))
+	})
 }
 
 func TestProdamusGetPaymentLink(t *testing.T) {
@@ -80,3 +100,102 @@ func TestProdamusGetPaymentLink(t *testing.T) {
 	require.NotNil(t, result)
 	t.Log(result.PaymentID, result.PaymentURL)
 }
+
+func newProdamusWebhookRequest(body string, sign string) WebhookRequest {
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/x-www-form-urlencoded")
+	if sign != "" {
+		headers.Set("Sign", sign)
+	}
+	return WebhookRequest{Body: []byte(body), Headers: headers}
+}
+
+func TestProdamusWebhookSign(t *testing.T) {
+	t.Parallel()
+	secret := "prodamus-secret"
+
+	form := url.Values{}
+	form.Set("order_id", "812072ad")
+	form.Set("order_num", "1970")
+	form.Set("sum", "2900.00")
+	form.Set("payment_status", "success")
+	form.Set("customer_email", "test@test.com")
+	form.Set("products[0][name]", "Курс по go/web")
+	form.Set("products[0][price]", "2900.00")
+	form.Set("products[0][quantity]", "1")
+	body := form.Encode()
+
+	canonical := `{"customer_email":"test@test.com","order_id":"812072ad","order_num":"1970",` +
+		`"payment_status":"success","products":[{"name":"Курс по go\/web","price":"2900.00","quantity":"1"}],"sum":"2900.00"}`
+
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(canonical))
+	sign := hex.EncodeToString(h.Sum(nil))
+
+	t.Run("should parse webhook into event", func(t *testing.T) {
+		prodamus, _ := newProdamusSystem()
+		event, err := prodamus.ParseWebhook(context.Background(), newProdamusWebhookRequest(body, sign))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1970), event.OrderID)
+		assert.Equal(t, "812072ad", event.PaymentID)
+		assert.Equal(t, uint64(290000), event.Amount)
+		assert.Equal(t, "success", event.RawStatus)
+		assert.Equal(t, "0", event.Error.StatusCode)
+	})
+
+	t.Run("should not parse webhook without sum", func(t *testing.T) {
+		prodamus, _ := newProdamusSystem()
+		withoutSum := strings.Replace(body, "sum=2900.00", "", 1)
+		_, err := prodamus.ParseWebhook(context.Background(), newProdamusWebhookRequest(withoutSum, sign))
+		assert.Error(t, err)
+	})
+
+	t.Run("should verify webhook with shop secret", func(t *testing.T) {
+		prodamus, _ := newProdamusSystem()
+		err := prodamus.VerifyWebhook(context.Background(), newProdamusWebhookRequest(body, sign), Credentials{Password: secret})
+		assert.NoError(t, err)
+	})
+
+	t.Run("should parse nested form fields", func(t *testing.T) {
+		data, err := ParseProdamusWebhook(newProdamusWebhookRequest(body, sign))
+		require.NoError(t, err)
+		assert.Equal(t, "1970", data["order_num"])
+		products, ok := data["products"].(map[string]interface{})
+		require.True(t, ok)
+		product, ok := products["0"].(map[string]interface{})
+		require.True(t, ok)
+		assert.Equal(t, "Курс по go/web", product["name"])
+	})
+
+	t.Run("should build data for sign the same way as prodamus", func(t *testing.T) {
+		data, err := ParseProdamusWebhook(newProdamusWebhookRequest(body, sign))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		writeProdamusJSON(&buf, data)
+		assert.Equal(t, canonical, buf.String())
+	})
+
+	t.Run("should accept correctly signed webhook", func(t *testing.T) {
+		err := VerifyProdamusWebhook(newProdamusWebhookRequest(body, sign), secret)
+		assert.NoError(t, err)
+	})
+
+	t.Run("should accept json webhook", func(t *testing.T) {
+		req := newProdamusWebhookRequest(`{"sum":"2900.00","order_num":"1970","order_id":"812072ad","payment_status":"success",`+
+			`"customer_email":"test@test.com","products":[{"quantity":"1","price":"2900.00","name":"Курс по go/web"}]}`, sign)
+		req.Headers.Set("Content-Type", "application/json")
+		err := VerifyProdamusWebhook(req, secret)
+		assert.NoError(t, err)
+	})
+
+	t.Run("should reject webhook with changed sum", func(t *testing.T) {
+		forged := strings.Replace(body, "sum=2900.00", "sum=1.00", 1)
+		err := VerifyProdamusWebhook(newProdamusWebhookRequest(forged, sign), secret)
+		assert.ErrorIs(t, err, common.ErrInvalidWebhookSignature)
+	})
+
+	t.Run("should reject webhook without sign", func(t *testing.T) {
+		err := VerifyProdamusWebhook(newProdamusWebhookRequest(body, ""), secret)
+		assert.ErrorIs(t, err, common.ErrInvalidWebhookSignature)
+	})
+}
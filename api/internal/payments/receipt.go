@@ -0,0 +1,163 @@
+package payments
+
+import (
+	"createtodayapi/internal/common"
+	"encoding/json"
+	"fmt"
+)
+
+// ReceiptSettings — настройки чеков по 54-ФЗ у интеграции.
+// Коды как у Тинькофф, под остальные платежные системы они переводятся при формировании чека
+type ReceiptSettings struct {
+	// Taxation — система налогообложения
+	Taxation string `json:"taxation"`
+	// Vat — ставка НДС
+	Vat string `json:"vat"`
+	// PaymentSubject — предмет расчета, по умолчанию service
+	PaymentSubject string `json:"payment_subject"`
+	// PaymentMode — способ расчета, по умолчанию full_payment
+	PaymentMode string `json:"payment_mode"`
+	// Agent — если проект продает чужие услуги как агент
+	Agent *ReceiptAgent `json:"agent"`
+}
+
+// ReceiptAgent — признак агента и данные поставщика, за которого принимается оплата
+type ReceiptAgent struct {
+	AgentSign      string   `json:"agent_sign"`
+	SupplierName   string   `json:"supplier_name"`
+	SupplierInn    string   `json:"supplier_inn"`
+	SupplierPhones []string `json:"supplier_phones"`
+}
+
+const (
+	defaultReceiptVat            = "none"
+	defaultReceiptPaymentSubject = "service"
+	defaultReceiptPaymentMode    = "full_payment"
+)
+
+var receiptTaxations = map[string]bool{
+	"osn":                true,
+	"usn_income":         true,
+	"usn_income_outcome": true,
+	"envd":               true,
+	"esn":                true,
+	"patent":             true,
+}
+
+var receiptVats = map[string]bool{
+	"none":   true,
+	"vat0":   true,
+	"vat10":  true,
+	"vat20":  true,
+	"vat110": true,
+	"vat120": true,
+}
+
+var receiptPaymentSubjects = map[string]bool{
+	"commodity":             true,
+	"excise":                true,
+	"job":                   true,
+	"service":               true,
+	"gambling_bet":          true,
+	"gambling_prize":        true,
+	"lottery":               true,
+	"lottery_prize":         true,
+	"intellectual_activity": true,
+	"payment":               true,
+	"agent_commission":      true,
+	"composite":             true,
+	"another":               true,
+}
+
+var receiptPaymentModes = map[string]bool{
+	"full_prepayment": true,
+	"prepayment":      true,
+	"advance":         true,
+	"full_payment":    true,
+	"partial_payment": true,
+	"credit":          true,
+	"credit_payment":  true,
+}
+
+var receiptAgentSigns = map[string]bool{
+	"bank_paying_agent":    true,
+	"bank_paying_subagent": true,
+	"paying_agent":         true,
+	"paying_subagent":      true,
+	"attorney":             true,
+	"commission_agent":     true,
+	"another":              true,
+}
+
+func (r *ReceiptSettings) Scan(v interface{}) error {
+	switch vv := v.(type) {
+	case []byte:
+		return json.Unmarshal(vv, r)
+	case string:
+		return json.Unmarshal([]byte(vv), r)
+	default:
+		return fmt.Errorf("unsupported type: %T", v)
+	}
+}
+
+// Validate проверяет, что все коды из допустимых. Пустые поля заменяются значениями по умолчанию,
+// поэтому пустые настройки тоже правильные
+func (r *ReceiptSettings) Validate() error {
+	if r == nil {
+		return nil
+	}
+
+	if r.Taxation != "" && !receiptTaxations[r.Taxation] {
+		return fmt.Errorf("%w: taxation %q", common.ErrInvalidReceiptSettings, r.Taxation)
+	}
+
+	if r.Vat != "" && !receiptVats[r.Vat] {
+		return fmt.Errorf("%w: vat %q", common.ErrInvalidReceiptSettings, r.Vat)
+	}
+
+	if r.PaymentSubject != "" && !receiptPaymentSubjects[r.PaymentSubject] {
+		return fmt.Errorf("%w: payment_subject %q", common.ErrInvalidReceiptSettings, r.PaymentSubject)
+	}
+
+	if r.PaymentMode != "" && !receiptPaymentModes[r.PaymentMode] {
+		return fmt.Errorf("%w: payment_mode %q", common.ErrInvalidReceiptSettings, r.PaymentMode)
+	}
+
+	if r.Agent != nil {
+		if !receiptAgentSigns[r.Agent.AgentSign] {
+			return fmt.Errorf("%w: agent_sign %q", common.ErrInvalidReceiptSettings, r.Agent.AgentSign)
+		}
+
+		// по 54-ФЗ в чеке агента обязательны наименование и ИНН поставщика
+		if r.Agent.SupplierName == "" || r.Agent.SupplierInn == "" {
+			return fmt.Errorf("%w: agent supplier name and inn are required", common.ErrInvalidReceiptSettings)
+		}
+
+		if len(r.Agent.SupplierInn) != 10 && len(r.Agent.SupplierInn) != 12 {
+			return fmt.Errorf("%w: supplier_inn %q", common.ErrInvalidReceiptSettings, r.Agent.SupplierInn)
+		}
+	}
+
+	return nil
+}
+
+// withDefaults — настройки, в которых пустые поля заполнены значениями по умолчанию.
+// Систему налогообложения каждая платежная система подставляет по-своему
+func (r *ReceiptSettings) withDefaults() ReceiptSettings {
+	settings := ReceiptSettings{}
+	if r != nil {
+		settings = *r
+	}
+
+	if settings.Vat == "" {
+		settings.Vat = defaultReceiptVat
+	}
+	if settings.PaymentSubject == "" {
+		settings.PaymentSubject = defaultReceiptPaymentSubject
+	}
+	if settings.PaymentMode == "" {
+		settings.PaymentMode = defaultReceiptPaymentMode
+	}
+
+	return settings
+}
@@ -0,0 +1,87 @@
+package payments
+
+import (
+	"createtodayapi/internal/common"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceiptSettingsValidate(t *testing.T) {
+	t.Parallel()
+
+	agent := &ReceiptAgent{
+		AgentSign:      "commission_agent",
+		SupplierName:   "ИП Иванов Иван Иванович",
+		SupplierInn:    "771234567890",
+		SupplierPhones: []string{"+79001234567"},
+	}
+
+	cases := map[string]struct {
+		Settings *ReceiptSettings
+		Valid    bool
+	}{
+		"empty settings":       {Settings: nil, Valid: true},
+		"defaults":             {Settings: &ReceiptSettings{}, Valid: true},
+		"full settings":        {Settings: &ReceiptSettings{Taxation: "usn_income", Vat: "vat20", PaymentSubject: "service", PaymentMode: "full_prepayment", Agent: agent}, Valid: true},
+		"unknown taxation":     {Settings: &ReceiptSettings{Taxation: "usn"}},
+		"unknown vat":          {Settings: &ReceiptSettings{Vat: "vat18"}},
+		"unknown subject":      {Settings: &ReceiptSettings{PaymentSubject: "course"}},
+		"unknown mode":         {Settings: &ReceiptSettings{PaymentMode: "full"}},
+		"unknown agent sign":   {Settings: &ReceiptSettings{Agent: &ReceiptAgent{AgentSign: "agent", SupplierName: "ООО Ромашка", SupplierInn: "7712345678"}}},
+		"agent without inn":    {Settings: &ReceiptSettings{Agent: &ReceiptAgent{AgentSign: "attorney", SupplierName: "ООО Ромашка"}}},
+		"agent with wrong inn": {Settings: &ReceiptSettings{Agent: &ReceiptAgent{AgentSign: "attorney", SupplierName: "ООО Ромашка", SupplierInn: "12345"}}},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.Settings.Validate()
+			if tc.Valid {
+				require.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, common.ErrInvalidReceiptSettings)
+		})
+	}
+}
+
+func TestNewTinkoffReceipt(t *testing.T) {
+	t.Parallel()
+
+	t.Run("should fill defaults", func(t *testing.T) {
+		receipt := newTinkoffReceipt("test@test.com", "Тестовый продукт", 290000, nil)
+		assert.Equal(t, "osn", receipt.Taxation)
+		require.Len(t, receipt.Items, 1)
+		assert.Equal(t, "none", receipt.Items[0].Tax)
+		assert.Equal(t, "full_payment", receipt.Items[0].PaymentMethod)
+		assert.Equal(t, "service", receipt.Items[0].PaymentObject)
+		assert.Nil(t, receipt.Items[0].AgentData)
+		assert.Nil(t, receipt.Items[0].SupplierInfo)
+	})
+
+	t.Run("should add agent and supplier info", func(t *testing.T) {
+		receipt := newTinkoffReceipt("test@test.com", "Тестовый продукт", 290000, &ReceiptSettings{
+			Taxation:       "usn_income",
+			Vat:            "vat10",
+			PaymentSubject: "agent_commission",
+			PaymentMode:    "full_prepayment",
+			Agent: &ReceiptAgent{
+				AgentSign:      "commission_agent",
+				SupplierName:   "ООО Ромашка",
+				SupplierInn:    "7712345678",
+				SupplierPhones: []string{"+79001234567"},
+			},
+		})
+		assert.Equal(t, "usn_income", receipt.Taxation)
+		item := receipt.Items[0]
+		assert.Equal(t, "vat10", item.Tax)
+		assert.Equal(t, "full_prepayment", item.PaymentMethod)
+		assert.Equal(t, "agent_commission", item.PaymentObject)
+		require.NotNil(t, item.AgentData)
+		assert.Equal(t, "commission_agent", item.AgentData.AgentSign)
+		require.NotNil(t, item.SupplierInfo)
+		assert.Equal(t, "7712345678", item.SupplierInfo.Inn)
+		assert.Equal(t, []string{"+79001234567"}, item.SupplierInfo.Phones)
+	})
+}
@@ -3,10 +3,14 @@ package payments
 import (
 	"bytes"
 	"context"
+	"createtodayapi/internal/common"
+	"createtodayapi/internal/logger"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"sort"
@@ -19,11 +23,25 @@ const (
 )
 
 type ReceiptItem struct {
-	Name     string `json:"Name"`
-	Price    uint64 `json:"Price"`
-	Quantity int    `json:"Quantity"`
-	Amount   uint64 `json:"Amount"`
-	Tax      string `json:"Tax"`
+	Name          string               `json:"Name"`
+	Price         uint64               `json:"Price"`
+	Quantity      int                  `json:"Quantity"`
+	Amount        uint64               `json:"Amount"`
+	Tax           string               `json:"Tax"`
+	PaymentMethod string               `json:"PaymentMethod,omitempty"`
+	PaymentObject string               `json:"PaymentObject,omitempty"`
+	AgentData     *ReceiptAgentData    `json:"AgentData,omitempty"`
+	SupplierInfo  *ReceiptSupplierInfo `json:"SupplierInfo,omitempty"`
+}
+
+type ReceiptAgentData struct {
+	AgentSign string `json:"AgentSign"`
+}
+
+type ReceiptSupplierInfo struct {
+	Phones []string `json:"Phones,omitempty"`
+	Name   string   `json:"Name"`
+	Inn    string   `json:"Inn"`
 }
 
 type Receipt struct {
@@ -39,7 +57,10 @@ type TinkoffInitPayload struct {
 	Description string            `json:"Description"`
 	DATA        map[string]string `json:"DATA"`
 	Receipt     *Receipt          `json:"Receipt"`
-	Token       string            `json:"Token"`
+	// Recurrent и CustomerKey — для первого платежа подписки, чтобы привязать карту покупателя
+	Recurrent   string `json:"Recurrent,omitempty"`
+	CustomerKey string `json:"CustomerKey,omitempty"`
+	Token       string `json:"Token"`
 }
 
 type TinkoffInitResponse struct {
@@ -56,15 +77,26 @@ type TinkoffInitResponse struct {
 }
 
 func (p *TinkoffInitPayload) getValuesForToken() map[string]string {
-	return map[string]string{
+	values := map[string]string{
 		"TerminalKey": p.TerminalKey,
 		"Amount":      strconv.FormatUint(p.Amount, 10),
 		"OrderId":     p.OrderId,
 		"Description": p.Description,
 	}
+
+	// необязательные поля участвуют в подписи, только если переданы
+	if p.Recurrent != "" {
+		values["Recurrent"] = p.Recurrent
+	}
+
+	if p.CustomerKey != "" {
+		values["CustomerKey"] = p.CustomerKey
+	}
+
+	return values
 }
 
-func (p *TinkoffInitPayload) sortValuesForToken(values map[string]string) []string {
+func sortTinkoffValuesForToken(values map[string]string) []string {
 	keys := make([]string, 0, len(values))
 
 	for k := range values {
@@ -87,11 +119,17 @@ func (p *TinkoffInitPayload) GenerateToken(password string) string {
 	// Шаг 1. Из payload убрать объекты и массивы
 	values := p.getValuesForToken()
 
+	p.Token = generateTinkoffToken(values, password)
+
+	return p.Token
+}
+
+func generateTinkoffToken(values map[string]string, password string) string {
 	// Шаг 2. Добавить в эти полученные значения пароль от терминала
 	values["Password"] = password
 
 	// Шаг 3. Отсортировать по ключу в алфавитном порядке
-	sortedValues := p.sortValuesForToken(values)
+	sortedValues := sortTinkoffValuesForToken(values)
 
 	// Шаг 4. Сделать конкатенацию значений в одну строку без пробелов
 	hashValue := strings.Join(sortedValues, "")
@@ -99,7 +137,144 @@ func (p *TinkoffInitPayload) GenerateToken(password string) string {
 	// Шаг 5. Сделать хэш sha256
 	h := sha256.New()
 	h.Write([]byte(hashValue))
-	p.Token = hex.EncodeToString(h.Sum(nil))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getTinkoffWebhookValues достает из уведомления значения для подписи:
+// все простые поля верхнего уровня, кроме самого Token
+func getTinkoffWebhookValues(body []byte) (map[string]string, string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var raw map[string]interface{}
+	err := decoder.Decode(&raw)
+	if err != nil {
+		return nil, "", err
+	}
+
+	values := make(map[string]string, len(raw))
+	var token string
+
+	for k, v := range raw {
+		if k == "Token" {
+			token, _ = v.(string)
+			continue
+		}
+
+		switch val := v.(type) {
+		case string:
+			values[k] = val
+		case json.Number:
+			values[k] = val.String()
+		case bool:
+			values[k] = strconv.FormatBool(val)
+		}
+	}
+
+	return values, token, nil
+}
+
+// VerifyTinkoffWebhook пересчитывает Token уведомления с паролем терминала
+// и сравнивает его с тем, что прислал Тинькофф
+func VerifyTinkoffWebhook(body []byte, password string) error {
+	values, token, err := getTinkoffWebhookValues(body)
+	if err != nil {
+		return err
+	}
+
+	if token == "" {
+		return common.ErrInvalidWebhookSignature
+	}
+
+	expected := generateTinkoffToken(values, password)
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(token))) != 1 {
+		return common.ErrInvalidWebhookSignature
+	}
+
+	return nil
+}
+
+type TinkoffCancelPayload struct {
+	TerminalKey string   `json:"TerminalKey"`
+	PaymentId   string   `json:"PaymentId"`
+	Amount      uint64   `json:"Amount"`
+	Receipt     *Receipt `json:"Receipt,omitempty"`
+	Token       string   `json:"Token"`
+}
+
+type TinkoffCancelResponse struct {
+	Success        bool   `json:"Success"`
+	ErrorCode      string `json:"ErrorCode"`
+	Status         string `json:"Status"`
+	PaymentId      string `json:"PaymentId"`
+	OriginalAmount uint64 `json:"OriginalAmount"`
+	NewAmount      uint64 `json:"NewAmount"`
+	Message        string `json:"Message"`
+	Details        string `json:"Details"`
+}
+
+func (p *TinkoffCancelPayload) GenerateToken(password string) string {
+	p.Token = generateTinkoffToken(map[string]string{
+		"TerminalKey": p.TerminalKey,
+		"PaymentId":   p.PaymentId,
+		"Amount":      strconv.FormatUint(p.Amount, 10),
+	}, password)
+
+	return p.Token
+}
+
+type TinkoffGetStatePayload struct {
+	TerminalKey string `json:"TerminalKey"`
+	PaymentId   string `json:"PaymentId"`
+	Token       string `json:"Token"`
+}
+
+type TinkoffGetStateResponse struct {
+	Success   bool   `json:"Success"`
+	ErrorCode string `json:"ErrorCode"`
+	Status    string `json:"Status"`
+	PaymentId string `json:"PaymentId"`
+	OrderId   string `json:"OrderId"`
+	Amount    uint64 `json:"Amount"`
+	Message   string `json:"Message"`
+	Details   string `json:"Details"`
+}
+
+func (p *TinkoffGetStatePayload) GenerateToken(password string) string {
+	p.Token = generateTinkoffToken(map[string]string{
+		"TerminalKey": p.TerminalKey,
+		"PaymentId":   p.PaymentId,
+	}, password)
+
+	return p.Token
+}
+
+type TinkoffChargePayload struct {
+	TerminalKey string `json:"TerminalKey"`
+	PaymentId   string `json:"PaymentId"`
+	RebillId    string `json:"RebillId"`
+	Token       string `json:"Token"`
+}
+
+type TinkoffChargeResponse struct {
+	Success   bool   `json:"Success"`
+	ErrorCode string `json:"ErrorCode"`
+	Status    string `json:"Status"`
+	PaymentId string `json:"PaymentId"`
+	OrderId   string `json:"OrderId"`
+	Amount    uint64 `json:"Amount"`
+	Message   string `json:"Message"`
+	Details   string `json:"Details"`
+}
+
+func (p *TinkoffChargePayload) GenerateToken(password string) string {
+	p.Token = generateTinkoffToken(map[string]string{
+		"TerminalKey": p.TerminalKey,
+		"PaymentId":   p.PaymentId,
+		"RebillId":    p.RebillId,
+	}, password)
 
 	return p.Token
 }
@@ -109,7 +284,90 @@ func (p *TinkoffInitPayload) updateAmount() {
 	p.Amount = p.Amount * 100
 }
 
-type Tinkoff struct{}
+type TinkoffWebhookBody struct {
+	TerminalKey string `json:"TerminalKey"`
+	Amount      uint64 `json:"Amount"`
+	OrderId     string `json:"OrderId"`
+	Success     bool   `json:"Success"`
+	Status      string `json:"Status"`
+	PaymentId   int64  `json:"PaymentId"`
+	ErrorCode   string `json:"ErrorCode"`
+	Message     string `json:"Message"`
+	Details     string `json:"Details"`
+	RebillId    int64  `json:"RebillId"`
+	CardId      int    `json:"CardId"`
+	Pan         string `json:"Pan"`
+	ExpDate     string `json:"ExpDate"`
+	Token       string `json:"Token"`
+}
+
+// tinkoffStatuses — все статусы платежа в тинькофф эквайринге.
+// Промежуточные статусы не меняют заказ, пока платеж не дойдет до конечного
+var tinkoffStatuses = map[string]string{
+	"NEW":              StatusPending,
+	"FORM_SHOWED":      StatusPending,
+	"AUTHORIZING":      StatusPending,
+	"3DS_CHECKING":     StatusPending,
+	"3DS_CHECKED":      StatusPending,
+	"AUTHORIZED":       StatusPending,
+	"CONFIRMING":       StatusPending,
+	"REVERSING":        StatusPending,
+	"CONFIRMED":        StatusSucceeded,
+	"REFUNDING":        StatusSucceeded,
+	"REVERSED":         StatusCanceled,
+	"PARTIAL_REVERSED": StatusPartiallyRefunded,
+	"CANCELED":         StatusCanceled,
+	"REJECTED":         StatusRejected,
+	"AUTH_FAIL":        StatusRejected,
+	"DEADLINE_EXPIRED": StatusExpired,
+	"REFUNDED":         StatusRefunded,
+	"PARTIAL_REFUNDED": StatusPartiallyRefunded,
+}
+
+// newTinkoffReceipt — чек из одной позиции на всю сумму в копейках
+func newTinkoffReceipt(email string, name string, amount uint64, receiptSettings *ReceiptSettings) *Receipt {
+	settings := receiptSettings.withDefaults()
+
+	item := ReceiptItem{
+		Name:          name,
+		Price:         amount,
+		Amount:        amount,
+		Quantity:      1,
+		Tax:           settings.Vat,
+		PaymentMethod: settings.PaymentMode,
+		PaymentObject: settings.PaymentSubject,
+	}
+
+	if settings.Agent != nil {
+		item.AgentData = &ReceiptAgentData{AgentSign: settings.Agent.AgentSign}
+		item.SupplierInfo = &ReceiptSupplierInfo{
+			Phones: settings.Agent.SupplierPhones,
+			Name:   settings.Agent.SupplierName,
+			Inn:    settings.Agent.SupplierInn,
+		}
+	}
+
+	// в Тинькофф система налогообложения обязательна
+	if settings.Taxation == "" {
+		settings.Taxation = "osn"
+	}
+
+	return &Receipt{
+		Email:    email,
+		Taxation: settings.Taxation,
+		Items:    []ReceiptItem{item},
+	}
+}
+
+type Tinkoff struct {
+	baseURL string
+}
+
+func init() {
+	Register("tinkoff", func() PaymentSystem {
+		return NewTinkoff()
+	})
+}
 
 func (t *Tinkoff) GetPaymentLink(ctx context.Context, payload GetPaymentLinkPayload) (*GetPaymentLinkResult, error) {
 	initPayload := TinkoffInitPayload{
@@ -122,25 +380,17 @@ func (t *Tinkoff) GetPaymentLink(ctx context.Context, payload GetPaymentLinkPayl
 		},
 	}
 
+	if payload.Recurrent {
+		initPayload.Recurrent = "Y"
+		initPayload.CustomerKey = payload.CustomerKey
+	}
+
 	initPayload.updateAmount()
 
 	initPayload.GenerateToken(payload.Password)
 
 	if payload.SendReceipt {
-		initPayload.Receipt = &Receipt{
-			Email: payload.Email,
-			// TODO: fix taxation
-			Taxation: "osn",
-			Items: []ReceiptItem{
-				{
-					Name:     initPayload.Description,
-					Price:    initPayload.Amount,
-					Amount:   initPayload.Amount,
-					Quantity: 1,
-					Tax:      "none",
-				},
-			},
-		}
+		initPayload.Receipt = newTinkoffReceipt(payload.Email, initPayload.Description, initPayload.Amount, payload.ReceiptSettings)
 	}
 
 	jsonBody, err := json.Marshal(initPayload)
@@ -148,7 +398,7 @@ func (t *Tinkoff) GetPaymentLink(ctx context.Context, payload GetPaymentLinkPayl
 		return nil, err
 	}
 
-	resp, err := http.Post(TinkoffBaseURL+"/Init", "application/json", bytes.NewBuffer(jsonBody))
+	resp, err := http.Post(t.baseURL+"/Init", "application/json", bytes.NewBuffer(jsonBody))
 
 	if err != nil {
 		return nil, err
@@ -181,6 +431,254 @@ func (t *Tinkoff) GetPaymentLink(ctx context.Context, payload GetPaymentLinkPayl
 	}, nil
 }
 
+// Refund отменяет платеж через /Cancel: до подтверждения он просто отменяется,
+// после — деньги возвращаются полностью или частично
+func (t *Tinkoff) Refund(ctx context.Context, payload RefundPayload) (*RefundResult, error) {
+	cancelPayload := TinkoffCancelPayload{
+		TerminalKey: payload.Login,
+		PaymentId:   payload.PaymentID,
+		// тинькофф эквайринг проводит платежи в копейках
+		Amount: payload.Amount * 100,
+	}
+
+	cancelPayload.GenerateToken(payload.Password)
+
+	if payload.SendReceipt {
+		cancelPayload.Receipt = newTinkoffReceipt(payload.Email, payload.Description, cancelPayload.Amount, payload.ReceiptSettings)
+	}
+
+	jsonBody, err := json.Marshal(cancelPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(t.baseURL+"/Cancel", "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		logger.Error(ctx, "error requesting tinkoff cancel", "err", err, "order_id", payload.OrderId)
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := TinkoffCancelResponse{}
+
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if !result.Success {
+		return nil, fmt.Errorf("tinkoff cancel failed with code %s: %s", result.ErrorCode, result.Details)
+	}
+
+	return &RefundResult{
+		RefundID: result.PaymentId,
+	}, nil
+}
+
+// Charge списывает очередной платеж подписки с привязанной карты:
+// через /Init создается новый платеж, а /Charge проводит его по RebillId
+func (t *Tinkoff) Charge(ctx context.Context, payload ChargePayload) (*WebhookEvent, error) {
+	payment, err := t.GetPaymentLink(ctx, GetPaymentLinkPayload{
+		Login:           payload.Login,
+		Password:        payload.Password,
+		Amount:          payload.Amount,
+		Email:           payload.Email,
+		Description:     payload.Description,
+		OrderId:         payload.OrderId,
+		SendReceipt:     payload.SendReceipt,
+		ReceiptSettings: payload.ReceiptSettings,
+	})
+	if err != nil {
+		logger.Error(ctx, "error initializing tinkoff recurrent payment", "err", err, "order_id", payload.OrderId)
+		return nil, err
+	}
+
+	chargePayload := TinkoffChargePayload{
+		TerminalKey: payload.Login,
+		PaymentId:   payment.PaymentID,
+		RebillId:    payload.RebillID,
+	}
+
+	chargePayload.GenerateToken(payload.Password)
+
+	jsonBody, err := json.Marshal(chargePayload)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(t.baseURL+"/Charge", "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		logger.Error(ctx, "error requesting tinkoff charge", "err", err, "order_id", payload.OrderId)
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := TinkoffChargeResponse{}
+
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	// отказ банка приходит с Success=false, но со статусом платежа — это результат, а не ошибка запроса
+	if !result.Success && result.Status == "" {
+		return nil, fmt.Errorf("tinkoff charge failed with code %s: %s", result.ErrorCode, result.Details)
+	}
+
+	event := WebhookEvent{
+		OrderID:   payload.OrderId,
+		PaymentID: payment.PaymentID,
+		Amount:    result.Amount,
+		RawStatus: result.Status,
+		Error: WebhookError{
+			StatusCode: result.ErrorCode,
+			Message:    result.Message,
+			Details:    result.Details,
+		},
+	}
+
+	if event.Error.StatusCode == "" {
+		event.Error.StatusCode = "0"
+	}
+
+	return &event, nil
+}
+
+// GetPaymentState запрашивает статус платежа через /GetState
+func (t *Tinkoff) GetPaymentState(ctx context.Context, payload PaymentStatePayload) (*WebhookEvent, error) {
+	statePayload := TinkoffGetStatePayload{
+		TerminalKey: payload.Login,
+		PaymentId:   payload.PaymentID,
+	}
+
+	statePayload.GenerateToken(payload.Password)
+
+	jsonBody, err := json.Marshal(statePayload)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(t.baseURL+"/GetState", "application/json", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		logger.Error(ctx, "error requesting tinkoff state", "err", err, "order_id", payload.OrderId)
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := TinkoffGetStateResponse{}
+
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if !result.Success {
+		return nil, fmt.Errorf("tinkoff get state failed with code %s: %s", result.ErrorCode, result.Details)
+	}
+
+	orderId, err := strconv.ParseInt(result.OrderId, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse order id %s: %w", result.OrderId, err)
+	}
+
+	return &WebhookEvent{
+		OrderID:   orderId,
+		PaymentID: result.PaymentId,
+		Amount:    result.Amount,
+		RawStatus: result.Status,
+		Error: WebhookError{
+			StatusCode: "0",
+		},
+	}, nil
+}
+
+func (t *Tinkoff) ParseWebhook(ctx context.Context, req WebhookRequest) (*WebhookEvent, error) {
+	var body TinkoffWebhookBody
+
+	err := json.Unmarshal(req.Body, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	orderId, err := strconv.ParseInt(body.OrderId, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse order id %s: %w", body.OrderId, err)
+	}
+
+	event := WebhookEvent{
+		OrderID:   orderId,
+		PaymentID: strconv.FormatInt(body.PaymentId, 10),
+		// тинькофф присылает сумму в копейках
+		Amount:    body.Amount,
+		RawStatus: body.Status,
+		CardInfo: WebhookCardInfo{
+			Pan:            body.Pan,
+			ExpirationDate: body.ExpDate,
+		},
+		Error: WebhookError{
+			StatusCode: body.ErrorCode,
+			Message:    body.Message,
+			Details:    body.Details,
+		},
+	}
+
+	if event.Error.StatusCode == "" {
+		event.Error.StatusCode = "0"
+	}
+
+	// RebillId приходит после первого платежа подписки — по нему списываются следующие
+	if body.RebillId != 0 {
+		event.RebillID = strconv.FormatInt(body.RebillId, 10)
+	}
+
+	// в уведомлении о возврате в Amount приходит сумма возврата
+	if status := tinkoffStatuses[body.Status]; status == StatusRefunded || status == StatusPartiallyRefunded {
+		event.RefundedAmount = body.Amount
+	}
+
+	return &event, nil
+}
+
+func (t *Tinkoff) VerifyWebhook(ctx context.Context, req WebhookRequest, credentials Credentials) error {
+	var body TinkoffWebhookBody
+
+	err := json.Unmarshal(req.Body, &body)
+	if err != nil {
+		return err
+	}
+
+	// уведомление должно прийти от терминала, через который создан заказ
+	if body.TerminalKey != credentials.Login {
+		return common.ErrInvalidWebhookSignature
+	}
+
+	return VerifyTinkoffWebhook(req.Body, credentials.Password)
+}
+
+func (t *Tinkoff) FormatStatus(status string) (string, error) {
+	return formatStatus("tinkoff", tinkoffStatuses, status)
+}
+
 func NewTinkoff() *Tinkoff {
-	return &Tinkoff{}
+	return &Tinkoff{
+		baseURL: TinkoffBaseURL,
+	}
 }
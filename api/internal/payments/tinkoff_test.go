@@ -2,7 +2,12 @@ package payments
 
 import (
 	"context"
+	"createtodayapi/internal/common"
 	"createtodayapi/internal/config"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,9 +15,9 @@ import (
 )
 
 func newTinkoffSystem() (*Tinkoff, *config.Config) {
-	tinkoff := Tinkoff{}
+	tinkoff := NewTinkoff()
 	conf := config.New("../../.env")
-	return &tinkoff, conf
+	return tinkoff, conf
 }
 
 func TestGetValuesForToken(t *testing.T) {
@@ -47,6 +52,24 @@ func TestGetValuesForToken(t *testing.T) {
 		assert.False(t, DataFieldExist)
 		assert.False(t, ReceiptFieldExist)
 	})
+
+	t.Run("should have recurrent fields in values for token only when set", func(t *testing.T) {
+		payload := TinkoffInitPayload{
+			TerminalKey: "98234234DEMO",
+			Amount:      2500,
+			OrderId:     "101231",
+		}
+
+		_, recurrentFieldExist := payload.getValuesForToken()["Recurrent"]
+		assert.False(t, recurrentFieldExist)
+
+		payload.Recurrent = "Y"
+		payload.CustomerKey = "42"
+
+		values := payload.getValuesForToken()
+		assert.Equal(t, "Y", values["Recurrent"])
+		assert.Equal(t, "42", values["CustomerKey"])
+	})
 }
 
 func TestGenerateToken(t *testing.T) {
@@ -150,3 +173,273 @@ func TestGetPaymentLink(t *testing.T) {
 		}
 	})
 }
+
+func TestVerifyTinkoffWebhook(t *testing.T) {
+	t.Parallel()
+	password := "secret-123"
+	values := map[string]string{
+		"TerminalKey": "98234234DEMO",
+		"OrderId":     "1967",
+		"Success":     "true",
+		"Status":      "CONFIRMED",
+		"PaymentId":   "4453714865",
+		"ErrorCode":   "0",
+		"Amount":      "290000",
+		"Pan":         "430000******0777",
+		"ExpDate":     "1122",
+	}
+	token := generateTinkoffToken(values, password)
+
+	body := `{"TerminalKey":"98234234DEMO","OrderId":"1967","Success":true,"Status":"CONFIRMED",` +
+		`"PaymentId":4453714865,"ErrorCode":"0","Amount":290000,"Pan":"430000******0777",` +
+		`"ExpDate":"1122","Data":{"email":"test@example.com"},"Token":"` + token + `"}`
+
+	t.Run("should accept correctly signed webhook", func(t *testing.T) {
+		err := VerifyTinkoffWebhook([]byte(body), password)
+		assert.NoError(t, err)
+	})
+
+	t.Run("should reject webhook signed with another password", func(t *testing.T) {
+		err := VerifyTinkoffWebhook([]byte(body), "another-secret")
+		assert.ErrorIs(t, err, common.ErrInvalidWebhookSignature)
+	})
+
+	t.Run("should reject webhook with changed amount", func(t *testing.T) {
+		forged := strings.Replace(body, `"Amount":290000`, `"Amount":100`, 1)
+		err := VerifyTinkoffWebhook([]byte(forged), password)
+		assert.ErrorIs(t, err, common.ErrInvalidWebhookSignature)
+	})
+
+	t.Run("should reject webhook without token", func(t *testing.T) {
+		forged := strings.Replace(body, `,"Token":"`+token+`"`, "", 1)
+		err := VerifyTinkoffWebhook([]byte(forged), password)
+		assert.ErrorIs(t, err, common.ErrInvalidWebhookSignature)
+	})
+}
+
+func TestTinkoffParseWebhook(t *testing.T) {
+	t.Parallel()
+	tinkoff, _ := newTinkoffSystem()
+
+	body := `{"TerminalKey":"98234234DEMO","OrderId":"1967","Success":true,"Status":"CONFIRMED",` +
+		`"PaymentId":4453714865,"ErrorCode":"","Amount":290000,"Pan":"430000******0777","ExpDate":"1122"}`
+
+	t.Run("should parse webhook into event", func(t *testing.T) {
+		event, err := tinkoff.ParseWebhook(context.Background(), WebhookRequest{Body: []byte(body)})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1967), event.OrderID)
+		assert.Equal(t, "4453714865", event.PaymentID)
+		assert.Equal(t, uint64(290000), event.Amount)
+		assert.Equal(t, "CONFIRMED", event.RawStatus)
+		assert.Equal(t, "430000******0777", event.CardInfo.Pan)
+		assert.Equal(t, "0", event.Error.StatusCode)
+	})
+
+	t.Run("should parse rebill id of recurrent payment", func(t *testing.T) {
+		recurrent := `{"TerminalKey":"98234234DEMO","OrderId":"1967","Success":true,"Status":"CONFIRMED",` +
+			`"PaymentId":4453714865,"ErrorCode":"0","Amount":290000,"RebillId":1712062592}`
+		event, err := tinkoff.ParseWebhook(context.Background(), WebhookRequest{Body: []byte(recurrent)})
+		require.NoError(t, err)
+		assert.Equal(t, "1712062592", event.RebillID)
+	})
+
+	t.Run("should parse refunded amount of partial refund", func(t *testing.T) {
+		refund := `{"TerminalKey":"98234234DEMO","OrderId":"1967","Success":true,"Status":"PARTIAL_REFUNDED",` +
+			`"PaymentId":4453714865,"ErrorCode":"0","Amount":100000}`
+		event, err := tinkoff.ParseWebhook(context.Background(), WebhookRequest{Body: []byte(refund)})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(100000), event.RefundedAmount)
+	})
+
+	t.Run("should not parse refunded amount of payment", func(t *testing.T) {
+		event, err := tinkoff.ParseWebhook(context.Background(), WebhookRequest{Body: []byte(body)})
+		require.NoError(t, err)
+		assert.Zero(t, event.RefundedAmount)
+	})
+
+	t.Run("should not parse webhook without order id", func(t *testing.T) {
+		_, err := tinkoff.ParseWebhook(context.Background(), WebhookRequest{Body: []byte(`{"Status":"CONFIRMED"}`)})
+		assert.Error(t, err)
+	})
+
+	t.Run("should reject webhook from another terminal", func(t *testing.T) {
+		err := tinkoff.VerifyWebhook(context.Background(), WebhookRequest{Body: []byte(body)}, Credentials{
+			Login:    "another-terminal",
+			Password: "secret-123",
+		})
+		assert.ErrorIs(t, err, common.ErrInvalidWebhookSignature)
+	})
+}
+
+func TestTinkoffRefund(t *testing.T) {
+	t.Parallel()
+
+	payload := RefundPayload{
+		Login:     "98234234DEMO",
+		Password:  "secret-123",
+		PaymentID: "4453714865",
+		OrderId:   1967,
+		Amount:    1000,
+	}
+
+	t.Run("should cancel payment with signed amount in kopecks", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/Cancel", r.URL.Path)
+
+			var got TinkoffCancelPayload
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+			assert.Equal(t, "4453714865", got.PaymentId)
+			assert.Equal(t, uint64(100000), got.Amount)
+			assert.Nil(t, got.Receipt)
+
+			want := generateTinkoffToken(map[string]string{
+				"TerminalKey": "98234234DEMO",
+				"PaymentId":   "4453714865",
+				"Amount":      "100000",
+			}, "secret-123")
+			assert.Equal(t, want, got.Token)
+
+			_, _ = w.Write([]byte(`{"Success":true,"ErrorCode":"0","Status":"PARTIAL_REFUNDED","PaymentId":"4453714865","OriginalAmount":290000,"NewAmount":190000}`))
+		}))
+		defer server.Close()
+
+		tinkoff := &Tinkoff{baseURL: server.URL}
+
+		result, err := tinkoff.Refund(context.Background(), payload)
+		require.NoError(t, err)
+		assert.Equal(t, "4453714865", result.RefundID)
+	})
+
+	t.Run("should return error when tinkoff declines cancel", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"Success":false,"ErrorCode":"9999","Message":"Неверные параметры","Details":"Сумма возврата больше суммы платежа"}`))
+		}))
+		defer server.Close()
+
+		tinkoff := &Tinkoff{baseURL: server.URL}
+
+		_, err := tinkoff.Refund(context.Background(), payload)
+		assert.Error(t, err)
+	})
+}
+
+func TestTinkoffGetPaymentState(t *testing.T) {
+	t.Parallel()
+
+	payload := PaymentStatePayload{
+		Login:     "98234234DEMO",
+		Password:  "secret-123",
+		PaymentID: "4453714865",
+		OrderId:   1967,
+	}
+
+	t.Run("should request signed state", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/GetState", r.URL.Path)
+
+			var got TinkoffGetStatePayload
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+			assert.Equal(t, "4453714865", got.PaymentId)
+
+			want := generateTinkoffToken(map[string]string{
+				"TerminalKey": "98234234DEMO",
+				"PaymentId":   "4453714865",
+			}, "secret-123")
+			assert.Equal(t, want, got.Token)
+
+			_, _ = w.Write([]byte(`{"Success":true,"ErrorCode":"0","Status":"CONFIRMED","PaymentId":"4453714865","OrderId":"1967","Amount":290000}`))
+		}))
+		defer server.Close()
+
+		tinkoff := &Tinkoff{baseURL: server.URL}
+
+		event, err := tinkoff.GetPaymentState(context.Background(), payload)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1967), event.OrderID)
+		assert.Equal(t, "4453714865", event.PaymentID)
+		assert.Equal(t, uint64(290000), event.Amount)
+		assert.Equal(t, "CONFIRMED", event.RawStatus)
+	})
+
+	t.Run("should return error when tinkoff declines request", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"Success":false,"ErrorCode":"7","Message":"Неверный статус транзакции","Details":"Платеж не найден"}`))
+		}))
+		defer server.Close()
+
+		tinkoff := &Tinkoff{baseURL: server.URL}
+
+		_, err := tinkoff.GetPaymentState(context.Background(), payload)
+		assert.Error(t, err)
+	})
+}
+
+func TestTinkoffCharge(t *testing.T) {
+	t.Parallel()
+
+	payload := ChargePayload{
+		Login:       "98234234DEMO",
+		Password:    "secret-123",
+		OrderId:     1968,
+		Amount:      2900,
+		RebillID:    "1712062592",
+		Email:       "test@test.com",
+		Description: "Подписка",
+	}
+
+	newServer := func(chargeResponse string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/Init":
+				var got TinkoffInitPayload
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+				assert.Equal(t, uint64(290000), got.Amount)
+				assert.Empty(t, got.Recurrent)
+
+				_, _ = w.Write([]byte(`{"Success":true,"ErrorCode":"0","Status":"NEW","PaymentId":"4453714999","OrderId":"1968","Amount":290000}`))
+			case "/Charge":
+				var got TinkoffChargePayload
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+				assert.Equal(t, "4453714999", got.PaymentId)
+				assert.Equal(t, "1712062592", got.RebillId)
+
+				want := generateTinkoffToken(map[string]string{
+					"TerminalKey": "98234234DEMO",
+					"PaymentId":   "4453714999",
+					"RebillId":    "1712062592",
+				}, "secret-123")
+				assert.Equal(t, want, got.Token)
+
+				_, _ = w.Write([]byte(chargeResponse))
+			default:
+				t.Errorf("unexpected path %s", r.URL.Path)
+			}
+		}))
+	}
+
+	t.Run("should charge saved card", func(t *testing.T) {
+		server := newServer(`{"Success":true,"ErrorCode":"0","Status":"CONFIRMED","PaymentId":"4453714999","OrderId":"1968","Amount":290000}`)
+		defer server.Close()
+
+		tinkoff := &Tinkoff{baseURL: server.URL}
+
+		event, err := tinkoff.Charge(context.Background(), payload)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1968), event.OrderID)
+		assert.Equal(t, "4453714999", event.PaymentID)
+		assert.Equal(t, "CONFIRMED", event.RawStatus)
+		assert.Equal(t, "0", event.Error.StatusCode)
+	})
+
+	t.Run("should return declined charge as rejected payment", func(t *testing.T) {
+		server := newServer(`{"Success":false,"ErrorCode":"1051","Status":"REJECTED","PaymentId":"4453714999","Message":"Недостаточно средств на карте"}`)
+		defer server.Close()
+
+		tinkoff := &Tinkoff{baseURL: server.URL}
+
+		event, err := tinkoff.Charge(context.Background(), payload)
+		require.NoError(t, err)
+		assert.Equal(t, "REJECTED", event.RawStatus)
+		assert.Equal(t, "1051", event.Error.StatusCode)
+	})
+}
@@ -0,0 +1,468 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"createtodayapi/internal/common"
+	"createtodayapi/internal/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	YooKassaBaseURL = "https://api.yookassa.ru/v3"
+	// yooKassaMaxDescription — юкасса не принимает описание платежа длиннее 128 символов
+	yooKassaMaxDescription = 128
+)
+
+type YooKassaAmount struct {
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+type YooKassaConfirmation struct {
+	Type            string `json:"type"`
+	ReturnURL       string `json:"return_url,omitempty"`
+	ConfirmationURL string `json:"confirmation_url,omitempty"`
+}
+
+type YooKassaReceiptCustomer struct {
+	Email string `json:"email,omitempty"`
+}
+
+type YooKassaReceiptItem struct {
+	Description    string                   `json:"description"`
+	Quantity       string                   `json:"quantity"`
+	Amount         YooKassaAmount           `json:"amount"`
+	VatCode        int                      `json:"vat_code"`
+	PaymentSubject string                   `json:"payment_subject"`
+	PaymentMode    string                   `json:"payment_mode"`
+	AgentType      string                   `json:"agent_type,omitempty"`
+	Supplier       *YooKassaReceiptSupplier `json:"supplier,omitempty"`
+}
+
+type YooKassaReceiptSupplier struct {
+	Name  string `json:"name"`
+	Phone string `json:"phone,omitempty"`
+	Inn   string `json:"inn"`
+}
+
+type YooKassaReceipt struct {
+	Customer      YooKassaReceiptCustomer `json:"customer"`
+	Items         []YooKassaReceiptItem   `json:"items"`
+	TaxSystemCode int                     `json:"tax_system_code,omitempty"`
+}
+
+type YooKassaPaymentPayload struct {
+	Amount       YooKassaAmount       `json:"amount"`
+	Capture      bool                 `json:"capture"`
+	Confirmation YooKassaConfirmation `json:"confirmation"`
+	Description  string               `json:"description"`
+	Metadata     map[string]string    `json:"metadata"`
+	Receipt      *YooKassaReceipt     `json:"receipt,omitempty"`
+}
+
+type YooKassaCard struct {
+	First6      string `json:"first6"`
+	Last4       string `json:"last4"`
+	ExpiryMonth string `json:"expiry_month"`
+	ExpiryYear  string `json:"expiry_year"`
+}
+
+type YooKassaPayment struct {
+	ID            string               `json:"id"`
+	Status        string               `json:"status"`
+	Paid          bool                 `json:"paid"`
+	Amount        YooKassaAmount       `json:"amount"`
+	Description   string               `json:"description"`
+	Metadata      map[string]string    `json:"metadata"`
+	Confirmation  YooKassaConfirmation `json:"confirmation"`
+	PaymentMethod struct {
+		Type string        `json:"type"`
+		Card *YooKassaCard `json:"card"`
+	} `json:"payment_method"`
+	CancellationDetails *struct {
+		Party  string `json:"party"`
+		Reason string `json:"reason"`
+	} `json:"cancellation_details"`
+	// RefundedAmount — сколько уже вернули по платежу. Статус платежа после возврата не меняется
+	RefundedAmount *YooKassaAmount `json:"refunded_amount"`
+}
+
+type YooKassaRefundPayload struct {
+	PaymentID   string           `json:"payment_id"`
+	Amount      YooKassaAmount   `json:"amount"`
+	Description string           `json:"description,omitempty"`
+	Receipt     *YooKassaReceipt `json:"receipt,omitempty"`
+}
+
+type YooKassaRefund struct {
+	ID        string         `json:"id"`
+	PaymentID string         `json:"payment_id"`
+	Status    string         `json:"status"`
+	Amount    YooKassaAmount `json:"amount"`
+}
+
+type YooKassaError struct {
+	Type        string `json:"type"`
+	ID          string `json:"id"`
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Parameter   string `json:"parameter"`
+}
+
+type YooKassaWebhookBody struct {
+	Type   string          `json:"type"`
+	Event  string          `json:"event"`
+	Object YooKassaPayment `json:"object"`
+}
+
+// Коды систем налогообложения и ставок НДС в юкассе
+var yooKassaTaxSystemCodes = map[string]int{
+	"osn":                1,
+	"usn_income":         2,
+	"usn_income_outcome": 3,
+	"envd":               4,
+	"esn":                5,
+	"patent":             6,
+}
+
+var yooKassaVatCodes = map[string]int{
+	"none":   1,
+	"vat0":   2,
+	"vat10":  3,
+	"vat20":  4,
+	"vat110": 5,
+	"vat120": 6,
+}
+
+// yooKassaAgentTypes — признаки агента в юкассе называются иначе, чем в 54-ФЗ у Тинькофф
+var yooKassaAgentTypes = map[string]string{
+	"bank_paying_agent":    "banking_payment_agent",
+	"bank_paying_subagent": "banking_payment_subagent",
+	"paying_agent":         "payment_agent",
+	"paying_subagent":      "payment_subagent",
+	"attorney":             "attorney",
+	"commission_agent":     "commissioner",
+	"another":              "agent",
+}
+
+// yooKassaStatuses — все статусы платежа в юкассе
+var yooKassaStatuses = map[string]string{
+	"pending":             StatusPending,
+	"waiting_for_capture": StatusPending,
+	"succeeded":           StatusSucceeded,
+	"canceled":            StatusCanceled,
+}
+
+type YooKassa struct {
+	baseURL string
+	client  *http.Client
+}
+
+func init() {
+	Register("yookassa", func() PaymentSystem {
+		return NewYooKassa()
+	})
+}
+
+func (y *YooKassa) GetPaymentLink(ctx context.Context, payload GetPaymentLinkPayload) (*GetPaymentLinkResult, error) {
+	paymentPayload := YooKassaPaymentPayload{
+		Amount: YooKassaAmount{
+			Value:    formatYooKassaAmount(payload.Amount),
+			Currency: "RUB",
+		},
+		Capture: true,
+		Confirmation: YooKassaConfirmation{
+			Type:      "redirect",
+			ReturnURL: payload.ReturnURL,
+		},
+		Description: truncateYooKassaDescription(payload.Description),
+		Metadata: map[string]string{
+			"order_id": strconv.FormatInt(payload.OrderId, 10),
+		},
+	}
+
+	if payload.SendReceipt {
+		paymentPayload.Receipt = newYooKassaReceipt(payload)
+	}
+
+	jsonBody, err := json.Marshal(paymentPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	// Повторный запрос с тем же ключом не создаст второй платеж по заказу
+	idempotenceKey := "order-" + strconv.FormatInt(payload.OrderId, 10)
+	if payload.Attempt > 0 {
+		idempotenceKey += "-" + strconv.Itoa(payload.Attempt)
+	}
+
+	var payment YooKassaPayment
+
+	err = y.do(ctx, http.MethodPost, "/payments", jsonBody, idempotenceKey, Credentials{
+		Login:    payload.Login,
+		Password: payload.Password,
+	}, &payment)
+	if err != nil {
+		logger.Error(ctx, "error creating yookassa payment", "err", err, "order_id", payload.OrderId)
+		return nil, err
+	}
+
+	if payment.Confirmation.ConfirmationURL == "" {
+		return nil, fmt.Errorf("yookassa payment %s has no confirmation url", payment.ID)
+	}
+
+	return &GetPaymentLinkResult{
+		PaymentID:  payment.ID,
+		PaymentURL: payment.Confirmation.ConfirmationURL,
+		OrderID:    payload.OrderId,
+	}, nil
+}
+
+func (y *YooKassa) Refund(ctx context.Context, payload RefundPayload) (*RefundResult, error) {
+	refundPayload := YooKassaRefundPayload{
+		PaymentID: payload.PaymentID,
+		Amount: YooKassaAmount{
+			Value:    formatYooKassaAmount(payload.Amount),
+			Currency: "RUB",
+		},
+	}
+
+	if payload.SendReceipt {
+		refundPayload.Receipt = newYooKassaReceipt(GetPaymentLinkPayload{
+			Amount:          payload.Amount,
+			Email:           payload.Email,
+			Description:     payload.Description,
+			ReceiptSettings: payload.ReceiptSettings,
+		})
+	}
+
+	jsonBody, err := json.Marshal(refundPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	var refund YooKassaRefund
+
+	err = y.do(ctx, http.MethodPost, "/refunds", jsonBody, payload.IdempotenceKey, Credentials{
+		Login:    payload.Login,
+		Password: payload.Password,
+	}, &refund)
+	if err != nil {
+		logger.Error(ctx, "error creating yookassa refund", "err", err, "order_id", payload.OrderId)
+		return nil, err
+	}
+
+	if refund.Status == "canceled" {
+		return nil, fmt.Errorf("yookassa refund %s was canceled", refund.ID)
+	}
+
+	return &RefundResult{
+		RefundID: refund.ID,
+	}, nil
+}
+
+func (y *YooKassa) ParseWebhook(ctx context.Context, req WebhookRequest) (*WebhookEvent, error) {
+	var body YooKassaWebhookBody
+
+	err := json.Unmarshal(req.Body, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	// на остальные события магазин тоже может быть подписан. Их не разбираем, но и повторять не просим
+	if body.Event != "payment.succeeded" && body.Event != "payment.canceled" {
+		return nil, fmt.Errorf("%w: yookassa event %s", common.ErrWebhookEventIgnored, body.Event)
+	}
+
+	return y.newWebhookEvent(body.Object)
+}
+
+// VerifyWebhook — юкасса не подписывает уведомления, поэтому платеж запрашивается
+// у нее заново ключами магазина и сверяется с тем, что пришло в уведомлении
+func (y *YooKassa) VerifyWebhook(ctx context.Context, req WebhookRequest, credentials Credentials) error {
+	var body YooKassaWebhookBody
+
+	err := json.Unmarshal(req.Body, &body)
+	if err != nil {
+		return err
+	}
+
+	if body.Object.ID == "" {
+		return common.ErrInvalidWebhookSignature
+	}
+
+	var payment YooKassaPayment
+
+	err = y.do(ctx, http.MethodGet, "/payments/"+body.Object.ID, nil, "", credentials, &payment)
+	if err != nil {
+		return err
+	}
+
+	if payment.Status != body.Object.Status ||
+		payment.Amount != body.Object.Amount ||
+		payment.Metadata["order_id"] != body.Object.Metadata["order_id"] {
+		return common.ErrInvalidWebhookSignature
+	}
+
+	return nil
+}
+
+// GetPaymentState запрашивает платеж так же, как при проверке уведомления
+func (y *YooKassa) GetPaymentState(ctx context.Context, payload PaymentStatePayload) (*WebhookEvent, error) {
+	var payment YooKassaPayment
+
+	credentials := Credentials{Login: payload.Login, Password: payload.Password}
+
+	err := y.do(ctx, http.MethodGet, "/payments/"+payload.PaymentID, nil, "", credentials, &payment)
+	if err != nil {
+		logger.Error(ctx, "error requesting yookassa payment", "err", err, "order_id", payload.OrderId)
+		return nil, err
+	}
+
+	return y.newWebhookEvent(payment)
+}
+
+func (y *YooKassa) FormatStatus(status string) (string, error) {
+	return formatStatus("yookassa", yooKassaStatuses, status)
+}
+
+func (y *YooKassa) newWebhookEvent(payment YooKassaPayment) (*WebhookEvent, error) {
+	orderId, err := strconv.ParseInt(payment.Metadata["order_id"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse order id %s: %w", payment.Metadata["order_id"], err)
+	}
+
+	amount, err := parseKopecks(payment.Amount.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	event := WebhookEvent{
+		OrderID:   orderId,
+		PaymentID: payment.ID,
+		Amount:    amount,
+		RawStatus: payment.Status,
+		Error: WebhookError{
+			StatusCode: "0",
+		},
+	}
+
+	if payment.RefundedAmount != nil {
+		event.RefundedAmount, err = parseKopecks(payment.RefundedAmount.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if card := payment.PaymentMethod.Card; card != nil {
+		event.CardInfo.Pan = card.First6 + "******" + card.Last4
+		if len(card.ExpiryYear) == 4 {
+			event.CardInfo.ExpirationDate = card.ExpiryMonth + card.ExpiryYear[2:]
+		}
+	}
+
+	if payment.CancellationDetails != nil {
+		event.Error.StatusCode = payment.CancellationDetails.Reason
+		event.Error.Details = payment.CancellationDetails.Party
+	}
+
+	return &event, nil
+}
+
+func (y *YooKassa) do(ctx context.Context, method string, path string, body []byte, idempotenceKey string, credentials Credentials, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, y.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(credentials.Login, credentials.Password)
+	req.Header.Set("Content-Type", "application/json")
+	if idempotenceKey != "" {
+		req.Header.Set("Idempotence-Key", idempotenceKey)
+	}
+
+	resp, err := y.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var yooKassaError YooKassaError
+		if json.Unmarshal(respBody, &yooKassaError) == nil && yooKassaError.Description != "" {
+			return errors.New(yooKassaError.Description)
+		}
+		return fmt.Errorf("yookassa responded with status %d", resp.StatusCode)
+	}
+
+	return json.Unmarshal(respBody, result)
+}
+
+func newYooKassaReceipt(payload GetPaymentLinkPayload) *YooKassaReceipt {
+	settings := payload.ReceiptSettings.withDefaults()
+
+	item := YooKassaReceiptItem{
+		Description: truncateYooKassaDescription(payload.Description),
+		Quantity:    "1.00",
+		Amount: YooKassaAmount{
+			Value:    formatYooKassaAmount(payload.Amount),
+			Currency: "RUB",
+		},
+		VatCode:        yooKassaVatCodes[settings.Vat],
+		PaymentSubject: settings.PaymentSubject,
+		PaymentMode:    settings.PaymentMode,
+	}
+
+	if settings.Agent != nil {
+		item.AgentType = yooKassaAgentTypes[settings.Agent.AgentSign]
+		item.Supplier = &YooKassaReceiptSupplier{
+			Name: settings.Agent.SupplierName,
+			Inn:  settings.Agent.SupplierInn,
+		}
+		if len(settings.Agent.SupplierPhones) > 0 {
+			item.Supplier.Phone = settings.Agent.SupplierPhones[0]
+		}
+	}
+
+	return &YooKassaReceipt{
+		Customer: YooKassaReceiptCustomer{
+			Email: payload.Email,
+		},
+		Items:         []YooKassaReceiptItem{item},
+		TaxSystemCode: yooKassaTaxSystemCodes[settings.Taxation],
+	}
+}
+
+// formatYooKassaAmount — юкасса принимает сумму строкой в рублях с копейками
+func formatYooKassaAmount(amount uint64) string {
+	return strconv.FormatUint(amount, 10) + ".00"
+}
+
+func truncateYooKassaDescription(description string) string {
+	if utf8.RuneCountInString(description) <= yooKassaMaxDescription {
+		return description
+	}
+
+	return string([]rune(description)[:yooKassaMaxDescription])
+}
+
+func NewYooKassa() *YooKassa {
+	return &YooKassa{
+		baseURL: YooKassaBaseURL,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
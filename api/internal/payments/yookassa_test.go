@@ -0,0 +1,258 @@
+package payments
+
+import (
+	"context"
+	"createtodayapi/internal/common"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const yooKassaTestPayment = `{
+	"id":"2d8b4a5c-000f-5000-9000-1b68e7b15f3f",
+	"status":"succeeded",
+	"paid":true,
+	"amount":{"value":"2900.00","currency":"RUB"},
+	"metadata":{"order_id":"1967"},
+	"payment_method":{"type":"bank_card","card":{"first6":"555555","last4":"4444","expiry_month":"07","expiry_year":"2028"}}
+}`
+
+func newYooKassaSystem(handler http.HandlerFunc) (*YooKassa, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	return &YooKassa{baseURL: server.URL, client: server.Client()}, server
+}
+
+func TestYooKassaGetPaymentLink(t *testing.T) {
+	t.Parallel()
+
+	payload := GetPaymentLinkPayload{
+		Login:       "123456",
+		Password:    "test_secret",
+		Amount:      2900,
+		Email:       "test@test.com",
+		Description: "Тестовый продукт",
+		OrderId:     1967,
+		SendReceipt: true,
+		ReceiptSettings: &ReceiptSettings{
+			Taxation: "usn_income",
+			Vat:      "vat20",
+		},
+		ReturnURL: "https://example.com/thanks",
+	}
+
+	t.Run("should create payment with redirect confirmation", func(t *testing.T) {
+		yooKassa, server := newYooKassaSystem(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodPost, r.Method)
+			assert.Equal(t, "/payments", r.URL.Path)
+			assert.Equal(t, "order-1967", r.Header.Get("Idempotence-Key"))
+
+			login, password, ok := r.BasicAuth()
+			assert.True(t, ok)
+			assert.Equal(t, "123456", login)
+			assert.Equal(t, "test_secret", password)
+
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+
+			var got YooKassaPaymentPayload
+			require.NoError(t, json.Unmarshal(body, &got))
+			assert.Equal(t, YooKassaAmount{Value: "2900.00", Currency: "RUB"}, got.Amount)
+			assert.True(t, got.Capture)
+			assert.Equal(t, "redirect", got.Confirmation.Type)
+			assert.Equal(t, "https://example.com/thanks", got.Confirmation.ReturnURL)
+			assert.Equal(t, "1967", got.Metadata["order_id"])
+			require.NotNil(t, got.Receipt)
+			assert.Equal(t, "test@test.com", got.Receipt.Customer.Email)
+			assert.Equal(t, 2, got.Receipt.TaxSystemCode)
+			require.Len(t, got.Receipt.Items, 1)
+			assert.Equal(t, 4, got.Receipt.Items[0].VatCode)
+			assert.Equal(t, "service", got.Receipt.Items[0].PaymentSubject)
+			assert.Equal(t, "full_payment", got.Receipt.Items[0].PaymentMode)
+
+			_, _ = w.Write([]byte(`{"id":"2d8b4a5c-000f-5000-9000-1b68e7b15f3f","status":"pending",` +
+				`"confirmation":{"type":"redirect","confirmation_url":"https://yoomoney.ru/checkout/payments/v2/contract?orderId=2d8b4a5c"}}`))
+		})
+		defer server.Close()
+
+		result, err := yooKassa.GetPaymentLink(context.Background(), payload)
+		require.NoError(t, err)
+		assert.Equal(t, "2d8b4a5c-000f-5000-9000-1b68e7b15f3f", result.PaymentID)
+		assert.Equal(t, "https://yoomoney.ru/checkout/payments/v2/contract?orderId=2d8b4a5c", result.PaymentURL)
+		assert.Equal(t, int64(1967), result.OrderID)
+	})
+
+	t.Run("should use new idempotence key for payment retry", func(t *testing.T) {
+		yooKassa, server := newYooKassaSystem(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "order-1967-2", r.Header.Get("Idempotence-Key"))
+			_, _ = w.Write([]byte(`{"id":"2d8b4a5c-0002","status":"pending",` +
+				`"confirmation":{"type":"redirect","confirmation_url":"https://yoomoney.ru/checkout/payments/v2/contract?orderId=2d8b4a5c-0002"}}`))
+		})
+		defer server.Close()
+
+		retry := payload
+		retry.Attempt = 2
+
+		result, err := yooKassa.GetPaymentLink(context.Background(), retry)
+		require.NoError(t, err)
+		assert.Equal(t, "2d8b4a5c-0002", result.PaymentID)
+	})
+
+	t.Run("should return yookassa error description", func(t *testing.T) {
+		yooKassa, server := newYooKassaSystem(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"type":"error","code":"invalid_credentials","description":"Login has an illegal format"}`))
+		})
+		defer server.Close()
+
+		_, err := yooKassa.GetPaymentLink(context.Background(), payload)
+		assert.EqualError(t, err, "Login has an illegal format")
+	})
+}
+
+func TestYooKassaWebhook(t *testing.T) {
+	t.Parallel()
+
+	body := `{"type":"notification","event":"payment.succeeded","object":` + yooKassaTestPayment + `}`
+	req := WebhookRequest{Body: []byte(body)}
+	credentials := Credentials{Login: "123456", Password: "test_secret"}
+
+	t.Run("should parse webhook into event", func(t *testing.T) {
+		event, err := NewYooKassa().ParseWebhook(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1967), event.OrderID)
+		assert.Equal(t, "2d8b4a5c-000f-5000-9000-1b68e7b15f3f", event.PaymentID)
+		assert.Equal(t, uint64(290000), event.Amount)
+		assert.Equal(t, "succeeded", event.RawStatus)
+		assert.Equal(t, "555555******4444", event.CardInfo.Pan)
+		assert.Equal(t, "0728", event.CardInfo.ExpirationDate)
+	})
+
+	t.Run("should parse canceled payment", func(t *testing.T) {
+		canceled := `{"type":"notification","event":"payment.canceled","object":{"id":"2d8b4a5c","status":"canceled",` +
+			`"amount":{"value":"2900.00","currency":"RUB"},"metadata":{"order_id":"1967"},` +
+			`"cancellation_details":{"party":"payment_network","reason":"insufficient_funds"}}}`
+		event, err := NewYooKassa().ParseWebhook(context.Background(), WebhookRequest{Body: []byte(canceled)})
+		require.NoError(t, err)
+		assert.Equal(t, "canceled", event.RawStatus)
+		assert.Equal(t, "insufficient_funds", event.Error.StatusCode)
+	})
+
+	t.Run("should parse refunded amount", func(t *testing.T) {
+		refunded := `{"type":"notification","event":"payment.succeeded","object":{"id":"2d8b4a5c","status":"succeeded",` +
+			`"amount":{"value":"2900.00","currency":"RUB"},"refunded_amount":{"value":"1000.00","currency":"RUB"},` +
+			`"metadata":{"order_id":"1967"}}}`
+		event, err := NewYooKassa().ParseWebhook(context.Background(), WebhookRequest{Body: []byte(refunded)})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(100000), event.RefundedAmount)
+	})
+
+	t.Run("should ignore unsupported event", func(t *testing.T) {
+		other := `{"type":"notification","event":"payout.succeeded","object":{"id":"po-1"}}`
+		_, err := NewYooKassa().ParseWebhook(context.Background(), WebhookRequest{Body: []byte(other)})
+		assert.ErrorIs(t, err, common.ErrWebhookEventIgnored)
+	})
+
+	t.Run("should accept webhook confirmed by yookassa", func(t *testing.T) {
+		yooKassa, server := newYooKassaSystem(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodGet, r.Method)
+			assert.Equal(t, "/payments/2d8b4a5c-000f-5000-9000-1b68e7b15f3f", r.URL.Path)
+			_, _ = w.Write([]byte(yooKassaTestPayment))
+		})
+		defer server.Close()
+
+		err := yooKassa.VerifyWebhook(context.Background(), req, credentials)
+		assert.NoError(t, err)
+	})
+
+	t.Run("should reject webhook with status that yookassa does not confirm", func(t *testing.T) {
+		yooKassa, server := newYooKassaSystem(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"id":"2d8b4a5c-000f-5000-9000-1b68e7b15f3f","status":"pending",` +
+				`"amount":{"value":"2900.00","currency":"RUB"},"metadata":{"order_id":"1967"}}`))
+		})
+		defer server.Close()
+
+		err := yooKassa.VerifyWebhook(context.Background(), req, credentials)
+		assert.ErrorIs(t, err, common.ErrInvalidWebhookSignature)
+	})
+}
+
+func TestYooKassaRefund(t *testing.T) {
+	t.Parallel()
+
+	payload := RefundPayload{
+		Login:          "123456",
+		Password:       "test_secret",
+		PaymentID:      "2d8b4a5c-000f-5000-9000-1b68e7b15f3f",
+		OrderId:        1967,
+		Amount:         1000,
+		Email:          "test@test.com",
+		Description:    "Тестовый продукт",
+		SendReceipt:    true,
+		IdempotenceKey: "refund-1967-0-1000",
+	}
+
+	t.Run("should create refund", func(t *testing.T) {
+		yooKassa, server := newYooKassaSystem(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/refunds", r.URL.Path)
+			assert.Equal(t, "refund-1967-0-1000", r.Header.Get("Idempotence-Key"))
+
+			var got YooKassaRefundPayload
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+			assert.Equal(t, "2d8b4a5c-000f-5000-9000-1b68e7b15f3f", got.PaymentID)
+			assert.Equal(t, YooKassaAmount{Value: "1000.00", Currency: "RUB"}, got.Amount)
+			require.NotNil(t, got.Receipt)
+			assert.Equal(t, "1000.00", got.Receipt.Items[0].Amount.Value)
+
+			_, _ = w.Write([]byte(`{"id":"216749f7-0016-50be-b000-078d43a63ae4","status":"succeeded",` +
+				`"payment_id":"2d8b4a5c-000f-5000-9000-1b68e7b15f3f","amount":{"value":"1000.00","currency":"RUB"}}`))
+		})
+		defer server.Close()
+
+		result, err := yooKassa.Refund(context.Background(), payload)
+		require.NoError(t, err)
+		assert.Equal(t, "216749f7-0016-50be-b000-078d43a63ae4", result.RefundID)
+	})
+
+	t.Run("should return error for canceled refund", func(t *testing.T) {
+		yooKassa, server := newYooKassaSystem(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"id":"216749f7","status":"canceled","payment_id":"2d8b4a5c"}`))
+		})
+		defer server.Close()
+
+		_, err := yooKassa.Refund(context.Background(), payload)
+		assert.Error(t, err)
+	})
+}
+
+func TestYooKassaGetPaymentState(t *testing.T) {
+	t.Parallel()
+
+	yooKassa, server := newYooKassaSystem(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/payments/2d8b4a5c-000f-5000-9000-1b68e7b15f3f", r.URL.Path)
+
+		login, password, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "123456", login)
+		assert.Equal(t, "test_secret", password)
+
+		_, _ = w.Write([]byte(yooKassaTestPayment))
+	})
+	defer server.Close()
+
+	event, err := yooKassa.GetPaymentState(context.Background(), PaymentStatePayload{
+		Login:     "123456",
+		Password:  "test_secret",
+		PaymentID: "2d8b4a5c-000f-5000-9000-1b68e7b15f3f",
+		OrderId:   1967,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1967), event.OrderID)
+	assert.Equal(t, uint64(290000), event.Amount)
+	assert.Equal(t, "succeeded", event.RawStatus)
+}